@@ -0,0 +1,166 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+const (
+	// authMaxFailures is the number of consecutive authentication failures
+	// from the same host after which the host is blocked.
+	authMaxFailures = 5
+	// authBlockDuration is how long a host is blocked after too many failures.
+	authBlockDuration = time.Minute
+)
+
+// sharedTokenIdentity is the identity of the clients authenticated with the
+// shared token.
+const sharedTokenIdentity = "default"
+
+// tokenAuth authenticates the clients with a shared token or with the
+// per-client tokens of a token file.
+type tokenAuth struct {
+	// tokens maps the identities to their tokens.
+	tokens map[string]authToken
+
+	lock     sync.Mutex
+	failures map[string]*authFailures
+}
+
+type authToken struct {
+	token string
+	// role overrides the role of the listener, if not empty.
+	role string
+}
+
+type authFailures struct {
+	count        int
+	blockedUntil time.Time
+}
+
+// newTokenAuth returns the token authentication for the given shared token
+// and token file, or nil if both are empty. Each line of the token file is
+// in the form "identity token [role]", empty lines and lines starting with
+// "#" are ignored.
+func newTokenAuth(sharedToken, tokenFile string) (*tokenAuth, error) {
+	tokens := map[string]authToken{}
+	if sharedToken != "" {
+		tokens[sharedTokenIdentity] = authToken{token: sharedToken}
+	}
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading auth token file: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields := strings.Fields(line)
+			if len(fields) != 2 && len(fields) != 3 {
+				return nil, fmt.Errorf("invalid line %d in auth token file %s: expected \"identity token [role]\"", n, tokenFile)
+			}
+			identity := fields[0]
+			if _, exists := tokens[identity]; exists {
+				return nil, fmt.Errorf("duplicate identity in auth token file %s: %s", tokenFile, identity)
+			}
+			t := authToken{token: fields[1]}
+			if len(fields) == 3 {
+				t.role = fields[2]
+			}
+			tokens[identity] = t
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	return &tokenAuth{
+		tokens:   tokens,
+		failures: map[string]*authFailures{},
+	}, nil
+}
+
+// checkRoles verifies that the roles assigned to the identities exist.
+func (a *tokenAuth) checkRoles(roles map[string]msgpackrouter.ACL) error {
+	if a == nil {
+		return nil
+	}
+	for identity, t := range a.tokens {
+		if _, ok := roles[t.role]; t.role != "" && !ok {
+			return fmt.Errorf("unknown role for identity %s: %s", identity, t.role)
+		}
+	}
+	return nil
+}
+
+// authenticator returns the Authenticator for a client connected from the
+// given remote address.
+func (a *tokenAuth) authenticator(remoteAddr string) msgpackrouter.Authenticator {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return func(token string) (string, string, error) {
+		return a.authenticate(host, token)
+	}
+}
+
+func (a *tokenAuth) authenticate(host, token string) (string, string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	f := a.failures[host]
+	if f != nil && time.Now().Before(f.blockedUntil) {
+		slog.Warn("Authentication rejected, too many failures", "host", host)
+		return "", "", errors.New("too many failed authentication attempts, retry later")
+	}
+
+	for identity, expected := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected.token)) == 1 {
+			delete(a.failures, host)
+			slog.Info("Client authenticated", "host", host, "identity", identity, "role", expected.role)
+			return identity, expected.role, nil
+		}
+	}
+
+	if f == nil {
+		f = &authFailures{}
+		a.failures[host] = f
+	}
+	f.count++
+	slog.Warn("Authentication failed", "host", host, "failures", f.count)
+	if f.count >= authMaxFailures {
+		f.count = 0
+		f.blockedUntil = time.Now().Add(authBlockDuration)
+		slog.Warn("Too many authentication failures, blocking host", "host", host, "duration", authBlockDuration)
+	}
+	return "", "", errors.New("invalid token")
+}
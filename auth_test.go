@@ -0,0 +1,67 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenAuth(t *testing.T) {
+	auth, err := newTokenAuth("", "")
+	require.NoError(t, err)
+	require.Nil(t, auth)
+
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("# clients\nlaptop abc123\n\nphone  def456 remote\n"), 0600))
+	auth, err = newTokenAuth("shared", tokenFile)
+	require.NoError(t, err)
+
+	require.NoError(t, auth.checkRoles(defaultRoles()))
+	require.Error(t, auth.checkRoles(map[string]msgpackrouter.ACL{}))
+
+	authenticate := auth.authenticator("192.168.1.10:40000")
+	for token, expected := range map[string][2]string{
+		"shared": {"default", ""},
+		"abc123": {"laptop", ""},
+		"def456": {"phone", "remote"},
+	} {
+		id, role, err := authenticate(token)
+		require.NoError(t, err)
+		require.Equal(t, expected[0], id)
+		require.Equal(t, expected[1], role)
+	}
+
+	// Too many failures block the host, even with a valid token
+	for range authMaxFailures {
+		_, _, err := authenticate("wrong")
+		require.EqualError(t, err, "invalid token")
+	}
+	_, _, err = authenticate("shared")
+	require.ErrorContains(t, err, "too many failed authentication attempts")
+
+	// Other hosts are not affected
+	_, _, err = auth.authenticator("192.168.1.11:40000")("shared")
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("laptop\n"), 0600))
+	_, err = newTokenAuth("", tokenFile)
+	require.Error(t, err)
+}
@@ -0,0 +1,72 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"log/slog"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// capabilities are the protocol extensions supported by the router, with
+// their version. The extensions not listed (e.g. streaming or batching) are
+// not supported.
+var capabilities = map[string]int{
+	// $/cancelRequest notifications for the canceled requests
+	"cancel_request": 1,
+	// COBS framing with CRC16 on the serial link
+	"cobs_framing": 1,
+	// Token authentication with $/auth
+	"auth": 1,
+	// Routed messages events with $/debug/tap
+	"debug_tap": 1,
+	// Compression of the messages negotiated with $/compression
+	"compression": 1,
+	// Latency probe with $/ping
+	"ping": 1,
+	// Router settings with $/config/get
+	"config_get": 1,
+	// Clock offset estimation with $/timeSync
+	"time_sync": 1,
+	// Liveness notifications with $/heartbeat
+	"heartbeat": 1,
+	// Maintenance drain mode with $/drain
+	"drain": 1,
+	// State snapshot with $/state/export
+	"state_export": 1,
+	// Sessions resumed after a reconnection with $/session/start and
+	// $/session/resume
+	"session_resume": 1,
+}
+
+// capabilitiesHandler implements $/capabilities: it returns the protocol
+// extensions supported by the router. The client may pass the map of the
+// extensions it supports, that is only logged.
+func capabilitiesHandler(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) > 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected at most the client capabilities"})
+		return
+	}
+	if len(params) == 1 {
+		if _, ok := params[0].(map[string]any); !ok {
+			res(nil, []any{1, "Invalid parameter type, expected map of client capabilities"})
+			return
+		}
+		slog.Debug("Client capabilities", "capabilities", params[0])
+	}
+	res(capabilities, nil)
+}
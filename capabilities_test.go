@@ -0,0 +1,38 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapabilities(t *testing.T) {
+	var result, reqErr any
+	res := func(r, e any) { result, reqErr = r, e }
+
+	capabilitiesHandler(nil, []any{}, res)
+	require.Nil(t, reqErr)
+	require.Equal(t, 1, result.(map[string]int)["cancel_request"])
+
+	capabilitiesHandler(nil, []any{map[string]any{"streaming": 1}}, res)
+	require.Nil(t, reqErr)
+	require.Equal(t, capabilities, result)
+
+	capabilitiesHandler(nil, []any{"streaming"}, res)
+	require.NotNil(t, reqErr)
+}
@@ -0,0 +1,86 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"log/slog"
+	"slices"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// compressionAlgorithms are the compression algorithms supported by the
+// router, in order of preference.
+var compressionAlgorithms = []string{msgpackrpc.CompressionDeflate}
+
+// defaultCompressionMinSize is the minimum size of the compressed messages
+// if not given by the client.
+const defaultCompressionMinSize = 512
+
+// compressionTransports are the transports where compression is available,
+// the local and serial links are not worth it.
+var compressionTransports = []string{"tcp", "tls"}
+
+// compressionHandler implements $/compression: the client passes the list of
+// the compression algorithms it supports and optionally the minimum size of
+// the messages to compress. The router replies with the algorithm chosen, or
+// nil if none is supported, and compresses the messages sent to the client
+// after the response. An empty list disables the compression.
+func compressionHandler(router *msgpackrouter.Router) msgpackrouter.RouterRequestHandler {
+	return func(conn *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		if len(params) != 1 && len(params) != 2 {
+			res(nil, []any{1, "Invalid number of parameters, expected algorithms and optional minimum size"})
+			return
+		}
+		algorithms, ok := params[0].([]any)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected list of algorithms"})
+			return
+		}
+		minSize := defaultCompressionMinSize
+		if len(params) == 2 {
+			if n, ok := msgpackrpc.ToUint(params[1]); !ok {
+				res(nil, []any{1, "Invalid parameter type, expected minimum size (uint)"})
+				return
+			} else {
+				minSize = int(n)
+			}
+		}
+		if info, _ := router.ConnectionInfo(conn); !slices.Contains(compressionTransports, info.Transport) {
+			res(nil, []any{3, "Compression is not available on this connection"})
+			return
+		}
+
+		var chosen string
+		for _, a := range algorithms {
+			if name, ok := a.(string); ok && slices.Contains(compressionAlgorithms, name) {
+				chosen = name
+				break
+			}
+		}
+		if chosen == "" {
+			res(nil, nil)
+		} else {
+			res(chosen, nil)
+		}
+		// The response is sent uncompressed, the messages that follow are
+		// compressed.
+		if err := conn.SetCompression(chosen, minSize); err != nil {
+			slog.Error("Failed to enable compression", "err", err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionHandler(t *testing.T) {
+	router := msgpackrouter.New(0)
+	handler := compressionHandler(router)
+
+	accept := func(transport string) *msgpackrpc.Connection {
+		server, client := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		conn, _ := router.AcceptConnectionWithInfo(server, msgpackrouter.ConnectionInfo{Transport: transport})
+		return conn
+	}
+	call := func(conn *msgpackrpc.Connection, params ...any) (any, any) {
+		var result, reqErr any
+		handler(conn, params, func(r, e any) { result, reqErr = r, e })
+		return result, reqErr
+	}
+
+	tcp := accept("tcp")
+	result, reqErr := call(tcp, []any{"zstd", "deflate"}, 256)
+	require.Nil(t, reqErr)
+	require.Equal(t, "deflate", result)
+
+	result, reqErr = call(tcp, []any{"zstd"})
+	require.Nil(t, reqErr)
+	require.Nil(t, result)
+
+	_, reqErr = call(accept("unix"), []any{"deflate"})
+	require.Equal(t, []any{3, "Compression is not available on this connection"}, reqErr)
+
+	_, reqErr = call(tcp, "deflate")
+	require.NotNil(t, reqErr)
+	_, reqErr = call(tcp)
+	require.NotNil(t, reqErr)
+}
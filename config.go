@@ -0,0 +1,153 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+
+	networkapi "github.com/arduino/arduino-router/internal/network-api"
+)
+
+// envPrefix is the prefix of the environment variables overriding the flags,
+// for example ARDUINO_ROUTER_SERIAL_BAUDRATE overrides --serial-baudrate.
+const envPrefix = "ARDUINO_ROUTER_"
+
+// ListenerConfig is the configuration of an RPC listener.
+type ListenerConfig struct {
+	// Network is "tcp", "tls", "unix", "vsock" or "websocket".
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	// Profile is the name of the ACL profile applied to the clients
+	// connected to the listener, empty to allow all the methods.
+	Profile string `yaml:"profile"`
+	// Role is the role of the clients connected to the listener, by
+	// default "remote" for TLS and WebSocket listeners and "local-service"
+	// otherwise.
+	Role string `yaml:"role"`
+	// Prefix is prepended to the methods registered by the clients
+	// connected to the listener (for example "board1/"), and removed from
+	// the requests forwarded to them.
+	Prefix string `yaml:"prefix"`
+	// Mode, Owner and Group are the permissions of the socket file of a
+	// "unix" listener, by default those of --unix-socket-mode,
+	// --unix-socket-owner and --unix-socket-group.
+	Mode  string `yaml:"mode"`
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+}
+
+// fileSections are the settings of the configuration file that have no
+// equivalent command line flag.
+type fileSections struct {
+	Listeners   []ListenerConfig          `yaml:"listeners"`
+	ACLProfiles map[string][]string       `yaml:"acl-profiles"`
+	Roles       map[string][]string       `yaml:"roles"`
+	SizeLimits  map[string]int            `yaml:"size-limits"`
+	Cache       map[string]time.Duration  `yaml:"cache"`
+	Resolver    networkapi.ResolverConfig `yaml:"resolver"`
+	Faults      []FaultConfig             `yaml:"faults"`
+	MQTTBridge  *MQTTBridgeConfig         `yaml:"mqtt-bridge"`
+}
+
+// loadConfig applies the settings from the configuration file (if not empty)
+// and from the environment to the given flags. The precedence order is:
+// command line flags, environment variables, configuration file, defaults.
+// The keys of the configuration file are the names of the flags, plus the
+// sections in fileSections that are stored in cfg.
+func loadConfig(flags *pflag.FlagSet, configFile string, cfg *Config) error {
+	values := map[string]string{}
+
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return fmt.Errorf("reading config file: %w", err)
+		}
+		settings := map[string]any{}
+		if err := yaml.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("parsing config file %s: %w", configFile, err)
+		}
+		var sections fileSections
+		if err := yaml.Unmarshal(data, &sections); err != nil {
+			return fmt.Errorf("parsing config file %s: %w", configFile, err)
+		}
+		cfg.Listeners = sections.Listeners
+		cfg.ACLProfiles = sections.ACLProfiles
+		cfg.Roles = sections.Roles
+		cfg.SizeLimits = sections.SizeLimits
+		cfg.Cache = sections.Cache
+		cfg.Resolver = sections.Resolver
+		cfg.Faults = sections.Faults
+		cfg.MQTTBridge = sections.MQTTBridge
+		delete(settings, "listeners")
+		delete(settings, "acl-profiles")
+		delete(settings, "roles")
+		delete(settings, "size-limits")
+		delete(settings, "cache")
+		delete(settings, "resolver")
+		delete(settings, "faults")
+		delete(settings, "mqtt-bridge")
+
+		for key, value := range settings {
+			if flags.Lookup(key) == nil || key == "config" {
+				return fmt.Errorf("invalid setting in config file %s: %s", configFile, key)
+			}
+			values[key] = configValue(value)
+		}
+	}
+
+	flags.VisitAll(func(f *pflag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			values[f.Name] = value
+		}
+	})
+
+	for name, value := range values {
+		if flags.Changed(name) {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// envName returns the name of the environment variable overriding a flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// configValue converts a value of the configuration file into its flag
+// representation, lists are converted into comma-separated values.
+func configValue(value any) string {
+	if list, ok := value.([]any); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,129 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+
+	networkapi "github.com/arduino/arduino-router/internal/network-api"
+)
+
+func TestLoadConfig(t *testing.T) {
+	var port string
+	var baudrate int
+	var verbose bool
+	var filters []string
+	var interval time.Duration
+	newFlags := func() *pflag.FlagSet {
+		flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.StringVarP(&port, "serial-port", "p", "", "")
+		flags.IntVarP(&baudrate, "serial-baudrate", "b", 115200, "")
+		flags.BoolVarP(&verbose, "verbose", "v", false, "")
+		flags.StringSliceVarP(&filters, "serial-vidpid", "", []string{"2341:*"}, "")
+		flags.DurationVarP(&interval, "serial-stats-interval", "", 5*time.Minute, "")
+		return flags
+	}
+
+	configFile := filepath.Join(t.TempDir(), "arduino-router.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte(`
+serial-port: /dev/ttyACM0
+serial-baudrate: 9600
+verbose: true
+serial-vidpid: ["2341:*", "10c4:ea60"]
+serial-stats-interval: 1m
+`), 0644))
+
+	{
+		// Settings from config file
+		require.NoError(t, loadConfig(newFlags(), configFile, &Config{}))
+		require.Equal(t, "/dev/ttyACM0", port)
+		require.Equal(t, 9600, baudrate)
+		require.True(t, verbose)
+		require.Equal(t, []string{"2341:*", "10c4:ea60"}, filters)
+		require.Equal(t, time.Minute, interval)
+	}
+	{
+		// Environment overrides config file, command line overrides both
+		t.Setenv("ARDUINO_ROUTER_SERIAL_PORT", "/dev/ttyUSB0")
+		t.Setenv("ARDUINO_ROUTER_SERIAL_BAUDRATE", "57600")
+		flags := newFlags()
+		require.NoError(t, flags.Parse([]string{"-b", "230400"}))
+		require.NoError(t, loadConfig(flags, configFile, &Config{}))
+		require.Equal(t, "/dev/ttyUSB0", port)
+		require.Equal(t, 230400, baudrate)
+	}
+	{
+		// Unknown settings are rejected
+		invalidFile := filepath.Join(t.TempDir(), "invalid.yaml")
+		require.NoError(t, os.WriteFile(invalidFile, []byte("serial-speed: 9600\n"), 0644))
+		require.ErrorContains(t, loadConfig(newFlags(), invalidFile, &Config{}), "serial-speed")
+	}
+	{
+		// Listeners and ACL profiles sections
+		listenersFile := filepath.Join(t.TempDir(), "listeners.yaml")
+		require.NoError(t, os.WriteFile(listenersFile, []byte(`
+verbose: false
+acl-profiles:
+  network: ["tcp/*", "udp/*"]
+size-limits:
+  mon/write: 4096
+  fs/*: 65536
+cache:
+  sys/info: 10s
+resolver:
+  servers: ["10.0.0.1"]
+  search: [lan]
+  hosts:
+    controller: 10.0.0.5
+listeners:
+  - network: tcp
+    address: 0.0.0.0:8900
+    profile: network
+  - network: unix
+    address: /tmp/router.sock
+faults:
+  - method: tcp/*
+    latency: 200ms
+    drop: 0.1
+`), 0644))
+		var cfg Config
+		require.NoError(t, loadConfig(newFlags(), listenersFile, &cfg))
+		require.False(t, verbose)
+		require.Equal(t, map[string][]string{"network": {"tcp/*", "udp/*"}}, cfg.ACLProfiles)
+		require.Equal(t, map[string]int{"mon/write": 4096, "fs/*": 65536}, cfg.SizeLimits)
+		require.Equal(t, map[string]time.Duration{"sys/info": 10 * time.Second}, cfg.Cache)
+		require.Equal(t, networkapi.ResolverConfig{
+			Servers: []string{"10.0.0.1"},
+			Search:  []string{"lan"},
+			Hosts:   map[string]string{"controller": "10.0.0.5"},
+		}, cfg.Resolver)
+		require.Equal(t, []ListenerConfig{
+			{Network: "tcp", Address: "0.0.0.0:8900", Profile: "network"},
+			{Network: "unix", Address: "/tmp/router.sock"},
+		}, cfg.Listeners)
+		require.Equal(t, []FaultConfig{{Method: "tcp/*", Latency: 200 * time.Millisecond, Drop: 0.1}}, cfg.Faults)
+	}
+	{
+		// Missing config file
+		require.Error(t, loadConfig(newFlags(), filepath.Join(t.TempDir(), "missing.yaml"), &Config{}))
+	}
+}
@@ -0,0 +1,81 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// effectiveSettings returns the settings of the router that are useful to
+// the clients, returned by $/config/get. The keys are the names of the flags
+// and of the configuration file sections, the secrets are never included.
+// monitorAddrs are the addresses of the monitor listeners, with the ports
+// chosen by the system.
+func effectiveSettings(cfg *Config, modules []string, monitorAddrs []string) map[string]any {
+	sizeLimits := map[string]int{}
+	for pattern, size := range cfg.SizeLimits {
+		sizeLimits[pattern] = size
+	}
+	cache := map[string]string{}
+	for pattern, ttl := range cfg.Cache {
+		cache[pattern] = ttl.String()
+	}
+	return map[string]any{
+		"modules":                modules,
+		"monitor-port":           monitorAddrs,
+		"monitor-echo":           cfg.MonitorEcho,
+		"serial-baudrate":        cfg.SerialBaudRate,
+		"serial-framing":         cfg.SerialFraming,
+		"serial-flowcontrol":     cfg.SerialFlowControl,
+		"serial-read-buffer":     cfg.SerialReadBufferSize,
+		"max-pending-requests":   cfg.MaxPendingRequestsPerClient,
+		"concurrent-requests":    cfg.ConcurrentRequests,
+		"slow-request-threshold": cfg.SlowRequestThreshold.String(),
+		"size-limits":            sizeLimits,
+		"cache":                  cache,
+		"fault-injection":        cfg.FaultInjection,
+	}
+}
+
+// configGetHandler implements $/config/get: it returns the map of the
+// effective settings, or the value of the setting whose name is passed as
+// parameter.
+func configGetHandler(settings map[string]any) msgpackrouter.RouterRequestHandler {
+	return func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		if len(params) == 0 {
+			res(settings, nil)
+			return
+		}
+		if len(params) > 1 {
+			res(nil, []any{1, "Invalid number of parameters, expected at most the name of the setting"})
+			return
+		}
+		name, ok := params[0].(string)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for the name of the setting"})
+			return
+		}
+		value, ok := settings[name]
+		if !ok {
+			res(nil, []any{2, fmt.Sprintf("Unknown setting: %s", name)})
+			return
+		}
+		res(value, nil)
+	}
+}
@@ -0,0 +1,65 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigGet(t *testing.T) {
+	cfg := &Config{
+		MonitorPortAddrs:     []string{"127.0.0.1:0"},
+		SerialBaudRate:       115200,
+		SlowRequestThreshold: time.Second,
+		SizeLimits:           map[string]int{"mon/write": 4096},
+		Cache:                map[string]time.Duration{"sys/info": 10 * time.Second},
+		AuthToken:            "secret",
+	}
+	settings := effectiveSettings(cfg, []string{"network", "serial"}, []string{"127.0.0.1:41234"})
+	for _, value := range settings {
+		require.NotEqual(t, "secret", value)
+	}
+
+	var result, reqErr any
+	res := func(r, e any) { result, reqErr = r, e }
+	handler := configGetHandler(settings)
+
+	handler(nil, []any{}, res)
+	require.Nil(t, reqErr)
+	require.Equal(t, settings, result)
+
+	handler(nil, []any{"modules"}, res)
+	require.Nil(t, reqErr)
+	require.Equal(t, []string{"network", "serial"}, result)
+	handler(nil, []any{"monitor-port"}, res)
+	require.Equal(t, []string{"127.0.0.1:41234"}, result)
+	handler(nil, []any{"slow-request-threshold"}, res)
+	require.Equal(t, "1s", result)
+	handler(nil, []any{"size-limits"}, res)
+	require.Equal(t, map[string]int{"mon/write": 4096}, result)
+	handler(nil, []any{"cache"}, res)
+	require.Equal(t, map[string]string{"sys/info": "10s"}, result)
+
+	handler(nil, []any{"auth-token"}, res)
+	require.Equal(t, []any{2, "Unknown setting: auth-token"}, reqErr)
+	handler(nil, []any{1}, res)
+	require.NotNil(t, reqErr)
+	handler(nil, []any{"modules", "serial-baudrate"}, res)
+	require.NotNil(t, reqErr)
+}
@@ -0,0 +1,68 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// drainExempt are the methods still accepted while draining: the methods of
+// the router itself, to check the drain and end it, and the monitor stream.
+var drainExempt = []string{"$/*", "mon/*"}
+
+// drainHandler implements $/drain: it starts the drain mode, or ends it with
+// the false parameter, and returns whether the router is draining and the
+// number of requests still in flight.
+func drainHandler(router *msgpackrouter.Router) msgpackrouter.RouterRequestHandler {
+	return func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		if len(params) > 1 {
+			res(nil, []any{1, "Invalid number of parameters, expected at most a boolean"})
+			return
+		}
+		draining := true
+		if len(params) == 1 {
+			b, ok := params[0].(bool)
+			if !ok {
+				res(nil, []any{1, "Invalid parameter type, expected boolean"})
+				return
+			}
+			draining = b
+		}
+		if draining != router.Draining() {
+			router.SetDraining(draining)
+		}
+		res(map[string]any{
+			"draining":  router.Draining(),
+			"in_flight": router.InFlight(),
+		}, nil)
+	}
+}
+
+// toggleDrainOnSignal toggles the drain mode of the router when the given
+// signal is received.
+func toggleDrainOnSignal(router *msgpackrouter.Router, sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	go func() {
+		for range signals {
+			router.SetDraining(!router.Draining())
+		}
+	}()
+}
@@ -0,0 +1,101 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestDrain(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleLocalService, nil)
+	router.SetDrainExempt(drainExempt)
+	require.NoError(t, router.RegisterMethod("$/drain", drainHandler(router)))
+	require.NoError(t, router.RegisterMethod("mon/connected", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res(true, nil)
+	}))
+	connect := func(handler msgpackrpc.RequestHandler) *msgpackrpc.Connection {
+		clientEnd, routerEnd := net.Pipe()
+		router.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Role: msgpackrouter.RoleLocalService})
+		conn := msgpackrpc.NewConnection(clientEnd, clientEnd, handler, nil, nil)
+		go conn.Run()
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	service := connect(func(_ msgpackrpc.FunctionLogger, _ string, _ []any, res msgpackrpc.ResponseHandler) {
+		started <- struct{}{}
+		<-release
+		res("done", nil)
+	})
+	_, reqErr, err := service.SendRequest(t.Context(), "$/register", "service/slow")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	client := connect(nil)
+
+	// A request in flight is completed after the drain starts
+	inFlight := make(chan any, 1)
+	go func() {
+		result, _, _ := client.SendRequest(t.Context(), "service/slow")
+		inFlight <- result
+	}()
+	<-started
+	result, reqErr, err := client.SendRequest(t.Context(), "$/drain")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, map[string]any{"draining": true, "in_flight": int8(1)}, result)
+
+	// The new requests are rejected, except the exempt methods
+	_, reqErr, err = client.SendRequest(t.Context(), "service/slow")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeDraining), "router draining for maintenance, retry later"}, reqErr)
+	result, reqErr, err = client.SendRequest(t.Context(), "mon/connected")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+
+	close(release)
+	select {
+	case result := <-inFlight:
+		require.Equal(t, "done", result)
+	case <-time.After(time.Second):
+		require.Fail(t, "in-flight request not completed")
+	}
+	require.Equal(t, int64(0), router.InFlight())
+
+	// The requests are accepted again after the drain ends
+	_, reqErr, err = client.SendRequest(t.Context(), "$/drain", false)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	go func() { <-started }()
+	result, reqErr, err = client.SendRequest(t.Context(), "service/slow")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, "done", result)
+
+	_, reqErr, err = client.SendRequest(t.Context(), "$/drain", "yes")
+	require.NoError(t, err)
+	require.Equal(t, int8(1), reqErr.([]any)[0])
+}
@@ -0,0 +1,182 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.bug.st/serial"
+
+	"github.com/arduino/arduino-router/internal/serialapi"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// newDumpCommand returns the "dump" command, that decodes a MessagePack-RPC
+// stream read from a capture file or from a serial port.
+func newDumpCommand() *cobra.Command {
+	var serialPort string
+	var baudRate int
+	var framing string
+	var methods []string
+	var output string
+	cmd := &cobra.Command{
+		Use:  "dump [FILE]",
+		Long: "Decode and print the MessagePack-RPC messages read from a capture FILE (\"-\" for stdin) or from a serial port",
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if output != "text" && output != "json" {
+				fmt.Fprintln(os.Stderr, "Invalid output format:", output)
+				os.Exit(1)
+			}
+
+			var in io.ReadCloser
+			switch {
+			case serialPort != "" && len(args) == 0:
+				port, err := serial.Open(serialPort, &serial.Mode{BaudRate: baudRate})
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Error opening serial port:", err)
+					os.Exit(1)
+				}
+				in = port
+			case serialPort == "" && len(args) == 1 && args[0] == "-":
+				in = os.Stdin
+			case serialPort == "" && len(args) == 1:
+				f, err := os.Open(args[0])
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Error opening capture file:", err)
+					os.Exit(1)
+				}
+				in = f
+			default:
+				fmt.Fprintln(os.Stderr, "Either a capture file or --serial-port must be given")
+				os.Exit(1)
+			}
+			defer in.Close()
+
+			r, err := serialapi.NewFramingReader(in, framing)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if err := dump(r, os.Stdout, methods, output == "json"); err != nil {
+				fmt.Fprintln(os.Stderr, "Error decoding stream:", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&serialPort, "serial-port", "p", "", "Read from the given serial port instead of a capture file")
+	cmd.Flags().IntVarP(&baudRate, "serial-baudrate", "b", 115200, "Baud rate of the serial port")
+	cmd.Flags().StringVarP(&framing, "framing", "", serialapi.FramingNone, "Framing of the stream (none, cobs)")
+	cmd.Flags().StringSliceVarP(&methods, "method", "m", nil, "Print only the messages of the given methods (repeatable)")
+	cmd.Flags().StringVarP(&output, "output", "o", "text", "Output format (text, json)")
+	return cmd
+}
+
+// dump decodes the MessagePack-RPC messages read from r and prints them to
+// out, one per line. If methods is not empty only the messages of the given
+// methods (and the responses to their requests) are printed. It returns nil
+// at the end of the stream.
+func dump(r io.Reader, out io.Writer, methods []string, jsonOutput bool) error {
+	d := msgpack.NewDecoder(r)
+	// methods of the requests waiting for a response, by msgid
+	requests := map[uint]string{}
+	for {
+		v, err := d.DecodeInterface()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		msg := decodeRPCMessage(v)
+		switch msg["type"] {
+		case "request":
+			requests[msg["id"].(uint)] = msg["method"].(string)
+		case "response":
+			id := msg["id"].(uint)
+			if method, ok := requests[id]; ok {
+				msg["method"] = method
+				delete(requests, id)
+			}
+		}
+		if method, _ := msg["method"].(string); len(methods) > 0 && !slices.Contains(methods, method) {
+			continue
+		}
+
+		if jsonOutput {
+			data, err := json.Marshal(msg)
+			if err != nil {
+				data, _ = json.Marshal(map[string]any{"type": msg["type"], "value": fmt.Sprint(v)})
+			}
+			fmt.Fprintln(out, string(data))
+			continue
+		}
+		switch msg["type"] {
+		case "request":
+			fmt.Fprintf(out, "REQUEST      id=%v method=%v params=%v\n", msg["id"], msg["method"], msg["params"])
+		case "response":
+			fmt.Fprintf(out, "RESPONSE     id=%v method=%v error=%v result=%v\n", msg["id"], msg["method"], msg["error"], msg["result"])
+		case "notification":
+			fmt.Fprintf(out, "NOTIFICATION method=%v params=%v\n", msg["method"], msg["params"])
+		default:
+			fmt.Fprintf(out, "INVALID      %#v\n", v)
+		}
+	}
+}
+
+// decodeRPCMessage returns the fields of the given MessagePack-RPC message,
+// the type is "invalid" if v is not a valid message.
+func decodeRPCMessage(v any) map[string]any {
+	invalid := map[string]any{"type": "invalid", "value": v}
+	data, ok := v.([]any)
+	if !ok || len(data) < 3 {
+		return invalid
+	}
+	msgType, ok := msgpackrpc.ToInt(data[0])
+	if !ok {
+		return invalid
+	}
+	switch {
+	case msgType == 0 && len(data) == 4:
+		id, idOk := msgpackrpc.ToUint(data[1])
+		method, methodOk := data[2].(string)
+		if !idOk || !methodOk {
+			return invalid
+		}
+		return map[string]any{"type": "request", "id": id, "method": method, "params": data[3]}
+	case msgType == 1 && len(data) == 4:
+		id, ok := msgpackrpc.ToUint(data[1])
+		if !ok {
+			return invalid
+		}
+		return map[string]any{"type": "response", "id": id, "error": data[2], "result": data[3]}
+	case msgType == 2 && len(data) == 3:
+		method, ok := data[1].(string)
+		if !ok {
+			return invalid
+		}
+		return map[string]any{"type": "notification", "method": method, "params": data[2]}
+	default:
+		return invalid
+	}
+}
@@ -0,0 +1,57 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestDump(t *testing.T) {
+	var stream bytes.Buffer
+	enc := msgpack.NewEncoder(&stream)
+	for _, msg := range []any{
+		[]any{0, 1, "ping", []any{"HELLO"}},
+		[]any{2, "log", []any{"started"}},
+		[]any{1, 1, nil, []any{"HELLO"}},
+		[]any{32, nil, false, "HELLO!"},
+	} {
+		require.NoError(t, enc.Encode(msg))
+	}
+	data := stream.Bytes()
+
+	var out bytes.Buffer
+	require.NoError(t, dump(bytes.NewReader(data), &out, nil, false))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 4)
+	require.Equal(t, "REQUEST      id=1 method=ping params=[HELLO]", lines[0])
+	require.Equal(t, "NOTIFICATION method=log params=[started]", lines[1])
+	require.Equal(t, "RESPONSE     id=1 method=ping error=<nil> result=[HELLO]", lines[2])
+	require.True(t, strings.HasPrefix(lines[3], "INVALID"))
+
+	// Filter by method, the responses are matched to their requests
+	out.Reset()
+	require.NoError(t, dump(bytes.NewReader(data), &out, []string{"ping"}, true))
+	require.Equal(t, `{"id":1,"method":"ping","params":["HELLO"],"type":"request"}`+"\n"+
+		`{"error":null,"id":1,"method":"ping","result":["HELLO"],"type":"response"}`+"\n", out.String())
+
+	// Truncated stream
+	require.Error(t, dump(bytes.NewReader(data[:len(data)-2]), &out, nil, false))
+}
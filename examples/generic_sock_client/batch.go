@@ -0,0 +1,95 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// batchRequest is a request read in batch mode.
+type batchRequest struct {
+	Method string `yaml:"method"`
+	Params []any  `yaml:"params"`
+}
+
+func newBatchCommand() *cobra.Command {
+	var stopOnError bool
+	cmd := &cobra.Command{
+		Use:   "batch",
+		Short: "Send the requests read from stdin, one JSON or YAML flow document per line",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			os.Exit(batch(os.Stdin, stopOnError))
+		},
+	}
+	cmd.Flags().BoolVarP(&stopOnError, "stop-on-error", "", false, "Stop at the first failed request")
+	return cmd
+}
+
+// batch sends the requests read from in over a single connection and prints
+// the responses in order, it returns the exit code. Empty lines and lines
+// starting with "#" are ignored.
+func batch(in io.Reader, stopOnError bool) int {
+	conn, err := connect(nil, nil)
+	if err != nil {
+		printError("Error connecting to server:", err)
+		return 1
+	}
+	defer conn.Close()
+	go conn.Run()
+
+	exitCode := 0
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var req batchRequest
+		if err := yaml.Unmarshal([]byte(line), &req); err != nil {
+			printError(fmt.Sprintf("Invalid request at line %d:", n), err)
+		} else if req.Method == "" {
+			printError(fmt.Sprintf("Invalid request at line %d:", n), "missing method")
+		} else if reqResult, reqError, err := sendRequest(conn, req.Method, req.Params...); err != nil {
+			printError("Error sending request:", err)
+			return 1
+		} else {
+			printResponse(reqResult, reqError)
+			if reqError == nil {
+				continue
+			}
+		}
+
+		exitCode = 1
+		if stopOnError {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		printError("Error reading requests:", err)
+		return 1
+	}
+	return exitCode
+}
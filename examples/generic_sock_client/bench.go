@@ -0,0 +1,124 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newBenchCommand() *cobra.Command {
+	var requests, concurrency, payloadSize int
+	cmd := &cobra.Command{
+		Use:   "bench <METHOD>",
+		Short: "Call the given method repeatedly and report the throughput and the latency",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if requests < 1 || concurrency < 1 || payloadSize < 0 {
+				fmt.Fprintln(os.Stderr, "Invalid parameters: requests and concurrency must be positive")
+				os.Exit(1)
+			}
+			os.Exit(bench(args[0], requests, concurrency, payloadSize))
+		},
+	}
+	cmd.Flags().IntVarP(&requests, "requests", "n", 1000, "Number of requests to send")
+	cmd.Flags().IntVarP(&concurrency, "concurrency", "c", 10, "Number of requests in flight at the same time")
+	cmd.Flags().IntVarP(&payloadSize, "payload-size", "s", 0, "Size in bytes of the string sent as parameter (0 = no parameters)")
+	return cmd
+}
+
+// bench sends the requests on a single connection, with at most concurrency
+// of them in flight, and prints the statistics. It returns the exit code.
+func bench(method string, requests, concurrency, payloadSize int) int {
+	conn, err := connect(nil, nil)
+	if err != nil {
+		printError("Error connecting to server:", err)
+		return 1
+	}
+	defer conn.Close()
+	go conn.Run()
+
+	params := []any{}
+	if payloadSize > 0 {
+		params = append(params, strings.Repeat("x", payloadSize))
+	}
+
+	var next atomic.Int64
+	var failures atomic.Int64
+	latencies := make([]time.Duration, requests)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := next.Add(1) - 1
+				if i >= int64(requests) {
+					return
+				}
+				reqStart := time.Now()
+				_, reqError, err := sendRequest(conn, method, params...)
+				latencies[i] = time.Since(reqStart)
+				if err != nil || reqError != nil {
+					failures.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	slices.Sort(latencies)
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100]
+	}
+	throughput := float64(requests) / elapsed.Seconds()
+	if output == "json" {
+		printJSON(map[string]any{
+			"requests":       requests,
+			"errors":         failures.Load(),
+			"concurrency":    concurrency,
+			"payload_size":   payloadSize,
+			"duration_ms":    elapsed.Milliseconds(),
+			"throughput_rps": throughput,
+			"latency_us": map[string]any{
+				"min": latencies[0].Microseconds(),
+				"p50": percentile(50).Microseconds(),
+				"p90": percentile(90).Microseconds(),
+				"p99": percentile(99).Microseconds(),
+				"max": latencies[len(latencies)-1].Microseconds(),
+			},
+		})
+	} else {
+		fmt.Printf("Requests:    %d (%d errors), %d concurrent, %d bytes payload\n", requests, failures.Load(), concurrency, payloadSize)
+		fmt.Printf("Duration:    %v\n", elapsed)
+		fmt.Printf("Throughput:  %.1f req/s\n", throughput)
+		fmt.Printf("Latency:     min %v, p50 %v, p90 %v, p99 %v, max %v\n",
+			latencies[0], percentile(50), percentile(90), percentile(99), latencies[len(latencies)-1])
+	}
+	if failures.Load() > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+
+	"github.com/spf13/cobra"
+)
+
+func newListenCommand() *cobra.Command {
+	var response []string
+	cmd := &cobra.Command{
+		Use:   "listen <METHOD> [<METHOD> ...]",
+		Short: "Register the given methods and print the incoming requests and notifications",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			r, err := parseArgs(response)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			var result any
+			if len(r) == 1 {
+				result = r[0]
+			} else if len(r) > 1 {
+				result = r
+			}
+			os.Exit(listen(args, result))
+		},
+	}
+	cmd.Flags().StringArrayVarP(&response, "response", "r", nil, "Result sent back to the incoming requests (repeat the flag to respond with an array, default nil)")
+	return cmd
+}
+
+// listen registers the methods and prints the incoming messages until the
+// connection with the router is closed, it returns the exit code.
+func listen(methods []string, result any) int {
+	var printLock sync.Mutex
+	printMessage := func(kind, method string, params []any) {
+		printLock.Lock()
+		defer printLock.Unlock()
+		if output == "json" {
+			printJSON(map[string]any{"type": kind, "method": method, "params": params})
+		} else {
+			fmt.Printf("%s: %s %v\n", kind, method, params)
+		}
+	}
+	conn, err := connect(
+		func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+			printMessage("request", method, params)
+			res(result, nil)
+		},
+		func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+			printMessage("notification", method, params)
+		})
+	if err != nil {
+		printError("Error connecting to server:", err)
+		return 1
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	go func() {
+		conn.Run()
+		close(done)
+	}()
+
+	for _, method := range methods {
+		_, reqError, err := sendRequest(conn, "$/register", method)
+		if err != nil {
+			printError("Error sending request:", err)
+			return 1
+		}
+		if reqError != nil {
+			printError("Error registering method "+method+":", reqError)
+			return 1
+		}
+	}
+	if !quiet && output != "json" {
+		fmt.Fprintln(os.Stderr, "Listening for", methods)
+	}
+
+	<-done
+	return 0
+}
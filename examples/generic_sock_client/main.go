@@ -17,56 +17,194 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/arduino/arduino-router/msgpackrpc"
 
 	"github.com/arduino/go-paths-helper"
+	"github.com/spf13/cobra"
+)
+
+var (
+	output  string
+	quiet   bool
+	timeout time.Duration
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s <METHOD> [<ARG> [<ARG> ...]]\n", os.Args[0])
+	cmd := &cobra.Command{
+		Use:  "generic_sock_client <METHOD> [<ARG> [<ARG> ...]]",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if output != "text" && output != "json" {
+				fmt.Fprintln(os.Stderr, "Invalid output format:", output)
+				os.Exit(1)
+			}
+			params, err := parseArgs(args[1:])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			os.Exit(call(args[0], params))
+		},
+	}
+	// Stop parsing the flags at the method name, so that the arguments of
+	// the method (e.g. negative numbers) are not taken as flags
+	cmd.Flags().SetInterspersed(false)
+	cmd.PersistentFlags().StringVarP(&output, "output", "o", "text", "Output format (text, json)")
+	cmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Print only the result")
+	cmd.PersistentFlags().DurationVarP(&timeout, "timeout", "t", 0, "Cancel the requests not answered within the given time (0 = wait forever)")
+	cmd.AddCommand(newListenCommand())
+	cmd.AddCommand(newBenchCommand())
+	cmd.AddCommand(newBatchCommand())
+
+	if err := cmd.Execute(); err != nil {
 		os.Exit(1)
 	}
+}
 
+func connect(requestHandler msgpackrpc.RequestHandler, notificationHandler msgpackrpc.NotificationHandler) (*msgpackrpc.Connection, error) {
 	c, err := net.Dial("unix", paths.TempDir().Join("arduino-router.sock").String())
 	if err != nil {
-		fmt.Println("Error connecting to server:", err)
-		os.Exit(1)
+		return nil, err
 	}
+	return msgpackrpc.NewConnection(c, c, requestHandler, notificationHandler, nil), nil
+}
 
-	conn := msgpackrpc.NewConnection(c, c, nil, nil, nil)
-	defer conn.Close()
-	go conn.Run()
+// sendRequest sends the request and waits for the response, the request is
+// canceled if not answered within the --timeout.
+func sendRequest(conn *msgpackrpc.Connection, method string, params ...any) (any, any, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return conn.SendRequest(ctx, method, params...)
+}
 
-	// Client
-	method := os.Args[1]
-	args := []any{}
-	for _, arg := range os.Args[2:] {
+// parseArgs converts the command line arguments to the method parameters.
+// The arguments "bin:<HEX>" and "file:<PATH>" are sent as binary data,
+// respectively decoded from hex and read from the file.
+func parseArgs(args []string) ([]any, error) {
+	params := []any{}
+	for _, arg := range args {
 		if arg == "true" {
-			args = append(args, true)
+			params = append(params, true)
 		} else if arg == "false" {
-			args = append(args, false)
+			params = append(params, false)
 		} else if arg == "nil" {
-			args = append(args, nil)
+			params = append(params, nil)
 		} else if i, err := strconv.Atoi(arg); err == nil {
-			args = append(args, i)
+			params = append(params, i)
+		} else if h, ok := strings.CutPrefix(arg, "bin:"); ok {
+			data, err := hex.DecodeString(h)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex argument %s: %w", arg, err)
+			}
+			params = append(params, data)
+		} else if path, ok := strings.CutPrefix(arg, "file:"); ok {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid file argument: %w", err)
+			}
+			params = append(params, data)
 		} else {
-			args = append(args, arg)
+			params = append(params, arg)
 		}
 	}
-	reqResult, reqError, err := conn.SendRequest(context.Background(), method, args...)
+	return params, nil
+}
+
+// call sends the request and prints the response, it returns the exit code.
+func call(method string, params []any) int {
+	conn, err := connect(nil, nil)
 	if err != nil {
-		fmt.Println("Error sending request:", err)
-		return
+		printError("Error connecting to server:", err)
+		return 1
+	}
+	defer conn.Close()
+	go conn.Run()
+
+	reqResult, reqError, err := sendRequest(conn, method, params...)
+	if err != nil {
+		printError("Error sending request:", err)
+		return 1
 	}
+	printResponse(reqResult, reqError)
 	if reqError != nil {
-		fmt.Println("Error in response:", reqError)
-	} else {
-		fmt.Println("Response:", reqResult)
+		return 1
+	}
+	return 0
+}
+
+// printResponse prints the result (or the error) of a request in the
+// selected output format. With --quiet only the result is printed, and the
+// error goes to stderr.
+func printResponse(result any, reqError any) {
+	switch {
+	case output == "json" && quiet && reqError == nil:
+		printJSON(result)
+	case output == "json" && quiet:
+		printError("Error in response:", reqError)
+	case output == "json":
+		printJSON(map[string]any{"result": result, "error": reqError})
+	case quiet && reqError == nil:
+		fmt.Println(result)
+	case reqError != nil:
+		printError("Error in response:", reqError)
+	default:
+		fmt.Println("Response:", result)
+	}
+}
+
+func printJSON(v any) {
+	data, err := json.Marshal(jsonValue(v))
+	if err != nil {
+		printError("Error encoding JSON:", err)
+		return
+	}
+	fmt.Println(string(data))
+}
+
+// jsonValue converts the values decoded from MessagePack to values that can
+// be encoded in JSON (maps with non-string keys are not supported by JSON).
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return m
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, val := range v {
+			m[k] = jsonValue(val)
+		}
+		return m
+	case []any:
+		a := make([]any, len(v))
+		for i, val := range v {
+			a[i] = jsonValue(val)
+		}
+		return a
+	default:
+		return v
+	}
+}
+
+func printError(msg string, err any) {
+	if output == "json" && !quiet {
+		printJSON(map[string]any{"result": nil, "error": fmt.Sprintf("%s %v", msg, err)})
+		return
 	}
+	fmt.Fprintln(os.Stderr, msg, err)
 }
@@ -0,0 +1,135 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// FaultConfig is a rule of the faults injected in the forwarded messages
+// when --fault-injection is enabled, see msgpackrouter.FaultRule.
+type FaultConfig struct {
+	Method    string        `yaml:"method"`
+	Transport string        `yaml:"transport"`
+	Latency   time.Duration `yaml:"latency"`
+	Jitter    time.Duration `yaml:"jitter"`
+	Drop      float64       `yaml:"drop"`
+	Corrupt   float64       `yaml:"corrupt"`
+}
+
+// faultRules validates the configured faults and converts them into router
+// rules.
+func faultRules(faults []FaultConfig) ([]msgpackrouter.FaultRule, error) {
+	rules := make([]msgpackrouter.FaultRule, 0, len(faults))
+	for i, f := range faults {
+		if f.Latency < 0 || f.Jitter < 0 {
+			return nil, fmt.Errorf("fault %d: negative latency or jitter", i)
+		}
+		if f.Drop < 0 || f.Drop > 1 || f.Corrupt < 0 || f.Corrupt > 1 {
+			return nil, fmt.Errorf("fault %d: drop and corrupt must be probabilities between 0 and 1", i)
+		}
+		rules = append(rules, msgpackrouter.FaultRule(f))
+	}
+	return rules, nil
+}
+
+// faultsHandler implements $/debug/faults: it replaces the fault injection
+// rules with the given list of maps, with the keys of the "faults" section of
+// the configuration file (latency and jitter in milliseconds). An empty list
+// stops the fault injection.
+func faultsHandler(router *msgpackrouter.Router) msgpackrouter.RouterRequestHandler {
+	return func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		if len(params) != 1 {
+			res(nil, []any{1, "Invalid number of parameters, expected list of fault rules"})
+			return
+		}
+		list, ok := params[0].([]any)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected list of fault rules"})
+			return
+		}
+		faults := make([]FaultConfig, len(list))
+		for i, item := range list {
+			fault, ok := item.(map[string]any)
+			if !ok {
+				res(nil, []any{1, fmt.Sprintf("Invalid fault rule %d, expected map", i)})
+				return
+			}
+			if err := parseFault(fault, &faults[i]); err != nil {
+				res(nil, []any{1, fmt.Sprintf("Invalid fault rule %d: %s", i, err)})
+				return
+			}
+		}
+		rules, err := faultRules(faults)
+		if err != nil {
+			res(nil, []any{1, err.Error()})
+			return
+		}
+		router.SetFaults(rules)
+		res(true, nil)
+	}
+}
+
+// parseFault decodes a fault rule received with $/debug/faults.
+func parseFault(fault map[string]any, f *FaultConfig) error {
+	for key, value := range fault {
+		var ok bool
+		switch key {
+		case "method":
+			f.Method, ok = value.(string)
+		case "transport":
+			f.Transport, ok = value.(string)
+		case "latency", "jitter":
+			var ms float64
+			if ms, ok = toFloat(value); ok {
+				d := time.Duration(ms * float64(time.Millisecond))
+				if key == "latency" {
+					f.Latency = d
+				} else {
+					f.Jitter = d
+				}
+			}
+		case "drop":
+			f.Drop, ok = toFloat(value)
+		case "corrupt":
+			f.Corrupt, ok = toFloat(value)
+		default:
+			return fmt.Errorf("unknown key %s", key)
+		}
+		if !ok {
+			return fmt.Errorf("invalid type %T for %s", value, key)
+		}
+	}
+	return nil
+}
+
+// toFloat converts the numbers decoded from MessagePack into a float64.
+func toFloat(value any) (float64, bool) {
+	switch f := value.(type) {
+	case float64:
+		return f, true
+	case float32:
+		return float64(f), true
+	}
+	if i, ok := msgpackrpc.ToInt(value); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
@@ -0,0 +1,63 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+func TestFaultsHandler(t *testing.T) {
+	var result, reqErr any
+	res := func(r, e any) { result, reqErr = r, e }
+	router := msgpackrouter.New(0)
+	handler := faultsHandler(router)
+
+	handler(nil, []any{[]any{
+		map[string]any{"method": "tcp/*", "latency": int8(100), "jitter": 2.5, "drop": 0.5},
+		map[string]any{"transport": "serial", "corrupt": int8(1)},
+	}}, res)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+
+	// Clear the rules
+	handler(nil, []any{[]any{}}, res)
+	require.Nil(t, reqErr)
+
+	handler(nil, []any{}, res)
+	require.NotNil(t, reqErr)
+	handler(nil, []any{[]any{"tcp/*"}}, res)
+	require.NotNil(t, reqErr)
+	handler(nil, []any{[]any{map[string]any{"delay": 100}}}, res)
+	require.Equal(t, []any{1, "Invalid fault rule 0: unknown key delay"}, reqErr)
+	handler(nil, []any{[]any{map[string]any{"drop": "always"}}}, res)
+	require.Equal(t, []any{1, "Invalid fault rule 0: invalid type string for drop"}, reqErr)
+	handler(nil, []any{[]any{map[string]any{"drop": 2}}}, res)
+	require.Equal(t, []any{1, "fault 0: drop and corrupt must be probabilities between 0 and 1"}, reqErr)
+}
+
+func TestFaultRules(t *testing.T) {
+	rules, err := faultRules([]FaultConfig{{Method: "tcp/*", Latency: time.Second, Corrupt: 0.2}})
+	require.NoError(t, err)
+	require.Equal(t, []msgpackrouter.FaultRule{{Method: "tcp/*", Latency: time.Second, Corrupt: 0.2}}, rules)
+
+	_, err = faultRules([]FaultConfig{{Jitter: -time.Second}})
+	require.Error(t, err)
+}
@@ -0,0 +1,482 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// The gRPC gateway implements the Router service of proto/router.proto on
+// top of the HTTP/2 server of the standard library, without TLS: the
+// messages are encoded by hand, since they only have string and integer
+// fields.
+
+const (
+	// grpcServicePath is the path prefix of the methods of the Router
+	// service.
+	grpcServicePath = "/arduino.router.v1.Router/"
+	// grpcMaxMessage is the maximum size of a message received, the default
+	// of the gRPC implementations.
+	grpcMaxMessage = 4 << 20
+)
+
+// gRPC status codes
+const (
+	grpcOK               = 0
+	grpcUnknown          = 2
+	grpcInvalidArgument  = 3
+	grpcDeadlineExceeded = 4
+	grpcNotFound         = 5
+	grpcPermissionDenied = 7
+	grpcResourceExhaust  = 8
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// Types of the Message of proto/router.proto
+const (
+	grpcMessageRequest      = 0
+	grpcMessageResponse     = 1
+	grpcMessageNotification = 2
+)
+
+// grpcMessage is the Message of proto/router.proto.
+type grpcMessage struct {
+	Type   uint64
+	ID     uint64
+	Method string
+	Params string
+	Result string
+	Error  string
+}
+
+// marshal returns the protobuf encoding of the message.
+func (m *grpcMessage) marshal() []byte {
+	var b []byte
+	for field, v := range []uint64{1: m.Type, 2: m.ID} {
+		if v != 0 {
+			b = binary.AppendUvarint(b, uint64(field)<<3) //nolint:gosec
+			b = binary.AppendUvarint(b, v)
+		}
+	}
+	for field, s := range []string{3: m.Method, 4: m.Params, 5: m.Result, 6: m.Error} {
+		if s != "" {
+			b = binary.AppendUvarint(b, uint64(field)<<3|2) //nolint:gosec
+			b = binary.AppendUvarint(b, uint64(len(s)))
+			b = append(b, s...)
+		}
+	}
+	return b
+}
+
+// unmarshalGRPCMessage decodes the protobuf encoding of a message, the
+// unknown fields are ignored.
+func unmarshalGRPCMessage(data []byte) (*grpcMessage, error) {
+	m := &grpcMessage{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid field key")
+		}
+		data = data[n:]
+		field := key >> 3
+		switch key & 7 {
+		case 0: // varint
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid varint of field %d", field)
+			}
+			data = data[n:]
+			switch field {
+			case 1:
+				m.Type = v
+			case 2:
+				m.ID = v
+			}
+		case 1: // 64-bit
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated field %d", field)
+			}
+			data = data[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return nil, fmt.Errorf("truncated field %d", field)
+			}
+			s := string(data[n : n+int(l)]) //nolint:gosec
+			data = data[n+int(l):]          //nolint:gosec
+			switch field {
+			case 3:
+				m.Method = s
+			case 4:
+				m.Params = s
+			case 5:
+				m.Result = s
+			case 6:
+				m.Error = s
+			}
+		case 5: // 32-bit
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated field %d", field)
+			}
+			data = data[4:]
+		default:
+			return nil, fmt.Errorf("invalid wire type of field %d", field)
+		}
+	}
+	return m, nil
+}
+
+// readGRPCFrame reads a length-prefixed gRPC message.
+func readGRPCFrame(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessage {
+		return nil, fmt.Errorf("message too large: %d bytes", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// appendGRPCFrame appends the message to b, with the gRPC length prefix.
+func appendGRPCFrame(b []byte, m *grpcMessage) []byte {
+	data := m.marshal()
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data))) //nolint:gosec
+	return append(b, data...)
+}
+
+// grpcGateway serves the Router service of proto/router.proto: like in the
+// HTTP gateway, each call is carried by its own router connection.
+type grpcGateway struct {
+	httpGateway
+}
+
+// listenGRPCGateway serves the gRPC gateway on the given TCP address.
+func listenGRPCGateway(address string, g *grpcGateway) (*http.Server, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on gRPC port %s: %w", address, err)
+	}
+	server := newGRPCServer(g)
+	go func() {
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("gRPC gateway stopped", "err", err)
+		}
+	}()
+	slog.Info("Listening on gRPC gateway", "listen_addr", address)
+	return server, nil
+}
+
+// newGRPCServer returns the HTTP/2 server without TLS of the gateway.
+func newGRPCServer(g *grpcGateway) *http.Server {
+	server := &http.Server{
+		Handler:           g,
+		ReadHeaderTimeout: 10 * time.Second,
+		Protocols:         new(http.Protocols),
+	}
+	server.Protocols.SetUnencryptedHTTP2(true)
+	return server
+}
+
+func (g *grpcGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires HTTP/2", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC request required", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Accept-Encoding", "identity")
+	switch strings.TrimPrefix(r.URL.Path, grpcServicePath) {
+	case "Call":
+		g.call(w, r)
+	case "Session":
+		g.session(w, r)
+	default:
+		setGRPCStatus(w, grpcUnimplemented, "unknown method: "+r.URL.Path)
+	}
+}
+
+// call implements the Call method: a single request to the router.
+func (g *grpcGateway) call(w http.ResponseWriter, r *http.Request) {
+	data, err := readGRPCFrame(r.Body)
+	if err != nil {
+		setGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	req, err := unmarshalGRPCMessage(data)
+	if err != nil {
+		setGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	params, err := decodeJSONParams([]byte(req.Params))
+	if err != nil {
+		setGRPCStatus(w, grpcInvalidArgument, "invalid JSON params: "+err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), httpGatewayTimeout)
+	defer cancel()
+	conn, authErr, err := g.connect(ctx, r, "grpc", nil, nil)
+	if err != nil {
+		setGRPCStatus(w, grpcUnavailable, err.Error())
+		return
+	}
+	defer conn.Close()
+	if authErr != nil {
+		setGRPCRouterError(w, authErr)
+		return
+	}
+
+	result, reqErr, err := conn.SendRequest(ctx, req.Method, params...)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		setGRPCStatus(w, grpcDeadlineExceeded, "timeout waiting for the response")
+	case err != nil:
+		setGRPCStatus(w, grpcUnavailable, err.Error())
+	case reqErr != nil:
+		setGRPCRouterError(w, reqErr)
+	default:
+		res := &grpcMessage{Type: grpcMessageResponse, ID: req.ID}
+		if data, err := encodeJSON(result); err != nil {
+			setGRPCStatus(w, grpcInternal, "failed to encode the result: "+err.Error())
+			return
+		} else {
+			res.Result = string(data)
+		}
+		_, _ = w.Write(appendGRPCFrame(nil, res))
+		setGRPCStatus(w, grpcOK, "")
+	}
+}
+
+// session implements the Session method: a router connection carrying the
+// messages of the stream in both directions.
+func (g *grpcGateway) session(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	var writeLock sync.Mutex
+	closed := false
+	defer func() {
+		// The response can't be written after the handler returns
+		writeLock.Lock()
+		closed = true
+		writeLock.Unlock()
+	}()
+	send := func(m *grpcMessage) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		if closed {
+			return net.ErrClosed
+		}
+		if _, err := w.Write(appendGRPCFrame(nil, m)); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	// The requests of the router to the client wait for the RESPONSE
+	// messages with the same id.
+	var pendingLock sync.Mutex
+	pending := map[uint64]msgpackrpc.ResponseHandler{}
+	var lastID uint64
+	requestHandler := func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		pendingLock.Lock()
+		lastID++
+		id := lastID
+		pending[id] = res
+		pendingLock.Unlock()
+		if err := send(&grpcMessage{Type: grpcMessageRequest, ID: id, Method: method, Params: jsonString(params)}); err != nil {
+			pendingLock.Lock()
+			delete(pending, id)
+			pendingLock.Unlock()
+			res(nil, []any{msgpackrouter.ErrCodeFailedToSendRequests, err.Error()})
+		}
+	}
+	notificationHandler := func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		if err := send(&grpcMessage{Type: grpcMessageNotification, Method: method, Params: jsonString(params)}); err != nil {
+			slog.Debug("Failed to send notification to gRPC client", "method", method, "err", err)
+		}
+	}
+
+	conn, authErr, err := g.connect(r.Context(), r, "grpc", requestHandler, notificationHandler)
+	if err != nil {
+		setGRPCStatus(w, grpcUnavailable, err.Error())
+		return
+	}
+	defer conn.Close()
+	if authErr != nil {
+		setGRPCRouterError(w, authErr)
+		return
+	}
+	// Send the headers, the client may wait for them before sending
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	var requests sync.WaitGroup
+	for {
+		data, err := readGRPCFrame(r.Body)
+		if errors.Is(err, io.EOF) {
+			// The client closed its side of the stream, the pending
+			// requests are still answered.
+			requests.Wait()
+			setGRPCStatus(w, grpcOK, "")
+			return
+		} else if err != nil {
+			setGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		m, err := unmarshalGRPCMessage(data)
+		if err != nil {
+			setGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+
+		switch m.Type {
+		case grpcMessageRequest:
+			requests.Go(func() {
+				res := &grpcMessage{Type: grpcMessageResponse, ID: m.ID}
+				if params, err := decodeJSONParams([]byte(m.Params)); err != nil {
+					res.Error = jsonString([]any{msgpackrouter.ErrCodeInvalidParams, "invalid JSON params: " + err.Error()})
+				} else if result, reqErr, err := conn.SendRequest(r.Context(), m.Method, params...); err != nil {
+					res.Error = jsonString([]any{msgpackrouter.ErrCodeGenericError, err.Error()})
+				} else if reqErr != nil {
+					res.Error = jsonString(reqErr)
+				} else {
+					res.Result = jsonString(result)
+				}
+				if err := send(res); err != nil {
+					slog.Debug("Failed to send response to gRPC client", "method", m.Method, "err", err)
+				}
+			})
+		case grpcMessageNotification:
+			params, err := decodeJSONParams([]byte(m.Params))
+			if err != nil {
+				slog.Debug("Invalid params of notification from gRPC client", "method", m.Method, "err", err)
+				continue
+			}
+			if err := conn.SendNotification(m.Method, params...); err != nil {
+				slog.Debug("Failed to forward notification of gRPC client", "method", m.Method, "err", err)
+			}
+		case grpcMessageResponse:
+			pendingLock.Lock()
+			res, ok := pending[m.ID]
+			delete(pending, m.ID)
+			pendingLock.Unlock()
+			if !ok {
+				slog.Debug("Response of gRPC client to unknown request", "id", m.ID)
+				continue
+			}
+			var result, reqErr any
+			if m.Error != "" {
+				if reqErr, err = decodeJSON([]byte(m.Error)); err != nil {
+					reqErr = m.Error
+				}
+			} else if m.Result != "" {
+				if result, err = decodeJSON([]byte(m.Result)); err != nil {
+					result, reqErr = nil, []any{msgpackrouter.ErrCodeGenericError, "invalid JSON result: " + err.Error()}
+				}
+			}
+			res(result, reqErr)
+		}
+	}
+}
+
+// jsonString returns the JSON encoding of a decoded msgpack value, or of its
+// string representation if it can't be encoded.
+func jsonString(v any) string {
+	data, err := encodeJSON(v)
+	if err != nil {
+		data, _ = encodeJSON(fmt.Sprint(v))
+	}
+	return string(data)
+}
+
+// setGRPCStatus sets the gRPC status sent in the trailers of the response.
+func setGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(message))
+	}
+}
+
+// setGRPCRouterError sets the gRPC status of a request failed with the given
+// router error, the router error code is sent in the "router-error-code"
+// trailer.
+func setGRPCRouterError(w http.ResponseWriter, reqErr any) {
+	code, message := msgpackrouter.ErrCodeGenericError, fmt.Sprint(reqErr)
+	if e, ok := reqErr.([]any); ok && len(e) == 2 {
+		code, _ = msgpackrpc.ToInt(e[0])
+		message = fmt.Sprint(e[1])
+	}
+	status := grpcUnknown
+	switch code {
+	case msgpackrouter.ErrCodeInvalidParams:
+		status = grpcInvalidArgument
+	case msgpackrouter.ErrCodeMethodNotAvailable, msgpackrouter.ErrCodeModuleDisabled:
+		status = grpcNotFound
+	case msgpackrouter.ErrCodeMethodNotAllowed:
+		status = grpcPermissionDenied
+	case msgpackrouter.ErrCodeNotAuthenticated:
+		status = grpcUnauthenticated
+	case msgpackrouter.ErrCodeMessageTooLarge, msgpackrouter.ErrCodeTooManyErrors:
+		status = grpcResourceExhaust
+	case msgpackrouter.ErrCodeServiceStarting, msgpackrouter.ErrCodeDraining:
+		status = grpcUnavailable
+	}
+	w.Header().Set(http.TrailerPrefix+"Router-Error-Code", strconv.Itoa(code))
+	setGRPCStatus(w, status, message)
+}
+
+// grpcPercentEncode encodes the grpc-message value: the bytes outside the
+// printable ASCII range and "%" are percent-encoded.
+func grpcPercentEncode(s string) string {
+	var b strings.Builder
+	for i := range len(s) {
+		if c := s[i]; c < 0x20 || c > 0x7E || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,151 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestGRPCMessage(t *testing.T) {
+	m := &grpcMessage{Type: grpcMessageResponse, ID: 300, Method: "test/add", Params: "[1,2]", Result: "3"}
+	data := m.marshal()
+	// Type 1, id 300 (varint), method
+	require.Equal(t, []byte{0x08, 0x01, 0x10, 0xAC, 0x02, 0x1A, 0x08}, data[:7])
+	decoded, err := unmarshalGRPCMessage(data)
+	require.NoError(t, err)
+	require.Equal(t, m, decoded)
+
+	// Unknown fields are skipped
+	decoded, err = unmarshalGRPCMessage(append([]byte{0x38, 0x05, 0x45, 1, 2, 3, 4}, data...))
+	require.NoError(t, err)
+	require.Equal(t, m, decoded)
+
+	_, err = unmarshalGRPCMessage([]byte{0x1A, 0x08, 'a'})
+	require.Error(t, err)
+
+	require.Equal(t, "caf%C3%A9 100%25", grpcPercentEncode("café 100%"))
+}
+
+func TestGRPCGateway(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleRemote, msgpackrouter.ACL{"!secret/*"})
+	require.NoError(t, router.RegisterMethod("test/add", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		a, _ := msgpackrpc.ToInt(params[0])
+		b, _ := msgpackrpc.ToInt(params[1])
+		res(a+b, nil)
+	}))
+	require.NoError(t, router.RegisterMethod("secret/get", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res("secret", nil)
+	}))
+
+	server := newGRPCServer(&grpcGateway{httpGateway{router: router, role: msgpackrouter.RoleRemote}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = server.Serve(l) }()
+	defer server.Close()
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	post := func(method string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, "http://"+l.Addr().String()+grpcServicePath+method, body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	call := func(method, params string) (*grpcMessage, http.Header) {
+		resp := post("Call", bytes.NewReader(appendGRPCFrame(nil, &grpcMessage{ID: 7, Method: method, Params: params})))
+		defer resp.Body.Close()
+		var res *grpcMessage
+		if data, err := readGRPCFrame(resp.Body); err == nil {
+			res, err = unmarshalGRPCMessage(data)
+			require.NoError(t, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return res, resp.Trailer
+	}
+
+	res, trailer := call("test/add", "[1, 2]")
+	require.Equal(t, "0", trailer.Get("Grpc-Status"))
+	require.Equal(t, &grpcMessage{Type: grpcMessageResponse, ID: 7, Result: "3"}, res)
+
+	res, trailer = call("secret/get", "")
+	require.Nil(t, res)
+	require.Equal(t, "7", trailer.Get("Grpc-Status"))
+	require.Equal(t, "6", trailer.Get("Router-Error-Code"))
+	_, trailer = call("test/missing", "")
+	require.Equal(t, "5", trailer.Get("Grpc-Status"))
+	_, trailer = call("test/add", "[1,")
+	require.Equal(t, "3", trailer.Get("Grpc-Status"))
+
+	// A session registering a method called by another client
+	body, bodyWriter := io.Pipe()
+	resp := post("Session", body)
+	defer resp.Body.Close()
+	in := bufio.NewReader(resp.Body)
+	sessionSend := func(m *grpcMessage) {
+		_, err := bodyWriter.Write(appendGRPCFrame(nil, m))
+		require.NoError(t, err)
+	}
+	sessionRecv := func() *grpcMessage {
+		data, err := readGRPCFrame(in)
+		require.NoError(t, err)
+		m, err := unmarshalGRPCMessage(data)
+		require.NoError(t, err)
+		return m
+	}
+
+	sessionSend(&grpcMessage{Type: grpcMessageRequest, ID: 1, Method: "$/register", Params: `"client/hello"`})
+	require.Equal(t, &grpcMessage{Type: grpcMessageResponse, ID: 1, Result: "true"}, sessionRecv())
+
+	otherEnd, routerEnd := net.Pipe()
+	router.AcceptConnection(routerEnd)
+	other := msgpackrpc.NewConnection(otherEnd, otherEnd, nil, nil, nil)
+	go other.Run()
+	defer other.Close()
+	type result struct{ result, reqErr any }
+	results := make(chan result, 1)
+	go func() {
+		r, reqErr, err := other.SendRequest(t.Context(), "client/hello", "world")
+		require.NoError(t, err)
+		results <- result{r, reqErr}
+	}()
+
+	req := sessionRecv()
+	require.Equal(t, uint64(grpcMessageRequest), req.Type)
+	require.Equal(t, "client/hello", req.Method)
+	require.Equal(t, `["world"]`, req.Params)
+	sessionSend(&grpcMessage{Type: grpcMessageResponse, ID: req.ID, Result: `{"greeting":"hello world"}`})
+	require.Equal(t, result{map[string]any{"greeting": "hello world"}, nil}, <-results)
+
+	// The session ends when the client closes its side
+	require.NoError(t, bodyWriter.Close())
+	_, err = readGRPCFrame(in)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
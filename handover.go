@@ -0,0 +1,573 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// handoverEnv is the environment variable with the file descriptor of the
+// handover state, set for the router process started by a hot restart.
+const handoverEnv = "ARDUINO_ROUTER_HANDOVER"
+
+// handoverTimeout is the maximum time waited for the requests in flight to
+// complete, and for the connections to stop, before a hot restart.
+const handoverTimeout = 10 * time.Second
+
+// handoverState is the state passed by the router to the new process
+// started by a hot restart: the listening sockets and the client connections,
+// that are served by the new process as they are.
+type handoverState struct {
+	Listeners   []handoverListener   `json:"listeners"`
+	Connections []handoverConnection `json:"connections"`
+}
+
+// handoverListener is a listening socket handed over.
+type handoverListener struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+	FD      int    `json:"fd"`
+
+	taken bool
+}
+
+// handoverConnection is a client connection handed over. The connections
+// without FD (like the MCU on the serial port) are opened again by the new
+// process, and their methods are restored when they connect.
+type handoverConnection struct {
+	FD int `json:"fd,omitempty"`
+	// Listener is the index of the listener of the connection in the
+	// Listeners of the state.
+	Listener           int      `json:"listener"`
+	Transport          string   `json:"transport"`
+	RemoteAddr         string   `json:"remote_addr"`
+	Identity           string   `json:"identity,omitempty"`
+	Role               string   `json:"role,omitempty"`
+	Authenticated      bool     `json:"authenticated"`
+	Methods            []string `json:"methods,omitempty"`
+	Compression        string   `json:"compression,omitempty"`
+	CompressionMinSize int      `json:"compression_min_size,omitempty"`
+	// Unread is the data received from the client and not processed yet.
+	Unread []byte `json:"unread,omitempty"`
+}
+
+// hotRestart serves the clients of the listeners, and hands the listeners
+// and the clients over to a new router process on a hot restart.
+type hotRestart struct {
+	router    *msgpackrouter.Router
+	listeners []*listener
+	// unavailable is the reason why the hot restart is not possible, if not
+	// empty.
+	unavailable string
+
+	lock       sync.Mutex
+	clients    map[*msgpackrpc.Connection]*handoverClient
+	restarting bool
+	// pending are the connections accepted during a hot restart, handed
+	// over without being served.
+	pending []pendingConnection
+}
+
+// handoverClient is a client connection that can be handed over.
+type handoverClient struct {
+	conn     net.Conn
+	listener int
+	done     <-chan struct{}
+}
+
+// pendingConnection is a connection accepted during a hot restart.
+type pendingConnection struct {
+	conn     net.Conn
+	listener int
+	info     msgpackrouter.ConnectionInfo
+}
+
+func newHotRestart(router *msgpackrouter.Router, listeners []*listener) *hotRestart {
+	return &hotRestart{
+		router:    router,
+		listeners: listeners,
+		clients:   map[*msgpackrpc.Connection]*handoverClient{},
+	}
+}
+
+// serve accepts the connections of the i-th listener.
+func (h *hotRestart) serve(i int) {
+	l := h.listeners[i]
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			slog.Error("Failed to accept connection", "err", err)
+			break
+		}
+
+		info := l.connectionInfo(conn)
+		if cred := info.PeerCredentials; cred != nil {
+			slog.Info("Accepted connection", "addr", conn.RemoteAddr(), "pid", cred.PID, "uid", cred.UID, "gid", cred.GID)
+		} else {
+			slog.Info("Accepted connection", "addr", conn.RemoteAddr())
+		}
+		h.lock.Lock()
+		if h.restarting {
+			h.pending = append(h.pending, pendingConnection{conn: conn, listener: i, info: info})
+		} else {
+			h.accept(conn, conn, i, info)
+		}
+		h.lock.Unlock()
+	}
+}
+
+// accept serves the stream of the given socket, and keeps track of it if it
+// can be handed over. It must be called with the lock held.
+func (h *hotRestart) accept(stream io.ReadWriteCloser, socket net.Conn, listener int, info msgpackrouter.ConnectionInfo) *msgpackrpc.Connection {
+	rpc, done := h.router.AcceptConnectionWithInfo(stream, info)
+	if canHandOver(socket) {
+		h.clients[rpc] = &handoverClient{conn: socket, listener: listener, done: done}
+		go func() {
+			<-done
+			h.lock.Lock()
+			delete(h.clients, rpc)
+			h.lock.Unlock()
+		}()
+	}
+	return rpc
+}
+
+// restartOnSignal starts a hot restart when the given signal is received.
+func restartOnSignal(h *hotRestart, sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	go func() {
+		for range signals {
+			h.restart()
+		}
+	}()
+}
+
+// restart replaces the router process with a new one, started with the same
+// command line (usually after updating the router binary), that serves the
+// listeners and the clients of the current process. The new requests are
+// rejected while the requests in flight complete. If the new process can't be
+// started the router goes on serving the listeners.
+func (h *hotRestart) restart() {
+	if h.unavailable != "" {
+		slog.Error("Hot restart not available", "reason", h.unavailable)
+		return
+	}
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		slog.Error("Hot restart failed", "err", err)
+		return
+	}
+
+	slog.Info("Hot restart, handing over the connections", "path", path)
+	wasDraining := h.router.Draining()
+	if !wasDraining {
+		h.router.SetDraining(true)
+	}
+	deadline := time.Now().Add(handoverTimeout)
+	for h.router.InFlight() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if inFlight := h.router.InFlight(); inFlight > 0 {
+		slog.Warn("Requests still in flight, their responses are lost", "in_flight", inFlight)
+	}
+
+	state, files, err := h.export(deadline)
+	if err == nil {
+		err = execHandover(path, state, files)
+	}
+	// execHandover returns only if the new process could not be started
+	slog.Error("Hot restart failed, the clients must connect again", "err", err)
+	for _, f := range files {
+		f.Close()
+	}
+	h.lock.Lock()
+	h.restarting = false
+	for _, p := range h.pending {
+		h.accept(p.conn, p.conn, p.listener, p.info)
+	}
+	h.pending = nil
+	h.lock.Unlock()
+	if !wasDraining {
+		h.router.SetDraining(false)
+	}
+}
+
+// export stops serving the clients that can be handed over, and returns the
+// state to pass to the new router process and the files of its sockets.
+func (h *hotRestart) export(deadline time.Time) (*handoverState, []*os.File, error) {
+	h.lock.Lock()
+	h.restarting = true
+	clients := maps.Clone(h.clients)
+	h.lock.Unlock()
+
+	state := &handoverState{}
+	var files []*os.File
+	listenerIndex := map[int]int{}
+	for i, l := range h.listeners {
+		if l.socket == nil {
+			continue
+		}
+		f, fd, err := inheritableFile(l.socket)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, fmt.Errorf("handing over listener %s: %w", l.address, err)
+		}
+		listenerIndex[i] = len(state.Listeners)
+		state.Listeners = append(state.Listeners, handoverListener{Network: l.network, Address: l.address, FD: fd})
+		files = append(files, f)
+	}
+
+	for rpc, c := range clients {
+		info, ok := h.router.ConnectionInfo(rpc)
+		if !ok {
+			continue
+		}
+		methods := h.router.RegisteredMethods(rpc)
+		f, fd, err := inheritableFile(c.conn)
+		if err != nil {
+			slog.Warn("Failed to hand over connection", "addr", info.RemoteAddr, "err", err)
+			continue
+		}
+
+		// Stop reading from the client, the data not processed yet is
+		// handed over with the connection
+		_ = c.conn.SetReadDeadline(time.Now())
+		select {
+		case <-c.done:
+		case <-time.After(time.Until(deadline)):
+			slog.Warn("Failed to hand over connection", "addr", info.RemoteAddr, "err", "timeout")
+			f.Close()
+			continue
+		}
+		compression, compressionMinSize := rpc.Compression()
+		state.Connections = append(state.Connections, handoverConnection{
+			FD:                 fd,
+			Listener:           listenerIndex[c.listener],
+			Transport:          info.Transport,
+			RemoteAddr:         info.RemoteAddr,
+			Identity:           info.Identity,
+			Role:               info.Role,
+			Authenticated:      info.Authenticated(),
+			Methods:            methods,
+			Compression:        compression,
+			CompressionMinSize: compressionMinSize,
+			Unread:             rpc.UnreadInput(),
+		})
+		files = append(files, f)
+	}
+
+	// The connections accepted in the meantime are served by the new process
+	h.lock.Lock()
+	pending := h.pending
+	h.pending = nil
+	h.lock.Unlock()
+	for _, p := range pending {
+		f, fd, err := inheritableFile(p.conn)
+		p.conn.Close()
+		if err != nil {
+			continue
+		}
+		state.Connections = append(state.Connections, handoverConnection{
+			FD:         fd,
+			Listener:   listenerIndex[p.listener],
+			Transport:  p.info.Transport,
+			RemoteAddr: p.info.RemoteAddr,
+		})
+		files = append(files, f)
+	}
+
+	// The MCU keeps its methods when the new process opens the serial port
+	for rpc, info := range h.router.Connections() {
+		if info.Transport != "serial" {
+			continue
+		}
+		if methods := h.router.RegisteredMethods(rpc); len(methods) > 0 {
+			state.Connections = append(state.Connections, handoverConnection{
+				Transport:  info.Transport,
+				RemoteAddr: info.RemoteAddr,
+				Methods:    methods,
+			})
+		}
+	}
+	return state, files, nil
+}
+
+// canHandOver returns true if the socket can be handed over to another
+// process.
+func canHandOver(socket any) bool {
+	switch socket.(type) {
+	case *net.TCPListener, *net.UnixListener, *net.TCPConn, *net.UnixConn:
+		return true
+	}
+	return false
+}
+
+// inheritableFile returns a copy of the file descriptor of the socket, that
+// is inherited by the new process, and its number.
+func inheritableFile(socket any) (*os.File, int, error) {
+	var f *os.File
+	var err error
+	switch s := socket.(type) {
+	case *net.TCPListener:
+		f, err = s.File()
+	case *net.UnixListener:
+		f, err = s.File()
+	case *net.TCPConn:
+		f, err = s.File()
+	case *net.UnixConn:
+		f, err = s.File()
+	default:
+		return nil, 0, errors.New("not supported")
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	raw, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	fd := -1
+	var fcntlErr error
+	if err := raw.Control(func(d uintptr) {
+		fd = int(d)
+		_, fcntlErr = unix.FcntlInt(d, unix.F_SETFD, 0)
+	}); err != nil {
+		fcntlErr = err
+	}
+	if fcntlErr != nil {
+		f.Close()
+		return nil, 0, fcntlErr
+	}
+	return f, fd, nil
+}
+
+// execHandover replaces the router process with the executable at path,
+// started with the same arguments, passing it the handover state and the
+// files. It returns only if the executable could not be started.
+func execHandover(path string, state *handoverState, files []*os.File) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.MemfdCreate("arduino-router-handover", 0)
+	if err != nil {
+		return fmt.Errorf("creating handover state: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "handover")
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("writing handover state: %w", err)
+	}
+
+	slog.Info("Starting new router process", "listeners", len(state.Listeners), "connections", len(state.Connections))
+	env := append(os.Environ(), handoverEnv+"="+strconv.Itoa(fd))
+	err = syscall.Exec(path, os.Args, env)
+	runtime.KeepAlive(files)
+	return err
+}
+
+// loadHandover returns the state handed over by the previous router process
+// after a hot restart, nil if the router was not started by a hot restart.
+func loadHandover() (*handoverState, error) {
+	env, ok := os.LookupEnv(handoverEnv)
+	if !ok {
+		return nil, nil
+	}
+	// The variable is not inherited by the plugins and the services
+	os.Unsetenv(handoverEnv)
+	fd, err := strconv.Atoi(env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", handoverEnv, env)
+	}
+	f := os.NewFile(uintptr(fd), "handover")
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("reading handover state: %w", err)
+	}
+	var state handoverState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, fmt.Errorf("reading handover state: %w", err)
+	}
+	slog.Info("Hot restart, taking over the connections", "listeners", len(state.Listeners), "connections", len(state.Connections))
+	return &state, nil
+}
+
+// openListener opens the listener described by lc (see openListener), or
+// takes over the listening socket handed over by the previous process.
+func (s *handoverState) openListener(lc ListenerConfig, cfg Config, tlsConfig *tls.Config) (*listener, error) {
+	if s == nil {
+		return openListener(lc, cfg, tlsConfig)
+	}
+	for i := range s.Listeners {
+		hl := &s.Listeners[i]
+		if hl.taken || hl.Network != lc.Network || hl.Address != lc.Address {
+			continue
+		}
+		acl, err := listenerACL(lc, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if lc.Network == "tls" && tlsConfig == nil {
+			return nil, fmt.Errorf("TLS is not configured for listener %s", lc.Address)
+		}
+		f := os.NewFile(uintptr(hl.FD), lc.Address)
+		socket, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to take over listener %s: %w", lc.Address, err)
+		}
+		hl.taken = true
+		if ul, ok := socket.(*net.UnixListener); ok && !strings.HasPrefix(lc.Address, "@") {
+			// Remove the socket file when closed, like the listener opened
+			// by the previous process
+			ul.SetUnlinkOnClose(true)
+		}
+		slog.Info("Taking over listener", "network", lc.Network, "listen_addr", lc.Address, "profile", lc.Profile)
+		l := &listener{Listener: socket, socket: socket, network: lc.Network, address: lc.Address, acl: acl, role: lc.Role, prefix: lc.Prefix}
+		if lc.Network == "tls" {
+			l.Listener = tls.NewListener(socket, tlsConfig)
+		}
+		return l, nil
+	}
+	return openListener(lc, cfg, tlsConfig)
+}
+
+// closeUnusedListeners closes the listening sockets handed over and not used
+// by the current configuration.
+func (s *handoverState) closeUnusedListeners() {
+	if s == nil {
+		return
+	}
+	for _, hl := range s.Listeners {
+		if !hl.taken {
+			slog.Info("Closing listener removed from the configuration", "network", hl.Network, "listen_addr", hl.Address)
+			unix.Close(hl.FD)
+		}
+	}
+}
+
+// restoreMethods restores the methods of the connections opened again by the
+// new process, like the serial port.
+func (s *handoverState) restoreMethods(router *msgpackrouter.Router) {
+	if s == nil {
+		return
+	}
+	for _, c := range s.Connections {
+		if c.FD == 0 && len(c.Methods) > 0 {
+			router.RestoreMethods(c.Transport, c.RemoteAddr, c.Methods)
+		}
+	}
+}
+
+// adopt serves the client connections handed over by the previous process.
+func (h *hotRestart) adopt(state *handoverState) {
+	if state == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, c := range state.Connections {
+		if c.FD == 0 {
+			continue
+		}
+		f := os.NewFile(uintptr(c.FD), c.RemoteAddr)
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			slog.Warn("Failed to take over connection", "addr", c.RemoteAddr, "err", err)
+			continue
+		}
+		i := h.listenerOf(state, c)
+		if i < 0 {
+			slog.Info("Closing connection of a listener removed from the configuration", "addr", c.RemoteAddr)
+			conn.Close()
+			continue
+		}
+
+		info := h.listeners[i].connectionInfo(conn)
+		if c.Authenticated {
+			info.Authenticator = nil
+			info.Identity = c.Identity
+			info.Role = c.Role
+		}
+		var stream io.ReadWriteCloser = conn
+		if len(c.Unread) > 0 {
+			stream = &unreadConn{Conn: conn, in: io.MultiReader(bytes.NewReader(c.Unread), conn)}
+		}
+		rpc := h.accept(stream, conn, i, info)
+		if c.Compression != "" {
+			if err := rpc.SetCompression(c.Compression, c.CompressionMinSize); err != nil {
+				slog.Warn("Failed to restore compression", "addr", c.RemoteAddr, "err", err)
+			}
+		}
+		if err := h.router.RegisterMethods(rpc, c.Methods); err != nil {
+			slog.Warn("Failed to restore methods", "addr", c.RemoteAddr, "err", err)
+		}
+		slog.Info("Took over connection", "transport", info.Transport, "addr", info.RemoteAddr, "identity", info.Identity, "methods", c.Methods)
+	}
+}
+
+// listenerOf returns the index of the listener of the connection handed
+// over, -1 if the listener is not used anymore.
+func (h *hotRestart) listenerOf(state *handoverState, c handoverConnection) int {
+	if c.Listener < 0 || c.Listener >= len(state.Listeners) {
+		return -1
+	}
+	hl := state.Listeners[c.Listener]
+	for i, l := range h.listeners {
+		if l.network == hl.Network && l.address == hl.Address {
+			return i
+		}
+	}
+	return -1
+}
+
+// unreadConn is a connection whose data not processed by the previous
+// process is read first.
+type unreadConn struct {
+	net.Conn
+	in io.Reader
+}
+
+func (c *unreadConn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
@@ -0,0 +1,164 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestHotRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+	lc := ListenerConfig{Network: "unix", Address: path, Role: msgpackrouter.RoleLocalService}
+	cfg := Config{UnixSocketMode: "0666"}
+	newRouter := func() *msgpackrouter.Router {
+		router := msgpackrouter.New(0)
+		router.SetRole(msgpackrouter.RoleLocalService, nil)
+		router.SetRole(msgpackrouter.RoleMCU, nil)
+		return router
+	}
+	connect := func() *msgpackrpc.Connection {
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		rpc := msgpackrpc.NewConnection(conn, conn, func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+			res(params[0], nil)
+		}, nil, nil)
+		go rpc.Run()
+		t.Cleanup(rpc.Close)
+		return rpc
+	}
+
+	// A service registers a method on the old router, and the MCU on the
+	// serial port registers another one
+	oldRouter := newRouter()
+	l, err := openListener(lc, cfg, nil)
+	require.NoError(t, err)
+	oldRestart := newHotRestart(oldRouter, []*listener{l})
+	go oldRestart.serve(0)
+	service := connect()
+	_, reqErr, err := service.SendRequest(t.Context(), "$/register", "service/echo")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	mcuEnd, routerEnd := net.Pipe()
+	oldRouter.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Transport: "serial", RemoteAddr: "/dev/ttyACM0", Role: msgpackrouter.RoleMCU})
+	mcu := msgpackrpc.NewConnection(mcuEnd, mcuEnd, nil, nil, nil)
+	go mcu.Run()
+	_, reqErr, err = mcu.SendRequest(t.Context(), "$/register", "mcu/led")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+
+	state, files, err := oldRestart.export(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, []handoverListener{{Network: "unix", Address: path, FD: state.Listeners[0].FD}}, state.Listeners)
+	require.Len(t, state.Connections, 2)
+	for _, c := range state.Connections {
+		if c.Transport == "serial" {
+			require.Zero(t, c.FD)
+			require.Equal(t, []string{"mcu/led"}, c.Methods)
+		} else {
+			require.NotZero(t, c.FD)
+			require.Equal(t, []string{"service/echo"}, c.Methods)
+			require.True(t, c.Authenticated)
+		}
+	}
+	mcu.Close()
+
+	// The new process inherits the file descriptors
+	for i := range state.Listeners {
+		state.Listeners[i].FD = inherit(t, state.Listeners[i].FD)
+	}
+	for i := range state.Connections {
+		if state.Connections[i].FD != 0 {
+			state.Connections[i].FD = inherit(t, state.Connections[i].FD)
+		}
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	l.Listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	restarted := newRouter()
+	state.restoreMethods(restarted)
+	l, err = state.openListener(lc, cfg, nil)
+	require.NoError(t, err)
+	defer l.Close()
+	state.closeUnusedListeners()
+	newRestart := newHotRestart(restarted, []*listener{l})
+	newRestart.adopt(state)
+	go newRestart.serve(0)
+
+	// The service is still connected, with its method
+	client := connect()
+	result, reqErr, err := client.SendRequest(t.Context(), "service/echo", "hello")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, "hello", result)
+
+	// The methods of the MCU are restored when it connects again
+	mcuEnd, routerEnd = net.Pipe()
+	restarted.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Transport: "serial", RemoteAddr: "/dev/ttyACM0", Role: msgpackrouter.RoleMCU})
+	mcu = msgpackrpc.NewConnection(mcuEnd, mcuEnd, func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		res(method, nil)
+	}, nil, nil)
+	go mcu.Run()
+	defer mcu.Close()
+	result, reqErr, err = service.SendRequest(t.Context(), "mcu/led", true)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, "mcu/led", result)
+}
+
+// inherit duplicates the file descriptor, as inherited by the new process.
+func inherit(t *testing.T, fd int) int {
+	dup, err := unix.Dup(fd)
+	require.NoError(t, err)
+	return dup
+}
+
+func TestLoadHandover(t *testing.T) {
+	state, err := loadHandover()
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	f, err := os.CreateTemp(t.TempDir(), "handover")
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"listeners":[{"network":"tcp","address":":8900","fd":7}],"connections":[{"transport":"serial","remote_addr":"/dev/ttyACM0","methods":["mcu/led"]}]}`)
+	require.NoError(t, err)
+	t.Setenv(handoverEnv, "x")
+	_, err = loadHandover()
+	require.ErrorContains(t, err, "invalid "+handoverEnv)
+
+	fd := inherit(t, int(f.Fd()))
+	f.Close()
+	t.Setenv(handoverEnv, strconv.Itoa(fd))
+	state, err = loadHandover()
+	require.NoError(t, err)
+	require.Equal(t, []handoverListener{{Network: "tcp", Address: ":8900", FD: 7}}, state.Listeners)
+	require.Equal(t, []string{"mcu/led"}, state.Connections[0].Methods)
+	_, set := os.LookupEnv(handoverEnv)
+	require.False(t, set)
+}
@@ -0,0 +1,86 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// newHealthcheckCommand returns the "healthcheck" command, that exits with a
+// non-zero status if the router is not responding.
+func newHealthcheckCommand() *cobra.Command {
+	var socket string
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:  "healthcheck",
+		Long: "Check that the router is running and responding (exits with a non-zero status on failure)",
+		Run: func(cmd *cobra.Command, args []string) {
+			if !cmd.Flags().Changed("unix-port") {
+				socket = cmp.Or(os.Getenv("ARDUINO_ROUTER_SOCKET"), socket)
+			}
+			version, err := healthcheck(socket, timeout)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Health check failed:", err)
+				os.Exit(1)
+			}
+			fmt.Println("OK, Arduino Router " + version)
+		},
+	}
+	cmd.Flags().StringVarP(&socket, "unix-port", "u", "/var/run/arduino-router.sock", "Unix socket of the router")
+	cmd.Flags().DurationVarP(&timeout, "timeout", "t", 5*time.Second, "Maximum time to wait for the router to respond")
+	return cmd
+}
+
+// healthcheck connects to the router on the given Unix socket and calls
+// $/version and $/stats, it returns the version of the router.
+func healthcheck(socket string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", socket)
+	if err != nil {
+		return "", fmt.Errorf("connecting to router: %w", err)
+	}
+	rpc := msgpackrpc.NewConnection(conn, conn, nil, nil, nil)
+	defer rpc.Close()
+	go rpc.Run()
+
+	version, reqErr, err := rpc.SendRequest(ctx, "$/version")
+	if err != nil {
+		return "", fmt.Errorf("calling $/version: %w", err)
+	} else if reqErr != nil {
+		return "", fmt.Errorf("calling $/version: %v", reqErr)
+	}
+	if _, reqErr, err := rpc.SendRequest(ctx, "$/stats"); err != nil {
+		return "", fmt.Errorf("calling $/stats: %w", err)
+	} else if reqErr != nil {
+		return "", fmt.Errorf("calling $/stats: %v", reqErr)
+	}
+	if info, ok := version.(map[string]any); ok {
+		version = info["version"]
+	}
+	return fmt.Sprint(version), nil
+}
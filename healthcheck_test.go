@@ -0,0 +1,86 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestHealthcheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+
+	// Router not running
+	_, err := healthcheck(path, time.Second)
+	require.Error(t, err)
+
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+	router := msgpackrouter.New(0)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			router.Accept(conn)
+		}
+	}()
+
+	// $/stats not available
+	require.NoError(t, router.RegisterMethod("$/version", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res("1.2.3", nil)
+	}))
+	_, err = healthcheck(path, time.Second)
+	require.ErrorContains(t, err, "$/stats")
+
+	// Router not responding
+	require.NoError(t, router.RegisterMethod("$/stats", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {}))
+	_, err = healthcheck(path, 100*time.Millisecond)
+	require.ErrorContains(t, err, "$/stats")
+}
+
+func TestHealthcheckHealthy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+	router := msgpackrouter.New(0)
+	require.NoError(t, router.RegisterMethod("$/version", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res(map[string]any{"version": "1.2.3", "protocol_revision": 1}, nil)
+	}))
+	require.NoError(t, router.RegisterMethod("$/stats", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res(router.Stats(), nil)
+	}))
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			router.Accept(conn)
+		}
+	}()
+
+	version, err := healthcheck(path, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "1.2.3", version)
+}
@@ -0,0 +1,188 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+const (
+	// heartbeatMethod is the notification exchanged by the router and the
+	// clients that enabled the heartbeat.
+	heartbeatMethod = "$/heartbeat"
+	// peerLostMethod and peerRecoveredMethod are the notifications
+	// broadcast when a client misses its heartbeats, and when its
+	// heartbeats resume.
+	peerLostMethod      = "$/peerLost"
+	peerRecoveredMethod = "$/peerRecovered"
+
+	// minHeartbeatInterval is the minimum interval between two heartbeats.
+	minHeartbeatInterval = 10 * time.Millisecond
+	// defaultHeartbeatMissed is the default number of missed heartbeats
+	// after which a client is lost.
+	defaultHeartbeatMissed = 3
+)
+
+// heartbeatPeer is a client that enabled the heartbeat.
+type heartbeatPeer struct {
+	interval time.Duration
+	missed   int
+	lastSeen time.Time
+	lost     bool
+	stop     chan struct{}
+}
+
+// heartbeats tracks the liveness of the clients that enabled the heartbeat.
+type heartbeats struct {
+	router *msgpackrouter.Router
+
+	lock  sync.Mutex
+	peers map[*msgpackrpc.Connection]*heartbeatPeer
+}
+
+// registerHeartbeat registers the $/heartbeat* methods.
+func registerHeartbeat(router *msgpackrouter.Router) error {
+	h := &heartbeats{router: router, peers: make(map[*msgpackrpc.Connection]*heartbeatPeer)}
+	router.OnConnectionClosed(h.stop)
+	if err := router.RegisterMethod("$/heartbeat/start", h.handleStart); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/heartbeat/stop", func(rpc *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		h.stop(rpc)
+		res(true, nil)
+	}); err != nil {
+		return err
+	}
+	return router.RegisterMethod(heartbeatMethod, h.handleHeartbeat)
+}
+
+// handleStart implements $/heartbeat/start(interval[, missed]): the router
+// sends a heartbeat to the client every interval ms, and expects the same
+// from the client. When the client misses the given number of heartbeats
+// (3 by default), the other clients are notified with $/peerLost.
+func (h *heartbeats) handleStart(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 && len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (interval ms[, missed heartbeats])"})
+		return
+	}
+	ms, ok := msgpackrpc.ToUint(params[0])
+	if !ok || time.Duration(ms)*time.Millisecond < minHeartbeatInterval {
+		res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected interval in ms (at least %d)", minHeartbeatInterval.Milliseconds())})
+		return
+	}
+	missed := uint(defaultHeartbeatMissed)
+	if len(params) == 2 {
+		if missed, ok = msgpackrpc.ToUint(params[1]); !ok || missed == 0 {
+			res(nil, []any{1, "Invalid parameter, expected number of missed heartbeats (at least 1)"})
+			return
+		}
+	}
+
+	h.stop(rpc)
+	p := &heartbeatPeer{
+		interval: time.Duration(ms) * time.Millisecond,
+		missed:   int(missed),
+		lastSeen: time.Now(),
+		stop:     make(chan struct{}),
+	}
+	h.lock.Lock()
+	h.peers[rpc] = p
+	h.lock.Unlock()
+	res(true, nil)
+	go h.run(rpc, p)
+}
+
+// handleHeartbeat records a heartbeat received from a client.
+func (h *heartbeats) handleHeartbeat(rpc *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+	h.lock.Lock()
+	p, ok := h.peers[rpc]
+	recovered := false
+	if ok {
+		p.lastSeen = time.Now()
+		recovered, p.lost = p.lost, false
+	}
+	h.lock.Unlock()
+	if !ok {
+		res(nil, []any{2, "Heartbeat not started"})
+		return
+	}
+	if recovered {
+		slog.Info("Peer heartbeat recovered", h.peerInfo(rpc)...)
+		h.router.BroadcastNotification(rpc, peerRecoveredMethod, h.peerMap(rpc))
+	}
+	res(true, nil)
+}
+
+// stop stops the heartbeat of the client.
+func (h *heartbeats) stop(rpc *msgpackrpc.Connection) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if p, ok := h.peers[rpc]; ok {
+		close(p.stop)
+		delete(h.peers, rpc)
+	}
+}
+
+// run sends the heartbeats to the client and checks the ones received.
+func (h *heartbeats) run(rpc *msgpackrpc.Connection, p *heartbeatPeer) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := rpc.SendNotification(heartbeatMethod); err != nil {
+			slog.Debug("Failed to send heartbeat", "err", err)
+		}
+
+		h.lock.Lock()
+		lost := !p.lost && time.Since(p.lastSeen) > p.interval*time.Duration(p.missed)
+		if lost {
+			p.lost = true
+		}
+		h.lock.Unlock()
+		if lost {
+			slog.Warn("Peer heartbeat lost", h.peerInfo(rpc)...)
+			h.router.BroadcastNotification(rpc, peerLostMethod, h.peerMap(rpc))
+		}
+	}
+}
+
+// peerMap describes the client in the $/peerLost and $/peerRecovered
+// notifications.
+func (h *heartbeats) peerMap(rpc *msgpackrpc.Connection) map[string]any {
+	info, _ := h.router.ConnectionInfo(rpc)
+	return map[string]any{
+		"transport": info.Transport,
+		"address":   info.RemoteAddr,
+		"identity":  info.Identity,
+		"role":      info.Role,
+	}
+}
+
+// peerInfo returns the attributes of the client for the logs.
+func (h *heartbeats) peerInfo(rpc *msgpackrpc.Connection) []any {
+	info, _ := h.router.ConnectionInfo(rpc)
+	return []any{"transport", info.Transport, "addr", info.RemoteAddr, "identity", info.Identity}
+}
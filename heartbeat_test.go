@@ -0,0 +1,99 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestHeartbeat(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleMCU, nil)
+	require.NoError(t, registerHeartbeat(router))
+
+	var received atomic.Int64
+	mcuEnd, routerEnd := net.Pipe()
+	router.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Transport: "serial", RemoteAddr: "/dev/ttyACM0", Role: msgpackrouter.RoleMCU})
+	mcu := msgpackrpc.NewConnection(mcuEnd, mcuEnd, nil, func(_ msgpackrpc.FunctionLogger, method string, _ []any) {
+		if method == heartbeatMethod {
+			received.Add(1)
+		}
+	}, nil)
+	go mcu.Run()
+	defer mcu.Close()
+
+	events := make(chan string, 10)
+	otherEnd, routerEnd2 := net.Pipe()
+	router.AcceptConnection(routerEnd2)
+	other := msgpackrpc.NewConnection(otherEnd, otherEnd, nil, func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		if method == peerLostMethod || method == peerRecoveredMethod {
+			require.Equal(t, "serial", params[0].(map[string]any)["transport"])
+			events <- method
+		}
+	}, nil)
+	go other.Run()
+	defer other.Close()
+
+	_, reqErr, err := mcu.SendRequest(t.Context(), heartbeatMethod)
+	require.NoError(t, err)
+	require.Equal(t, int8(2), reqErr.([]any)[0])
+	_, reqErr, err = mcu.SendRequest(t.Context(), "$/heartbeat/start", 1)
+	require.NoError(t, err)
+	require.Equal(t, int8(1), reqErr.([]any)[0])
+
+	_, reqErr, err = mcu.SendRequest(t.Context(), "$/heartbeat/start", 50, 3)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+
+	// The peer is alive while it sends the heartbeats
+	for range 10 {
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, mcu.SendNotification(heartbeatMethod))
+	}
+	require.Empty(t, events)
+	require.Positive(t, received.Load())
+
+	// The other clients are notified when the heartbeats stop...
+	select {
+	case event := <-events:
+		require.Equal(t, peerLostMethod, event)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "peer not lost")
+	}
+
+	// ...and when they resume
+	require.NoError(t, mcu.SendNotification(heartbeatMethod))
+	select {
+	case event := <-events:
+		require.Equal(t, peerRecoveredMethod, event)
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "peer not recovered")
+	}
+
+	_, reqErr, err = mcu.SendRequest(t.Context(), "$/heartbeat/stop")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, events)
+}
@@ -0,0 +1,295 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+const (
+	// httpGatewayPath is the path prefix of the methods called through the
+	// HTTP gateway.
+	httpGatewayPath = "/rpc/"
+	// httpGatewayMaxBody is the maximum size of the body of a request.
+	httpGatewayMaxBody = 1 << 20
+	// httpGatewayTimeout is the maximum time waiting for the response of a
+	// method.
+	httpGatewayTimeout = 30 * time.Second
+)
+
+// httpGateway maps the HTTP requests POST /rpc/<method>, with a JSON array of
+// params as body, to calls of the method through the router. Each HTTP
+// request is carried by its own router connection, with the ACL and the role
+// of the gateway.
+type httpGateway struct {
+	router *msgpackrouter.Router
+	acl    msgpackrouter.ACL
+	role   string
+	// auth, if not nil, requires the token of the clients in the
+	// "Authorization: Bearer <token>" header.
+	auth *tokenAuth
+}
+
+// newHTTPGateway returns the gateway calling the methods of the router with
+// the given ACL profile and role.
+func newHTTPGateway(router *msgpackrouter.Router, cfg Config, profile, role string, roles map[string]msgpackrouter.ACL, auth *tokenAuth) (*httpGateway, error) {
+	g := &httpGateway{router: router, role: role, auth: auth}
+	if profile != "" {
+		patterns, ok := cfg.ACLProfiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown ACL profile for gateway: %s", profile)
+		}
+		g.acl = append(msgpackrouter.ACL{}, patterns...)
+	}
+	if _, ok := roles[role]; !ok {
+		return nil, fmt.Errorf("unknown role for gateway: %s", role)
+	}
+	return g, nil
+}
+
+// listenHTTPGateway serves the HTTP gateway on the given TCP address.
+func listenHTTPGateway(address string, g *httpGateway) (*http.Server, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on HTTP port %s: %w", address, err)
+	}
+	server := &http.Server{
+		Handler:           g,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP gateway stopped", "err", err)
+		}
+	}()
+	slog.Info("Listening on HTTP gateway", "listen_addr", address)
+	return server, nil
+}
+
+func (g *httpGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, ok := strings.CutPrefix(r.URL.Path, httpGatewayPath)
+	if !ok || method == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed, use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The body is the array of params, a single param, or empty for no
+	// params.
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpGatewayMaxBody))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	params, err := decodeJSONParams(body)
+	if err != nil {
+		http.Error(w, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), httpGatewayTimeout)
+	defer cancel()
+	conn, authErr, err := g.connect(ctx, r, "http", nil, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	if authErr != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, authErr)
+		return
+	}
+
+	result, reqErr, err := conn.SendRequest(ctx, method, params...)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Timeout waiting for the response", http.StatusGatewayTimeout)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case reqErr != nil:
+		writeJSON(w, httpGatewayErrorStatus(reqErr), reqErr)
+	default:
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// connect opens a router connection for the HTTP request, reported with the
+// given transport, with the ACL and the role of the gateway. If tokens are configured, the connection is
+// authenticated with the token of the "Authorization: Bearer <token>"
+// header, and the error of $/auth is returned if it fails.
+func (g *httpGateway) connect(ctx context.Context, r *http.Request, transport string, requestHandler msgpackrpc.RequestHandler, notificationHandler msgpackrpc.NotificationHandler) (*msgpackrpc.Connection, any, error) {
+	clientEnd, routerEnd := net.Pipe()
+	info := msgpackrouter.ConnectionInfo{
+		Transport:  transport,
+		RemoteAddr: r.RemoteAddr,
+		ACL:        g.acl,
+		Role:       g.role,
+	}
+	if g.auth != nil {
+		info.Authenticator = g.auth.authenticator(r.RemoteAddr)
+	}
+	g.router.AcceptConnectionWithInfo(routerEnd, info)
+	conn := msgpackrpc.NewConnection(clientEnd, clientEnd, requestHandler, notificationHandler, nil)
+	go conn.Run()
+
+	if g.auth != nil {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		_, authErr, err := conn.SendRequest(ctx, "$/auth", token)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if authErr != nil {
+			return conn, authErr, nil
+		}
+	}
+	return conn, nil, nil
+}
+
+// httpGatewayErrorStatus returns the HTTP status of a request failed with
+// the given error, from its router error code.
+func httpGatewayErrorStatus(reqErr any) int {
+	if e, ok := reqErr.([]any); ok && len(e) > 0 {
+		code, _ := msgpackrpc.ToInt(e[0])
+		switch code {
+		case msgpackrouter.ErrCodeInvalidParams:
+			return http.StatusBadRequest
+		case msgpackrouter.ErrCodeMethodNotAvailable, msgpackrouter.ErrCodeModuleDisabled:
+			return http.StatusNotFound
+		case msgpackrouter.ErrCodeMethodNotAllowed:
+			return http.StatusForbidden
+		case msgpackrouter.ErrCodeNotAuthenticated:
+			return http.StatusUnauthorized
+		case msgpackrouter.ErrCodeMessageTooLarge:
+			return http.StatusRequestEntityTooLarge
+		case msgpackrouter.ErrCodeServiceStarting, msgpackrouter.ErrCodeDraining:
+			return http.StatusServiceUnavailable
+		case msgpackrouter.ErrCodeTooManyErrors:
+			return http.StatusTooManyRequests
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// decodeJSONParams decodes the params of a method from a JSON body: an
+// array is the list of params, any other value is the only param.
+func decodeJSONParams(body []byte) ([]any, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+	v, err := decodeJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	if params, ok := v.([]any); ok {
+		return params, nil
+	}
+	return []any{v}, nil
+}
+
+// decodeJSON decodes a JSON value, the integers are decoded as int64 so that
+// they are encoded as msgpack integers.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return fromJSON(v), nil
+}
+
+// fromJSON converts the json.Number values of a decoded JSON value to int64,
+// or float64 if they are not integers.
+func fromJSON(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i := range v {
+			v[i] = fromJSON(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = fromJSON(v[k])
+		}
+	}
+	return v
+}
+
+// toJSON converts a decoded msgpack value to a value that can be encoded as
+// JSON: the maps with non-string keys get string keys.
+func toJSON(v any) any {
+	switch v := v.(type) {
+	case []any:
+		for i := range v {
+			v[i] = toJSON(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = toJSON(v[k])
+		}
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, value := range v {
+			m[fmt.Sprint(k)] = toJSON(value)
+		}
+		return m
+	}
+	return v
+}
+
+// encodeJSON encodes a decoded msgpack value as JSON.
+func encodeJSON(v any) ([]byte, error) {
+	return json.Marshal(toJSON(v))
+}
+
+// writeJSON writes the value as JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := encodeJSON(v)
+	if err != nil {
+		http.Error(w, "Failed to encode the response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
@@ -0,0 +1,91 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestHTTPGateway(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleRemote, msgpackrouter.ACL{"!secret/*"})
+	require.NoError(t, router.RegisterMethod("test/add", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		a, _ := msgpackrpc.ToInt(params[0])
+		b, _ := msgpackrpc.ToInt(params[1])
+		res(map[string]any{"sum": a + b}, nil)
+	}))
+	require.NoError(t, router.RegisterMethod("test/params", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		res(len(params), nil)
+	}))
+	require.NoError(t, router.RegisterMethod("secret/get", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res("secret", nil)
+	}))
+
+	auth, err := newTokenAuth("s3cret", "")
+	require.NoError(t, err)
+	server := httptest.NewServer(&httpGateway{router: router, role: msgpackrouter.RoleRemote, auth: auth})
+	defer server.Close()
+
+	post := func(path, token, body string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, strings.TrimSpace(string(data))
+	}
+
+	status, body := post("/rpc/test/add", "s3cret", "[1, 2]")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, `{"sum":3}`, body)
+
+	// A single value is the only param, an empty body means no params
+	status, body = post("/rpc/test/params", "s3cret", `"one"`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "1", body)
+	status, body = post("/rpc/test/params", "s3cret", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "0", body)
+
+	status, _ = post("/rpc/test/add", "wrong", "[1, 2]")
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = post("/rpc/test/add", "s3cret", "[1,")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, body = post("/rpc/secret/get", "s3cret", "")
+	require.Equal(t, http.StatusForbidden, status)
+	require.Contains(t, body, "[6,")
+	status, _ = post("/rpc/test/missing", "s3cret", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	resp, err := http.Get(server.URL + "/rpc/test/add")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
@@ -0,0 +1,220 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package adcapi
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// SamplesMethod is the notification method used to send the samples of a
+// subscription to the client, with the subscription handle and the array of
+// the raw values as parameters.
+const SamplesMethod = "adc/samples"
+
+// maxSampleRate is the maximum sampling rate of a subscription in Hz.
+const maxSampleRate = 1000
+
+// maxBatchSize is the maximum number of samples sent in a notification.
+const maxBatchSize = 1024
+
+// iioDevicesPath is the sysfs directory of the IIO devices.
+var iioDevicesPath = "/sys/bus/iio/devices"
+
+// subscription samples a channel periodically and sends the samples to the
+// owner in batches.
+type subscription struct {
+	owner *msgpackrpc.Connection
+	stop  chan struct{}
+}
+
+var lock sync.Mutex
+var subscriptions = make(map[uint]*subscription)
+var nextSubscriptionID uint
+
+// Register registers the ADC API methods with the router.
+func Register(router *msgpackrouter.Router) {
+	_ = router.RegisterMethod("adc/read", adcRead)
+	_ = router.RegisterMethod("adc/subscribe", adcSubscribe)
+	_ = router.RegisterMethod("adc/unsubscribe", adcUnsubscribe)
+	router.OnConnectionClosed(unsubscribeAll)
+}
+
+// Stats returns the number of active subscriptions.
+func Stats() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return map[string]any{
+		"subscriptions": len(subscriptions),
+	}
+}
+
+// unsubscribeAll stops the subscriptions of the given client.
+func unsubscribeAll(conn *msgpackrpc.Connection) {
+	lock.Lock()
+	defer lock.Unlock()
+	for id, s := range subscriptions {
+		if s.owner == conn {
+			close(s.stop)
+			delete(subscriptions, id)
+			slog.Info("Stopped ADC subscription of disconnected client", "id", id)
+		}
+	}
+}
+
+// channelPath returns the sysfs path of the raw value of the channel,
+// after checking the parameters.
+func channelPath(params []any) (string, any) {
+	device, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		return "", []any{1, "Invalid parameter type, expected int for IIO device number"}
+	}
+	channel, ok := msgpackrpc.ToUint(params[1])
+	if !ok {
+		return "", []any{1, "Invalid parameter type, expected int for channel number"}
+	}
+	return filepath.Join(iioDevicesPath, fmt.Sprintf("iio:device%d", device), fmt.Sprintf("in_voltage%d_raw", channel)), nil
+}
+
+// readChannel reads the raw value of the channel.
+func readChannel(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// adcRead returns the raw value of the channel of the IIO device.
+func adcRead(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (IIO device number, channel number)"})
+		return
+	}
+	path, errRes := channelPath(params)
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	value, err := readChannel(path)
+	if err != nil {
+		res(nil, []any{3, "Failed to read ADC channel: " + err.Error()})
+		return
+	}
+	res(value, nil)
+}
+
+// adcSubscribe samples the channel of the IIO device at the given rate (in
+// Hz) and sends the samples to the client with SamplesMethod notifications,
+// in batches of the given size (1 by default). It returns the handle of the
+// subscription.
+func adcSubscribe(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 3 && len(params) != 4 {
+		res(nil, []any{1, "Invalid number of parameters, expected (IIO device number, channel number, sample rate[, samples per notification])"})
+		return
+	}
+	path, errRes := channelPath(params)
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	rate, ok := msgpackrpc.ToUint(params[2])
+	if !ok || rate == 0 || rate > maxSampleRate {
+		res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected sample rate (1-%d Hz)", maxSampleRate)})
+		return
+	}
+	batchSize := uint(1)
+	if len(params) == 4 {
+		if batchSize, ok = msgpackrpc.ToUint(params[3]); !ok || batchSize == 0 || batchSize > maxBatchSize {
+			res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected samples per notification (1-%d)", maxBatchSize)})
+			return
+		}
+	}
+	// Check that the channel can be read before starting the sampling
+	if _, err := readChannel(path); err != nil {
+		res(nil, []any{3, "Failed to read ADC channel: " + err.Error()})
+		return
+	}
+
+	s := &subscription{owner: rpc, stop: make(chan struct{})}
+	lock.Lock()
+	nextSubscriptionID++
+	id := nextSubscriptionID
+	subscriptions[id] = s
+	lock.Unlock()
+
+	slog.Info("Started ADC subscription", "path", path, "id", id, "rate", rate, "batch", batchSize)
+	res(id, nil)
+	go s.run(id, path, time.Second/time.Duration(rate), batchSize)
+}
+
+func (s *subscription) run(id uint, path string, interval time.Duration, batchSize uint) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	samples := make([]int64, 0, batchSize)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		value, err := readChannel(path)
+		if err != nil {
+			slog.Warn("Failed to read ADC channel", "path", path, "id", id, "err", err)
+			continue
+		}
+		samples = append(samples, value)
+		if uint(len(samples)) < batchSize {
+			continue
+		}
+		if err := s.owner.SendNotification(SamplesMethod, id, samples); err != nil {
+			slog.Debug("Failed to send ADC samples", "id", id, "err", err)
+		}
+		samples = make([]int64, 0, batchSize)
+	}
+}
+
+// adcUnsubscribe stops the subscription with the given handle.
+func adcUnsubscribe(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected subscription handle"})
+		return
+	}
+	id, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for subscription handle"})
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	s, ok := subscriptions[id]
+	if !ok || s.owner != rpc {
+		res(nil, []any{2, fmt.Sprintf("ADC subscription not found for handle: %d", id)})
+		return
+	}
+	close(s.stop)
+	delete(subscriptions, id)
+	res(true, nil)
+}
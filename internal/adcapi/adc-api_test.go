@@ -0,0 +1,98 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package adcapi
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, rpc *msgpackrpc.Connection, params ...any) (any, any) {
+	var result, reqErr any
+	handler(rpc, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestADC(t *testing.T) {
+	iioDevicesPath = t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(iioDevicesPath, "iio:device0"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(iioDevicesPath, "iio:device0", "in_voltage1_raw"), []byte("2048\n"), 0600))
+
+	routerSide, clientSide := net.Pipe()
+	owner := msgpackrpc.NewConnection(routerSide, routerSide, nil, nil, nil)
+	defer owner.Close()
+	samples := make(chan []any, 10)
+	client := msgpackrpc.NewConnection(clientSide, clientSide, nil, func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		if method == SamplesMethod {
+			samples <- params
+		}
+	}, func(err error) {})
+	go client.Run()
+	defer client.Close()
+	other := new(msgpackrpc.Connection)
+
+	res, reqErr := call(adcRead, owner, 0, 1)
+	require.Nil(t, reqErr)
+	require.Equal(t, int64(2048), res)
+	_, reqErr = call(adcRead, owner, 0, 2)
+	require.Equal(t, 3, reqErr.([]any)[0])
+	_, reqErr = call(adcRead, owner, "0", 1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+
+	_, reqErr = call(adcSubscribe, owner, 0, 1, 0)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(adcSubscribe, owner, 0, 1, 100, maxBatchSize+1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(adcSubscribe, owner, 0, 2, 100)
+	require.Equal(t, 3, reqErr.([]any)[0])
+
+	handle, reqErr := call(adcSubscribe, owner, 0, 1, 100, 3)
+	require.Nil(t, reqErr)
+	require.Equal(t, map[string]any{"subscriptions": 1}, Stats())
+	select {
+	case params := <-samples:
+		require.Len(t, params, 2)
+		require.EqualValues(t, handle, params[0])
+		require.Len(t, params[1], 3)
+		require.EqualValues(t, 2048, params[1].([]any)[0])
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "no samples received")
+	}
+
+	// Only the owner can stop the subscription
+	_, reqErr = call(adcUnsubscribe, other, handle)
+	require.Equal(t, 2, reqErr.([]any)[0])
+	unsubscribeAll(other)
+	require.Equal(t, map[string]any{"subscriptions": 1}, Stats())
+	res, reqErr = call(adcUnsubscribe, owner, handle)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	require.Equal(t, map[string]any{"subscriptions": 0}, Stats())
+
+	// The subscriptions are stopped when the owner disconnects
+	_, reqErr = call(adcSubscribe, owner, 0, 1, 10)
+	require.Nil(t, reqErr)
+	unsubscribeAll(owner)
+	require.Equal(t, map[string]any{"subscriptions": 0}, Stats())
+}
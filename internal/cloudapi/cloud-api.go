@@ -0,0 +1,356 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package cloudapi
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/arduino/arduino-router/internal/mqtt"
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// PropertyMethod is the notification method used to send the property
+// updates received from the cloud to the subscribed clients, with the
+// property name and value as parameters.
+const PropertyMethod = "cloud/property"
+
+// DefaultBroker is the MQTT broker of the Arduino IoT Cloud for the devices
+// authenticated with a secret key.
+const DefaultBroker = "mqtts-up.iot.arduino.cc:8884"
+
+// keepAlive is the MQTT keep-alive interval.
+const keepAlive = 60 * time.Second
+
+// maxReconnectBackoff is the maximum delay between connection attempts.
+const maxReconnectBackoff = time.Minute
+
+// Config is the configuration of the cloud API.
+type Config struct {
+	// Broker is the address of the MQTT broker.
+	Broker string
+	// CredentialsFile is the file where the device credentials are stored.
+	CredentialsFile string
+}
+
+// credentials identify the device and its thing on the cloud.
+type credentials struct {
+	DeviceID  string `yaml:"device_id"`
+	SecretKey string `yaml:"secret_key"`
+	ThingID   string `yaml:"thing_id"`
+}
+
+var config Config
+var dial = func(addr string) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, nil)
+}
+
+var lock sync.Mutex
+var creds *credentials
+var client *mqtt.Client
+var stopSession chan struct{}
+var subscribers = make(map[*msgpackrpc.Connection]bool)
+var published atomic.Uint64
+var received atomic.Uint64
+
+// Register registers the cloud API methods with the router, and starts the
+// cloud session if the device has already been provisioned.
+func Register(router *msgpackrouter.Router, cfg Config) error {
+	config = cfg
+	data, err := os.ReadFile(cfg.CredentialsFile)
+	if err == nil {
+		var c credentials
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("invalid cloud credentials file %s: %w", cfg.CredentialsFile, err)
+		}
+		lock.Lock()
+		startSessionLocked(c)
+		lock.Unlock()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("reading cloud credentials: %w", err)
+	}
+
+	_ = router.RegisterMethod("cloud/provision", cloudProvision)
+	_ = router.RegisterMethod("cloud/status", cloudStatus)
+	_ = router.RegisterMethod("cloud/update", cloudUpdate)
+	_ = router.RegisterMethod("cloud/subscribe", cloudSubscribe)
+	_ = router.RegisterMethod("cloud/unsubscribe", cloudUnsubscribe)
+	router.OnConnectionClosed(func(conn *msgpackrpc.Connection) {
+		lock.Lock()
+		delete(subscribers, conn)
+		lock.Unlock()
+	})
+	return nil
+}
+
+// Stats returns the state of the cloud session and the number of property
+// messages exchanged.
+func Stats() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return map[string]any{
+		"connected":   client != nil,
+		"subscribers": len(subscribers),
+		"published":   published.Load(),
+		"received":    received.Load(),
+	}
+}
+
+// startSessionLocked stops the current cloud session, if any, and starts a
+// new one with the given credentials.
+func startSessionLocked(c credentials) {
+	if stopSession != nil {
+		close(stopSession)
+	}
+	if client != nil {
+		go client.Close()
+		client = nil
+	}
+	creds = &c
+	stopSession = make(chan struct{})
+	go runSession(c, stopSession)
+}
+
+// runSession keeps the device connected to the cloud until stop is closed.
+func runSession(c credentials, stop chan struct{}) {
+	backoff := time.Second
+	wait := func() bool {
+		select {
+		case <-stop:
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxReconnectBackoff)
+		return true
+	}
+
+	for {
+		conn, err := dial(config.Broker)
+		if err != nil {
+			slog.Warn("Failed to connect to the cloud", "broker", config.Broker, "err", err)
+			if !wait() {
+				return
+			}
+			continue
+		}
+		mc, err := mqtt.Dial(conn, c.DeviceID, c.DeviceID, c.SecretKey, keepAlive)
+		if err == nil {
+			err = mc.Subscribe(thingTopic(c.ThingID, "i"))
+		}
+		if err != nil {
+			conn.Close()
+			slog.Warn("Failed to connect to the cloud", "broker", config.Broker, "err", err)
+			if !wait() {
+				return
+			}
+			continue
+		}
+
+		lock.Lock()
+		select {
+		case <-stop:
+			lock.Unlock()
+			mc.Close()
+			return
+		default:
+		}
+		client = mc
+		lock.Unlock()
+		slog.Info("Connected to the cloud", "broker", config.Broker, "device_id", c.DeviceID)
+		backoff = time.Second
+
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(keepAlive / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					_ = mc.Ping()
+				}
+			}
+		}()
+		err = mc.ReadLoop(handleMessage)
+		close(done)
+
+		lock.Lock()
+		if client == mc {
+			client = nil
+		}
+		lock.Unlock()
+		slog.Warn("Disconnected from the cloud", "err", err)
+		if !wait() {
+			return
+		}
+	}
+}
+
+// thingTopic returns the topic of the thing properties, in the given
+// direction ("i" from the cloud, "o" to the cloud).
+func thingTopic(thingID, direction string) string {
+	return "/a/t/" + thingID + "/e/" + direction
+}
+
+// handleMessage relays the property updates received from the cloud to the
+// subscribed clients.
+func handleMessage(topic string, payload []byte) {
+	received.Add(1)
+	names, values, err := decodeProperties(payload)
+	if err != nil {
+		slog.Warn("Invalid property message from the cloud", "topic", topic, "err", err)
+		return
+	}
+	lock.Lock()
+	conns := make([]*msgpackrpc.Connection, 0, len(subscribers))
+	for conn := range subscribers {
+		conns = append(conns, conn)
+	}
+	lock.Unlock()
+	for i, name := range names {
+		for _, conn := range conns {
+			if err := conn.SendNotification(PropertyMethod, name, values[i]); err != nil {
+				slog.Debug("Failed to send cloud property", "name", name, "err", err)
+			}
+		}
+	}
+}
+
+// cloudProvision stores the credentials of the device and (re)connects to
+// the cloud with them.
+func cloudProvision(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 3 {
+		res(nil, []any{1, "Invalid number of parameters, expected (device ID, secret key, thing ID)"})
+		return
+	}
+	var values [3]string
+	for i, p := range params {
+		s, ok := p.(string)
+		if !ok || s == "" {
+			res(nil, []any{1, "Invalid parameter, expected non-empty strings for device ID, secret key and thing ID"})
+			return
+		}
+		values[i] = s
+	}
+	c := credentials{DeviceID: values[0], SecretKey: values[1], ThingID: values[2]}
+
+	data, err := yaml.Marshal(c)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(config.CredentialsFile), 0750)
+	}
+	if err == nil {
+		err = os.WriteFile(config.CredentialsFile, data, 0600)
+	}
+	if err != nil {
+		res(nil, []any{3, "Failed to save credentials: " + err.Error()})
+		return
+	}
+
+	lock.Lock()
+	startSessionLocked(c)
+	lock.Unlock()
+	slog.Info("Provisioned cloud credentials", "device_id", c.DeviceID, "thing_id", c.ThingID)
+	res(true, nil)
+}
+
+// cloudStatus returns whether the device is provisioned and connected.
+func cloudStatus(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 0 {
+		res(nil, []any{1, "Invalid number of parameters, expected none"})
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	status := map[string]any{
+		"provisioned": creds != nil,
+		"connected":   client != nil,
+	}
+	if creds != nil {
+		status["device_id"] = creds.DeviceID
+		status["thing_id"] = creds.ThingID
+	}
+	res(status, nil)
+}
+
+// cloudUpdate sends the property values, a map from the property names to
+// their values (bool, number or string), to the cloud.
+func cloudUpdate(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected property values"})
+		return
+	}
+	properties, ok := params[0].(map[string]any)
+	if !ok || len(properties) == 0 {
+		res(nil, []any{1, "Invalid parameter type, expected map of property values"})
+		return
+	}
+	payload, err := encodeProperties(properties)
+	if err != nil {
+		res(nil, []any{1, "Invalid property values: " + err.Error()})
+		return
+	}
+
+	lock.Lock()
+	mc, c := client, creds
+	lock.Unlock()
+	if mc == nil {
+		res(nil, []any{3, "Not connected to the cloud"})
+		return
+	}
+	if err := mc.Publish(thingTopic(c.ThingID, "o"), payload); err != nil {
+		res(nil, []any{3, "Failed to send properties: " + err.Error()})
+		return
+	}
+	published.Add(1)
+	res(true, nil)
+}
+
+// cloudSubscribe starts sending the property updates received from the cloud
+// to the caller with PropertyMethod notifications.
+func cloudSubscribe(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 0 {
+		res(nil, []any{1, "Invalid number of parameters, expected none"})
+		return
+	}
+	lock.Lock()
+	subscribers[rpc] = true
+	lock.Unlock()
+	res(true, nil)
+}
+
+// cloudUnsubscribe stops sending the property updates to the caller.
+func cloudUnsubscribe(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 0 {
+		res(nil, []any{1, "Invalid number of parameters, expected none"})
+		return
+	}
+	lock.Lock()
+	delete(subscribers, rpc)
+	lock.Unlock()
+	res(true, nil)
+}
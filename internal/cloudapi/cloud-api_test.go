@@ -0,0 +1,155 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package cloudapi
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/mqtt"
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, rpc *msgpackrpc.Connection, params ...any) (any, any) {
+	var result, reqErr any
+	handler(rpc, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestSenML(t *testing.T) {
+	data, err := encodeProperties(map[string]any{"temperature": 21.5, "on": true, "label": "kitchen", "count": 3})
+	require.NoError(t, err)
+	names, values, err := decodeProperties(data)
+	require.NoError(t, err)
+	require.Equal(t, []string{"count", "label", "on", "temperature"}, names)
+	require.Equal(t, []any{3.0, "kitchen", true, 21.5}, values)
+
+	_, err = encodeProperties(map[string]any{"list": []any{1}})
+	require.Error(t, err)
+
+	// [{-2: "urn:", 0: "x", 2: 1.5 (half float)}, {0: "y", 2: -3}]
+	names, values, err = decodeProperties([]byte{0x82,
+		0xA3, 0x21, 0x64, 'u', 'r', 'n', ':', 0x00, 0x61, 'x', 0x02, 0xF9, 0x3E, 0x00,
+		0xA2, 0x00, 0x61, 'y', 0x02, 0x22})
+	require.NoError(t, err)
+	require.Equal(t, []string{"urn:x", "urn:y"}, names)
+	require.Equal(t, []any{1.5, int64(-3)}, values)
+
+	_, _, err = decodeProperties([]byte{0x82, 0xA1})
+	require.Error(t, err)
+}
+
+func TestCloudSession(t *testing.T) {
+	brokerConns := make(chan net.Conn, 1)
+	dial = func(addr string) (net.Conn, error) {
+		require.Equal(t, "broker:8884", addr)
+		deviceSide, brokerSide := net.Pipe()
+		brokerConns <- brokerSide
+		return deviceSide, nil
+	}
+	credentialsFile := filepath.Join(t.TempDir(), "cloud", "credentials.yaml")
+	require.NoError(t, Register(msgpackrouter.New(0), Config{Broker: "broker:8884", CredentialsFile: credentialsFile}))
+
+	routerSide, clientSide := net.Pipe()
+	caller := msgpackrpc.NewConnection(routerSide, routerSide, nil, nil, nil)
+	defer caller.Close()
+	properties := make(chan []any, 10)
+	client := msgpackrpc.NewConnection(clientSide, clientSide, nil, func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		if method == PropertyMethod {
+			properties <- params
+		}
+	}, func(err error) {})
+	go client.Run()
+	defer client.Close()
+
+	status, reqErr := call(cloudStatus, caller)
+	require.Nil(t, reqErr)
+	require.Equal(t, map[string]any{"provisioned": false, "connected": false}, status)
+	_, reqErr = call(cloudUpdate, caller, map[string]any{"temperature": 20})
+	require.Equal(t, []any{3, "Not connected to the cloud"}, reqErr)
+	_, reqErr = call(cloudProvision, caller, "device", "", "thing")
+	require.Equal(t, 1, reqErr.([]any)[0])
+
+	_, reqErr = call(cloudProvision, caller, "device", "secret", "thing")
+	require.Nil(t, reqErr)
+	_, statErr := os.Stat(credentialsFile)
+	require.NoError(t, statErr)
+
+	// The device connects with its credentials and subscribes to the thing
+	conn := <-brokerConns
+	broker := mqtt.NewClient(conn)
+	header, body, err := broker.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, byte(mqtt.Connect<<4), header)
+	require.Contains(t, string(body), "device")
+	require.Contains(t, string(body), "secret")
+	require.NoError(t, broker.WritePacket(mqtt.ConnAck<<4, []byte{0, 0}))
+	header, body, err = broker.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, byte(mqtt.Subscribe<<4|0x02), header)
+	require.Contains(t, string(body), "/a/t/thing/e/i")
+
+	require.Eventually(t, func() bool { return Stats()["connected"] == true }, time.Second, 10*time.Millisecond)
+	status, _ = call(cloudStatus, caller)
+	require.Equal(t, map[string]any{"provisioned": true, "connected": true, "device_id": "device", "thing_id": "thing"}, status)
+
+	// Property updates are published on the thing topic
+	go func() {
+		_, reqErr := call(cloudUpdate, caller, map[string]any{"temperature": 20})
+		require.Nil(t, reqErr)
+	}()
+	header, body, err = broker.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, byte(mqtt.Publish<<4), header)
+	topicLen := int(binary.BigEndian.Uint16(body))
+	require.Equal(t, "/a/t/thing/e/o", string(body[2:2+topicLen]))
+	names, values, err := decodeProperties(body[2+topicLen:])
+	require.NoError(t, err)
+	require.Equal(t, []string{"temperature"}, names)
+	require.Equal(t, []any{20.0}, values)
+
+	// Property updates from the cloud are sent to the subscribers
+	_, reqErr = call(cloudSubscribe, caller)
+	require.Nil(t, reqErr)
+	payload, err := encodeProperties(map[string]any{"led": true})
+	require.NoError(t, err)
+	require.NoError(t, broker.Publish("/a/t/thing/e/i", payload))
+	select {
+	case params := <-properties:
+		require.Equal(t, []any{"led", true}, params)
+	case <-time.After(time.Second):
+		require.Fail(t, "property not received")
+	}
+	require.Equal(t, uint64(1), Stats()["received"])
+
+	// A new provisioning replaces the session
+	_, reqErr = call(cloudProvision, caller, "device2", "secret2", "thing2")
+	require.Nil(t, reqErr)
+	require.Equal(t, false, Stats()["connected"])
+	conn.Close()
+	(<-brokerConns).Close()
+	lock.Lock()
+	close(stopSession)
+	stopSession = nil
+	lock.Unlock()
+}
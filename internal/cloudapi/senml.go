@@ -0,0 +1,300 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package cloudapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// SenML labels of the CBOR representation (RFC 8428)
+const (
+	senmlBaseName    = -2
+	senmlName        = 0
+	senmlValue       = 2
+	senmlStringValue = 3
+	senmlBoolValue   = 4
+)
+
+// maxCBORDepth is the maximum nesting of the decoded CBOR items.
+const maxCBORDepth = 8
+
+// encodeProperties encodes the property values as a SenML pack in CBOR, as
+// exchanged with the Arduino IoT Cloud. The numbers are sent as floats, the
+// properties are sorted by name.
+func encodeProperties(properties map[string]any) ([]byte, error) {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	out := cborHead(nil, 4, uint64(len(names)))
+	for _, name := range names {
+		out = cborHead(out, 5, 2)
+		out = cborHead(out, 0, senmlName)
+		out = cborHead(out, 3, uint64(len(name)))
+		out = append(out, name...)
+		switch v := properties[name].(type) {
+		case bool:
+			out = cborHead(out, 0, senmlBoolValue)
+			if v {
+				out = append(out, 0xF5)
+			} else {
+				out = append(out, 0xF4)
+			}
+		case string:
+			out = cborHead(out, 0, senmlStringValue)
+			out = cborHead(out, 3, uint64(len(v)))
+			out = append(out, v...)
+		default:
+			f, ok := toFloat(v)
+			if !ok {
+				return nil, fmt.Errorf("unsupported value type for property %s: %T", name, v)
+			}
+			out = cborHead(out, 0, senmlValue)
+			out = append(out, 0xFB)
+			out = binary.BigEndian.AppendUint64(out, math.Float64bits(f))
+		}
+	}
+	return out, nil
+}
+
+// decodeProperties decodes a SenML pack in CBOR and returns the names and the
+// values of the records, in order.
+func decodeProperties(data []byte) ([]string, []any, error) {
+	item, rest, err := decodeCBOR(data, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) != 0 {
+		return nil, nil, errors.New("trailing data after SenML pack")
+	}
+	records, ok := item.([]any)
+	if !ok {
+		return nil, nil, errors.New("SenML pack is not an array")
+	}
+	var names []string
+	var values []any
+	baseName := ""
+	for _, r := range records {
+		record, ok := r.(map[any]any)
+		if !ok {
+			return nil, nil, errors.New("SenML record is not a map")
+		}
+		if bn, ok := record[int64(senmlBaseName)].(string); ok {
+			baseName = bn
+		}
+		name, _ := record[int64(senmlName)].(string)
+		var value any
+		if v, ok := record[int64(senmlValue)]; ok {
+			value = v
+		} else if v, ok := record[int64(senmlStringValue)]; ok {
+			value = v
+		} else if v, ok := record[int64(senmlBoolValue)]; ok {
+			value = v
+		} else {
+			continue
+		}
+		names = append(names, baseName+name)
+		values = append(values, value)
+	}
+	return names, values, nil
+}
+
+func toFloat(v any) (float64, bool) {
+	switch f := v.(type) {
+	case float64:
+		return f, true
+	case float32:
+		return float64(f), true
+	case uint64:
+		return float64(f), true
+	case int64:
+		return float64(f), true
+	}
+	if i, ok := msgpackrpc.ToInt(v); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// cborHead appends the head of a CBOR item of the given major type.
+func cborHead(out []byte, major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return append(out, major|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(out, major|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(out, major|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(out, major|26), uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64(append(out, major|27), arg)
+	}
+}
+
+var errCBORTruncated = errors.New("truncated CBOR data")
+
+// decodeCBOR decodes the first CBOR item of data (definite lengths only) and
+// returns it with the remaining data. The integers are decoded as int64 (or
+// uint64 if too large), the maps as map[any]any.
+func decodeCBOR(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, errors.New("CBOR data nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	major, info := data[0]>>5, data[0]&0x1F
+	data = data[1:]
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		case 25:
+			if len(data) < 2 {
+				return nil, nil, errCBORTruncated
+			}
+			return float16(binary.BigEndian.Uint16(data)), data[2:], nil
+		case 26:
+			if len(data) < 4 {
+				return nil, nil, errCBORTruncated
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+		case 27:
+			if len(data) < 8 {
+				return nil, nil, errCBORTruncated
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+		default:
+			return nil, nil, fmt.Errorf("unsupported CBOR simple value: %d", info)
+		}
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(data) < size {
+			return nil, nil, errCBORTruncated
+		}
+		for _, b := range data[:size] {
+			arg = arg<<8 | uint64(b)
+		}
+		data = data[size:]
+	default:
+		return nil, nil, errors.New("unsupported CBOR indefinite length")
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return arg, data, nil
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR negative integer out of range")
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if uint64(len(data)) < arg {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 2 {
+			return slices.Clone(data[:arg]), data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		if uint64(len(data)) < arg {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]any, 0, arg)
+		for range arg {
+			item, rest, err := decodeCBOR(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+			data = rest
+		}
+		return items, data, nil
+	case 5:
+		if uint64(len(data)) < arg*2 {
+			return nil, nil, errCBORTruncated
+		}
+		items := make(map[any]any, arg)
+		for range arg {
+			key, rest, err := decodeCBOR(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("unsupported CBOR map key")
+			}
+			value, rest, err := decodeCBOR(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+			data = rest
+		}
+		return items, data, nil
+	default:
+		// Tags: return the tagged item
+		return decodeCBOR(data, depth+1)
+	}
+}
+
+// float16 converts an IEEE 754 half precision float.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1F
+	mant := float64(h & 0x3FF)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
@@ -0,0 +1,369 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package fsapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// maxReadSize is the maximum number of bytes returned by a single read.
+const maxReadSize = 8192
+
+// openFlags are the modes accepted by fs/open, as in fopen(3).
+var openFlags = map[string]int{
+	"r":  os.O_RDONLY,
+	"r+": os.O_RDWR,
+	"w":  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	"w+": os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+	"a":  os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	"a+": os.O_RDWR | os.O_CREATE | os.O_APPEND,
+}
+
+// openFile is a file opened by a client.
+type openFile struct {
+	file  *os.File
+	owner *msgpackrpc.Connection
+}
+
+var root *os.Root
+var lock sync.Mutex
+var openFiles = make(map[uint]*openFile)
+var nextFileID uint
+
+// Register registers the filesystem API methods with the router. All the
+// paths are resolved inside the rootDir directory, that is created if
+// missing: the clients cannot access the files outside of it.
+func Register(router *msgpackrouter.Router, rootDir string) error {
+	if err := os.MkdirAll(rootDir, 0750); err != nil {
+		return fmt.Errorf("failed to create filesystem root: %w", err)
+	}
+	r, err := os.OpenRoot(rootDir)
+	if err != nil {
+		return fmt.Errorf("failed to open filesystem root: %w", err)
+	}
+	root = r
+
+	_ = router.RegisterMethod("fs/open", fsOpen)
+	_ = router.RegisterMethod("fs/read", fsRead)
+	_ = router.RegisterMethod("fs/write", fsWrite)
+	_ = router.RegisterMethod("fs/close", fsClose)
+	_ = router.RegisterMethod("fs/list", fsList)
+	_ = router.RegisterMethod("fs/remove", fsRemove)
+	_ = router.RegisterMethod("fs/stat", fsStat)
+	router.OnConnectionClosed(closeOwnedBy)
+	router.OnConnectionResumed(moveOwned)
+	return nil
+}
+
+// Stats returns the number of open files.
+func Stats() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return map[string]any{
+		"open_files": len(openFiles),
+	}
+}
+
+// moveOwned moves the files of a client to its new connection, when it
+// resumes its session.
+func moveOwned(from, to *msgpackrpc.Connection) {
+	lock.Lock()
+	defer lock.Unlock()
+	for _, f := range openFiles {
+		if f.owner == from {
+			f.owner = to
+		}
+	}
+}
+
+// closeOwnedBy closes the files opened by the given client.
+func closeOwnedBy(conn *msgpackrpc.Connection) {
+	lock.Lock()
+	defer lock.Unlock()
+	for id, f := range openFiles {
+		if f.owner == conn {
+			f.file.Close()
+			delete(openFiles, id)
+			slog.Info("Closed file of disconnected client", "id", id)
+		}
+	}
+}
+
+// Open opens for reading the file at the given path, resolved in the root
+// like the paths of the fs/* methods, for the modules sending the files to
+// the clients.
+func Open(p string) (*os.File, error) {
+	if root == nil {
+		return nil, errors.New("filesystem API not registered")
+	}
+	p, _ = getPath(p)
+	return root.Open(p)
+}
+
+// getPath returns the path relative to the root, the paths starting with
+// "/" are relative to the root too.
+func getPath(param any) (string, any) {
+	p, ok := param.(string)
+	if !ok {
+		return "", []any{1, "Invalid parameter type, expected string for path"}
+	}
+	p = path.Clean("/" + p)[1:]
+	if p == "" {
+		p = "."
+	}
+	return p, nil
+}
+
+// getFile returns the file with the given ID, if opened by the client.
+func getFile(rpc *msgpackrpc.Connection, param any) (uint, *openFile, any) {
+	id, ok := msgpackrpc.ToUint(param)
+	if !ok {
+		return 0, nil, []any{1, "Invalid parameter type, expected int for file handle"}
+	}
+	lock.Lock()
+	f, ok := openFiles[id]
+	lock.Unlock()
+	if !ok || f.owner != rpc {
+		return 0, nil, []any{2, fmt.Sprintf("File not found for handle: %d", id)}
+	}
+	return id, f, nil
+}
+
+// fileError returns the response error for a failed file operation.
+func fileError(msg string, err error) any {
+	if errors.Is(err, os.ErrNotExist) {
+		return []any{2, msg + ": " + err.Error()}
+	}
+	return []any{3, msg + ": " + err.Error()}
+}
+
+// fileInfo returns the description of a file sent to the clients.
+func fileInfo(info os.FileInfo) map[string]any {
+	return map[string]any{
+		"name":     info.Name(),
+		"size":     info.Size(),
+		"dir":      info.IsDir(),
+		"mod_time": info.ModTime().Unix(),
+	}
+}
+
+// fsOpen opens the file with the given mode ("r", "r+", "w", "w+", "a" or
+// "a+", "r" by default) and returns its handle, that can only be used by the
+// calling client.
+func fsOpen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 && len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (path[, mode])"})
+		return
+	}
+	p, errRes := getPath(params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	flags := os.O_RDONLY
+	if len(params) == 2 {
+		mode, ok := params[1].(string)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for mode"})
+			return
+		}
+		if flags, ok = openFlags[mode]; !ok {
+			res(nil, []any{1, "Invalid mode, expected r, r+, w, w+, a or a+"})
+			return
+		}
+	}
+	file, err := root.OpenFile(p, flags, 0640)
+	if err != nil {
+		res(nil, fileError("Failed to open file", err))
+		return
+	}
+
+	lock.Lock()
+	nextFileID++
+	id := nextFileID
+	openFiles[id] = &openFile{file: file, owner: rpc}
+	lock.Unlock()
+	slog.Debug("Opened file", "path", p, "id", id)
+	res(id, nil)
+}
+
+// fsRead reads up to count bytes from the file, an empty result means that
+// the end of the file has been reached.
+func fsRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (file handle, max bytes to read)"})
+		return
+	}
+	_, f, errRes := getFile(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	count, ok := msgpackrpc.ToUint(params[1])
+	if !ok || count > maxReadSize {
+		res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected max bytes to read (0-%d)", maxReadSize)})
+		return
+	}
+	buffer := make([]byte, count)
+	n, err := f.file.Read(buffer)
+	if err != nil && !errors.Is(err, io.EOF) {
+		res(nil, fileError("Failed to read file", err))
+		return
+	}
+	res(buffer[:n], nil)
+}
+
+// fsWrite writes the data to the file and returns the number of bytes
+// written.
+func fsWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (file handle, data to write)"})
+		return
+	}
+	_, f, errRes := getFile(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	data, ok := params[1].([]byte)
+	if !ok {
+		if s, ok := params[1].(string); ok {
+			data = []byte(s)
+		} else {
+			res(nil, []any{1, "Invalid parameter type, expected []byte or string for data to write"})
+			return
+		}
+	}
+	n, err := f.file.Write(data)
+	if err != nil {
+		res(nil, fileError("Failed to write file", err))
+		return
+	}
+	res(n, nil)
+}
+
+// fsClose closes the file with the given handle.
+func fsClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected file handle"})
+		return
+	}
+	id, f, errRes := getFile(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	lock.Lock()
+	delete(openFiles, id)
+	lock.Unlock()
+	if err := f.file.Close(); err != nil {
+		res(nil, fileError("Failed to close file", err))
+		return
+	}
+	res(true, nil)
+}
+
+// fsList returns the entries of the directory (the root by default), sorted
+// by name.
+func fsList(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) > 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected ([path])"})
+		return
+	}
+	p := "."
+	if len(params) == 1 {
+		var errRes any
+		if p, errRes = getPath(params[0]); errRes != nil {
+			res(nil, errRes)
+			return
+		}
+	}
+	dir, err := root.Open(p)
+	if err != nil {
+		res(nil, fileError("Failed to open directory", err))
+		return
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		res(nil, fileError("Failed to list directory", err))
+		return
+	}
+	slices.SortFunc(entries, func(a, b os.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	list := make([]any, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// The file has been removed in the meantime
+			continue
+		}
+		list = append(list, fileInfo(info))
+	}
+	res(list, nil)
+}
+
+// fsRemove removes the file or the empty directory.
+func fsRemove(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected path"})
+		return
+	}
+	p, errRes := getPath(params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	if p == "." {
+		res(nil, []any{1, "Cannot remove the root directory"})
+		return
+	}
+	if err := root.Remove(p); err != nil {
+		res(nil, fileError("Failed to remove file", err))
+		return
+	}
+	res(true, nil)
+}
+
+// fsStat returns the name, size, type and modification time (in seconds
+// since the epoch) of the file.
+func fsStat(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected path"})
+		return
+	}
+	p, errRes := getPath(params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	info, err := root.Stat(p)
+	if err != nil {
+		res(nil, fileError("Failed to stat file", err))
+		return
+	}
+	res(fileInfo(info), nil)
+}
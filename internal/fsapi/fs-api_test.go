@@ -0,0 +1,114 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package fsapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, rpc *msgpackrpc.Connection, params ...any) (any, any) {
+	var result, reqErr any
+	handler(rpc, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestFilesystem(t *testing.T) {
+	dir := t.TempDir()
+	rootDir := filepath.Join(dir, "root")
+	require.NoError(t, Register(msgpackrouter.New(0), rootDir))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret"), []byte("SECRET"), 0600))
+
+	owner := new(msgpackrpc.Connection)
+	other := new(msgpackrpc.Connection)
+
+	// Write and read back a file
+	handle, reqErr := call(fsOpen, owner, "/data.txt", "w")
+	require.Nil(t, reqErr)
+	require.Equal(t, map[string]any{"open_files": 1}, Stats())
+	_, reqErr = call(fsWrite, other, handle, "HELLO")
+	require.Equal(t, 2, reqErr.([]any)[0])
+	n, reqErr := call(fsWrite, owner, handle, []byte("HELLO"))
+	require.Nil(t, reqErr)
+	require.Equal(t, 5, n)
+	_, reqErr = call(fsClose, owner, handle)
+	require.Nil(t, reqErr)
+	require.Equal(t, map[string]any{"open_files": 0}, Stats())
+
+	handle, reqErr = call(fsOpen, owner, "data.txt")
+	require.Nil(t, reqErr)
+	_, reqErr = call(fsRead, owner, handle, maxReadSize+1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	data, reqErr := call(fsRead, owner, handle, 3)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte("HEL"), data)
+	data, reqErr = call(fsRead, owner, handle, 10)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte("LO"), data)
+	data, reqErr = call(fsRead, owner, handle, 10)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte{}, data)
+	closeOwnedBy(owner)
+	require.Equal(t, map[string]any{"open_files": 0}, Stats())
+
+	// Stat and list
+	info, reqErr := call(fsStat, owner, "data.txt")
+	require.Nil(t, reqErr)
+	require.Equal(t, "data.txt", info.(map[string]any)["name"])
+	require.Equal(t, int64(5), info.(map[string]any)["size"])
+	require.Equal(t, false, info.(map[string]any)["dir"])
+	require.NoError(t, os.Mkdir(filepath.Join(rootDir, "assets"), 0700))
+	list, reqErr := call(fsList, owner)
+	require.Nil(t, reqErr)
+	require.Len(t, list, 2)
+	require.Equal(t, "assets", list.([]any)[0].(map[string]any)["name"])
+	require.Equal(t, true, list.([]any)[0].(map[string]any)["dir"])
+	_, reqErr = call(fsList, owner, "missing")
+	require.Equal(t, 2, reqErr.([]any)[0])
+
+	// The files outside the root cannot be reached
+	_, reqErr = call(fsStat, owner, "../secret")
+	require.Equal(t, 2, reqErr.([]any)[0])
+	require.NoError(t, os.Symlink(filepath.Join(dir, "secret"), filepath.Join(rootDir, "link")))
+	_, reqErr = call(fsOpen, owner, "link")
+	require.NotNil(t, reqErr)
+	_, reqErr = call(fsOpen, owner, "data.txt", "x")
+	require.Equal(t, 1, reqErr.([]any)[0])
+
+	// The files opened by the other modules are confined too
+	f, err := Open("/data.txt")
+	require.NoError(t, err)
+	f.Close()
+	_, err = Open("../secret")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = Open("link")
+	require.Error(t, err)
+
+	// Remove
+	_, reqErr = call(fsRemove, owner, "/")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	res, reqErr := call(fsRemove, owner, "data.txt")
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	_, reqErr = call(fsStat, owner, "data.txt")
+	require.Equal(t, 2, reqErr.([]any)[0])
+}
@@ -18,36 +18,78 @@ package hciapi
 import (
 	"context"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
-	"sync/atomic"
-
-	"golang.org/x/sys/unix"
+	"sync"
 
 	"github.com/arduino/arduino-router/internal/msgpackrouter"
 	"github.com/arduino/arduino-router/msgpackrpc"
 )
 
-var hciSocket atomic.Int32
+// Options are the settings of the HCI API.
+type Options struct {
+	// Open opens the HCI sockets, OpenUserChannel if nil.
+	Open Opener
+}
+
+// Service is an instance of the HCI API, with the HCI socket opened by the
+// MCU.
+type Service struct {
+	open Opener
+
+	socketLock sync.Mutex
+	socket     Socket
+}
 
-//nolint:gochecknoinits
-func init() {
-	hciSocket.Store(-1)
+// New creates an instance of the HCI API with the given options.
+func New(opts Options) *Service {
+	if opts.Open == nil {
+		opts.Open = OpenUserChannel
+	}
+	return &Service{open: opts.Open}
 }
 
 // Register registers the HCI API methods with the router.
-func Register(router *msgpackrouter.Router) {
-	_ = router.RegisterMethod("hci/open", HCIOpen)
-	_ = router.RegisterMethod("hci/send", HCISend)
-	_ = router.RegisterMethod("hci/recv", HCIRecv)
-	_ = router.RegisterMethod("hci/avail", HCIAvail)
-	_ = router.RegisterMethod("hci/close", HCIClose)
+func (s *Service) Register(router *msgpackrouter.Router) {
+	_ = router.RegisterMethod("hci/open", s.HCIOpen)
+	_ = router.RegisterMethod("hci/send", s.HCISend)
+	_ = router.RegisterMethod("hci/recv", s.HCIRecv)
+	_ = router.RegisterMethod("hci/avail", s.HCIAvail)
+	_ = router.RegisterMethod("hci/close", s.HCIClose)
+}
+
+// Close closes the open HCI socket.
+func (s *Service) Close() {
+	s.swapSocket(nil)
+}
+
+// Stats returns the state of the HCI socket.
+func (s *Service) Stats() map[string]any {
+	return map[string]any{
+		"open": s.currentSocket() != nil,
+	}
+}
+
+func (s *Service) currentSocket() Socket {
+	s.socketLock.Lock()
+	defer s.socketLock.Unlock()
+	return s.socket
+}
+
+// swapSocket replaces the open socket, and closes the previous one.
+func (s *Service) swapSocket(socket Socket) {
+	s.socketLock.Lock()
+	old := s.socket
+	s.socket = socket
+	s.socketLock.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
 }
 
 // HCIOpen opens an HCI socket bound to the specified device (e.g. "hci0").
-func HCIOpen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) HCIOpen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Expected one parameter: HCI device name (e.g., 'hci0')"})
 		return
@@ -71,61 +113,34 @@ func HCIOpen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 	}
 
 	// Close any existing socket
-	if fd := hciSocket.Swap(-1); fd >= 0 {
-		_ = unix.Close(int(fd))
-	}
+	s.swapSocket(nil)
 
-	// Create raw HCI socket
-	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	socket, err := s.open(uint16(devNum)) //nolint:gosec
 	if err != nil {
-		res(nil, []any{3, fmt.Sprintf("Failed to create HCI socket: %v", err)})
-		return
-	}
-
-	// Bring down the HCI device using ioctl (HCIDEVDOWN)
-	const HCIDEVDOWN = 0x400448CA // from <bluetooth/hci.h>
-
-	if err := unix.IoctlSetInt(fd, HCIDEVDOWN, devNum); err != nil {
-		unix.Close(fd)
-		res(nil, []any{3, "Failed to bring down HCI device: " + err.Error()})
-		return
-	}
-	slog.Info("Brought down HCI device", "device", deviceName)
-
-	// Bind to device (user channel)
-	addr := &unix.SockaddrHCI{
-		Dev:     uint16(devNum), //nolint:gosec
-		Channel: unix.HCI_CHANNEL_USER,
-	}
-
-	if err := unix.Bind(fd, addr); err != nil {
-		unix.Close(fd)
-		res(nil, []any{3, fmt.Sprintf("Failed to bind to HCI device: %v", err)})
+		res(nil, []any{3, fmt.Sprintf("Failed to open HCI device: %v", err)})
 		return
 	}
 
-	hciSocket.Store(int32(fd)) //nolint:gosec
-	slog.Info("Opened HCI device", "device", deviceName, "fd", fd)
+	s.swapSocket(socket)
+	slog.Info("Opened HCI device", "device", deviceName)
 	res(true, nil)
 }
 
 // HCIClose closes the currently open HCI socket.
-func HCIClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) HCIClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 0 {
 		res(nil, []any{1, "Expected no parameters"})
 		return
 	}
 
-	if fd := hciSocket.Swap(-1); fd >= 0 {
-		unix.Close(int(fd))
-	}
+	s.swapSocket(nil)
 
 	slog.Info("Closed HCI device")
 	res(true, nil)
 }
 
 // HCISend transmits raw data to the open HCI socket.
-func HCISend(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) HCISend(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Expected one parameter: data to send"})
 		return
@@ -142,13 +157,13 @@ func HCISend(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 		return
 	}
 
-	fd := hciSocket.Load()
-	if fd < 0 {
+	socket := s.currentSocket()
+	if socket == nil {
 		res(nil, []any{2, "No HCI device open"})
 		return
 	}
 
-	n, err := unix.Write(int(fd), data)
+	n, err := socket.Write(data)
 	if err != nil {
 		slog.Error("Failed to send HCI packet", "err", err)
 		res(nil, []any{3, fmt.Sprintf("Failed to send HCI packet: %v", err)})
@@ -162,7 +177,7 @@ func HCISend(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 }
 
 // HCIRecv reads available data from the HCI socket.
-func HCIRecv(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) HCIRecv(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Expected one parameter: max bytes to receive"})
 		return
@@ -174,28 +189,15 @@ func HCIRecv(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 		return
 	}
 
-	fd := hciSocket.Load()
-	if fd < 0 {
+	socket := s.currentSocket()
+	if socket == nil {
 		res(nil, []any{2, "No HCI device open"})
 		return
 	}
 
 	buffer := make([]byte, size)
-
-	// Short timeout (1ms) for non-blocking behavior
-	tv := unix.Timeval{Usec: 1000}
-	if err := unix.SetsockoptTimeval(int(fd), unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
-		res(nil, []any{3, fmt.Sprintf("Failed to set read timeout: %v", err)})
-		return
-	}
-
-	n, err := unix.Read(int(fd), buffer)
+	n, err := socket.Read(buffer)
 	if err != nil {
-		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
-			slog.Debug("HCI recv timeout - no data available")
-			res([]byte{}, nil)
-			return
-		}
 		slog.Error("Failed to receive HCI packet", "err", err)
 		res(nil, []any{3, fmt.Sprintf("Failed to receive HCI packet: %v", err)})
 		return
@@ -208,33 +210,24 @@ func HCIRecv(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 }
 
 // HCIAvail checks whether data is available to read on the HCI socket.
-func HCIAvail(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) HCIAvail(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 0 {
 		res(nil, []any{1, "Expected no parameters"})
 		return
 	}
 
-	fd := hciSocket.Load()
-	if fd < 0 {
+	socket := s.currentSocket()
+	if socket == nil {
 		res(nil, []any{2, "No HCI device open"})
 		return
 	}
 
-	fds := []unix.PollFd{{
-		Fd:     fd,
-		Events: unix.POLLIN,
-	}}
-
-	n, err := unix.Poll(fds, 0)
+	available, err := socket.Readable()
 	if err != nil {
-		if errors.Is(err, unix.EINTR) {
-			res(false, nil)
-			return
-		}
 		slog.Error("Failed to poll HCI socket", "err", err)
 		res(nil, []any{3, fmt.Sprintf("Poll failed: %v", err)})
 		return
 	}
 
-	res(n > 0 && (fds[0].Revents&unix.POLLIN) != 0, nil)
+	res(available, nil)
 }
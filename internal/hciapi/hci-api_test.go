@@ -0,0 +1,154 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package hciapi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+// fakeSocket is a Socket that records the sent packets and returns the
+// queued received ones.
+type fakeSocket struct {
+	devNum uint16
+	sent   [][]byte
+	recv   [][]byte
+	closed bool
+}
+
+func (s *fakeSocket) Write(data []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("socket closed")
+	}
+	s.sent = append(s.sent, data)
+	return len(data), nil
+}
+
+func (s *fakeSocket) Read(buf []byte) (int, error) {
+	if len(s.recv) == 0 {
+		return 0, nil
+	}
+	n := copy(buf, s.recv[0])
+	s.recv = s.recv[1:]
+	return n, nil
+}
+
+func (s *fakeSocket) Readable() (bool, error) {
+	return len(s.recv) > 0, nil
+}
+
+func (s *fakeSocket) Close() error {
+	s.closed = true
+	return nil
+}
+
+func call(handler msgpackrouter.RouterRequestHandler, params ...any) (any, any) {
+	var result, reqErr any
+	handler(nil, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestHCIParams(t *testing.T) {
+	s := New(Options{})
+	for _, name := range []any{"hc0", "hci", "hciX", "hci70000", 0} {
+		_, reqErr := call(s.HCIOpen, name)
+		require.Equal(t, 1, reqErr.([]any)[0], name)
+	}
+	_, reqErr := call(s.HCISend, 1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.HCIRecv, "x")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.HCIAvail, 1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.HCIClose, 1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+}
+
+func TestHCISocket(t *testing.T) {
+	var sockets []*fakeSocket
+	s := New(Options{Open: func(devNum uint16) (Socket, error) {
+		if devNum > 1 {
+			return nil, errors.New("no such device")
+		}
+		socket := &fakeSocket{devNum: devNum}
+		sockets = append(sockets, socket)
+		return socket, nil
+	}})
+
+	// No device is open
+	_, reqErr := call(s.HCISend, []byte{1})
+	require.Equal(t, 2, reqErr.([]any)[0])
+	_, reqErr = call(s.HCIRecv, 10)
+	require.Equal(t, 2, reqErr.([]any)[0])
+	_, reqErr = call(s.HCIAvail)
+	require.Equal(t, 2, reqErr.([]any)[0])
+	_, reqErr = call(s.HCIOpen, "hci2")
+	require.Equal(t, 3, reqErr.([]any)[0])
+	require.Equal(t, map[string]any{"open": false}, s.Stats())
+
+	res, reqErr := call(s.HCIOpen, "hci1")
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	require.Equal(t, map[string]any{"open": true}, s.Stats())
+	socket := sockets[0]
+	require.Equal(t, uint16(1), socket.devNum)
+
+	res, reqErr = call(s.HCISend, []byte{0x01, 0x03, 0x0c, 0x00})
+	require.Nil(t, reqErr)
+	require.Equal(t, 4, res)
+	res, reqErr = call(s.HCISend, "\x01")
+	require.Nil(t, reqErr)
+	require.Equal(t, 1, res)
+	require.Equal(t, [][]byte{{0x01, 0x03, 0x0c, 0x00}, {0x01}}, socket.sent)
+
+	// The received data is read up to the given size
+	res, reqErr = call(s.HCIAvail)
+	require.Nil(t, reqErr)
+	require.Equal(t, false, res)
+	res, reqErr = call(s.HCIRecv, 10)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte{}, res)
+	socket.recv = [][]byte{{0x04, 0x0e, 0x04, 0x01}}
+	res, reqErr = call(s.HCIAvail)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	res, reqErr = call(s.HCIRecv, 2)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte{0x04, 0x0e}, res)
+
+	// Opening a device again closes the previous socket
+	_, reqErr = call(s.HCIOpen, "hci0")
+	require.Nil(t, reqErr)
+	require.True(t, socket.closed)
+	require.False(t, sockets[1].closed)
+
+	res, reqErr = call(s.HCIClose)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	require.True(t, sockets[1].closed)
+	require.Equal(t, map[string]any{"open": false}, s.Stats())
+
+	// Closing the instance closes the open socket
+	_, reqErr = call(s.HCIOpen, "hci1")
+	require.Nil(t, reqErr)
+	s.Close()
+	require.True(t, sockets[2].closed)
+	require.Equal(t, map[string]any{"open": false}, s.Stats())
+}
@@ -0,0 +1,133 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package hciapi
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/sys/unix"
+)
+
+// Socket is an HCI socket bound to a Bluetooth controller.
+type Socket interface {
+	// Write sends a raw HCI packet.
+	Write(data []byte) (int, error)
+	// Read receives the available data, without waiting for it: it returns
+	// 0 bytes if no data is available.
+	Read(buf []byte) (int, error)
+	// Readable returns true if data is available to read.
+	Readable() (bool, error)
+	Close() error
+}
+
+// Opener opens the HCI socket of the device with the given number.
+type Opener func(devNum uint16) (Socket, error)
+
+// userChannel is a raw HCI socket bound to the user channel of a device, that
+// gives exclusive access to the controller.
+type userChannel struct {
+	fd int
+}
+
+// OpenUserChannel brings down the HCI device with the given number and binds
+// a raw socket to its user channel.
+func OpenUserChannel(devNum uint16) (Socket, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, fmt.Errorf("creating HCI socket: %w", err)
+	}
+
+	// Bring down the HCI device using ioctl (HCIDEVDOWN)
+	const HCIDEVDOWN = 0x400448CA // from <bluetooth/hci.h>
+
+	if err := unix.IoctlSetInt(fd, HCIDEVDOWN, int(devNum)); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("bringing down HCI device: %w", err)
+	}
+	slog.Info("Brought down HCI device", "device", devNum)
+
+	// Bind to device (user channel)
+	addr := &unix.SockaddrHCI{
+		Dev:     devNum,
+		Channel: unix.HCI_CHANNEL_USER,
+	}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("binding to HCI device: %w", err)
+	}
+	return &userChannel{fd: fd}, nil
+}
+
+// CheckUserChannel verifies that a raw socket could be bound to the user
+// channel of a device, without touching the devices: the kernel must support
+// Bluetooth and the process needs the net_admin capability.
+func CheckUserChannel() error {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.BTPROTO_HCI)
+	if err != nil {
+		return fmt.Errorf("creating HCI socket: %w", err)
+	}
+	unix.Close(fd)
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("reading capabilities: %w", err)
+	}
+	if data[0].Effective&(1<<unix.CAP_NET_ADMIN) == 0 {
+		return errors.New("binding to the HCI user channel requires the net_admin capability")
+	}
+	return nil
+}
+
+func (s *userChannel) Write(data []byte) (int, error) {
+	return unix.Write(s.fd, data)
+}
+
+func (s *userChannel) Read(buf []byte) (int, error) {
+	// Short timeout (1ms) for non-blocking behavior
+	tv := unix.Timeval{Usec: 1000}
+	if err := unix.SetsockoptTimeval(s.fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return 0, fmt.Errorf("setting read timeout: %w", err)
+	}
+	n, err := unix.Read(s.fd, buf)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
+		slog.Debug("HCI recv timeout - no data available")
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *userChannel) Readable() (bool, error) {
+	fds := []unix.PollFd{{
+		Fd:     int32(s.fd), //nolint:gosec
+		Events: unix.POLLIN,
+	}}
+	n, err := unix.Poll(fds, 0)
+	if errors.Is(err, unix.EINTR) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return n > 0 && (fds[0].Revents&unix.POLLIN) != 0, nil
+}
+
+func (s *userChannel) Close() error {
+	return unix.Close(s.fd)
+}
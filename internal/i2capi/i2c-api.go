@@ -0,0 +1,337 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package i2capi
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// ioctl requests and flags from <linux/i2c-dev.h> and <linux/i2c.h>
+const (
+	i2cSlave = 0x0703
+	i2cRDWR  = 0x0707
+	i2cMRD   = 0x0001
+)
+
+// maxTransferSize is the maximum number of bytes of a single transfer.
+const maxTransferSize = 8192
+
+// devicePath is the path of the I2C bus devices, the bus number is appended.
+var devicePath = "/dev/i2c-"
+
+// bus is an I2C bus opened by a client.
+type bus struct {
+	file *os.File
+	// lock serializes the transfers on the bus, because the slave address
+	// is a property of the file descriptor.
+	lock sync.Mutex
+}
+
+// ownedBuses holds the buses opened by a client, by handle.
+var ownedBuses = msgpackrpc.NewKey[map[uint]*bus]("i2c/buses")
+
+// lock guards the maps of the owned buses and the counters.
+var lock sync.Mutex
+var openBuses int
+var nextBusID uint
+
+// Register registers the I2C API methods with the router.
+func Register(router *msgpackrouter.Router) {
+	_ = router.RegisterMethod("i2c/open", i2cOpen)
+	_ = router.RegisterMethod("i2c/write", i2cWrite)
+	_ = router.RegisterMethod("i2c/read", i2cRead)
+	_ = router.RegisterMethod("i2c/writeRead", i2cWriteRead)
+	_ = router.RegisterMethod("i2c/close", i2cClose)
+	router.OnConnectionClosed(closeOwnedBy)
+}
+
+// Stats returns the number of open I2C buses.
+func Stats() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return map[string]any{
+		"open_buses": openBuses,
+	}
+}
+
+// closeOwnedBy closes the buses opened by the given client.
+func closeOwnedBy(conn *msgpackrpc.Connection) {
+	lock.Lock()
+	defer lock.Unlock()
+	buses, _ := ownedBuses.Get(conn)
+	for id, b := range buses {
+		b.file.Close()
+		slog.Info("Closed I2C bus of disconnected client", "id", id)
+	}
+	openBuses -= len(buses)
+	ownedBuses.Delete(conn)
+}
+
+// getBus returns the bus with the given ID, if opened by the client.
+func getBus(rpc *msgpackrpc.Connection, param any) (*bus, any) {
+	id, ok := msgpackrpc.ToUint(param)
+	if !ok {
+		return nil, []any{1, "Invalid parameter type, expected int for bus handle"}
+	}
+	lock.Lock()
+	buses, _ := ownedBuses.Get(rpc)
+	b, ok := buses[id]
+	lock.Unlock()
+	if !ok {
+		return nil, []any{2, fmt.Sprintf("I2C bus not found for handle: %d", id)}
+	}
+	return b, nil
+}
+
+func toAddress(param any) (uint16, any) {
+	addr, ok := msgpackrpc.ToUint(param)
+	if !ok || addr > 0x7F {
+		return 0, []any{1, "Invalid parameter, expected 7-bit I2C address"}
+	}
+	return uint16(addr), nil //nolint:gosec
+}
+
+func toData(param any) ([]byte, any) {
+	switch data := param.(type) {
+	case []byte:
+		if len(data) > maxTransferSize {
+			return nil, []any{1, fmt.Sprintf("Too much data, at most %d bytes can be transferred", maxTransferSize)}
+		}
+		return data, nil
+	case string:
+		return toData([]byte(data))
+	default:
+		return nil, []any{1, "Invalid parameter type, expected []byte or string for data to write"}
+	}
+}
+
+func toCount(param any) (uint, any) {
+	count, ok := msgpackrpc.ToUint(param)
+	if !ok || count > maxTransferSize {
+		return 0, []any{1, fmt.Sprintf("Invalid parameter, expected number of bytes to read (at most %d)", maxTransferSize)}
+	}
+	return count, nil
+}
+
+// i2cOpen opens the I2C bus with the given number (/dev/i2c-N) and returns
+// its handle, that can only be used by the calling client.
+func i2cOpen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected I2C bus number"})
+		return
+	}
+	busNum, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for I2C bus number"})
+		return
+	}
+
+	path := fmt.Sprintf("%s%d", devicePath, busNum)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		res(nil, []any{3, "Failed to open I2C bus: " + err.Error()})
+		return
+	}
+
+	lock.Lock()
+	buses, ok := ownedBuses.Get(rpc)
+	if !ok {
+		buses = make(map[uint]*bus)
+		ownedBuses.Set(rpc, buses)
+	}
+	nextBusID++
+	id := nextBusID
+	buses[id] = &bus{file: f}
+	openBuses++
+	lock.Unlock()
+	slog.Info("Opened I2C bus", "path", path, "id", id)
+	res(id, nil)
+}
+
+// i2cClose closes the I2C bus with the given handle.
+func i2cClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected bus handle"})
+		return
+	}
+	b, errRes := getBus(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	id, _ := msgpackrpc.ToUint(params[0])
+	lock.Lock()
+	buses, _ := ownedBuses.Get(rpc)
+	if _, ok := buses[id]; ok {
+		delete(buses, id)
+		openBuses--
+	}
+	lock.Unlock()
+	b.file.Close()
+	res(true, nil)
+}
+
+// i2cWrite writes the data to the device with the given address, and returns
+// the number of bytes written.
+func i2cWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 3 {
+		res(nil, []any{1, "Invalid number of parameters, expected (bus handle, address, data to write)"})
+		return
+	}
+	b, errRes := getBus(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	addr, errRes := toAddress(params[1])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	data, errRes := toData(params[2])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := unix.IoctlSetInt(int(b.file.Fd()), i2cSlave, int(addr)); err != nil {
+		res(nil, []any{3, "Failed to set I2C address: " + err.Error()})
+		return
+	}
+	n, err := b.file.Write(data)
+	if err != nil {
+		res(nil, []any{3, "Failed to write to I2C device: " + err.Error()})
+		return
+	}
+	res(n, nil)
+}
+
+// i2cRead reads the given number of bytes from the device with the given
+// address.
+func i2cRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 3 {
+		res(nil, []any{1, "Invalid number of parameters, expected (bus handle, address, number of bytes to read)"})
+		return
+	}
+	b, errRes := getBus(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	addr, errRes := toAddress(params[1])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	count, errRes := toCount(params[2])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := unix.IoctlSetInt(int(b.file.Fd()), i2cSlave, int(addr)); err != nil {
+		res(nil, []any{3, "Failed to set I2C address: " + err.Error()})
+		return
+	}
+	buffer := make([]byte, count)
+	n, err := b.file.Read(buffer)
+	if err != nil {
+		res(nil, []any{3, "Failed to read from I2C device: " + err.Error()})
+		return
+	}
+	res(buffer[:n], nil)
+}
+
+// i2cMsg is struct i2c_msg from <linux/i2c.h>
+type i2cMsg struct {
+	addr  uint16
+	flags uint16
+	len   uint16
+	buf   *byte
+}
+
+// i2cRdwrData is struct i2c_rdwr_ioctl_data from <linux/i2c-dev.h>
+type i2cRdwrData struct {
+	msgs  *i2cMsg
+	nmsgs uint32
+}
+
+// i2cWriteRead writes the data to the device with the given address and
+// then, with a repeated start condition, reads the given number of bytes
+// (e.g. to read a register of a sensor).
+func i2cWriteRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 4 {
+		res(nil, []any{1, "Invalid number of parameters, expected (bus handle, address, data to write, number of bytes to read)"})
+		return
+	}
+	b, errRes := getBus(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	addr, errRes := toAddress(params[1])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	data, errRes := toData(params[2])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	count, errRes := toCount(params[3])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	if len(data) == 0 || count == 0 {
+		res(nil, []any{1, "Invalid parameters, data to write and number of bytes to read must not be empty"})
+		return
+	}
+
+	buffer := make([]byte, count)
+	msgs := []i2cMsg{
+		{addr: addr, len: uint16(len(data)), buf: &data[0]},                    //nolint:gosec
+		{addr: addr, flags: i2cMRD, len: uint16(len(buffer)), buf: &buffer[0]}, //nolint:gosec
+	}
+	rdwr := i2cRdwrData{msgs: &msgs[0], nmsgs: uint32(len(msgs))}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, b.file.Fd(), i2cRDWR, uintptr(unsafe.Pointer(&rdwr)))
+	runtime.KeepAlive(msgs)
+	runtime.KeepAlive(data)
+	runtime.KeepAlive(buffer)
+	if errno != 0 {
+		res(nil, []any{3, "Failed to transfer on I2C bus: " + errno.Error()})
+		return
+	}
+	res(buffer, nil)
+}
@@ -0,0 +1,74 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package i2capi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, rpc *msgpackrpc.Connection, params ...any) (any, any) {
+	var result, reqErr any
+	handler(rpc, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestI2CHandles(t *testing.T) {
+	dir := t.TempDir()
+	devicePath = filepath.Join(dir, "i2c-")
+	// A regular file stands in for the bus device: the transfers fail
+	// because the ioctls are not supported, but the handles can be tested.
+	require.NoError(t, os.WriteFile(devicePath+"1", nil, 0600))
+
+	owner := new(msgpackrpc.Connection)
+	other := new(msgpackrpc.Connection)
+
+	_, reqErr := call(i2cOpen, owner, 2)
+	require.Equal(t, 3, reqErr.([]any)[0])
+
+	handle, reqErr := call(i2cOpen, owner, 1)
+	require.Nil(t, reqErr)
+	require.Equal(t, map[string]any{"open_buses": 1}, Stats())
+
+	// Only the owner can use the bus
+	_, reqErr = call(i2cWrite, other, handle, 0x40, []byte{1})
+	require.Equal(t, 2, reqErr.([]any)[0])
+	_, reqErr = call(i2cWrite, owner, handle, 0x80, []byte{1})
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(i2cWrite, owner, handle, 0x40, []byte{1})
+	require.Equal(t, 3, reqErr.([]any)[0])
+
+	_, reqErr = call(i2cClose, other, handle)
+	require.Equal(t, 2, reqErr.([]any)[0])
+	res, reqErr := call(i2cClose, owner, handle)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	require.Equal(t, map[string]any{"open_buses": 0}, Stats())
+
+	// The buses are closed when the owner disconnects
+	_, reqErr = call(i2cOpen, owner, 1)
+	require.Nil(t, reqErr)
+	closeOwnedBy(other)
+	require.Equal(t, map[string]any{"open_buses": 1}, Stats())
+	closeOwnedBy(owner)
+	require.Equal(t, map[string]any{"open_buses": 0}, Stats())
+}
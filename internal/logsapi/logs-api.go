@@ -0,0 +1,277 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package logsapi records a sample of the requests received by the router in
+// a file, and provides the logs/query method to read the most recent entries,
+// for the analysis of the incidents on the devices without remote logging.
+package logsapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// defaultQueryLimit and maxQueryLimit are the default and the maximum number
+// of entries returned by logs/query.
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// Config is the configuration of the request logs.
+type Config struct {
+	// File is the file where the entries are appended, rotated to File+".1"
+	// when it exceeds MaxFileSize.
+	File string
+	// SampleRate is the fraction of the requests that are logged, from 0 to
+	// 1.
+	SampleRate float64
+	// MaxPayloadSize is the maximum size in bytes of the params stored with
+	// an entry, the larger params are logged only with their size.
+	MaxPayloadSize int
+	// MaxFileSize is the maximum size in bytes of the log file.
+	MaxFileSize int64
+}
+
+// entry is a logged request, stored as a MessagePack array.
+type entry struct {
+	_msgpack struct{} `msgpack:",as_array"` //nolint:unused
+
+	// Time is the time of the request in milliseconds since the epoch.
+	Time       int64
+	Method     string
+	Caller     string
+	DurationUs int64
+	ParamsSize int
+	// Params are the params of the request, nil if larger than
+	// MaxPayloadSize.
+	Params msgpack.RawMessage
+	// Error is the error of the response, nil on success.
+	Error any
+}
+
+var config Config
+
+var lock sync.Mutex
+var file *os.File
+var fileSize int64
+
+var logged atomic.Uint64
+var payloadsDropped atomic.Uint64
+var writeErrors atomic.Uint64
+
+// Register starts logging the requests received by the router, and registers
+// the logs API methods.
+func Register(router *msgpackrouter.Router, cfg Config) error {
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return fmt.Errorf("invalid sample rate of the request logs: %v", cfg.SampleRate)
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.File), 0750); err != nil {
+		return fmt.Errorf("failed to create request logs directory: %w", err)
+	}
+	f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open request logs: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open request logs: %w", err)
+	}
+	lock.Lock()
+	config = cfg
+	file = f
+	fileSize = info.Size()
+	lock.Unlock()
+	router.SetRequestObserver(observe)
+	_ = router.RegisterMethod("logs/query", logsQuery)
+	return nil
+}
+
+// Stats returns the number of logged requests, of the params not stored
+// because too large and of the failed writes.
+func Stats() map[string]any {
+	lock.Lock()
+	size := fileSize
+	lock.Unlock()
+	return map[string]any{
+		"logged":           logged.Load(),
+		"payloads_dropped": payloadsDropped.Load(),
+		"write_errors":     writeErrors.Load(),
+		"file_size":        size,
+	}
+}
+
+// observe is the msgpackrouter.RequestObserver logging a sample of the
+// requests.
+func observe(method string, params msgpackrpc.RawMessage, caller string) func(result, err any) {
+	if config.SampleRate < 1 && rand.Float64() >= config.SampleRate {
+		return nil
+	}
+	start := time.Now()
+	e := entry{Time: start.UnixMilli(), Method: method, Caller: caller, ParamsSize: len(params)}
+	if len(params) <= config.MaxPayloadSize {
+		e.Params = msgpack.RawMessage(slices.Clone(params))
+	} else {
+		payloadsDropped.Add(1)
+	}
+	return func(_, err any) {
+		e.DurationUs = time.Since(start).Microseconds()
+		e.Error = err
+		write(e)
+	}
+}
+
+// write appends the entry to the log file, rotating it if needed.
+func write(e entry) {
+	data, err := msgpack.Marshal(&e)
+	if err != nil {
+		// The error of the response can not be encoded
+		e.Error = fmt.Sprint(e.Error)
+		if data, err = msgpack.Marshal(&e); err != nil {
+			writeErrors.Add(1)
+			return
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if fileSize > 0 && fileSize+int64(len(data)) > config.MaxFileSize {
+		if err := rotate(); err != nil {
+			writeErrors.Add(1)
+			slog.Warn("Failed to rotate request logs", "file", config.File, "err", err)
+			return
+		}
+	}
+	n, err := file.Write(data)
+	fileSize += int64(n)
+	if err != nil {
+		writeErrors.Add(1)
+		slog.Debug("Failed to write request log", "file", config.File, "err", err)
+		return
+	}
+	logged.Add(1)
+}
+
+// rotate renames the log file to File+".1", replacing the previous one, and
+// starts a new log file. It must be called with the lock held.
+func rotate() error {
+	file.Close()
+	if err := os.Rename(config.File, config.File+".1"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	file = f
+	fileSize = 0
+	return nil
+}
+
+// readEntries returns the entries of the log files, from the oldest. The
+// incomplete entry at the end of a file, written when the router was
+// stopped, is ignored.
+func readEntries() []entry {
+	var entries []entry
+	for _, path := range []string{config.File + ".1", config.File} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		d := msgpack.NewDecoder(bytes.NewReader(data))
+		for {
+			var e entry
+			if err := d.Decode(&e); err != nil {
+				if !errors.Is(err, io.EOF) {
+					slog.Debug("Invalid request log entry", "file", path, "err", err)
+				}
+				break
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// logsQuery returns the most recent logged requests, at most limit (100 by
+// default), optionally only those of the methods matching the pattern (for
+// example "tcp/*"). The entries are returned from the oldest.
+func logsQuery(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) > 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected ([limit[, method pattern]])"})
+		return
+	}
+	limit := defaultQueryLimit
+	if len(params) >= 1 {
+		l, ok := msgpackrpc.ToUint(params[0])
+		if !ok || l == 0 || l > maxQueryLimit {
+			res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected limit between 1 and %d", maxQueryLimit)})
+			return
+		}
+		limit = int(l) //nolint:gosec
+	}
+	var filter msgpackrouter.ACL
+	if len(params) == 2 {
+		pattern, ok := params[1].(string)
+		if !ok || pattern == "" {
+			res(nil, []any{1, "Invalid parameter type, expected string for method pattern"})
+			return
+		}
+		filter = msgpackrouter.ACL{pattern}
+	}
+
+	lock.Lock()
+	entries := readEntries()
+	lock.Unlock()
+	entries = slices.DeleteFunc(entries, func(e entry) bool { return !filter.Allows(e.Method) })
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	result := make([]any, len(entries))
+	for i, e := range entries {
+		item := map[string]any{
+			"time":        time.UnixMilli(e.Time).UTC().Format(time.RFC3339Nano),
+			"method":      e.Method,
+			"caller":      e.Caller,
+			"duration_us": e.DurationUs,
+			"params_size": e.ParamsSize,
+			"error":       e.Error,
+		}
+		if e.Params != nil {
+			var p any
+			if err := msgpack.Unmarshal(e.Params, &p); err == nil {
+				item["params"] = p
+			}
+		}
+		result[i] = item
+	}
+	res(result, nil)
+}
@@ -0,0 +1,153 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package logsapi
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestRequestLogs(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleLocalService, nil)
+	file := filepath.Join(t.TempDir(), "logs", "requests.log")
+	require.Error(t, Register(router, Config{File: file, SampleRate: 2}))
+	require.NoError(t, Register(router, Config{File: file, SampleRate: 1, MaxPayloadSize: 16, MaxFileSize: 4096}))
+	defer router.SetRequestObserver(nil)
+	dropped := Stats()["payloads_dropped"].(uint64)
+
+	connect := func(handler msgpackrpc.RequestHandler) *msgpackrpc.Connection {
+		clientEnd, routerEnd := net.Pipe()
+		router.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Transport: "unix", RemoteAddr: "test", Role: msgpackrouter.RoleLocalService})
+		conn := msgpackrpc.NewConnection(clientEnd, clientEnd, handler, nil, nil)
+		go conn.Run()
+		t.Cleanup(conn.Close)
+		return conn
+	}
+	service := connect(func(_ msgpackrpc.FunctionLogger, _ string, params []any, res msgpackrpc.ResponseHandler) {
+		res(params[0], nil)
+	})
+	_, reqErr, err := service.SendRequest(t.Context(), "$/register", "echo")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+
+	client := connect(nil)
+	_, _, err = client.SendRequest(t.Context(), "echo", "hi")
+	require.NoError(t, err)
+	_, _, err = client.SendRequest(t.Context(), "echo", strings.Repeat("x", 100))
+	require.NoError(t, err)
+	_, reqErr, err = client.SendRequest(t.Context(), "missing")
+	require.NoError(t, err)
+	require.NotNil(t, reqErr)
+
+	result, reqErr, err := client.SendRequest(t.Context(), "logs/query", 2)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	entries := result.([]any)
+	require.Len(t, entries, 2)
+	large := entries[0].(map[string]any)
+	require.Equal(t, "echo", large["method"])
+	require.Equal(t, "unix test", large["caller"])
+	require.NotContains(t, large, "params")
+	require.EqualValues(t, 103, large["params_size"])
+	require.Nil(t, large["error"])
+	missing := entries[1].(map[string]any)
+	require.Equal(t, "missing", missing["method"])
+	require.NotNil(t, missing["error"])
+
+	result, reqErr, err = client.SendRequest(t.Context(), "logs/query", 10, "ec*")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	entries = result.([]any)
+	require.Len(t, entries, 2)
+	require.Equal(t, []any{"hi"}, entries[0].(map[string]any)["params"])
+
+	_, reqErr, err = client.SendRequest(t.Context(), "logs/query", 0)
+	require.NoError(t, err)
+	require.NotNil(t, reqErr)
+	_, reqErr, err = client.SendRequest(t.Context(), "logs/query", 1, 2)
+	require.NoError(t, err)
+	require.NotNil(t, reqErr)
+
+	// An incomplete entry at the end of the file is ignored
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x98, 0xcf})
+	require.NoError(t, err)
+	f.Close()
+	result, _, err = client.SendRequest(t.Context(), "logs/query")
+	require.NoError(t, err)
+	require.NotEmpty(t, result)
+	require.Equal(t, dropped+1, Stats()["payloads_dropped"])
+}
+
+func TestRequestLogsRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "requests.log")
+	router := msgpackrouter.New(0)
+	require.NoError(t, Register(router, Config{File: file, SampleRate: 1, MaxPayloadSize: 16, MaxFileSize: 100}))
+	defer router.SetRequestObserver(nil)
+
+	for range 20 {
+		done := observe("sensor/read", nil, "serial /dev/ttyACM0")
+		require.NotNil(t, done)
+		done(21.5, nil)
+	}
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Size(), int64(100))
+	_, err = os.Stat(file + ".1")
+	require.NoError(t, err)
+
+	// The entries of the rotated file are still returned
+	var result any
+	logsQuery(nil, []any{}, func(r, _ any) { result = r })
+	current, err := os.ReadFile(file)
+	require.NoError(t, err)
+	rotated, err := os.ReadFile(file + ".1")
+	require.NoError(t, err)
+	require.Len(t, result.([]any), countEntries(t, rotated)+countEntries(t, current))
+
+	// No request is logged with a zero sample rate
+	config.SampleRate = 0
+	require.Nil(t, observe("sensor/read", nil, "serial /dev/ttyACM0"))
+}
+
+// countEntries returns the number of entries in the content of a log file.
+func countEntries(t *testing.T, data []byte) int {
+	d := msgpack.NewDecoder(bytes.NewReader(data))
+	count := 0
+	for {
+		var e entry
+		if err := d.Decode(&e); errors.Is(err, io.EOF) {
+			return count
+		} else {
+			require.NoError(t, err)
+		}
+		count++
+	}
+}
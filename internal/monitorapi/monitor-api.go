@@ -16,12 +16,12 @@
 package monitorapi
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/djherbis/buffer"
 	"github.com/djherbis/nio/v3"
@@ -30,75 +30,155 @@ import (
 	"github.com/arduino/arduino-router/msgpackrpc"
 )
 
-var socketsLock sync.RWMutex
-var sockets map[net.Conn]struct{}
-var monSendPipeRd *nio.PipeReader
-var monSendPipeWr *nio.PipeWriter
-var bytesInSendPipe atomic.Int64
+// monitorWriteQueueSize is the maximum number of pending writes queued
+// for each monitor client before it is considered stuck and dropped.
+const monitorWriteQueueSize = 64
 
-// Register the Monitor API methods
-func Register(router *msgpackrouter.Router, addr string) error {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to start listener: %w", err)
+type monitorClient struct {
+	service   *Service
+	conn      net.Conn
+	outQueue  chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Options are the settings of the Monitor API.
+type Options struct {
+	// Listeners accept the monitor clients.
+	Listeners []net.Listener
+	// Echo mirrors the data sent by each client to the other clients, so
+	// that they all see the input of the others.
+	Echo bool
+}
+
+// Service is an instance of the Monitor API, relaying the data between the
+// MCU and the clients of its listeners.
+type Service struct {
+	listeners []net.Listener
+	echo      bool
+
+	socketsLock     sync.RWMutex
+	sockets         map[net.Conn]*monitorClient
+	monSendPipeRd   *nio.PipeReader
+	monSendPipeWr   *nio.PipeWriter
+	bytesInSendPipe atomic.Int64
+}
+
+// New creates an instance of the Monitor API with the given options.
+func New(opts Options) *Service {
+	s := &Service{
+		listeners: opts.Listeners,
+		echo:      opts.Echo,
+		sockets:   make(map[net.Conn]*monitorClient),
+	}
+	s.monSendPipeRd, s.monSendPipeWr = nio.Pipe(buffer.New(1024))
+	return s
+}
+
+// Register the Monitor API methods, and start accepting the monitor clients.
+func (s *Service) Register(router *msgpackrouter.Router) {
+	for _, listener := range s.listeners {
+		go s.connectionHandler(listener)
 	}
-	sockets = make(map[net.Conn]struct{})
-	monSendPipeRd, monSendPipeWr = nio.Pipe(buffer.New(1024))
+	_ = router.RegisterMethod("mon/connected", s.connected)
+	_ = router.RegisterMethod("mon/read", s.read)
+	_ = router.RegisterMethod("mon/write", s.write)
+	_ = router.RegisterMethod("mon/reset", s.reset)
+}
 
-	go connectionHandler(listener)
-	_ = router.RegisterMethod("mon/connected", connected)
-	_ = router.RegisterMethod("mon/read", read)
-	_ = router.RegisterMethod("mon/write", write)
-	_ = router.RegisterMethod("mon/reset", reset)
-	return nil
+// Close stops accepting the monitor clients, and disconnects them.
+func (s *Service) Close() {
+	for _, listener := range s.listeners {
+		_ = listener.Close()
+	}
+	s.closeClients()
+	_ = s.monSendPipeWr.Close()
 }
 
-func connectionHandler(listener net.Listener) {
+// Addrs returns the addresses where the monitor clients are accepted, with
+// the ports chosen by the system for the listeners on port 0.
+func (s *Service) Addrs() []string {
+	addrs := make([]string, len(s.listeners))
+	for i, listener := range s.listeners {
+		addrs[i] = listener.Addr().String()
+	}
+	return addrs
+}
+
+// Stats returns the number of connected monitor clients and the number of
+// bytes waiting to be read by the MCU.
+func (s *Service) Stats() map[string]any {
+	s.socketsLock.RLock()
+	clients := len(s.sockets)
+	s.socketsLock.RUnlock()
+	return map[string]any{
+		"clients":       clients,
+		"bytes_pending": s.bytesInSendPipe.Load(),
+	}
+}
+
+func (s *Service) connectionHandler(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			slog.Error("Failed to accept monitor connection", "error", err)
 			return
 		}
 
 		slog.Info("Accepted monitor connection", "from", conn.RemoteAddr())
-		socketsLock.Lock()
-		sockets[conn] = struct{}{}
-		socketsLock.Unlock()
+		client := &monitorClient{
+			service:  s,
+			conn:     conn,
+			outQueue: make(chan []byte, monitorWriteQueueSize),
+			done:     make(chan struct{}),
+		}
+		s.socketsLock.Lock()
+		s.sockets[conn] = client
+		s.socketsLock.Unlock()
 
+		go client.writeLoop()
 		go func() {
-			defer close(conn)
+			defer client.close()
 
 			// Read from the connection and write to the monitor send pipe
 			buff := make([]byte, 1024)
 			for {
-				if n, err := conn.Read(buff); err != nil {
+				n, err := conn.Read(buff)
+				if err != nil {
 					// Connection closed from client
 					return
-				} else if written, err := monSendPipeWr.Write(buff[:n]); err != nil {
+				}
+				if s.echo {
+					// The other clients see the data even if the MCU is not
+					// reading it, the buffer is reused by the next read
+					s.broadcast(bytes.Clone(buff[:n]), client)
+				}
+				if written, err := s.monSendPipeWr.Write(buff[:n]); err != nil {
 					return
 				} else {
-					bytesInSendPipe.Add(int64(written))
+					s.bytesInSendPipe.Add(int64(written))
 				}
 			}
 		}()
 	}
 }
 
-func connected(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) connected(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 0 {
 		res(nil, []any{1, "Invalid number of parameters, expected no parameters"})
 		return
 	}
 
-	socketsLock.RLock()
-	connected := len(sockets) > 0
-	socketsLock.RUnlock()
+	s.socketsLock.RLock()
+	connected := len(s.sockets) > 0
+	s.socketsLock.RUnlock()
 
 	res(connected, nil)
 }
 
-func read(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) read(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Invalid number of parameters, expected max bytes to read"})
 		return
@@ -109,22 +189,22 @@ func read(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResp
 		return
 	}
 
-	if bytesInSendPipe.Load() == 0 {
+	if s.bytesInSendPipe.Load() == 0 {
 		res([]byte{}, nil)
 		return
 	}
 
 	buffer := make([]byte, maxBytes)
-	if readed, err := monSendPipeRd.Read(buffer); err != nil {
+	if readed, err := s.monSendPipeRd.Read(buffer); err != nil {
 		slog.Error("Error reading monitor", "error", err)
 		res(nil, []any{3, "Failed to read from connection: " + err.Error()})
 	} else {
-		bytesInSendPipe.Add(int64(-readed))
+		s.bytesInSendPipe.Add(int64(-readed))
 		res(buffer[:readed], nil)
 	}
 }
 
-func write(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) write(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Invalid number of parameters, expected data to write"})
 		return
@@ -140,53 +220,91 @@ func write(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterRes
 		}
 	}
 
-	socketsLock.RLock()
-	clients := make([]net.Conn, 0, len(sockets))
-	for c := range sockets {
-		clients = append(clients, c)
-	}
-	socketsLock.RUnlock()
+	s.broadcast(data, nil)
+	res(len(data), nil)
+}
 
-	for _, conn := range clients {
-		if len(clients) > 1 {
-			// If there are multiple clients, allow 500 ms for the data to
-			// get through each one.
-			_ = conn.SetWriteDeadline(time.Now().Add(time.Millisecond * 500))
-		} else {
-			_ = conn.SetWriteDeadline(time.Time{})
-		}
-		if _, err := conn.Write(data); err != nil {
-			// If we get an error, we assume the connection is lost.
-			slog.Error("Monitor connection lost, closing connection", "error", err)
-			close(conn)
+// broadcast sends data to all the clients except the sender (nil for the
+// data written by the MCU).
+func (s *Service) broadcast(data []byte, sender *monitorClient) {
+	s.socketsLock.RLock()
+	clients := make([]*monitorClient, 0, len(s.sockets))
+	for _, c := range s.sockets {
+		if c != sender {
+			clients = append(clients, c)
 		}
 	}
+	s.socketsLock.RUnlock()
 
-	res(len(data), nil)
+	// The actual write is performed by each client's writer goroutine, so a
+	// slow or stuck client does not delay the response to the MCU.
+	for _, client := range clients {
+		client.enqueue(data)
+	}
 }
 
-func close(conn net.Conn) {
-	socketsLock.Lock()
-	delete(sockets, conn)
-	socketsLock.Unlock()
-	_ = conn.Close()
+// enqueue schedules data to be written to the client. If the client's
+// queue is full the client is considered stuck and is disconnected.
+func (c *monitorClient) enqueue(data []byte) {
+	select {
+	case c.outQueue <- data:
+	case <-c.done:
+	default:
+		slog.Error("Monitor connection write queue full, closing connection", "addr", c.conn.RemoteAddr())
+		c.close()
+	}
 }
 
-func reset(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+// writeLoop sends the queued data to the client until the connection
+// is closed or a write fails.
+func (c *monitorClient) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.outQueue:
+			if _, err := c.conn.Write(data); err != nil {
+				// If we get an error, we assume the connection is lost.
+				slog.Error("Monitor connection lost, closing connection", "error", err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *monitorClient) close() {
+	c.closeOnce.Do(func() {
+		c.service.socketsLock.Lock()
+		if c.service.sockets[c.conn] == c {
+			delete(c.service.sockets, c.conn)
+		}
+		c.service.socketsLock.Unlock()
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+func (s *Service) reset(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 0 {
 		res(nil, []any{1, "Invalid number of parameters, expected no parameters"})
 		return
 	}
 
-	socketsLock.Lock()
-	socketsToClose := sockets
-	sockets = make(map[net.Conn]struct{})
-	socketsLock.Unlock()
-
-	for c := range socketsToClose {
-		_ = c.Close()
-	}
+	s.closeClients()
 
 	slog.Info("Monitor connection reset")
 	res(true, nil)
 }
+
+// closeClients disconnects all the monitor clients.
+func (s *Service) closeClients() {
+	s.socketsLock.Lock()
+	socketsToClose := s.sockets
+	s.sockets = make(map[net.Conn]*monitorClient)
+	s.socketsLock.Unlock()
+
+	for _, c := range socketsToClose {
+		c.close()
+	}
+}
@@ -0,0 +1,215 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package monitorapi
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+// fakeListener is a net.Listener accepting the in-memory connections
+// created with dial.
+type fakeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *fakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7500}
+}
+
+// dial connects a monitor client of s, and waits until it is accepted.
+func (l *fakeListener) dial(t *testing.T, s *Service) net.Conn {
+	clients := s.Stats()["clients"].(int)
+	client, server := net.Pipe()
+	l.conns <- server
+	t.Cleanup(func() { client.Close() })
+	require.Eventually(t, func() bool { return s.Stats()["clients"] == clients+1 }, time.Second, time.Millisecond)
+	return client
+}
+
+func call(handler msgpackrouter.RouterRequestHandler, params ...any) (any, any) {
+	var result, reqErr any
+	handler(nil, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func isConnected(t *testing.T, s *Service) bool {
+	res, reqErr := call(s.connected)
+	require.Nil(t, reqErr)
+	return res.(bool)
+}
+
+func TestMonitor(t *testing.T) {
+	listener := newFakeListener()
+	s := New(Options{Listeners: []net.Listener{listener}})
+	defer s.Close()
+	s.Register(msgpackrouter.New(0))
+
+	require.False(t, isConnected(t, s))
+	res, reqErr := call(s.read, 10)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte{}, res)
+
+	// The data written by the MCU is sent to all the clients
+	client1 := listener.dial(t, s)
+	client2 := listener.dial(t, s)
+	require.Equal(t, 2, s.Stats()["clients"])
+	res, reqErr = call(s.write, "hello")
+	require.Nil(t, reqErr)
+	require.Equal(t, 5, res)
+	for _, client := range []net.Conn{client1, client2} {
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(client, buf)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buf))
+	}
+
+	// The data sent by the clients is read by the MCU
+	_, err := client1.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return s.Stats()["bytes_pending"] == int64(3) }, time.Second, time.Millisecond)
+	res, reqErr = call(s.read, 2)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte("ab"), res)
+	res, reqErr = call(s.read, 10)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte("c"), res)
+	require.Equal(t, int64(0), s.Stats()["bytes_pending"])
+
+	// A disconnected client is forgotten
+	client2.Close()
+	require.Eventually(t, func() bool { return s.Stats()["clients"] == 1 }, time.Second, time.Millisecond)
+
+	// The reset disconnects all the clients
+	res, reqErr = call(s.reset)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	require.False(t, isConnected(t, s))
+	_, err = client1.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestMonitorParams(t *testing.T) {
+	s := New(Options{})
+	_, reqErr := call(s.connected, 1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.read)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.read, "x")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.write, 1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.reset, 1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+}
+
+func TestMonitorEcho(t *testing.T) {
+	listener := newFakeListener()
+	s := New(Options{Listeners: []net.Listener{listener}, Echo: true})
+	defer s.Close()
+	s.Register(msgpackrouter.New(0))
+	client1 := listener.dial(t, s)
+	client2 := listener.dial(t, s)
+
+	// The data sent by a client is read by the MCU and mirrored to the
+	// other clients
+	_, err := client1.Write([]byte("abc"))
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(client2, buf)
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(buf))
+	require.Eventually(t, func() bool { return s.Stats()["bytes_pending"] == int64(3) }, time.Second, time.Millisecond)
+	res, reqErr := call(s.read, 10)
+	require.Nil(t, reqErr)
+	require.Equal(t, []byte("abc"), res)
+
+	// The sender does not get its own data back
+	_, reqErr = call(s.write, "x")
+	require.Nil(t, reqErr)
+	_, err = io.ReadFull(client1, buf[:1])
+	require.NoError(t, err)
+	require.Equal(t, "x", string(buf[:1]))
+}
+
+func TestMonitorClose(t *testing.T) {
+	listener := newFakeListener()
+	s := New(Options{Listeners: []net.Listener{listener}})
+	s.Register(msgpackrouter.New(0))
+	client := listener.dial(t, s)
+
+	// Closing the instance disconnects the clients and stops the listener
+	s.Close()
+	require.Equal(t, 0, s.Stats()["clients"])
+	_, err := client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	_, err = listener.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestMonitorListeners(t *testing.T) {
+	var listeners []net.Listener
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, l)
+	}
+	s := New(Options{Listeners: listeners})
+	defer s.Close()
+	s.Register(msgpackrouter.New(0))
+
+	// The clients are accepted on all the listeners, reported with the
+	// ports chosen by the system
+	addrs := s.Addrs()
+	require.Len(t, addrs, 2)
+	for i, addr := range addrs {
+		require.Equal(t, listeners[i].Addr().String(), addr)
+		client, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer client.Close()
+		require.Eventually(t, func() bool { return s.Stats()["clients"] == i+1 }, time.Second, time.Millisecond)
+	}
+	res, reqErr := call(s.write, "hi")
+	require.Nil(t, reqErr)
+	require.Equal(t, 2, res)
+}
@@ -0,0 +1,230 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package mqtt implements a minimal MQTT 3.1.1 client, used by the cloud
+// session and by the MQTT bridge of the pub/sub topics.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	Connect    = 1
+	ConnAck    = 2
+	Publish    = 3
+	PubAck     = 4
+	Subscribe  = 8
+	SubAck     = 9
+	PingReq    = 12
+	PingResp   = 13
+	Disconnect = 14
+)
+
+// MaxPacketSize is the maximum size of the packets accepted from the peer.
+const MaxPacketSize = 256 * 1024
+
+// Client is a minimal MQTT 3.1.1 client, supporting only QoS 0 publishing,
+// subscriptions and keep-alive.
+type Client struct {
+	conn      net.Conn
+	in        *bufio.Reader
+	writeLock sync.Mutex
+	nextID    uint16
+}
+
+// NewClient returns a Client exchanging packets on conn, without the CONNECT
+// handshake: it is used by Dial, and to implement a broker in the tests.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn, in: bufio.NewReader(conn)}
+}
+
+// Dial sends the CONNECT packet on conn and waits for the broker acceptance.
+// The username is not sent if empty, and the password is sent only with a
+// username, as required by MQTT 3.1.1.
+func Dial(conn net.Conn, clientID, username, password string, keepAlive time.Duration) (*Client, error) {
+	c := NewClient(conn)
+
+	flags := byte(0x02) // clean session
+	if username != "" {
+		flags |= 0x80
+	}
+	if username != "" && password != "" {
+		flags |= 0x40
+	}
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(keepAlive/time.Second))
+	body = appendString(body, clientID)
+	if flags&0x80 != 0 {
+		body = appendString(body, username)
+	}
+	if flags&0x40 != 0 {
+		body = appendString(body, password)
+	}
+	if err := c.WritePacket(Connect<<4, body); err != nil {
+		return nil, err
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	header, ack, err := c.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	if header>>4 != ConnAck || len(ack) != 2 {
+		return nil, errors.New("unexpected response to MQTT connect")
+	}
+	if ack[1] != 0 {
+		return nil, fmt.Errorf("MQTT connection refused (code %d)", ack[1])
+	}
+	return c, nil
+}
+
+// Subscribe subscribes to the topic filter with QoS 0.
+func (c *Client) Subscribe(topic string) error {
+	c.writeLock.Lock()
+	c.nextID++
+	id := c.nextID
+	c.writeLock.Unlock()
+
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = appendString(body, topic)
+	body = append(body, 0)
+	return c.WritePacket(Subscribe<<4|0x02, body)
+}
+
+// Publish publishes the payload on the topic with QoS 0.
+func (c *Client) Publish(topic string, payload []byte) error {
+	body := appendString(nil, topic)
+	body = append(body, payload...)
+	return c.WritePacket(Publish<<4, body)
+}
+
+// Ping sends a keep-alive request.
+func (c *Client) Ping() error {
+	return c.WritePacket(PingReq<<4, nil)
+}
+
+// Close sends the DISCONNECT packet and closes the connection.
+func (c *Client) Close() {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_ = c.WritePacket(Disconnect<<4, nil)
+	c.conn.Close()
+}
+
+// ReadLoop reads the packets from the broker, calling onPublish for each
+// received message, until the connection is closed.
+func (c *Client) ReadLoop(onPublish func(topic string, payload []byte)) error {
+	for {
+		header, body, err := c.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if header>>4 != Publish {
+			// CONNACK, SUBACK and PINGRESP need no handling
+			continue
+		}
+		qos := (header >> 1) & 0x03
+		if len(body) < 2 {
+			return errors.New("invalid MQTT publish packet")
+		}
+		topicLen := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+topicLen {
+			return errors.New("invalid MQTT publish packet")
+		}
+		topic := string(body[2 : 2+topicLen])
+		payload := body[2+topicLen:]
+		if qos > 0 {
+			if len(payload) < 2 {
+				return errors.New("invalid MQTT publish packet")
+			}
+			if err := c.WritePacket(PubAck<<4, payload[:2]); err != nil {
+				return err
+			}
+			payload = payload[2:]
+		}
+		onPublish(topic, payload)
+	}
+}
+
+// WritePacket sends a packet with the given fixed header byte and body.
+func (c *Client) WritePacket(header byte, body []byte) error {
+	packet := []byte{header}
+	// Remaining length, 7 bits per byte
+	n := len(body)
+	for {
+		b := byte(n & 0x7F)
+		n >>= 7
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// ReadPacket reads a packet, returning its fixed header byte and body.
+func (c *Client) ReadPacket() (byte, []byte, error) {
+	header, err := c.in.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for shift := 0; ; shift += 7 {
+		if shift > 21 {
+			return 0, nil, errors.New("invalid MQTT packet length")
+		}
+		b, err := c.in.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > MaxPacketSize {
+		return 0, nil, fmt.Errorf("MQTT packet too large: %d bytes", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.in, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s))) //nolint:gosec
+	return append(b, s...)
+}
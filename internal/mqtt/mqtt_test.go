@@ -0,0 +1,147 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// dialBroker runs Dial against a fake broker on a pipe, the broker checks
+// the CONNECT packet and replies with the given CONNACK return code.
+func dialBroker(t *testing.T, username, password string, expectedConnect []byte, returnCode byte) (*Client, *Client, error) {
+	clientSide, brokerSide := net.Pipe()
+	t.Cleanup(func() {
+		clientSide.Close()
+		brokerSide.Close()
+	})
+	broker := NewClient(brokerSide)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		header, body, err := broker.ReadPacket()
+		require.NoError(t, err)
+		require.Equal(t, byte(Connect<<4), header)
+		require.Equal(t, expectedConnect, body)
+		require.NoError(t, broker.WritePacket(ConnAck<<4, []byte{0, returnCode}))
+	}()
+	client, err := Dial(clientSide, "id", username, password, 60*time.Second)
+	<-done
+	return client, broker, err
+}
+
+func TestDial(t *testing.T) {
+	header := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04}
+
+	// Username and password
+	connect := append(append([]byte{}, header...), 0xC2, 0x00, 0x3C, 0x00, 0x02, 'i', 'd', 0x00, 0x04, 'u', 's', 'e', 'r', 0x00, 0x04, 'p', 'a', 's', 's')
+	_, _, err := dialBroker(t, "user", "pass", connect, 0)
+	require.NoError(t, err)
+
+	// Username only
+	connect = append(append([]byte{}, header...), 0x82, 0x00, 0x3C, 0x00, 0x02, 'i', 'd', 0x00, 0x04, 'u', 's', 'e', 'r')
+	_, _, err = dialBroker(t, "user", "", connect, 0)
+	require.NoError(t, err)
+
+	// A password without username is not sent
+	connect = append(append([]byte{}, header...), 0x02, 0x00, 0x3C, 0x00, 0x02, 'i', 'd')
+	_, _, err = dialBroker(t, "", "pass", connect, 0)
+	require.NoError(t, err)
+
+	// Connection refused by the broker
+	_, _, err = dialBroker(t, "user", "wrong", append(append([]byte{}, header...), 0xC2, 0x00, 0x3C, 0x00, 0x02, 'i', 'd', 0x00, 0x04, 'u', 's', 'e', 'r', 0x00, 0x05, 'w', 'r', 'o', 'n', 'g'), 5)
+	require.EqualError(t, err, "MQTT connection refused (code 5)")
+}
+
+func TestPackets(t *testing.T) {
+	client, broker, err := dialBroker(t, "", "", []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C, 0x00, 0x02, 'i', 'd'}, 0)
+	require.NoError(t, err)
+
+	// The subscriptions use QoS 0 and increasing packet identifiers
+	for id := byte(1); id <= 2; id++ {
+		go func() { require.NoError(t, client.Subscribe("a/b")) }()
+		header, body, err := broker.ReadPacket()
+		require.NoError(t, err)
+		require.Equal(t, byte(Subscribe<<4|0x02), header)
+		require.Equal(t, []byte{0x00, id, 0x00, 0x03, 'a', '/', 'b', 0x00}, body)
+	}
+
+	// The remaining length takes two bytes over 127 bytes
+	payload := bytes.Repeat([]byte{0x55}, 200)
+	go func() { require.NoError(t, client.Publish("t", payload)) }()
+	raw := make([]byte, 3+3+len(payload))
+	_, err = io.ReadFull(broker.in, raw)
+	require.NoError(t, err)
+	require.Equal(t, []byte{Publish << 4, 0xCB, 0x01, 0x00, 0x01, 't'}, raw[:6])
+	require.Equal(t, payload, raw[6:])
+
+	go func() { require.NoError(t, client.Ping()) }()
+	header, body, err := broker.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, byte(PingReq<<4), header)
+	require.Empty(t, body)
+}
+
+func TestReadLoop(t *testing.T) {
+	client, broker, err := dialBroker(t, "", "", []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C, 0x00, 0x02, 'i', 'd'}, 0)
+	require.NoError(t, err)
+
+	type message struct {
+		topic   string
+		payload string
+	}
+	received := make(chan message, 10)
+	loopErr := make(chan error, 1)
+	go func() {
+		loopErr <- client.ReadLoop(func(topic string, payload []byte) {
+			received <- message{topic, string(payload)}
+		})
+	}()
+
+	// The SUBACK and PINGRESP are ignored
+	require.NoError(t, broker.WritePacket(SubAck<<4, []byte{0x00, 0x01, 0x00}))
+	require.NoError(t, broker.WritePacket(PingResp<<4, nil))
+
+	// QoS 0 message
+	require.NoError(t, broker.WritePacket(Publish<<4, []byte{0x00, 0x03, 'a', '/', 'b', 'h', 'i'}))
+	require.Equal(t, message{"a/b", "hi"}, <-received)
+
+	// QoS 1 message, acknowledged with its packet identifier
+	require.NoError(t, broker.WritePacket(Publish<<4|0x02, []byte{0x00, 0x01, 'c', 0x12, 0x34, 'o', 'k'}))
+	header, body, err := broker.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, byte(PubAck<<4), header)
+	require.Equal(t, []byte{0x12, 0x34}, body)
+	require.Equal(t, message{"c", "ok"}, <-received)
+
+	// A truncated topic ends the loop
+	require.NoError(t, broker.WritePacket(Publish<<4, []byte{0x00, 0x05, 'a'}))
+	require.EqualError(t, <-loopErr, "invalid MQTT publish packet")
+}
+
+func TestReadPacketTooLarge(t *testing.T) {
+	clientSide, brokerSide := net.Pipe()
+	defer clientSide.Close()
+	defer brokerSide.Close()
+	go func() { _, _ = brokerSide.Write([]byte{Publish << 4, 0xFF, 0xFF, 0x7F}) }()
+	_, _, err := NewClient(clientSide).ReadPacket()
+	require.ErrorContains(t, err, "MQTT packet too large")
+}
@@ -0,0 +1,55 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import "strings"
+
+// ACL is a list of patterns of the methods that a client is allowed to call.
+// A pattern ending with "*" matches all the methods starting with the given
+// prefix (for example "tcp/*"), otherwise the method must match exactly.
+// A pattern starting with "!" denies the matching methods: a method is
+// allowed if it matches no deny pattern and, when the ACL has allow patterns,
+// at least one of them. A nil ACL allows all the methods, an empty ACL
+// allows none.
+type ACL []string
+
+// Allows returns true if the ACL allows calling the given method.
+func (a ACL) Allows(method string) bool {
+	if a == nil {
+		return true
+	}
+	allowed, hasAllowPatterns := false, false
+	for _, pattern := range a {
+		if deny, ok := strings.CutPrefix(pattern, "!"); ok {
+			if matchMethod(deny, method) {
+				return false
+			}
+			continue
+		}
+		hasAllowPatterns = true
+		if matchMethod(pattern, method) {
+			allowed = true
+		}
+	}
+	return allowed || (!hasAllowPatterns && len(a) > 0)
+}
+
+func matchMethod(pattern, method string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(method, prefix)
+	}
+	return method == pattern
+}
@@ -0,0 +1,171 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// maxCacheEntries is the maximum number of cached responses, the responses
+// exceeding it are not cached until the oldest entries expire.
+const maxCacheEntries = 1024
+
+// maxCoalescedWait is the time after which a request in flight is considered
+// lost (for example because its provider disconnected), and the identical
+// requests are forwarded again instead of waiting for its response.
+const maxCoalescedWait = 30 * time.Second
+
+// responseCache holds the results of the requests of the cacheable methods,
+// by method and encoded params.
+type responseCache struct {
+	lock    sync.Mutex
+	ttls    map[string]time.Duration // pattern -> TTL
+	entries map[string]cacheEntry
+	// inFlight are the requests forwarded and not answered yet, by method
+	// and encoded params.
+	inFlight map[string]*flight
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+type cacheEntry struct {
+	result  any
+	expires time.Time
+}
+
+// flight is a request forwarded and not answered yet, with the identical
+// requests waiting for its response.
+type flight struct {
+	start   time.Time
+	waiting []RouterResponseHandler
+}
+
+// SetCacheTTL sets the time the successful responses of the methods matching
+// the given pattern (with the syntax of the ACL patterns, for example
+// "sys/timezone" or "weather/*") are cached, 0 disables the caching. The repeated
+// requests with the same params are answered by the router from the cache,
+// for all the callers, so only the methods whose result depends on the
+// params alone should be cached. When several patterns match a method the
+// most specific one is used.
+func (r *Router) SetCacheTTL(pattern string, ttl time.Duration) {
+	r.cache.lock.Lock()
+	defer r.cache.lock.Unlock()
+	if ttl > 0 {
+		r.cache.ttls[pattern] = ttl
+	} else {
+		delete(r.cache.ttls, pattern)
+	}
+	// The cached responses of the pattern may have a different TTL now
+	clear(r.cache.entries)
+}
+
+// cacheTTL returns the time the responses of the method are cached, 0 if
+// they are not cached. It must be called with the lock held.
+func (c *responseCache) cacheTTL(method string) time.Duration {
+	if ttl, ok := c.ttls[method]; ok {
+		return ttl
+	}
+	var ttl time.Duration
+	longest := -1
+	for pattern, t := range c.ttls {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(method, prefix) && len(prefix) > longest {
+			ttl, longest = t, len(prefix)
+		}
+	}
+	return ttl
+}
+
+// lookup answers the request of a cacheable method with the cached result,
+// or makes it wait for the response of the identical request in flight, and
+// returns true. Otherwise it returns the response handler that caches the
+// successful response and passes it to the waiting requests, or res itself
+// if the method is not cacheable. The response handlers of the waiting
+// requests are wrapped with queue, so that they are written to the callers
+// without blocking the callee.
+func (c *responseCache) lookup(method string, params msgpackrpc.RawMessage, res RouterResponseHandler, queue func(RouterResponseHandler) RouterResponseHandler) (RouterResponseHandler, bool) {
+	c.lock.Lock()
+	if len(c.ttls) == 0 {
+		c.lock.Unlock()
+		return res, false
+	}
+	ttl := c.cacheTTL(method)
+	if ttl == 0 {
+		c.lock.Unlock()
+		return res, false
+	}
+	key := method + "\x00" + string(params)
+	if e, ok := c.entries[key]; ok && time.Now().Before(e.expires) {
+		c.lock.Unlock()
+		c.hits.Add(1)
+		res(e.result, nil)
+		return nil, true
+	}
+	if f, ok := c.inFlight[key]; ok && time.Since(f.start) < maxCoalescedWait {
+		f.waiting = append(f.waiting, queue(res))
+		c.lock.Unlock()
+		c.coalesced.Add(1)
+		return nil, true
+	}
+	f := &flight{start: time.Now()}
+	c.inFlight[key] = f
+	c.lock.Unlock()
+	c.misses.Add(1)
+	return func(result any, err any) {
+		// The raw results are backed by the read buffer of the connection
+		if raw, ok := result.(msgpackrpc.RawMessage); ok {
+			result = msgpackrpc.RawMessage(slices.Clone(raw))
+		}
+		c.lock.Lock()
+		if c.inFlight[key] == f {
+			delete(c.inFlight, key)
+		}
+		waiting := f.waiting
+		f.waiting = nil
+		if err == nil {
+			c.store(key, result, time.Now().Add(ttl))
+		}
+		c.lock.Unlock()
+		res(result, err)
+		for _, w := range waiting {
+			w(result, err)
+		}
+	}, false
+}
+
+// store caches the result of a request until expires. It must be called
+// with the lock held.
+func (c *responseCache) store(key string, result any, expires time.Time) {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = cacheEntry{result: result, expires: expires}
+}
@@ -0,0 +1,57 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import "log/slog"
+
+// SetDrainExempt sets the patterns (with the syntax of the ACL patterns) of
+// the methods still accepted while draining, for example the methods of the
+// router itself. It must be called before accepting the connections.
+func (r *Router) SetDrainExempt(patterns []string) {
+	r.drainExempt = ACL(patterns)
+}
+
+// SetDraining starts (or stops) the drain mode: the new requests fail with
+// ErrCodeDraining, except those of the exempted methods, while the requests
+// in flight are completed. The notifications are still routed.
+func (r *Router) SetDraining(draining bool) {
+	r.draining.Store(draining)
+	if draining {
+		slog.Warn("Draining, new requests are rejected", "in_flight", r.inFlight.Load())
+	} else {
+		slog.Info("Drain ended, accepting new requests")
+	}
+}
+
+// Draining returns true if the router is in drain mode.
+func (r *Router) Draining() bool {
+	return r.draining.Load()
+}
+
+// InFlight returns the number of requests being handled, not counting those
+// of the methods exempted from the drain.
+func (r *Router) InFlight() int64 {
+	return r.inFlight.Load()
+}
+
+// admitRequest checks the drain mode for a new request: it returns false if
+// the request must be rejected, and whether it is counted as in flight.
+func (r *Router) admitRequest(method string) (admitted bool, counted bool) {
+	if len(r.drainExempt) > 0 && r.drainExempt.Allows(method) {
+		return true, false
+	}
+	return !r.draining.Load(), true
+}
@@ -0,0 +1,93 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// ErrorLimit limits the rate of the errors caused by a client: invalid
+// params, unknown or not allowed methods and authentication failures.
+type ErrorLimit struct {
+	// MaxErrors is the number of errors allowed in each Window.
+	MaxErrors int
+	Window    time.Duration
+	// Disconnect closes the connection of a client exceeding the limit,
+	// otherwise its requests fail with ErrCodeTooManyErrors (and its
+	// notifications are dropped) for a Window.
+	Disconnect bool
+}
+
+// limitedErrorCodes are the codes of the errors counted by the ErrorLimit.
+var limitedErrorCodes = map[int]bool{
+	ErrCodeInvalidParams:      true,
+	ErrCodeMethodNotAvailable: true,
+	ErrCodeMethodNotAllowed:   true,
+	ErrCodeNotAuthenticated:   true,
+}
+
+// errorCounter counts the errors of a connection in the current window.
+type errorCounter struct {
+	limit *ErrorLimit
+
+	lock         sync.Mutex
+	windowStart  time.Time
+	count        int
+	blockedUntil time.Time
+}
+
+// record counts the error of a response sent to the client, and returns
+// true if the client has just exceeded the limit.
+func (c *errorCounter) record(err any) bool {
+	if c.limit == nil || !isLimitedError(err) {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if now.Sub(c.windowStart) > c.limit.Window {
+		c.windowStart = now
+		c.count = 0
+	}
+	c.count++
+	if c.count != c.limit.MaxErrors+1 {
+		return false
+	}
+	c.blockedUntil = now.Add(c.limit.Window)
+	return true
+}
+
+// blocked returns true if the client exceeded the limit in the last window.
+func (c *errorCounter) blocked() bool {
+	if c.limit == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Now().Before(c.blockedUntil)
+}
+
+func isLimitedError(err any) bool {
+	e, ok := err.([]any)
+	if !ok || len(e) == 0 {
+		return false
+	}
+	code, ok := msgpackrpc.ToInt(e[0])
+	return ok && limitedErrorCodes[code]
+}
@@ -24,6 +24,15 @@ const (
 	ErrCodeFailedToSendRequests = 3
 	ErrCodeGenericError         = 4
 	ErrCodeRouteAlreadyExists   = 5
+	ErrCodeMethodNotAllowed     = 6
+	ErrCodeNotAuthenticated     = 7
+	ErrCodeMessageTooLarge      = 8
+	ErrCodeModuleDisabled       = 9
+	ErrCodeServiceStarting      = 10
+	ErrCodeTooManyErrors        = 11
+	ErrCodeDraining             = 12
+	ErrCodeSessionNotFound      = 13
+	ErrCodeRequestExpired       = 14
 )
 
 type RouteError struct {
@@ -46,6 +55,20 @@ func newRouteAlreadyExistsError(route string) *RouteError {
 	}
 }
 
+func newRouteReservedError(route string, service string) *RouteError {
+	return &RouteError{
+		message: fmt.Sprintf("route reserved by service %s: %s", service, route),
+		code:    ErrCodeRouteAlreadyExists,
+	}
+}
+
+func newModuleDisabledError(method string) *RouteError {
+	return &RouteError{
+		message: fmt.Sprintf("method %s belongs to a disabled module", method),
+		code:    ErrCodeModuleDisabled,
+	}
+}
+
 func routerError(code int8, message string) []any {
 	return []any{code, message}
 }
@@ -13,28 +13,12 @@
 // Arduino software without disclosing the source code of your own applications.
 // To purchase a commercial license, send an email to license@arduino.cc.
 
-package main
+package msgpackrouter
 
-import (
-	"log"
-	"os"
-
-	"github.com/arduino/go-paths-helper"
-	"github.com/davecgh/go-spew/spew"
-	"github.com/vmihailenco/msgpack/v5"
-)
-
-func main() {
-	f, err := paths.New(os.Args[1]).Open()
-	if err != nil {
-		log.Fatal(err)
-	}
-	d := msgpack.NewDecoder(f)
-	for {
-		if v, err := d.DecodeInterface(); err != nil {
-			log.Fatal(err)
-		} else {
-			spew.Dump(v)
-		}
-	}
+// SetFaultRandom replaces the random source of the corrupted bytes, it
+// returns a function restoring the original one.
+func SetFaultRandom(f func(n int) int) (restore func()) {
+	orig := randIntN
+	randIntN = f
+	return func() { randIntN = orig }
 }
@@ -0,0 +1,157 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// FaultRule describes the faults injected in the forwarded messages, used to
+// test the robustness of the clients against a degraded link. Faults are
+// never injected in the messages handled by the router itself.
+type FaultRule struct {
+	// Method is the pattern of the affected methods, with the syntax of the
+	// ACL patterns (for example "tcp/*"), empty to match all the methods.
+	Method string
+	// Transport selects the messages sent or received by the connections
+	// with the given transport (for example "serial"), empty to match all
+	// the connections.
+	Transport string
+	// Latency is the delay added before forwarding the message, plus a
+	// random delay up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Drop is the probability (0 to 1) that the message is discarded: the
+	// caller of a dropped request gets no response, unless it cancels it.
+	Drop float64
+	// Corrupt is the probability (0 to 1) that a random byte of the params
+	// is altered before forwarding the message. The header of the params
+	// array is never altered, so that the message is still forwarded.
+	Corrupt float64
+}
+
+// faultStats are the counters of the injected faults.
+type faultStats struct {
+	delayed   atomic.Uint64
+	dropped   atomic.Uint64
+	corrupted atomic.Uint64
+}
+
+// SetFaults replaces the rules of the faults injected in the forwarded
+// messages, the first rule matching a message is applied. No rules disable
+// the fault injection.
+func (r *Router) SetFaults(rules []FaultRule) {
+	if len(rules) == 0 {
+		r.faults.Store(nil)
+		return
+	}
+	slog.Warn("Fault injection enabled", "rules", len(rules))
+	rules = append([]FaultRule(nil), rules...)
+	r.faults.Store(&rules)
+}
+
+// faultFor returns the fault rule matching a message forwarded from caller
+// to callee, or nil if no faults must be injected.
+func (r *Router) faultFor(method string, caller, callee *msgpackrpc.Connection) *FaultRule {
+	rules := r.faults.Load()
+	if rules == nil {
+		return nil
+	}
+	var callerTransport, calleeTransport string
+	for i := range *rules {
+		rule := &(*rules)[i]
+		if rule.Method != "" && !matchMethod(rule.Method, method) {
+			continue
+		}
+		if rule.Transport != "" {
+			if callerTransport == "" && calleeTransport == "" {
+				callerInfo, _ := r.ConnectionInfo(caller)
+				calleeInfo, _ := r.ConnectionInfo(callee)
+				callerTransport, calleeTransport = callerInfo.Transport, calleeInfo.Transport
+			}
+			if rule.Transport != callerTransport && rule.Transport != calleeTransport {
+				continue
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+// injectFault applies the rule to a message: it waits for the latency (or
+// until ctx is done) and returns the params to forward, possibly corrupted,
+// or false if the message must be dropped.
+func (r *Router) injectFault(ctx context.Context, rule *FaultRule, method string, rawParams msgpackrpc.RawMessage) (msgpackrpc.RawMessage, bool) {
+	if delay := rule.Latency + randomDuration(rule.Jitter); delay > 0 {
+		r.faultStats.delayed.Add(1)
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, false
+		}
+	}
+	if rule.Drop > 0 && rand.Float64() < rule.Drop {
+		r.faultStats.dropped.Add(1)
+		slog.Debug("Fault injection: message dropped", "method", method)
+		return nil, false
+	}
+	header := arrayHeaderLen(rawParams)
+	if rule.Corrupt > 0 && len(rawParams) > header && rand.Float64() < rule.Corrupt {
+		r.faultStats.corrupted.Add(1)
+		slog.Debug("Fault injection: params corrupted", "method", method)
+		corrupted := append(msgpackrpc.RawMessage(nil), rawParams...)
+		corrupted[header+randIntN(len(corrupted)-header)] ^= byte(1 + randIntN(255))
+		return corrupted, true
+	}
+	return rawParams, true
+}
+
+// randIntN returns a random number in [0, n), it is replaced by the tests to
+// corrupt a known byte.
+var randIntN = rand.IntN
+
+// arrayHeaderLen returns the length of the header of the MessagePack array
+// at the beginning of data, or 0 if data does not start with an array.
+func arrayHeaderLen(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	switch {
+	case data[0]&0xF0 == 0x90:
+		return 1
+	case data[0] == 0xDC:
+		return 3
+	case data[0] == 0xDD:
+		return 5
+	}
+	return 0
+}
+
+// randomDuration returns a random duration in [0, max).
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
@@ -0,0 +1,51 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import "github.com/arduino/arduino-router/msgpackrpc"
+
+// RequestObserver is called when the router receives a request from an
+// authenticated client, with the name of the caller (as in the tap events).
+// It returns the function called with the response of the request, or nil
+// to ignore the request. It must not block.
+type RequestObserver func(method string, params msgpackrpc.RawMessage, caller string) func(result, err any)
+
+// SetRequestObserver sets the observer of the requests received by the
+// router, nil to remove it.
+func (r *Router) SetRequestObserver(observer RequestObserver) {
+	if observer == nil {
+		r.requestObserver.Store(nil)
+		return
+	}
+	r.requestObserver.Store(&observer)
+}
+
+// observeRequest returns the response handler that passes the response to
+// the observer of the requests, if any.
+func (r *Router) observeRequest(method string, params msgpackrpc.RawMessage, caller *msgpackrpc.Connection, res RouterResponseHandler) RouterResponseHandler {
+	observer := r.requestObserver.Load()
+	if observer == nil {
+		return res
+	}
+	done := (*observer)(method, params, r.connectionName(caller))
+	if done == nil {
+		return res
+	}
+	return func(result any, err any) {
+		done(result, err)
+		res(result, err)
+	}
+}
@@ -0,0 +1,65 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+// maxQueuedResponses is the number of responses waiting to be written to a
+// caller, when the queue is full the callee waits for the caller.
+const maxQueuedResponses = 256
+
+// responseQueue writes the responses of the forwarded requests to a caller,
+// in order, from its own goroutine: the connection of the callee, that
+// receives the responses, is not blocked while they are written to a slow
+// caller, and the responses for the other callers are not delayed.
+type responseQueue struct {
+	responses chan func()
+	done      chan struct{}
+}
+
+func newResponseQueue() *responseQueue {
+	q := &responseQueue{
+		responses: make(chan func(), maxQueuedResponses),
+		done:      make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *responseQueue) run() {
+	for {
+		select {
+		case send := <-q.responses:
+			send()
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// wrap returns a response handler that queues the call to res.
+func (q *responseQueue) wrap(res RouterResponseHandler) RouterResponseHandler {
+	return func(result any, err any) {
+		select {
+		case q.responses <- func() { res(result, err) }:
+		case <-q.done:
+			// The caller is gone, the response is dropped
+		}
+	}
+}
+
+// close stops the queue, the pending responses are dropped.
+func (q *responseQueue) close() {
+	close(q.done)
+}
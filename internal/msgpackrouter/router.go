@@ -16,45 +16,509 @@
 package msgpackrouter
 
 import (
+	"cmp"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"maps"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/arduino/arduino-router/internal/tracing"
 	"github.com/arduino/arduino-router/msgpackrpc"
 )
 
 type RouterRequestHandler func(rpc *msgpackrpc.Connection, params []any, res RouterResponseHandler)
 
+// RouterRequestHandlerWithContext is a RouterRequestHandler that also gets
+// the context of the request, canceled when the caller cancels the request
+// or disconnects. Handlers that block should return as soon as possible when
+// the context is canceled.
+type RouterRequestHandlerWithContext func(ctx context.Context, rpc *msgpackrpc.Connection, params []any, res RouterResponseHandler)
+
 type RouterResponseHandler func(result any, err any)
 
 type Router struct {
-	routesLock     sync.Mutex
-	routes         map[string]*msgpackrpc.Connection
-	routesInternal map[string]RouterRequestHandler
-	sendMaxWorkers int
+	routesLock        sync.Mutex
+	routes            map[string]*msgpackrpc.Connection
+	routesInternal    map[string]RouterRequestHandlerWithContext
+	reserved          map[string]string // method -> service
+	perConnMaxWorkers int
+
+	concurrentRequests atomic.Bool
+
+	// restoredMethods are the methods registered on behalf of the next
+	// connection with the given transport and address (see RestoreMethods),
+	// restoredRoutes are the routes registered this way.
+	restoredMethods map[[2]string][]string
+	restoredRoutes  map[string]bool
+
+	connectionsLock sync.Mutex
+	connections     map[*msgpackrpc.Connection]ConnectionInfo
+
+	rolesLock sync.RWMutex
+	roles     map[string]ACL
+
+	sizeLimitsLock sync.RWMutex
+	sizeLimits     map[string]int
+
+	// slowRequestThreshold is the round trip time (in nanoseconds) over
+	// which a forwarded request is logged as slow, 0 disables the check.
+	slowRequestThreshold atomic.Int64
+	slowRequests         atomic.Uint64
+
+	// requestCeiling is the time (in nanoseconds) after which a forwarded
+	// request still waiting for its response is expired by the watchdog,
+	// 0 disables the watchdog.
+	requestCeiling  atomic.Int64
+	watchdogRunning atomic.Bool
+	requestsExpired atomic.Uint64
+
+	closeHandlersLock sync.Mutex
+	closeHandlers     []func(*msgpackrpc.Connection)
+	resumeHandlers    []func(from, to *msgpackrpc.Connection)
+
+	// sessions are the sessions started by the clients, by token and by
+	// connection (the last one of the client, while suspended).
+	sessionsLock    sync.Mutex
+	sessions        map[string]*session
+	connSessions    map[*msgpackrpc.Connection]*session
+	sessionGrace    atomic.Int64
+	sessionsResumed atomic.Uint64
+	sessionsExpired atomic.Uint64
+
+	tapsLock  sync.Mutex
+	taps      map[*msgpackrpc.Connection]*tap
+	tapCount  atomic.Int32
+	tapLastID atomic.Uint64
+
+	faults     atomic.Pointer[[]FaultRule]
+	faultStats faultStats
+
+	connectionWrapper func(conn io.ReadWriteCloser, info ConnectionInfo) io.ReadWriteCloser
+	disabledMethods   ACL
+
+	upstream          atomic.Pointer[msgpackrpc.Connection]
+	upstreamForwarded atomic.Uint64
+
+	errorLimited atomic.Uint64
+
+	draining    atomic.Bool
+	drainExempt ACL
+	inFlight    atomic.Int64
+
+	requestObserver atomic.Pointer[RequestObserver]
+
+	cache responseCache
+}
+
+// ConnectionInfo holds the metadata of a client connection.
+type ConnectionInfo struct {
+	// Transport is the kind of link used by the client ("tcp", "unix", "serial"...).
+	Transport  string
+	RemoteAddr string
+	// PeerCredentials are the credentials of the process connected to a
+	// Unix socket, or nil if not available.
+	PeerCredentials *PeerCredentials
+	// ACL restricts the methods that the client is allowed to call, a nil
+	// ACL allows all the methods.
+	ACL ACL
+	// Authenticator, if not nil, requires the client to authenticate with
+	// $/auth before calling any other method.
+	Authenticator Authenticator
+	// Identity is the identity of the authenticated client.
+	Identity string
+	// Role is the role of the client, that gates the methods the client
+	// is allowed to call (see Router.SetRole). An empty role has no
+	// restrictions.
+	Role string
+	// ErrorLimit, if not nil, limits the rate of the errors caused by the
+	// client.
+	ErrorLimit *ErrorLimit
+	// Prefix is prepended to the methods registered by the client, and
+	// removed from the method of the requests forwarded to it, to expose
+	// several boards with the same methods under different namespaces
+	// (for example "board1/").
+	Prefix string
+
+	authenticated bool
+}
+
+// Authenticated returns true if the client does not need to authenticate,
+// or if it has already authenticated.
+func (i ConnectionInfo) Authenticated() bool {
+	return i.Authenticator == nil || i.authenticated
+}
+
+// Authenticator validates the token sent by a client with $/auth and
+// returns the identity of the client, and its role if it overrides the role
+// of the connection.
+type Authenticator func(token string) (identity string, role string, err error)
+
+// Built-in roles
+const (
+	// RoleMCU is the role of the microcontroller connected to the serial port.
+	RoleMCU = "mcu"
+	// RoleLocalService is the role of the services running on the same host.
+	RoleLocalService = "local-service"
+	// RoleRemote is the role of the clients connected from the network.
+	RoleRemote = "remote"
+)
+
+// PeerCredentials are the credentials of a process connected to a Unix socket.
+type PeerCredentials struct {
+	PID int
+	UID int
+	GID int
 }
 
+// New creates a Router. The requests of each client connection are handled
+// in order, or by at most perConnMaxWorkers concurrent handlers (0 =
+// unlimited) if enabled with SetConcurrentRequests.
 func New(perConnMaxWorkers int) *Router {
 	return &Router{
-		routes:         make(map[string]*msgpackrpc.Connection),
-		routesInternal: make(map[string]RouterRequestHandler),
-		sendMaxWorkers: perConnMaxWorkers,
+		routes:            make(map[string]*msgpackrpc.Connection),
+		routesInternal:    make(map[string]RouterRequestHandlerWithContext),
+		reserved:          make(map[string]string),
+		perConnMaxWorkers: perConnMaxWorkers,
+		restoredMethods:   make(map[[2]string][]string),
+		restoredRoutes:    make(map[string]bool),
+		connections:       make(map[*msgpackrpc.Connection]ConnectionInfo),
+		roles:             make(map[string]ACL),
+		sizeLimits:        make(map[string]int),
+		cache: responseCache{
+			ttls:     make(map[string]time.Duration),
+			entries:  make(map[string]cacheEntry),
+			inFlight: make(map[string]*flight),
+		},
+		taps:         make(map[*msgpackrpc.Connection]*tap),
+		sessions:     make(map[string]*session),
+		connSessions: make(map[*msgpackrpc.Connection]*session),
 	}
 }
 
 func (r *Router) Accept(conn io.ReadWriteCloser) <-chan struct{} {
+	_, res := r.AcceptConnection(conn)
+	return res
+}
+
+// AcceptConnection works like Accept, and it also returns the MessagePack-RPC
+// connection created to handle conn.
+func (r *Router) AcceptConnection(conn io.ReadWriteCloser) (*msgpackrpc.Connection, <-chan struct{}) {
+	return r.AcceptConnectionWithInfo(conn, ConnectionInfo{})
+}
+
+// AcceptConnectionWithInfo works like AcceptConnection, and it also attaches
+// the given metadata to the connection.
+func (r *Router) AcceptConnectionWithInfo(conn io.ReadWriteCloser, info ConnectionInfo) (*msgpackrpc.Connection, <-chan struct{}) {
+	if r.connectionWrapper != nil {
+		conn = r.connectionWrapper(conn, info)
+	}
+	msgpackconn, responses := r.newConnection(conn, info)
+	r.connectionsLock.Lock()
+	r.connections[msgpackconn] = info
+	r.connectionsLock.Unlock()
+	r.registerRestoredMethods(msgpackconn, info)
+
 	res := make(chan struct{})
 	go func() {
-		r.connectionLoop(conn)
+		suspended := r.connectionLoop(conn, msgpackconn)
+		responses.close()
+		r.setTap(msgpackconn, false)
+		if !suspended {
+			// The resources of a suspended session are released when it
+			// expires
+			r.runCloseHandlers(msgpackconn)
+		}
+		r.connectionsLock.Lock()
+		delete(r.connections, msgpackconn)
+		r.connectionsLock.Unlock()
 		close(res)
 	}()
-	return res
+	return msgpackconn, res
+}
+
+// runCloseHandlers calls the handlers added with OnConnectionClosed.
+func (r *Router) runCloseHandlers(conn *msgpackrpc.Connection) {
+	r.closeHandlersLock.Lock()
+	closeHandlers := slices.Clone(r.closeHandlers)
+	r.closeHandlersLock.Unlock()
+	for _, handler := range closeHandlers {
+		handler(conn)
+	}
+}
+
+// SetConnectionWrapper sets a function that wraps the streams of the
+// connections accepted afterwards, for example to record the traffic. It must
+// be called before accepting the connections.
+func (r *Router) SetConnectionWrapper(wrapper func(conn io.ReadWriteCloser, info ConnectionInfo) io.ReadWriteCloser) {
+	r.connectionWrapper = wrapper
+}
+
+// SetDisabledMethods sets the patterns (with the syntax of the ACL patterns)
+// of the methods of the disabled modules: calling them, or registering them,
+// fails with the ErrCodeModuleDisabled error. It must be called before
+// accepting the connections.
+func (r *Router) SetDisabledMethods(patterns []string) {
+	r.disabledMethods = ACL(patterns)
+}
+
+// methodDisabled returns true if the method belongs to a disabled module.
+func (r *Router) methodDisabled(method string) bool {
+	return len(r.disabledMethods) > 0 && r.disabledMethods.Allows(method)
+}
+
+// OnConnectionClosed adds a handler called when a client connection is
+// closed, to release the resources owned by the client.
+func (r *Router) OnConnectionClosed(handler func(conn *msgpackrpc.Connection)) {
+	r.closeHandlersLock.Lock()
+	r.closeHandlers = append(r.closeHandlers, handler)
+	r.closeHandlersLock.Unlock()
+}
+
+// ConnectionInfo returns the metadata of the given connection, the boolean
+// is false if the connection is not handled by the router.
+func (r *Router) ConnectionInfo(conn *msgpackrpc.Connection) (ConnectionInfo, bool) {
+	r.connectionsLock.Lock()
+	defer r.connectionsLock.Unlock()
+	info, ok := r.connections[conn]
+	return info, ok
+}
+
+// Connections returns the metadata of the connected clients.
+func (r *Router) Connections() map[*msgpackrpc.Connection]ConnectionInfo {
+	r.connectionsLock.Lock()
+	defer r.connectionsLock.Unlock()
+	return maps.Clone(r.connections)
+}
+
+// SetRole sets the ACL gating the methods that the clients with the given
+// role are allowed to call.
+func (r *Router) SetRole(role string, acl ACL) {
+	r.rolesLock.Lock()
+	defer r.rolesLock.Unlock()
+	r.roles[role] = acl
+}
+
+// roleAllows returns true if the role allows calling the given method,
+// unknown roles are not allowed to call any method.
+func (r *Router) roleAllows(role string, method string) bool {
+	if role == "" {
+		return true
+	}
+	r.rolesLock.RLock()
+	defer r.rolesLock.RUnlock()
+	acl, ok := r.roles[role]
+	return ok && acl.Allows(method)
+}
+
+// SetSizeLimit sets the maximum size in bytes of the encoded params and
+// result of the methods matching the given pattern (with the syntax of the
+// ACL patterns, for example "mon/write" or "fs/*"), 0 removes the limit.
+// When several patterns match a method the most specific one is used.
+func (r *Router) SetSizeLimit(pattern string, size int) {
+	r.sizeLimitsLock.Lock()
+	defer r.sizeLimitsLock.Unlock()
+	if size > 0 {
+		r.sizeLimits[pattern] = size
+	} else {
+		delete(r.sizeLimits, pattern)
+	}
+}
+
+// sizeLimit returns the size limit of the params and result of the given
+// method, 0 if not limited.
+func (r *Router) sizeLimit(method string) int {
+	r.sizeLimitsLock.RLock()
+	defer r.sizeLimitsLock.RUnlock()
+	if size, ok := r.sizeLimits[method]; ok {
+		return size
+	}
+	limit, longest := 0, -1
+	for pattern, size := range r.sizeLimits {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(method, prefix) && len(prefix) > longest {
+			limit, longest = size, len(prefix)
+		}
+	}
+	return limit
+}
+
+func (r *Router) setIdentity(conn *msgpackrpc.Connection, identity string, role string) {
+	r.connectionsLock.Lock()
+	defer r.connectionsLock.Unlock()
+	if info, ok := r.connections[conn]; ok {
+		info.Identity = identity
+		if role != "" {
+			info.Role = role
+		}
+		info.authenticated = true
+		r.connections[conn] = info
+	}
+}
+
+// Stats returns a snapshot of the state of the router: the connected
+// clients, the registered methods and the counters of the active connections.
+func (r *Router) Stats() map[string]any {
+	r.connectionsLock.Lock()
+	conns := make([]*msgpackrpc.Connection, 0, len(r.connections))
+	byTransport := map[string]int{}
+	for conn, info := range r.connections {
+		conns = append(conns, conn)
+		byTransport[cmp.Or(info.Transport, "other")]++
+	}
+	r.connectionsLock.Unlock()
+
+	var total msgpackrpc.ConnectionStats
+	for _, conn := range conns {
+		s := conn.Stats()
+		total.FramesIn += s.FramesIn
+		total.FramesOut += s.FramesOut
+		total.DecodeErrors += s.DecodeErrors
+		total.PendingRequests += s.PendingRequests
+	}
+
+	r.routesLock.Lock()
+	routes := len(r.routes)
+	internalMethods := len(r.routesInternal)
+	r.routesLock.Unlock()
+
+	return map[string]any{
+		"connections":              len(conns),
+		"connections_by_transport": byTransport,
+		"routes":                   routes,
+		"internal_methods":         internalMethods,
+		"pending_requests":         total.PendingRequests,
+		"frames_in":                total.FramesIn,
+		"frames_out":               total.FramesOut,
+		"decode_errors":            total.DecodeErrors,
+		"slow_requests":            r.slowRequests.Load(),
+		"upstream_forwarded":       r.upstreamForwarded.Load(),
+		"error_limited":            r.errorLimited.Load(),
+		"draining":                 r.Draining(),
+		"in_flight":                r.inFlight.Load(),
+		"cache_hits":               r.cache.hits.Load(),
+		"cache_misses":             r.cache.misses.Load(),
+		"cache_coalesced":          r.cache.coalesced.Load(),
+		"faults_delayed":           r.faultStats.delayed.Load(),
+		"faults_dropped":           r.faultStats.dropped.Load(),
+		"faults_corrupted":         r.faultStats.corrupted.Load(),
+		"sessions_resumed":         r.sessionsResumed.Load(),
+		"sessions_expired":         r.sessionsExpired.Load(),
+		"requests_expired":         r.requestsExpired.Load(),
+	}
+}
+
+// SetConcurrentRequests enables the concurrent handling of the requests of
+// each client connection accepted afterwards, that may then complete out of
+// order (see msgpackrpc.Connection.SetMaxWorkers). By default the requests
+// of a connection are handled one at a time, in order.
+func (r *Router) SetConcurrentRequests(enable bool) {
+	r.concurrentRequests.Store(enable)
+}
+
+// SetSlowRequestThreshold sets the round trip time over which a forwarded
+// request is logged as slow and counted in the "slow_requests" statistic.
+// A zero threshold disables the check.
+func (r *Router) SetSlowRequestThreshold(threshold time.Duration) {
+	r.slowRequestThreshold.Store(int64(threshold))
+}
+
+func (r *Router) logSlowRequest(caller, callee *msgpackrpc.Connection, method string, size int, elapsed time.Duration) {
+	r.slowRequests.Add(1)
+	callerInfo, _ := r.ConnectionInfo(caller)
+	calleeInfo, _ := r.ConnectionInfo(callee)
+	slog.Warn("Slow request",
+		"method", method,
+		"duration", elapsed,
+		"caller_transport", callerInfo.Transport,
+		"caller_addr", callerInfo.RemoteAddr,
+		"caller_identity", callerInfo.Identity,
+		"callee_transport", calleeInfo.Transport,
+		"callee_addr", calleeInfo.RemoteAddr,
+		"params_size", size)
+}
+
+// SetRequestCeiling sets the time after which a request still waiting for
+// the response of a client is completed with ErrCodeRequestExpired, so that
+// the requests never answered don't pile up. The expired requests are
+// counted in the "requests_expired" statistic. A zero ceiling disables the
+// check.
+func (r *Router) SetRequestCeiling(ceiling time.Duration) {
+	r.requestCeiling.Store(int64(ceiling))
+	if ceiling > 0 && r.watchdogRunning.CompareAndSwap(false, true) {
+		go r.requestWatchdog()
+	}
+}
+
+// requestWatchdog expires the pending requests of all the connections, until
+// the ceiling is disabled.
+func (r *Router) requestWatchdog() {
+	defer r.watchdogRunning.Store(false)
+	for {
+		ceiling := time.Duration(r.requestCeiling.Load())
+		if ceiling <= 0 {
+			return
+		}
+		// Check often enough to expire the requests shortly after the ceiling
+		time.Sleep(max(ceiling/10, 10*time.Millisecond))
+		for conn := range r.Connections() {
+			if n := conn.ExpireRequests(ceiling); n > 0 {
+				r.requestsExpired.Add(uint64(n))
+			}
+		}
+	}
+}
+
+func (r *Router) logExpiredRequest(caller, callee *msgpackrpc.Connection, method string, age time.Duration) {
+	callerInfo, _ := r.ConnectionInfo(caller)
+	calleeInfo, _ := r.ConnectionInfo(callee)
+	slog.Warn("Request expired without response",
+		"method", method,
+		"age", age,
+		"caller_transport", callerInfo.Transport,
+		"caller_addr", callerInfo.RemoteAddr,
+		"caller_identity", callerInfo.Identity,
+		"callee_transport", calleeInfo.Transport,
+		"callee_addr", calleeInfo.RemoteAddr)
+}
+
+// BroadcastNotification sends a notification to all the connected clients,
+// except the given connection (that may be nil) and the clients that have
+// not authenticated yet.
+func (r *Router) BroadcastNotification(except *msgpackrpc.Connection, method string, params ...any) {
+	r.connectionsLock.Lock()
+	conns := make([]*msgpackrpc.Connection, 0, len(r.connections))
+	for conn, info := range r.connections {
+		if info.Authenticator != nil && !info.authenticated {
+			continue
+		}
+		if conn != except {
+			conns = append(conns, conn)
+		}
+	}
+	r.connectionsLock.Unlock()
+
+	for _, conn := range conns {
+		if err := conn.SendNotification(method, params...); err != nil {
+			slog.Error("Failed to send notification", "method", method, "err", err)
+		}
+	}
 }
 
 func (r *Router) RegisterMethod(method string, handler RouterRequestHandler) error {
+	return r.RegisterMethodWithContext(method, func(_ context.Context, rpc *msgpackrpc.Connection, params []any, res RouterResponseHandler) {
+		handler(rpc, params, res)
+	})
+}
+
+// RegisterMethodWithContext registers an internal method whose handler gets
+// the context of the request.
+func (r *Router) RegisterMethodWithContext(method string, handler RouterRequestHandlerWithContext) error {
 	r.routesLock.Lock()
 	defer r.routesLock.Unlock()
 
@@ -69,19 +533,134 @@ func (r *Router) RegisterMethod(method string, handler RouterRequestHandler) err
 	return nil
 }
 
-func (r *Router) connectionLoop(conn io.ReadWriteCloser) {
-	defer conn.Close()
-
+func (r *Router) newConnection(conn io.ReadWriteCloser, info ConnectionInfo) (*msgpackrpc.Connection, *responseQueue) {
+	acl, authenticator, role := info.ACL, info.Authenticator, info.Role
 	var msgpackconn *msgpackrpc.Connection
-	msgpackconn = msgpackrpc.NewConnection(conn, conn,
-		func(_ msgpackrpc.FunctionLogger, method string, params []any, _res msgpackrpc.ResponseHandler) {
+	responses := newResponseQueue()
+	errorCount := &errorCounter{limit: info.ErrorLimit}
+	var authenticated atomic.Bool
+	authenticated.Store(authenticator == nil)
+	var connRole atomic.Value
+	connRole.Store(role)
+	allows := func(method string) bool {
+		return acl.Allows(method) && r.roleAllows(connRole.Load().(string), method)
+	}
+	var clock peerClock
+	msgpackconn = msgpackrpc.NewRawConnection(conn, conn,
+		func(ctx context.Context, _ msgpackrpc.FunctionLogger, method string, rawParams msgpackrpc.RawMessage, _res msgpackrpc.ResponseHandler) {
 			// This handler is called when a request is received from the client
-			slog.Debug("Received request", "method", method, "params", params)
+			received := time.Now()
+			slog.Debug("Received request", clock.logAttrs("method", method, "params", rawParams)...)
+			// The errors of the forwarded requests are not caused by the
+			// client, they are not counted by the error limit
+			forwarded := false
 			res := func(result any, err any) {
-				slog.Debug("Received response", "method", method, "result", result, "error", err)
+				slog.Debug("Received response", clock.logAttrs("method", method, "result", result, "error", err)...)
 				_res(result, err)
+				if !forwarded && errorCount.record(err) {
+					r.errorLimited.Add(1)
+					if info.ErrorLimit.Disconnect {
+						slog.Warn("Too many errors, disconnecting client", "addr", info.RemoteAddr, "method", method)
+						msgpackconn.Close()
+					} else {
+						slog.Warn("Too many errors, throttling client", "addr", info.RemoteAddr, "method", method, "duration", info.ErrorLimit.Window)
+					}
+				}
+			}
+
+			if errorCount.blocked() {
+				res(nil, routerError(ErrCodeTooManyErrors, "too many errors, retry later"))
+				return
+			}
+
+			// The params are decoded only for the methods handled by the
+			// router, the forwarded requests carry them as they are.
+			var params []any
+			decodeParams := func() bool {
+				var err error
+				if params, err = rawParams.DecodeArray(); err != nil {
+					res(nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: %s", err)))
+					return false
+				}
+				return true
+			}
+
+			if method == "$/auth" {
+				if !decodeParams() {
+					return
+				}
+				if len(params) != 1 {
+					res(nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: only one param is expected, got %d", len(params))))
+				} else if token, ok := params[0].(string); !ok {
+					res(nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: expected string, got %T", params[0])))
+				} else if authenticator == nil {
+					res(true, nil)
+				} else if identity, identityRole, err := authenticator(token); err != nil {
+					res(nil, routerError(ErrCodeNotAuthenticated, err.Error()))
+				} else {
+					if identityRole != "" {
+						connRole.Store(identityRole)
+					}
+					r.setIdentity(msgpackconn, identity, identityRole)
+					authenticated.Store(true)
+					res(true, nil)
+				}
+				return
+			}
+			if !authenticated.Load() {
+				res(nil, routerError(ErrCodeNotAuthenticated, "authentication required"))
+				return
+			}
+			res = r.observeRequest(method, rawParams, msgpackconn, res)
+
+			if !allows(method) {
+				slog.Warn("Method not allowed", "method", method)
+				res(nil, routerError(ErrCodeMethodNotAllowed, fmt.Sprintf("method %s not allowed", method)))
+				return
 			}
 
+			if r.methodDisabled(method) {
+				res(nil, newModuleDisabledError(method).ToEncodedError())
+				return
+			}
+
+			if limit := r.sizeLimit(method); limit > 0 {
+				if len(rawParams) > limit {
+					slog.Warn("Params too large", "method", method, "size", len(rawParams), "limit", limit)
+					res(nil, routerError(ErrCodeMessageTooLarge, fmt.Sprintf("params of %d bytes exceed the limit of %d bytes of %s", len(rawParams), limit, method)))
+					return
+				}
+				sendResponse := res
+				res = func(result any, err any) {
+					if size := payloadSize(result); size > limit {
+						slog.Warn("Result too large", "method", method, "size", size, "limit", limit)
+						sendResponse(nil, routerError(ErrCodeMessageTooLarge, fmt.Sprintf("result of %d bytes exceeds the limit of %d bytes of %s", size, limit, method)))
+						return
+					}
+					sendResponse(result, err)
+				}
+			}
+
+			// Reject the new requests while draining, and count the
+			// requests in flight
+			if admitted, counted := r.admitRequest(method); !admitted {
+				res(nil, routerError(ErrCodeDraining, "router draining for maintenance, retry later"))
+				return
+			} else if counted {
+				r.inFlight.Add(1)
+				sendResponse := res
+				res = func(result any, err any) {
+					r.inFlight.Add(-1)
+					sendResponse(result, err)
+				}
+			}
+
+			switch method {
+			case "$/register", TapMethod, "$/reset", TimeSyncMethod, SessionStartMethod, SessionResumeMethod:
+				if !decodeParams() {
+					return
+				}
+			}
 			switch method {
 			case "$/register":
 				// Check if the client is trying to register a new method
@@ -102,6 +681,49 @@ func (r *Router) connectionLoop(conn io.ReadWriteCloser) {
 					res(true, nil)
 					return
 				}
+			case TapMethod:
+				// Check if the client wants to receive (or stop receiving) the routed messages
+				enable := true
+				if len(params) > 1 {
+					res(nil, routerError(ErrCodeInvalidParams, "invalid params: at most one param is expected"))
+					return
+				} else if len(params) == 1 {
+					if b, ok := params[0].(bool); !ok {
+						res(nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: expected bool, got %T", params[0])))
+						return
+					} else {
+						enable = b
+					}
+				}
+				r.setTap(msgpackconn, enable)
+				res(true, nil)
+				return
+			case TimeSyncMethod:
+				// Exchange the timestamps to estimate the clock offset
+				res(clock.timeSync(received, params))
+				return
+			case SessionStartMethod:
+				// Start a session, resumable after a reconnection
+				if len(params) != 0 {
+					res(nil, routerError(ErrCodeInvalidParams, "invalid params: no params are expected"))
+				} else if token, err := r.startSession(msgpackconn); err != nil {
+					res(nil, err)
+				} else {
+					res(token, nil)
+				}
+				return
+			case SessionResumeMethod:
+				// Reclaim the state of a session after a reconnection
+				if len(params) != 1 {
+					res(nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: only one param is expected, got %d", len(params))))
+				} else if token, ok := params[0].(string); !ok {
+					res(nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: expected string, got %T", params[0])))
+				} else if err := r.resumeSession(msgpackconn, token); err != nil {
+					res(nil, err)
+				} else {
+					res(true, nil)
+				}
+				return
 			case "$/reset":
 				// Check if the client is trying to remove its registered methods
 				if len(params) != 0 {
@@ -114,50 +736,158 @@ func (r *Router) connectionLoop(conn io.ReadWriteCloser) {
 				}
 			}
 
+			// Answer the repeated requests of the cacheable methods from the
+			// cache, or with the response of the identical request in flight
+			var answered bool
+			if res, answered = r.cache.lookup(method, rawParams, res, responses.wrap); answered {
+				return
+			}
+
+			// Trace the request until the response is sent back to the caller
+			if span := tracing.StartSpan(method, tracing.KindServer, nil,
+				"rpc.system", "msgpack-rpc",
+				"rpc.method", method,
+			); span != nil {
+				sendResponse := res
+				res = func(result any, err any) {
+					span.End(err)
+					sendResponse(result, err)
+				}
+				// Make the span available to the internal handler as the
+				// parent of its own spans
+				defer tracing.SetCurrent(msgpackconn, span)()
+			}
+
 			// Check if the method is an internal method
 			if handler, ok := r.routesInternal[method]; ok {
+				if !decodeParams() {
+					return
+				}
+				if r.tapping() {
+					res = r.tapRequest(method, rawParams, msgpackconn, nil, res)
+				}
 				// Call the internal method handler
-				handler(msgpackconn, params, res)
+				handler(ctx, msgpackconn, params, res)
 				return
 			}
 
 			// Check if the method is registered
 			client, ok := r.getConnectionForMethod(method)
 			if !ok {
-				res(nil, routerError(ErrCodeMethodNotAvailable, fmt.Sprintf("method %s not available", method)))
-				return
+				if service, reserved := r.reservedBy(method); reserved {
+					res(nil, routerError(ErrCodeServiceStarting, fmt.Sprintf("service %s providing method %s is starting", service, method)))
+					return
+				}
+				// Forward the methods not available locally to the upstream router
+				if client, ok = r.upstreamFor(msgpackconn, method); !ok {
+					res(nil, routerError(ErrCodeMethodNotAvailable, fmt.Sprintf("method %s not available", method)))
+					return
+				}
+			}
+			if rule := r.faultFor(method, msgpackconn, client); rule != nil {
+				var forward bool
+				if rawParams, forward = r.injectFault(ctx, rule, method, rawParams); !forward {
+					if ctx.Err() != nil {
+						res(nil, routerError(ErrCodeGenericError, "request canceled"))
+					}
+					return
+				}
 			}
+			if r.tapping() {
+				res = r.tapRequest(method, rawParams, msgpackconn, client, res)
+			}
+
+			// The response is received by the connection of the client, it
+			// is written to the caller by the queue of the caller.
+			forwarded = true
+			res = responses.wrap(res)
 
 			// Forward the call to the registered client
-			err := client.SendRequestWithAsyncResult(
+			if threshold := time.Duration(r.slowRequestThreshold.Load()); threshold > 0 {
+				start := time.Now()
+				sendResponse := res
+				res = func(result any, err any) {
+					if elapsed := time.Since(start); elapsed > threshold {
+						r.logSlowRequest(msgpackconn, client, method, len(rawParams), elapsed)
+					}
+					sendResponse(result, err)
+				}
+			}
+			if time.Duration(r.requestCeiling.Load()) > 0 {
+				sendResponse := res
+				res = func(result any, err any) {
+					if e, ok := err.(*msgpackrpc.ExpiredRequestError); ok {
+						r.logExpiredRequest(msgpackconn, client, method, e.Age)
+						err = routerError(ErrCodeRequestExpired, fmt.Sprintf("no response from %s after %s", method, e.Age.Round(time.Second)))
+					}
+					sendResponse(result, err)
+				}
+			}
+			err := client.SendRawRequestWithAsyncResult(
 				res, // Send the response back to the original caller
-				method, params...)
+				r.calleeMethod(client, method), rawParams)
 			if err != nil {
 				slog.Error("Failed to send request", "method", method, "err", err)
 				res(nil, routerError(ErrCodeFailedToSendRequests, fmt.Sprintf("failed to send request: %s", err)))
 				return
 			}
 		},
-		func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		func(_ msgpackrpc.FunctionLogger, method string, rawParams msgpackrpc.RawMessage) {
 			// This handler is called when a notification is received from the client
-			slog.Debug("Received notification", "method", method, "params", params)
+			slog.Debug("Received notification", clock.logAttrs("method", method, "params", rawParams)...)
+
+			if errorCount.blocked() {
+				return
+			}
+			if !authenticated.Load() || !allows(method) {
+				slog.Warn("Notification not allowed", "method", method)
+				return
+			}
+			if r.methodDisabled(method) {
+				slog.Warn("Notification of a disabled module", "method", method)
+				return
+			}
+			if limit := r.sizeLimit(method); limit > 0 && len(rawParams) > limit {
+				slog.Warn("Notification params too large", "method", method, "size", len(rawParams), "limit", limit)
+				return
+			}
 
 			// Check if the method is an internal method
 			if handler, ok := r.routesInternal[method]; ok {
+				params, err := rawParams.DecodeArray()
+				if err != nil {
+					slog.Warn("Invalid notification params", "method", method, "err", err)
+					return
+				}
+				if r.tapping() {
+					r.tapMessage("notification", 0, method, msgpackconn, nil, rawParams)
+				}
 				// call the internal method handler (since it's a notification, discard the result)
-				handler(msgpackconn, params, func(_, _ any) {})
+				handler(context.Background(), msgpackconn, params, func(_, _ any) {})
 				return
 			}
 
 			// Check if the method is registered
 			client, ok := r.getConnectionForMethod(method)
+			if !ok {
+				client, ok = r.upstreamFor(msgpackconn, method)
+			}
 			if !ok {
 				// if the method is not registered, the notifitication is lost
 				return
 			}
+			if rule := r.faultFor(method, msgpackconn, client); rule != nil {
+				var forward bool
+				if rawParams, forward = r.injectFault(context.Background(), rule, method, rawParams); !forward {
+					return
+				}
+			}
+			if r.tapping() {
+				r.tapMessage("notification", 0, method, msgpackconn, client, rawParams)
+			}
 
 			// Forward the notification to the registered client
-			if err := client.SendNotification(method, params...); err != nil {
+			if err := client.SendRawNotification(r.calleeMethod(client, method), rawParams); err != nil {
 				slog.Error("Failed to send notification", "method", method, "err", err)
 				return
 			}
@@ -170,32 +900,151 @@ func (r *Router) connectionLoop(conn io.ReadWriteCloser) {
 			slog.Error("Error in connection", "err", err)
 		},
 	)
+	if r.concurrentRequests.Load() {
+		msgpackconn.SetMaxWorkers(r.perConnMaxWorkers)
+	}
+	return msgpackconn, responses
+}
+
+// connectionLoop serves the connection until it is terminated, and returns
+// true if the session of the client is suspended.
+func (r *Router) connectionLoop(conn io.ReadWriteCloser, msgpackconn *msgpackrpc.Connection) bool {
+	defer conn.Close()
 
 	msgpackconn.Run()
 
-	// Unregister the methods when the connection is terminated
+	// Unregister the methods when the connection is terminated, the methods
+	// of a session are kept to be registered again when it is resumed
+	suspended := r.suspendSession(msgpackconn)
 	r.removeMethodsFromConnection(msgpackconn)
 	msgpackconn.Close()
-
+	return suspended
 }
 
 func (r *Router) registerMethod(method string, conn *msgpackrpc.Connection) error {
+	info, _ := r.ConnectionInfo(conn)
+	method = info.Prefix + method
+	if r.methodDisabled(method) {
+		return newModuleDisabledError(method)
+	}
+
 	r.routesLock.Lock()
 	defer r.routesLock.Unlock()
 
-	if _, ok := r.routes[method]; ok {
+	if service, ok := r.reserved[method]; ok && service != info.Identity {
+		return newRouteReservedError(method, service)
+	}
+	if existing, ok := r.routes[method]; ok {
+		if existing == conn && r.restoredRoutes[method] {
+			// The client registers again a restored method
+			delete(r.restoredRoutes, method)
+			return nil
+		}
 		return newRouteAlreadyExistsError(method)
 	}
 	r.routes[method] = conn
 	return nil
 }
 
+// ReserveMethods reserves the given methods to the connections with the
+// identity of the service: the other clients can not register them, and
+// while the service is not connected the callers get the
+// ErrCodeServiceStarting error instead of ErrCodeMethodNotAvailable.
+func (r *Router) ReserveMethods(service string, methods []string) {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+	for _, method := range methods {
+		r.reserved[method] = service
+	}
+}
+
+// Reservations returns the methods reserved with ReserveMethods, with the
+// services that reserved them.
+func (r *Router) Reservations() map[string]string {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+	return maps.Clone(r.reserved)
+}
+
+// RegisterMethods registers the given methods on behalf of the client
+// connection, as if it had called $/register for each of them.
+func (r *Router) RegisterMethods(conn *msgpackrpc.Connection, methods []string) error {
+	for _, method := range methods {
+		if err := r.registerMethod(method, conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisteredMethods returns the methods registered by the client connection,
+// without the prefix of the connection, as they are passed to
+// RegisterMethods.
+func (r *Router) RegisteredMethods(conn *msgpackrpc.Connection) []string {
+	info, _ := r.ConnectionInfo(conn)
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+	var methods []string
+	for method, c := range r.routes {
+		if c == conn {
+			methods = append(methods, strings.TrimPrefix(method, info.Prefix))
+		}
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+// RestoreMethods registers the given methods on behalf of the next client
+// connection with the given transport and remote address, for example the
+// MCU connected again to the serial port after a restart of the router. The
+// client may register the restored methods again.
+func (r *Router) RestoreMethods(transport, remoteAddr string, methods []string) {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+	r.restoredMethods[[2]string{transport, remoteAddr}] = methods
+}
+
+// registerRestoredMethods registers the methods restored for the connection,
+// if any.
+func (r *Router) registerRestoredMethods(conn *msgpackrpc.Connection, info ConnectionInfo) {
+	key := [2]string{info.Transport, info.RemoteAddr}
+	r.routesLock.Lock()
+	methods, ok := r.restoredMethods[key]
+	delete(r.restoredMethods, key)
+	r.routesLock.Unlock()
+	if !ok {
+		return
+	}
+	for _, method := range methods {
+		if err := r.registerMethod(method, conn); err != nil {
+			slog.Warn("Failed to restore method", "method", method, "transport", info.Transport, "addr", info.RemoteAddr, "err", err)
+			continue
+		}
+		r.routesLock.Lock()
+		r.restoredRoutes[info.Prefix+method] = true
+		r.routesLock.Unlock()
+	}
+	slog.Info("Restored methods", "transport", info.Transport, "addr", info.RemoteAddr, "methods", methods)
+}
+
+// reservedBy returns the service that reserved the method.
+func (r *Router) reservedBy(method string) (string, bool) {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+	service, ok := r.reserved[method]
+	return service, ok
+}
+
 func (r *Router) removeMethodsFromConnection(conn *msgpackrpc.Connection) {
 	r.routesLock.Lock()
 	defer r.routesLock.Unlock()
 
 	maps.DeleteFunc(r.routes, func(k string, v *msgpackrpc.Connection) bool {
-		return v == conn
+		if v == conn {
+			delete(r.restoredRoutes, k)
+			return true
+		}
+		return false
 	})
 }
 
@@ -205,3 +1054,36 @@ func (r *Router) getConnectionForMethod(method string) (*msgpackrpc.Connection,
 	conn, ok := r.routes[method]
 	return conn, ok
 }
+
+// calleeMethod returns the method sent to the callee connection, without
+// the prefix of its registrations.
+func (r *Router) calleeMethod(callee *msgpackrpc.Connection, method string) string {
+	info, _ := r.ConnectionInfo(callee)
+	return strings.TrimPrefix(method, info.Prefix)
+}
+
+// SetUpstream sets the connection to an upstream router, where the requests
+// and notifications of the methods not available locally are forwarded, so
+// that the clients see the methods of both routers. The prefix of the
+// connection, if any, is removed from the forwarded methods. A nil
+// connection stops the forwarding.
+func (r *Router) SetUpstream(conn *msgpackrpc.Connection) {
+	r.upstream.Store(conn)
+}
+
+// upstreamFor returns the upstream connection where the messages of the
+// caller are forwarded. The messages received from the upstream router are
+// never sent back to it, to avoid loops between routers that use each other
+// as upstream. If the upstream connection has a prefix, only the methods
+// with the prefix are forwarded.
+func (r *Router) upstreamFor(caller *msgpackrpc.Connection, method string) (*msgpackrpc.Connection, bool) {
+	upstream := r.upstream.Load()
+	if upstream == nil || upstream == caller {
+		return nil, false
+	}
+	if info, _ := r.ConnectionInfo(upstream); !strings.HasPrefix(method, info.Prefix) {
+		return nil, false
+	}
+	r.upstreamForwarded.Add(1)
+	return upstream, true
+}
@@ -0,0 +1,55 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func BenchmarkForwarding(b *testing.B) {
+	ch1a, ch1b := newFullPipe()
+	ch2a, ch2b := newFullPipe()
+
+	service := msgpackrpc.NewConnection(ch1a, ch1a, func(logger msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		res(params[0], nil)
+	}, nil, nil)
+	go service.Run()
+	b.Cleanup(service.Close)
+
+	client := msgpackrpc.NewConnection(ch2a, ch2a, nil, nil, nil)
+	go client.Run()
+	b.Cleanup(client.Close)
+
+	router := msgpackrouter.New(0)
+	router.Accept(ch1b)
+	router.Accept(ch2b)
+
+	if _, reqErr, err := service.SendRequest(context.Background(), "$/register", "echo"); err != nil || reqErr != nil {
+		b.Fatal(err, reqErr)
+	}
+
+	payload := make([]byte, 256)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, reqErr, err := client.SendRequest(context.Background(), "echo", payload); err != nil || reqErr != nil {
+			b.Fatal(err, reqErr)
+		}
+	}
+}
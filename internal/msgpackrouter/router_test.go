@@ -16,11 +16,15 @@
 package msgpackrouter_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -30,6 +34,7 @@ import (
 	"github.com/djherbis/buffer"
 	"github.com/djherbis/nio/v3"
 	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 type FullPipe struct {
@@ -212,3 +217,1019 @@ func TestMessageForwarderCongestionControl(t *testing.T) {
 	fmt.Println("Elapsed time for requests:", elapsed)
 	require.Greater(t, elapsed, expectedLatency, "Expected elapsed time to be greater than %s", expectedLatency)
 }
+
+func TestBroadcastNotification(t *testing.T) {
+	var notificationsMux sync.Mutex
+	notifications := map[string][]string{}
+	newClient := func(name string) (*msgpackrpc.Connection, io.ReadWriteCloser) {
+		cha, chb := newFullPipe()
+		cl := msgpackrpc.NewConnection(cha, cha, nil, func(logger msgpackrpc.FunctionLogger, method string, params []any) {
+			notificationsMux.Lock()
+			notifications[name] = append(notifications[name], fmt.Sprintf("%s %v", method, params))
+			notificationsMux.Unlock()
+		}, nil)
+		go cl.Run()
+		return cl, chb
+	}
+	_, ch1 := newClient("cl1")
+	_, ch2 := newClient("cl2")
+
+	router := msgpackrouter.New(0)
+	router.Accept(ch1)
+	conn2, _ := router.AcceptConnection(ch2)
+
+	router.BroadcastNotification(nil, "$/test", 1)
+	router.BroadcastNotification(conn2, "$/test", 2)
+	time.Sleep(100 * time.Millisecond) // Give some time for the notifications to be processed
+
+	notificationsMux.Lock()
+	require.Equal(t, []string{"$/test [1]", "$/test [2]"}, notifications["cl1"])
+	require.Equal(t, []string{"$/test [1]"}, notifications["cl2"])
+	notificationsMux.Unlock()
+}
+
+func TestConnectionInfo(t *testing.T) {
+	cha, chb := newFullPipe()
+	cl := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+	go cl.Run()
+
+	router := msgpackrouter.New(0)
+	var closed *msgpackrpc.Connection
+	router.OnConnectionClosed(func(conn *msgpackrpc.Connection) {
+		closed = conn
+	})
+	info := msgpackrouter.ConnectionInfo{
+		Transport:       "unix",
+		RemoteAddr:      "@",
+		PeerCredentials: &msgpackrouter.PeerCredentials{PID: 100, UID: 1000, GID: 1000},
+	}
+	conn, exit := router.AcceptConnectionWithInfo(chb, info)
+
+	res, ok := router.ConnectionInfo(conn)
+	require.True(t, ok)
+	require.Equal(t, info, res)
+
+	cl.Close()
+	<-exit
+	_, ok = router.ConnectionInfo(conn)
+	require.False(t, ok)
+	require.Equal(t, conn, closed)
+}
+
+func TestACL(t *testing.T) {
+	require.True(t, msgpackrouter.ACL(nil).Allows("any/method"))
+	acl := msgpackrouter.ACL{"tcp/*", "$/version"}
+	require.True(t, acl.Allows("tcp/connect"))
+	require.True(t, acl.Allows("$/version"))
+	require.False(t, acl.Allows("$/version/extra"))
+	require.False(t, acl.Allows("udp/connect"))
+	require.False(t, msgpackrouter.ACL{}.Allows("tcp/connect"))
+
+	cha, chb := newFullPipe()
+	cl := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+
+	router := msgpackrouter.New(0)
+	require.NoError(t, router.RegisterMethod("tcp/ping", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		res(true, nil)
+	}))
+	router.AcceptConnectionWithInfo(chb, msgpackrouter.ConnectionInfo{ACL: acl})
+
+	result, reqErr, err := cl.SendRequest(t.Context(), "tcp/ping")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+
+	result, reqErr, err = cl.SendRequest(t.Context(), "$/register", "ping")
+	require.NoError(t, err)
+	require.Nil(t, result)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAllowed), "method $/register not allowed"}, reqErr)
+}
+
+func TestAuthentication(t *testing.T) {
+	cha, chb := newFullPipe()
+	cl := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+
+	router := msgpackrouter.New(0)
+	require.NoError(t, router.RegisterMethod("ping", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		res(true, nil)
+	}))
+	conn, _ := router.AcceptConnectionWithInfo(chb, msgpackrouter.ConnectionInfo{
+		Authenticator: func(token string) (string, string, error) {
+			if token != "secret" {
+				return "", "", errors.New("invalid token")
+			}
+			return "client1", "", nil
+		},
+	})
+
+	result, reqErr, err := cl.SendRequest(t.Context(), "ping")
+	require.NoError(t, err)
+	require.Nil(t, result)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeNotAuthenticated), "authentication required"}, reqErr)
+
+	result, reqErr, err = cl.SendRequest(t.Context(), "$/auth", "wrong")
+	require.NoError(t, err)
+	require.Nil(t, result)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeNotAuthenticated), "invalid token"}, reqErr)
+
+	result, reqErr, err = cl.SendRequest(t.Context(), "$/auth", "secret")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+	info, ok := router.ConnectionInfo(conn)
+	require.True(t, ok)
+	require.Equal(t, "client1", info.Identity)
+
+	result, reqErr, err = cl.SendRequest(t.Context(), "ping")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+}
+
+func TestRoles(t *testing.T) {
+	acl := msgpackrouter.ACL{"!hci/*", "!$/serial/*"}
+	require.True(t, acl.Allows("tcp/connect"))
+	require.False(t, acl.Allows("hci/open"))
+	require.False(t, msgpackrouter.ACL{"tcp/*", "!tcp/listen"}.Allows("tcp/listen"))
+	require.True(t, msgpackrouter.ACL{"tcp/*", "!tcp/listen"}.Allows("tcp/connect"))
+	require.False(t, msgpackrouter.ACL{"tcp/*", "!tcp/listen"}.Allows("udp/connect"))
+
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleRemote, acl)
+	router.SetRole(msgpackrouter.RoleLocalService, nil)
+	for _, method := range []string{"tcp/ping", "hci/open"} {
+		require.NoError(t, router.RegisterMethod(method, func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+			res(true, nil)
+		}))
+	}
+
+	cha, chb := newFullPipe()
+	cl := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+	conn, _ := router.AcceptConnectionWithInfo(chb, msgpackrouter.ConnectionInfo{
+		Role: msgpackrouter.RoleRemote,
+		Authenticator: func(token string) (string, string, error) {
+			return "admin", msgpackrouter.RoleLocalService, nil
+		},
+	})
+	require.NoError(t, cl.SendNotification("$/auth", "unused"))
+
+	result, reqErr, err := cl.SendRequest(t.Context(), "tcp/ping")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeNotAuthenticated), "authentication required"}, reqErr)
+	require.Nil(t, result)
+
+	// The role assigned to the identity overrides the role of the connection
+	result, reqErr, err = cl.SendRequest(t.Context(), "$/auth", "token")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+	result, reqErr, err = cl.SendRequest(t.Context(), "hci/open")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+	info, _ := router.ConnectionInfo(conn)
+	require.Equal(t, msgpackrouter.RoleLocalService, info.Role)
+
+	// Remote clients cannot call the denied methods
+	cha2, chb2 := newFullPipe()
+	cl2 := msgpackrpc.NewConnection(cha2, cha2, nil, nil, nil)
+	go cl2.Run()
+	defer cl2.Close()
+	router.AcceptConnectionWithInfo(chb2, msgpackrouter.ConnectionInfo{Role: msgpackrouter.RoleRemote})
+	result, reqErr, err = cl2.SendRequest(t.Context(), "tcp/ping")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+	result, reqErr, err = cl2.SendRequest(t.Context(), "hci/open")
+	require.NoError(t, err)
+	require.Nil(t, result)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAllowed), "method hci/open not allowed"}, reqErr)
+}
+
+func TestRouterStats(t *testing.T) {
+	cha, chb := newFullPipe()
+	cl := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+
+	router := msgpackrouter.New(0)
+	require.NoError(t, router.RegisterMethod("ping", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		res(true, nil)
+	}))
+	router.AcceptConnectionWithInfo(chb, msgpackrouter.ConnectionInfo{Transport: "unix"})
+	_, _, err := cl.SendRequest(t.Context(), "$/register", "test")
+	require.NoError(t, err)
+
+	stats := router.Stats()
+	require.Equal(t, 1, stats["connections"])
+	require.Equal(t, map[string]int{"unix": 1}, stats["connections_by_transport"])
+	require.Equal(t, 1, stats["routes"])
+	require.Equal(t, 1, stats["internal_methods"])
+	require.Equal(t, 0, stats["pending_requests"])
+	require.Equal(t, uint64(1), stats["frames_in"])
+	require.Equal(t, uint64(1), stats["frames_out"])
+}
+
+func TestSlowRequests(t *testing.T) {
+	ch1a, ch1b := newFullPipe()
+	cl1 := msgpackrpc.NewConnection(ch1a, ch1a, func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		if method == "slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		res(true, nil)
+	}, nil, nil)
+	go cl1.Run()
+	defer cl1.Close()
+	ch2a, ch2b := newFullPipe()
+	cl2 := msgpackrpc.NewConnection(ch2a, ch2a, nil, nil, nil)
+	go cl2.Run()
+	defer cl2.Close()
+
+	router := msgpackrouter.New(0)
+	router.SetSlowRequestThreshold(50 * time.Millisecond)
+	router.Accept(ch1b)
+	router.Accept(ch2b)
+	for _, method := range []string{"fast", "slow"} {
+		_, _, err := cl1.SendRequest(t.Context(), "$/register", method)
+		require.NoError(t, err)
+	}
+
+	result, reqErr, err := cl2.SendRequest(t.Context(), "fast")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+	require.Equal(t, uint64(0), router.Stats()["slow_requests"])
+
+	result, reqErr, err = cl2.SendRequest(t.Context(), "slow", "data")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+	require.Equal(t, uint64(1), router.Stats()["slow_requests"])
+
+	// Disable the check
+	router.SetSlowRequestThreshold(0)
+	_, _, err = cl2.SendRequest(t.Context(), "slow")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), router.Stats()["slow_requests"])
+}
+
+func TestTap(t *testing.T) {
+	ch1a, ch1b := newFullPipe()
+	cl1 := msgpackrpc.NewConnection(ch1a, ch1a, func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		res(params, nil)
+	}, nil, nil)
+	go cl1.Run()
+	defer cl1.Close()
+
+	events := make(chan map[string]any, 10)
+	ch2a, ch2b := newFullPipe()
+	cl2 := msgpackrpc.NewConnection(ch2a, ch2a, nil, func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		require.Equal(t, msgpackrouter.TapMethod, method)
+		events <- params[0].(map[string]any)
+	}, nil)
+	go cl2.Run()
+	defer cl2.Close()
+
+	router := msgpackrouter.New(0)
+	router.AcceptConnectionWithInfo(ch1b, msgpackrouter.ConnectionInfo{Transport: "serial", RemoteAddr: "/dev/ttyACM0"})
+	router.AcceptConnectionWithInfo(ch2b, msgpackrouter.ConnectionInfo{Transport: "unix", Identity: "sniffer"})
+	_, _, err := cl1.SendRequest(t.Context(), "$/register", "echo")
+	require.NoError(t, err)
+
+	result, reqErr, err := cl2.SendRequest(t.Context(), msgpackrouter.TapMethod)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+
+	_, _, err = cl2.SendRequest(t.Context(), "echo", "hello")
+	require.NoError(t, err)
+	require.NoError(t, cl2.SendNotification("echo", 1))
+
+	next := func() map[string]any {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(time.Second):
+			require.FailNow(t, "tap event not received")
+			return nil
+		}
+	}
+	e := next()
+	require.Equal(t, "request", e["type"])
+	require.Equal(t, "echo", e["method"])
+	require.Equal(t, "unix sniffer", e["from"])
+	require.Equal(t, "serial /dev/ttyACM0", e["to"])
+	id := e["id"]
+	e = next()
+	require.Equal(t, "response", e["type"])
+	require.Equal(t, id, e["id"])
+	require.Equal(t, "serial /dev/ttyACM0", e["from"])
+	require.Equal(t, "unix sniffer", e["to"])
+	require.Equal(t, false, e["error"])
+	require.Contains(t, e, "latency_us")
+	e = next()
+	require.Equal(t, "notification", e["type"])
+	require.Equal(t, "echo", e["method"])
+
+	// Stop tapping
+	_, _, err = cl2.SendRequest(t.Context(), msgpackrouter.TapMethod, false)
+	require.NoError(t, err)
+	_, _, err = cl2.SendRequest(t.Context(), "echo", "hello")
+	require.NoError(t, err)
+	select {
+	case e := <-events:
+		require.FailNow(t, "unexpected tap event", "%v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRequestCeiling(t *testing.T) {
+	ch1a, ch1b := newFullPipe()
+	cl1 := msgpackrpc.NewConnection(ch1a, ch1a, func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		if method == "lost" {
+			// The response is never sent
+			return
+		}
+		res(true, nil)
+	}, nil, nil)
+	go cl1.Run()
+	defer cl1.Close()
+	ch2a, ch2b := newFullPipe()
+	cl2 := msgpackrpc.NewConnection(ch2a, ch2a, nil, nil, nil)
+	go cl2.Run()
+	defer cl2.Close()
+
+	router := msgpackrouter.New(0)
+	router.SetRequestCeiling(100 * time.Millisecond)
+	defer router.SetRequestCeiling(0)
+	router.Accept(ch1b)
+	router.Accept(ch2b)
+	for _, method := range []string{"answered", "lost"} {
+		_, _, err := cl1.SendRequest(t.Context(), "$/register", method)
+		require.NoError(t, err)
+	}
+
+	result, reqErr, err := cl2.SendRequest(t.Context(), "answered")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+
+	// The lost request is completed with an error, and forgotten by the router
+	_, reqErr, err = cl2.SendRequest(t.Context(), "lost")
+	require.NoError(t, err)
+	require.Equal(t, int8(msgpackrouter.ErrCodeRequestExpired), reqErr.([]any)[0])
+	stats := router.Stats()
+	require.Equal(t, uint64(1), stats["requests_expired"])
+	require.Equal(t, 0, stats["pending_requests"])
+}
+
+func TestSlowCallerDoesNotBlockOtherCallers(t *testing.T) {
+	// A service answering with large results
+	ch1a, ch1b := newFullPipe()
+	service := msgpackrpc.NewConnection(ch1a, ch1a, func(logger msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		res(make([]byte, 2048), nil)
+	}, nil, nil)
+	go service.Run()
+	t.Cleanup(service.Close)
+
+	// A caller that never reads its responses
+	ch2a, ch2b := net.Pipe()
+	slowCaller := msgpackrpc.NewConnection(ch2a, ch2a, nil, nil, nil)
+	t.Cleanup(slowCaller.Close)
+
+	ch3a, ch3b := newFullPipe()
+	caller := msgpackrpc.NewConnection(ch3a, ch3a, nil, nil, nil)
+	go caller.Run()
+	t.Cleanup(caller.Close)
+
+	router := msgpackrouter.New(0)
+	router.Accept(ch1b)
+	router.Accept(ch2b)
+	router.Accept(ch3b)
+
+	_, reqErr, err := service.SendRequest(t.Context(), "$/register", "data")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+
+	// The responses to the slow caller fill its connection
+	for range 4 {
+		require.NoError(t, slowCaller.SendRequestWithAsyncResult(func(any, any) {}, "data"))
+	}
+
+	// The other callers of the same service still get their responses
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	result, reqErr, err := caller.SendRequest(ctx, "data")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Len(t, result, 2048)
+}
+
+func TestSizeLimits(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetSizeLimit("fs/*", 1024)
+	router.SetSizeLimit("fs/write", 16)
+	router.SetSizeLimit("mon/*", 100)
+	router.SetSizeLimit("mon/*", 0)
+	require.NoError(t, router.RegisterMethod("fs/read", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		size, _ := msgpackrpc.ToUint(params[0])
+		res(make([]byte, size), nil)
+	}))
+
+	// A service answering with the size of the params
+	ch1a, ch1b := newFullPipe()
+	service := msgpackrpc.NewConnection(ch1a, ch1a, func(logger msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		res(len(params[0].([]byte)), nil)
+	}, nil, nil)
+	go service.Run()
+	defer service.Close()
+	router.Accept(ch1b)
+	for _, method := range []string{"fs/write", "mon/write"} {
+		_, reqErr, err := service.SendRequest(t.Context(), "$/register", method)
+		require.NoError(t, err)
+		require.Nil(t, reqErr)
+	}
+
+	ch2a, ch2b := newFullPipe()
+	cl := msgpackrpc.NewConnection(ch2a, ch2a, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+	router.Accept(ch2b)
+
+	// The most specific pattern is used
+	result, reqErr, err := cl.SendRequest(t.Context(), "fs/write", make([]byte, 10))
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.EqualValues(t, 10, result)
+	_, reqErr, err = cl.SendRequest(t.Context(), "fs/write", make([]byte, 100))
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMessageTooLarge), "params of 103 bytes exceed the limit of 16 bytes of fs/write"}, reqErr)
+
+	// The results are limited too
+	result, reqErr, err = cl.SendRequest(t.Context(), "fs/read", 100)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Len(t, result, 100)
+	result, reqErr, err = cl.SendRequest(t.Context(), "fs/read", 2000)
+	require.NoError(t, err)
+	require.Nil(t, result)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMessageTooLarge), "result of 2003 bytes exceeds the limit of 1024 bytes of fs/read"}, reqErr)
+
+	// The limit can be removed
+	result, reqErr, err = cl.SendRequest(t.Context(), "mon/write", make([]byte, 200))
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.EqualValues(t, 200, result)
+}
+
+func TestFaultInjection(t *testing.T) {
+	router := msgpackrouter.New(5)
+	router.SetFaults([]msgpackrouter.FaultRule{
+		{Method: "delayed", Latency: 100 * time.Millisecond},
+		{Method: "dropped", Drop: 1},
+		{Method: "corrupted", Corrupt: 1},
+		{Transport: "serial", Drop: 1},
+	})
+
+	// A service echoing the params
+	ch1a, ch1b := newFullPipe()
+	service := msgpackrpc.NewConnection(ch1a, ch1a, func(logger msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		res(params, nil)
+	}, nil, nil)
+	go service.Run()
+	defer service.Close()
+	router.Accept(ch1b)
+	for _, method := range []string{"delayed", "dropped", "echo"} {
+		_, reqErr, err := service.SendRequest(t.Context(), "$/register", method)
+		require.NoError(t, err)
+		require.Nil(t, reqErr)
+	}
+
+	ch2a, ch2b := newFullPipe()
+	cl := msgpackrpc.NewConnection(ch2a, ch2a, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+	router.Accept(ch2b)
+
+	// The messages not matching any rule are untouched
+	result, reqErr, err := cl.SendRequest(t.Context(), "echo", "data")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, []any{"data"}, result)
+
+	start := time.Now()
+	result, _, err = cl.SendRequest(t.Context(), "delayed", "data")
+	require.NoError(t, err)
+	require.Equal(t, []any{"data"}, result)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// The caller of a dropped request gets no response
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err = cl.SendRequest(ctx, "dropped", "data")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Check the corruption on the raw frames received by a service
+	ch3a, ch3b := newFullPipe()
+	defer ch3a.Close()
+	router.Accept(ch3b)
+	in := bufio.NewReader(ch3a)
+	require.NoError(t, msgpack.NewEncoder(ch3a).Encode([]any{0, 1, "$/register", []any{"corrupted"}}))
+	var response []any
+	require.NoError(t, msgpack.NewDecoder(in).Decode(&response))
+	require.Equal(t, []any{int8(1), int8(1), nil, true}, response)
+	// The last byte is corrupted by flipping all its bits
+	defer msgpackrouter.SetFaultRandom(func(n int) int { return n - 1 })()
+	params := bytes.Repeat([]byte{0x55}, 32)
+	require.NoError(t, cl.SendNotification("corrupted", params))
+	// The router encodes the messages with compact ints
+	var expected bytes.Buffer
+	enc := msgpack.NewEncoder(&expected)
+	enc.UseCompactInts(true)
+	require.NoError(t, enc.Encode([]any{2, "corrupted", []any{params}}))
+	frame := make([]byte, expected.Len())
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(in, frame)
+		read <- err
+	}()
+	select {
+	case err = <-read:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.FailNow(t, "the corrupted message was not forwarded")
+	}
+	corrupted := bytes.Clone(expected.Bytes())
+	corrupted[len(corrupted)-1] ^= 0xFF
+	require.Equal(t, corrupted, frame)
+
+	// The rules can select the connections by transport
+	ch4a, ch4b := newFullPipe()
+	mcu := msgpackrpc.NewConnection(ch4a, ch4a, func(logger msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+		res(params, nil)
+	}, nil, nil)
+	go mcu.Run()
+	defer mcu.Close()
+	router.AcceptConnectionWithInfo(ch4b, msgpackrouter.ConnectionInfo{Transport: "serial"})
+	_, reqErr, err = mcu.SendRequest(t.Context(), "$/register", "mcu/echo")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	ctx, cancel = context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err = cl.SendRequest(ctx, "mcu/echo", "data")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	stats := router.Stats()
+	require.Equal(t, uint64(1), stats["faults_delayed"])
+	require.Equal(t, uint64(2), stats["faults_dropped"])
+	require.Equal(t, uint64(1), stats["faults_corrupted"])
+
+	// Without rules the messages are forwarded untouched
+	router.SetFaults(nil)
+	result, _, err = cl.SendRequest(t.Context(), "dropped", "data")
+	require.NoError(t, err)
+	require.Equal(t, []any{"data"}, result)
+}
+
+func TestDisabledMethods(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetDisabledMethods([]string{"hci/*", "$/stats"})
+
+	ch1a, ch1b := newFullPipe()
+	cl := msgpackrpc.NewConnection(ch1a, ch1a, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+	router.Accept(ch1b)
+
+	// The methods of the disabled modules can not be called...
+	disabled := []any{int8(msgpackrouter.ErrCodeModuleDisabled), "method hci/open belongs to a disabled module"}
+	_, reqErr, err := cl.SendRequest(t.Context(), "hci/open", "hci0")
+	require.NoError(t, err)
+	require.Equal(t, disabled, reqErr)
+
+	// ...nor registered by a client
+	_, reqErr, err = cl.SendRequest(t.Context(), "$/register", "hci/open")
+	require.NoError(t, err)
+	require.Equal(t, disabled, reqErr)
+
+	// The other methods are not affected
+	_, reqErr, err = cl.SendRequest(t.Context(), "$/register", "hci2/open")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	_, reqErr, err = cl.SendRequest(t.Context(), "$/stats/all")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAvailable), "method $/stats/all not available"}, reqErr)
+}
+
+func TestReservedMethods(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.ReserveMethods("camera", []string{"camera/snap"})
+	require.Equal(t, map[string]string{"camera/snap": "camera"}, router.Reservations())
+
+	ch1a, ch1b := newFullPipe()
+	cl := msgpackrpc.NewConnection(ch1a, ch1a, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+	router.Accept(ch1b)
+
+	// The callers know that the method will be available soon...
+	_, reqErr, err := cl.SendRequest(t.Context(), "camera/snap")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeServiceStarting), "service camera providing method camera/snap is starting"}, reqErr)
+
+	// ...and the other clients can not register it
+	_, reqErr, err = cl.SendRequest(t.Context(), "$/register", "camera/snap")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeRouteAlreadyExists), "route reserved by service camera: camera/snap"}, reqErr)
+
+	// The connection of the service registers it
+	ch2a, ch2b := newFullPipe()
+	service := msgpackrpc.NewConnection(ch2a, ch2a, func(_ msgpackrpc.FunctionLogger, _ string, _ []any, res msgpackrpc.ResponseHandler) {
+		res("jpeg", nil)
+	}, nil, nil)
+	go service.Run()
+	defer service.Close()
+	conn, _ := router.AcceptConnectionWithInfo(ch2b, msgpackrouter.ConnectionInfo{Identity: "camera"})
+	require.NoError(t, router.RegisterMethods(conn, []string{"camera/snap"}))
+	result, reqErr, err := cl.SendRequest(t.Context(), "camera/snap")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, "jpeg", result)
+}
+
+func TestRoutePrefix(t *testing.T) {
+	router := msgpackrouter.New(0)
+
+	// Two boards registering the same method
+	boards := map[string]*msgpackrpc.Connection{}
+	for _, prefix := range []string{"board1/", "board2/"} {
+		cha, chb := newFullPipe()
+		board := msgpackrpc.NewConnection(cha, cha, func(_ msgpackrpc.FunctionLogger, method string, _ []any, res msgpackrpc.ResponseHandler) {
+			res(prefix+" "+method, nil)
+		}, nil, nil)
+		go board.Run()
+		defer board.Close()
+		router.AcceptConnectionWithInfo(chb, msgpackrouter.ConnectionInfo{Prefix: prefix})
+		boards[prefix] = board
+		_, reqErr, err := board.SendRequest(t.Context(), "$/register", "temperature")
+		require.NoError(t, err)
+		require.Nil(t, reqErr)
+	}
+
+	cha, chb := newFullPipe()
+	cl := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+	router.Accept(chb)
+
+	// The methods are called with the prefix, and received without it
+	for _, prefix := range []string{"board1/", "board2/"} {
+		result, reqErr, err := cl.SendRequest(t.Context(), prefix+"temperature")
+		require.NoError(t, err)
+		require.Nil(t, reqErr)
+		require.Equal(t, prefix+" temperature", result)
+	}
+	_, reqErr, err := cl.SendRequest(t.Context(), "temperature")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAvailable), "method temperature not available"}, reqErr)
+
+	// Only the methods with the prefix of the upstream are forwarded to it
+	ch2a, ch2b := newFullPipe()
+	upstream := msgpackrpc.NewConnection(ch2a, ch2a, func(_ msgpackrpc.FunctionLogger, method string, _ []any, res msgpackrpc.ResponseHandler) {
+		res("upstream "+method, nil)
+	}, nil, nil)
+	go upstream.Run()
+	defer upstream.Close()
+	conn, _ := router.AcceptConnectionWithInfo(ch2b, msgpackrouter.ConnectionInfo{Prefix: "carrier/"})
+	router.SetUpstream(conn)
+	result, reqErr, err := cl.SendRequest(t.Context(), "carrier/gpio/read")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, "upstream gpio/read", result)
+	_, reqErr, err = cl.SendRequest(t.Context(), "gpio/read")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAvailable), "method gpio/read not available"}, reqErr)
+}
+
+func TestErrorLimit(t *testing.T) {
+	router := msgpackrouter.New(0)
+	require.NoError(t, router.RegisterMethod("test/ok", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res(true, nil)
+	}))
+
+	connect := func(limit *msgpackrouter.ErrorLimit) *msgpackrpc.Connection {
+		cha, chb := newFullPipe()
+		cl := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+		go cl.Run()
+		t.Cleanup(cl.Close)
+		router.AcceptConnectionWithInfo(chb, msgpackrouter.ConnectionInfo{ErrorLimit: limit})
+		return cl
+	}
+
+	// The client is throttled after exceeding the limit...
+	cl := connect(&msgpackrouter.ErrorLimit{MaxErrors: 2, Window: 100 * time.Millisecond})
+	for range 3 {
+		_, reqErr, err := cl.SendRequest(t.Context(), "test/missing")
+		require.NoError(t, err)
+		require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAvailable), "method test/missing not available"}, reqErr)
+	}
+	_, reqErr, err := cl.SendRequest(t.Context(), "test/ok")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeTooManyErrors), "too many errors, retry later"}, reqErr)
+	require.Equal(t, uint64(1), router.Stats()["error_limited"])
+
+	// ...until the end of the window
+	time.Sleep(150 * time.Millisecond)
+	result, reqErr, err := cl.SendRequest(t.Context(), "test/ok")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+
+	// The client is disconnected after exceeding the limit
+	cl = connect(&msgpackrouter.ErrorLimit{MaxErrors: 1, Window: time.Minute, Disconnect: true})
+	for range 2 {
+		_, _, err := cl.SendRequest(t.Context(), "test/missing")
+		require.NoError(t, err)
+	}
+	_, _, err = cl.SendRequest(t.Context(), "test/ok")
+	require.Error(t, err)
+}
+
+func TestTimeSync(t *testing.T) {
+	router := msgpackrouter.New(0)
+	ch1a, ch1b := newFullPipe()
+	cl := msgpackrpc.NewConnection(ch1a, ch1a, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+	router.Accept(ch1b)
+
+	// The client clock is one hour behind the router clock
+	skew := time.Hour
+	t1 := time.Now().Add(-skew).UnixMicro()
+	result, reqErr, err := cl.SendRequest(t.Context(), msgpackrouter.TimeSyncMethod, t1)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	t4 := time.Now().Add(-skew).UnixMicro()
+	times := result.([]any)
+	require.Len(t, times, 3)
+	require.EqualValues(t, t1, times[0])
+	t2, _ := msgpackrpc.ToInt(times[1])
+	t3, _ := msgpackrpc.ToInt(times[2])
+	require.LessOrEqual(t, t2, t3)
+	offset := ((int64(t2) - t1) + (int64(t3) - t4)) / 2
+	require.InDelta(t, skew.Microseconds(), offset, float64(100*time.Millisecond/time.Microsecond))
+
+	// The client reports the offset, used to stamp the logs
+	_, reqErr, err = cl.SendRequest(t.Context(), msgpackrouter.TimeSyncMethod, t4, offset)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+
+	_, reqErr, err = cl.SendRequest(t.Context(), msgpackrouter.TimeSyncMethod, "now")
+	require.NoError(t, err)
+	require.Equal(t, int8(msgpackrouter.ErrCodeInvalidParams), reqErr.([]any)[0])
+}
+
+func TestRestoreMethods(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.RestoreMethods("serial", "/dev/ttyACM0", []string{"mcu/led", "mcu/temp"})
+	connect := func(info msgpackrouter.ConnectionInfo) *msgpackrpc.Connection {
+		a, b := newFullPipe()
+		cl := msgpackrpc.NewConnection(a, a, func(_ msgpackrpc.FunctionLogger, method string, _ []any, res msgpackrpc.ResponseHandler) {
+			res(method, nil)
+		}, nil, nil)
+		go cl.Run()
+		t.Cleanup(cl.Close)
+		router.AcceptConnectionWithInfo(b, info)
+		return cl
+	}
+
+	// The methods are restored only for the given transport and address
+	other := connect(msgpackrouter.ConnectionInfo{Transport: "serial", RemoteAddr: "/dev/ttyUSB0"})
+	_, reqErr, err := other.SendRequest(t.Context(), "mcu/led")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAvailable), "method mcu/led not available"}, reqErr)
+
+	mcu := connect(msgpackrouter.ConnectionInfo{Transport: "serial", RemoteAddr: "/dev/ttyACM0"})
+	result, reqErr, err := other.SendRequest(t.Context(), "mcu/led")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, "mcu/led", result)
+
+	// The client may register the restored methods again, but only once
+	for _, expected := range []any{nil, []any{int8(msgpackrouter.ErrCodeRouteAlreadyExists), "route already exists: mcu/temp"}} {
+		_, reqErr, err = mcu.SendRequest(t.Context(), "$/register", "mcu/temp")
+		require.NoError(t, err)
+		require.Equal(t, expected, reqErr)
+	}
+	_, reqErr, err = other.SendRequest(t.Context(), "$/register", "mcu/led")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeRouteAlreadyExists), "route already exists: mcu/led"}, reqErr)
+}
+
+func TestResponseCache(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetCacheTTL("weather/*", 100*time.Millisecond)
+
+	var calls atomic.Int32
+	ch1a, ch1b := newFullPipe()
+	provider := msgpackrpc.NewConnection(ch1a, ch1a, func(_ msgpackrpc.FunctionLogger, _ string, params []any, res msgpackrpc.ResponseHandler) {
+		count := calls.Add(1)
+		if params[0] == "mars" {
+			res(nil, []any{1, "unknown city"})
+			return
+		}
+		res(fmt.Sprintf("sunny in %s (%d)", params[0], count), nil)
+	}, nil, nil)
+	go provider.Run()
+	defer provider.Close()
+	router.Accept(ch1b)
+	_, _, err := provider.SendRequest(t.Context(), "$/register", "weather/now")
+	require.NoError(t, err)
+
+	ch2a, ch2b := newFullPipe()
+	cl := msgpackrpc.NewConnection(ch2a, ch2a, nil, nil, nil)
+	go cl.Run()
+	defer cl.Close()
+	router.Accept(ch2b)
+	call := func(city string) (any, any) {
+		result, reqErr, err := cl.SendRequest(t.Context(), "weather/now", city)
+		require.NoError(t, err)
+		return result, reqErr
+	}
+
+	// The repeated requests are answered from the cache...
+	result, _ := call("turin")
+	require.Equal(t, "sunny in turin (1)", result)
+	result, _ = call("turin")
+	require.Equal(t, "sunny in turin (1)", result)
+	// ...unless the params are different...
+	result, _ = call("milan")
+	require.Equal(t, "sunny in milan (2)", result)
+	// ...or the response is an error
+	_, reqErr := call("mars")
+	require.NotNil(t, reqErr)
+	_, reqErr = call("mars")
+	require.NotNil(t, reqErr)
+	require.Equal(t, uint64(1), router.Stats()["cache_hits"])
+	require.Equal(t, uint64(4), router.Stats()["cache_misses"])
+
+	// The cached responses expire
+	time.Sleep(150 * time.Millisecond)
+	result, _ = call("turin")
+	require.Equal(t, "sunny in turin (5)", result)
+
+	// The caching can be disabled
+	router.SetCacheTTL("weather/*", 0)
+	result, _ = call("turin")
+	require.Equal(t, "sunny in turin (6)", result)
+}
+
+func TestRequestCoalescing(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetCacheTTL("net/resolve", time.Minute)
+
+	var calls atomic.Int32
+	release := make(chan struct{})
+	ch1a, ch1b := newFullPipe()
+	provider := msgpackrpc.NewConnection(ch1a, ch1a, func(_ msgpackrpc.FunctionLogger, _ string, params []any, res msgpackrpc.ResponseHandler) {
+		calls.Add(1)
+		<-release
+		res("192.0.2.1", nil)
+	}, nil, nil)
+	go provider.Run()
+	defer provider.Close()
+	router.Accept(ch1b)
+	_, _, err := provider.SendRequest(t.Context(), "$/register", "net/resolve")
+	require.NoError(t, err)
+
+	// The identical requests of several callers are forwarded once...
+	var wg sync.WaitGroup
+	results := make([]any, 3)
+	for i := range results {
+		cha, chb := newFullPipe()
+		cl := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+		go cl.Run()
+		defer cl.Close()
+		router.Accept(chb)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _, _ = cl.SendRequest(t.Context(), "net/resolve", "example.com")
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return router.Stats()["cache_coalesced"] == uint64(2)
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+
+	// ...and all of them get the response
+	wg.Wait()
+	require.Equal(t, []any{"192.0.2.1", "192.0.2.1", "192.0.2.1"}, results)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestSessionResume(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetSessionGracePeriod(time.Minute)
+	router.SetRole(msgpackrouter.RoleMCU, nil)
+	var lock sync.Mutex
+	var closed []*msgpackrpc.Connection
+	var resumed [][2]*msgpackrpc.Connection
+	router.OnConnectionClosed(func(conn *msgpackrpc.Connection) {
+		lock.Lock()
+		defer lock.Unlock()
+		closed = append(closed, conn)
+	})
+	router.OnConnectionResumed(func(from, to *msgpackrpc.Connection) {
+		lock.Lock()
+		defer lock.Unlock()
+		resumed = append(resumed, [2]*msgpackrpc.Connection{from, to})
+	})
+	connectMCU := func() (*msgpackrpc.Connection, *msgpackrpc.Connection, <-chan struct{}) {
+		cha, chb := newFullPipe()
+		mcu := msgpackrpc.NewConnection(cha, cha, func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+			res(params[0], nil)
+		}, nil, nil)
+		go mcu.Run()
+		routerConn, exited := router.AcceptConnectionWithInfo(chb, msgpackrouter.ConnectionInfo{Transport: "serial", Role: msgpackrouter.RoleMCU})
+		return mcu, routerConn, exited
+	}
+	cha, chb := newFullPipe()
+	caller := msgpackrpc.NewConnection(cha, cha, nil, nil, nil)
+	go caller.Run()
+	defer caller.Close()
+	router.Accept(chb)
+
+	// The MCU starts a session, always with the same token
+	mcu, oldConn, exited := connectMCU()
+	_, reqErr, err := mcu.SendRequest(t.Context(), "$/register", "mcu/echo")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	token, reqErr, err := mcu.SendRequest(t.Context(), msgpackrouter.SessionStartMethod)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Len(t, token, 32)
+	again, _, err := mcu.SendRequest(t.Context(), msgpackrouter.SessionStartMethod)
+	require.NoError(t, err)
+	require.Equal(t, token, again)
+
+	// While disconnected its methods are not available, and its state is kept
+	mcu.Close()
+	<-exited
+	_, reqErr, err = caller.SendRequest(t.Context(), "mcu/echo", "hello")
+	require.NoError(t, err)
+	require.Equal(t, int8(msgpackrouter.ErrCodeMethodNotAvailable), reqErr.([]any)[0])
+	lock.Lock()
+	require.Empty(t, closed)
+	lock.Unlock()
+
+	// The session can only be resumed with the token, by a client with the
+	// same role
+	_, reqErr, err = caller.SendRequest(t.Context(), msgpackrouter.SessionResumeMethod, token)
+	require.NoError(t, err)
+	require.Equal(t, int8(msgpackrouter.ErrCodeSessionNotFound), reqErr.([]any)[0])
+	mcu, newConn, exited := connectMCU()
+	_, reqErr, err = mcu.SendRequest(t.Context(), msgpackrouter.SessionResumeMethod, "wrong")
+	require.NoError(t, err)
+	require.Equal(t, int8(msgpackrouter.ErrCodeSessionNotFound), reqErr.([]any)[0])
+	result, reqErr, err := mcu.SendRequest(t.Context(), msgpackrouter.SessionResumeMethod, token)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+	lock.Lock()
+	require.Equal(t, [][2]*msgpackrpc.Connection{{oldConn, newConn}}, resumed)
+	lock.Unlock()
+	result, reqErr, err = caller.SendRequest(t.Context(), "mcu/echo", "hello")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, "hello", result)
+	require.Equal(t, uint64(1), router.Stats()["sessions_resumed"])
+
+	// The state is released when the grace period expires
+	router.SetSessionGracePeriod(10 * time.Millisecond)
+	mcu.Close()
+	<-exited
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(closed) == 1 && closed[0] == newConn
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(1), router.Stats()["sessions_expired"])
+	mcu, _, _ = connectMCU()
+	defer mcu.Close()
+	_, reqErr, err = mcu.SendRequest(t.Context(), msgpackrouter.SessionResumeMethod, token)
+	require.NoError(t, err)
+	require.Equal(t, int8(msgpackrouter.ErrCodeSessionNotFound), reqErr.([]any)[0])
+
+	// The sessions can be disabled
+	router.SetSessionGracePeriod(0)
+	_, reqErr, err = mcu.SendRequest(t.Context(), msgpackrouter.SessionStartMethod)
+	require.NoError(t, err)
+	require.NotNil(t, reqErr)
+}
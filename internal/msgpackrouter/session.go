@@ -0,0 +1,177 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// Session methods: a client starts a session to get a token, and after a
+// reconnection it resumes the session with the token to reclaim its state.
+const (
+	SessionStartMethod  = "$/session/start"
+	SessionResumeMethod = "$/session/resume"
+)
+
+// session is the state of a client kept for the grace period after it
+// disconnects.
+type session struct {
+	token string
+	conn  *msgpackrpc.Connection
+	// identity and role of the client, the connection resuming the session
+	// must have the same ones.
+	identity string
+	role     string
+	// methods are the methods registered by the client when it disconnected,
+	// that are registered again when the session is resumed.
+	methods []string
+	// expiry releases the state of the client at the end of the grace
+	// period, it is nil while the client is connected.
+	expiry *time.Timer
+}
+
+// SetSessionGracePeriod sets how long the state of a client that started a
+// session is kept after it disconnects, waiting for the client to resume the
+// session. A zero period disables the sessions.
+func (r *Router) SetSessionGracePeriod(period time.Duration) {
+	r.sessionGrace.Store(int64(period))
+}
+
+// OnConnectionResumed adds a handler called when a client resumes its
+// session with a new connection, to move the resources owned by the old
+// connection to the new one. The handlers added with OnConnectionClosed are
+// called for the old connection only if the session expires.
+func (r *Router) OnConnectionResumed(handler func(from, to *msgpackrpc.Connection)) {
+	r.closeHandlersLock.Lock()
+	defer r.closeHandlersLock.Unlock()
+	r.resumeHandlers = append(r.resumeHandlers, handler)
+}
+
+// startSession starts the session of the connection, or returns the token of
+// the session already started.
+func (r *Router) startSession(conn *msgpackrpc.Connection) (string, []any) {
+	if r.sessionGrace.Load() <= 0 {
+		return "", routerError(ErrCodeGenericError, "sessions are not enabled")
+	}
+	info, _ := r.ConnectionInfo(conn)
+	r.sessionsLock.Lock()
+	defer r.sessionsLock.Unlock()
+	if s, ok := r.connSessions[conn]; ok {
+		return s.token, nil
+	}
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	s := &session{
+		token:    hex.EncodeToString(token),
+		conn:     conn,
+		identity: info.Identity,
+		role:     info.Role,
+	}
+	r.sessions[s.token] = s
+	r.connSessions[conn] = s
+	slog.Info("Started session", "transport", info.Transport, "addr", info.RemoteAddr)
+	return s.token, nil
+}
+
+// suspendSession keeps the state of the disconnected client for the grace
+// period, if it started a session, and returns true. It must be called before
+// removing the methods of the connection.
+func (r *Router) suspendSession(conn *msgpackrpc.Connection) bool {
+	methods := r.RegisteredMethods(conn)
+	r.sessionsLock.Lock()
+	defer r.sessionsLock.Unlock()
+	s, ok := r.connSessions[conn]
+	if !ok {
+		return false
+	}
+	grace := time.Duration(r.sessionGrace.Load())
+	if grace <= 0 {
+		delete(r.connSessions, conn)
+		delete(r.sessions, s.token)
+		return false
+	}
+	s.methods = methods
+	s.expiry = time.AfterFunc(grace, func() { r.expireSession(s) })
+	slog.Info("Suspended session", "methods", methods, "grace_period", grace)
+	return true
+}
+
+// expireSession releases the state of the client that did not resume its
+// session in time.
+func (r *Router) expireSession(s *session) {
+	r.sessionsLock.Lock()
+	if r.sessions[s.token] != s || s.expiry == nil {
+		// Resumed meanwhile
+		r.sessionsLock.Unlock()
+		return
+	}
+	delete(r.sessions, s.token)
+	delete(r.connSessions, s.conn)
+	r.sessionsLock.Unlock()
+	r.sessionsExpired.Add(1)
+	slog.Info("Session expired", "methods", s.methods)
+	r.runCloseHandlers(s.conn)
+}
+
+// resumeSession moves the state of the suspended session with the given
+// token to the connection.
+func (r *Router) resumeSession(conn *msgpackrpc.Connection, token string) []any {
+	info, _ := r.ConnectionInfo(conn)
+	r.sessionsLock.Lock()
+	s, ok := r.sessions[token]
+	if !ok || s.expiry == nil || s.identity != info.Identity || s.role != info.Role {
+		r.sessionsLock.Unlock()
+		return routerError(ErrCodeSessionNotFound, "session not found or expired")
+	}
+	if _, started := r.connSessions[conn]; started {
+		r.sessionsLock.Unlock()
+		return routerError(ErrCodeGenericError, "a session is already started on this connection")
+	}
+	if !s.expiry.Stop() {
+		// Expiring right now
+		r.sessionsLock.Unlock()
+		return routerError(ErrCodeSessionNotFound, "session not found or expired")
+	}
+	old := s.conn
+	s.expiry = nil
+	s.conn = conn
+	delete(r.connSessions, old)
+	r.connSessions[conn] = s
+	methods := s.methods
+	s.methods = nil
+	r.sessionsLock.Unlock()
+
+	for _, method := range methods {
+		if err := r.registerMethod(method, conn); err != nil {
+			slog.Warn("Failed to register method of resumed session", "method", method, "err", err)
+		}
+	}
+	r.closeHandlersLock.Lock()
+	resumeHandlers := slices.Clone(r.resumeHandlers)
+	r.closeHandlersLock.Unlock()
+	for _, handler := range resumeHandlers {
+		handler(old, conn)
+	}
+	r.sessionsResumed.Add(1)
+	slog.Info("Resumed session", "transport", info.Transport, "addr", info.RemoteAddr, "methods", methods)
+	return nil
+}
@@ -0,0 +1,155 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// TapMethod is the method used by the clients to start (or stop) receiving
+// the routed messages, and the notification method of the events sent to them.
+const TapMethod = "$/debug/tap"
+
+// tapQueueSize is the number of events that can be queued for a tap client,
+// further events are dropped until the client catches up.
+const tapQueueSize = 256
+
+// tap is a client receiving the events of the routed messages.
+type tap struct {
+	events  chan map[string]any
+	dropped uint64
+}
+
+// setTap starts or stops sending the routed messages events to conn.
+func (r *Router) setTap(conn *msgpackrpc.Connection, enable bool) {
+	r.tapsLock.Lock()
+	defer r.tapsLock.Unlock()
+
+	if t, ok := r.taps[conn]; ok && !enable {
+		delete(r.taps, conn)
+		close(t.events)
+	} else if !ok && enable {
+		t := &tap{events: make(chan map[string]any, tapQueueSize)}
+		r.taps[conn] = t
+		go func() {
+			for event := range t.events {
+				if err := conn.SendNotification(TapMethod, event); err != nil {
+					slog.Debug("Failed to send tap event", "err", err)
+				}
+			}
+		}()
+	}
+	r.tapCount.Store(int32(len(r.taps))) //nolint:gosec
+}
+
+// tapping returns true if there are clients receiving the tap events.
+func (r *Router) tapping() bool {
+	return r.tapCount.Load() > 0
+}
+
+// emitTap sends the event to all the tap clients.
+func (r *Router) emitTap(event map[string]any) {
+	event["time"] = time.Now().Format(time.RFC3339Nano)
+	r.tapsLock.Lock()
+	defer r.tapsLock.Unlock()
+	for _, t := range r.taps {
+		select {
+		case t.events <- event:
+		default:
+			t.dropped++
+		}
+	}
+}
+
+// tapMessage emits the event of a routed message, from and to may be nil for
+// messages handled by the router itself.
+func (r *Router) tapMessage(kind string, id uint64, method string, from, to *msgpackrpc.Connection, payload any) {
+	event := map[string]any{
+		"type":   kind,
+		"method": method,
+		"from":   r.connectionName(from),
+		"to":     r.connectionName(to),
+		"size":   payloadSize(payload),
+	}
+	if id != 0 {
+		event["id"] = id
+	}
+	r.emitTap(event)
+}
+
+// tapRequest emits the event of a routed request, and returns the response
+// handler that emits the event of its response.
+func (r *Router) tapRequest(method string, params msgpackrpc.RawMessage, from, to *msgpackrpc.Connection, res RouterResponseHandler) RouterResponseHandler {
+	id := r.tapLastID.Add(1)
+	start := time.Now()
+	r.tapMessage("request", id, method, from, to, params)
+	return func(result any, err any) {
+		r.tapResponse(id, method, to, from, start, result, err)
+		res(result, err)
+	}
+}
+
+// tapResponse emits the event of the response to a routed request.
+func (r *Router) tapResponse(id uint64, method string, from, to *msgpackrpc.Connection, start time.Time, result, err any) {
+	r.emitTap(map[string]any{
+		"type":       "response",
+		"id":         id,
+		"method":     method,
+		"from":       r.connectionName(from),
+		"to":         r.connectionName(to),
+		"size":       payloadSize([]any{result, err}),
+		"latency_us": time.Since(start).Microseconds(),
+		"error":      err != nil,
+	})
+}
+
+// connectionName returns a human readable name of the connection, "router"
+// if conn is nil.
+func (r *Router) connectionName(conn *msgpackrpc.Connection) string {
+	if conn == nil {
+		return "router"
+	}
+	info, _ := r.ConnectionInfo(conn)
+	name := cmp.Or(info.Transport, "conn")
+	switch {
+	case info.Identity != "":
+		name += " " + info.Identity
+	case info.PeerCredentials != nil:
+		name += fmt.Sprintf(" pid=%d", info.PeerCredentials.PID)
+	case info.RemoteAddr != "":
+		name += " " + info.RemoteAddr
+	}
+	return name
+}
+
+// payloadSize returns the size of the MessagePack encoding of v.
+func payloadSize(v any) int {
+	if raw, ok := v.(msgpackrpc.RawMessage); ok {
+		return len(raw)
+	}
+	data, err := msgpack.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
@@ -0,0 +1,81 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrouter
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// TimeSyncMethod is the method used by the clients to estimate the offset
+// between their clock and the clock of the router, NTP-style.
+const TimeSyncMethod = "$/timeSync"
+
+// peerClock is the estimated clock of a client, reported with $/timeSync.
+type peerClock struct {
+	// offset is the clock of the router minus the clock of the client, in
+	// microseconds.
+	offset atomic.Int64
+	synced atomic.Bool
+}
+
+// now returns the current time of the client clock, false if the client has
+// not reported its offset.
+func (c *peerClock) now() (time.Time, bool) {
+	if !c.synced.Load() {
+		return time.Time{}, false
+	}
+	return time.Now().Add(-time.Duration(c.offset.Load()) * time.Microsecond), true
+}
+
+// logAttrs appends the time of the client clock (if known) to the
+// attributes of a log record.
+func (c *peerClock) logAttrs(args ...any) []any {
+	if t, ok := c.now(); ok {
+		return append(args, "peer_time", t)
+	}
+	return args
+}
+
+// timeSync handles a $/timeSync request received at the given time: the
+// params are the transmit time of the client (t1) and, optionally, the
+// offset that the client computed in a previous exchange, that is stored to
+// stamp the logs. The result is [t1, t2, t3], where t2 and t3 are the
+// receive and transmit times of the router. All the times are microseconds
+// since the Unix epoch, and the offset is the router clock minus the client
+// clock: the client computes it from the time t4 when it receives the
+// response as ((t2 - t1) + (t3 - t4)) / 2.
+func (c *peerClock) timeSync(received time.Time, params []any) (any, any) {
+	if len(params) != 1 && len(params) != 2 {
+		return nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: expected (client time[, offset]), got %d params", len(params)))
+	}
+	t1, ok := msgpackrpc.ToInt(params[0])
+	if !ok {
+		return nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: expected int, got %T", params[0]))
+	}
+	if len(params) == 2 {
+		offset, ok := msgpackrpc.ToInt(params[1])
+		if !ok {
+			return nil, routerError(ErrCodeInvalidParams, fmt.Sprintf("invalid params: expected int, got %T", params[1]))
+		}
+		c.offset.Store(int64(offset))
+		c.synced.Store(true)
+	}
+	return []any{t1, received.UnixMicro(), time.Now().UnixMicro()}, nil
+}
@@ -0,0 +1,98 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package networkapi
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// outgoingBinding pins the outgoing connections to a local address and/or a
+// network interface, so that multi-homed boards can choose the uplink used.
+type outgoingBinding struct {
+	// localAddr is the source address of the connections, any if empty.
+	localAddr string
+	// iface is the name of the network interface of the connections, the
+	// one chosen by the routing table if empty.
+	iface string
+}
+
+// parseOutgoingBinding reads the optional local address and interface
+// parameters starting at params[i]. It returns the error to send to the
+// client if a parameter is not valid.
+func parseOutgoingBinding(params []any, i int) (outgoingBinding, []any) {
+	var b outgoingBinding
+	if len(params) > i {
+		addr, ok := params[i].(string)
+		if !ok {
+			return b, []any{1, "Invalid parameter type, expected string for local address"}
+		}
+		b.localAddr = addr
+	}
+	if len(params) > i+1 {
+		iface, errRes := parseInterface(params[i+1])
+		if errRes != nil {
+			return b, errRes
+		}
+		b.iface = iface
+	}
+	return b, nil
+}
+
+// parseInterface reads the name of a network interface, that must exist if
+// not empty.
+func parseInterface(param any) (string, []any) {
+	iface, ok := param.(string)
+	if !ok {
+		return "", []any{1, "Invalid parameter type, expected string for network interface"}
+	}
+	if iface != "" {
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return "", []any{2, "Unknown network interface: " + iface}
+		}
+	}
+	return iface, nil
+}
+
+// dialer returns a dialer of TCP connections with the binding applied.
+func (b outgoingBinding) dialer() (*net.Dialer, error) {
+	d := &net.Dialer{Control: b.control}
+	if b.localAddr != "" {
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(b.localAddr, "0"))
+		if err != nil {
+			return nil, err
+		}
+		d.LocalAddr = addr
+	}
+	return d, nil
+}
+
+// control binds the socket to the network interface, if any. Before Linux
+// 5.7 this requires the net_raw capability.
+func (b outgoingBinding) control(_, _ string, c syscall.RawConn) error {
+	if b.iface == "" {
+		return nil
+	}
+	var err error
+	if ctrlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, b.iface)
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	return err
+}
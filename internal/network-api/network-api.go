@@ -16,74 +16,214 @@
 package networkapi
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"maps"
+	"math/rand/v2"
 	"net"
 	"os"
+	"slices"
 	"strconv"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/internal/tracing"
 	"github.com/arduino/arduino-router/msgpackrpc"
 )
 
-// Register the Network API methods
-func Register(router *msgpackrouter.Router) {
-	_ = router.RegisterMethod("tcp/connect", tcpConnect)
+// Options are the settings of the Network API.
+type Options struct {
+	// Resolver is the policy used to resolve the host names.
+	Resolver ResolverConfig
+}
+
+// Service is an instance of the Network API, holding the network handles
+// opened by the clients of a router.
+type Service struct {
+	opts   Options
+	router *msgpackrouter.Router
+	// resolver is the policy of the host names, nil to let the dialers
+	// resolve them with the resolver of the system.
+	resolver *resolverPolicy
+	// openFile opens the files sent by net/sendFile.
+	openFile func(path string) (*os.File, error)
+
+	// The open handles by ID. There is no global lock: the calls on
+	// different handles don't contend, and the state of each UDP socket has
+	// its own lock.
+	liveConnections    sync.Map // uint -> net.Conn
+	liveListeners      sync.Map // uint -> net.Listener
+	liveUdpConnections sync.Map // uint -> *udpSocket
+
+	// owners holds the ownership of the open handles, by ID.
+	ownersLock sync.Mutex
+	owners     map[uint]*handleOwnership
+}
+
+// New creates an instance of the Network API with the given options.
+func New(opts Options) *Service {
+	return &Service{
+		opts:   opts,
+		owners: make(map[uint]*handleOwnership),
+	}
+}
+
+// Register validates the options and registers the Network API methods.
+func (s *Service) Register(router *msgpackrouter.Router) error {
+	policy, err := newResolverPolicy(s.opts.Resolver)
+	if err != nil {
+		return err
+	}
+	s.resolver = policy
+	s.router = router
+
+	_ = router.RegisterMethodWithContext("tcp/connect", s.tcpConnect)
+
+	_ = router.RegisterMethod("tcp/listen", s.tcpListen)
+	_ = router.RegisterMethod("tcp/closeListener", s.tcpCloseListener)
 
-	_ = router.RegisterMethod("tcp/listen", tcpListen)
-	_ = router.RegisterMethod("tcp/closeListener", tcpCloseListener)
+	_ = router.RegisterMethodWithContext("tcp/accept", s.tcpAccept)
+	_ = router.RegisterMethodWithContext("tcp/read", s.tcpRead)
+	_ = router.RegisterMethod("tcp/write", s.tcpWrite)
+	_ = router.RegisterMethod("tcp/close", s.tcpClose)
 
-	_ = router.RegisterMethod("tcp/accept", tcpAccept)
-	_ = router.RegisterMethod("tcp/read", tcpRead)
-	_ = router.RegisterMethod("tcp/write", tcpWrite)
-	_ = router.RegisterMethod("tcp/close", tcpClose)
+	_ = router.RegisterMethodWithContext("tcp/connectSSL", s.tcpConnectSSL)
 
-	_ = router.RegisterMethod("tcp/connectSSL", tcpConnectSSL)
+	_ = router.RegisterMethod("udp/connect", s.udpConnect)
+	_ = router.RegisterMethod("udp/beginPacket", s.udpBeginPacket)
+	_ = router.RegisterMethod("udp/write", s.udpWrite)
+	_ = router.RegisterMethod("udp/endPacket", s.udpEndPacket)
+	_ = router.RegisterMethodWithContext("udp/awaitPacket", s.udpAwaitPacket)
+	_ = router.RegisterMethod("udp/read", s.udpRead)
+	_ = router.RegisterMethod("udp/dropPacket", s.udpDropPacket)
+	_ = router.RegisterMethod("udp/close", s.udpClose)
 
-	_ = router.RegisterMethod("udp/connect", udpConnect)
-	_ = router.RegisterMethod("udp/beginPacket", udpBeginPacket)
-	_ = router.RegisterMethod("udp/write", udpWrite)
-	_ = router.RegisterMethod("udp/endPacket", udpEndPacket)
-	_ = router.RegisterMethod("udp/awaitPacket", udpAwaitPacket)
-	_ = router.RegisterMethod("udp/read", udpRead)
-	_ = router.RegisterMethod("udp/dropPacket", udpDropPacket)
-	_ = router.RegisterMethod("udp/close", udpClose)
+	_ = router.RegisterMethod("net/transferHandle", s.netTransferHandle)
+	_ = router.RegisterMethod("net/acceptHandle", s.netAcceptHandle)
+	router.OnConnectionClosed(s.closeOwnedBy)
+	router.OnConnectionResumed(s.moveOwned)
+	return nil
 }
 
-var lock sync.RWMutex
-var liveConnections = make(map[uint]net.Conn)
-var liveListeners = make(map[uint]net.Listener)
-var liveUdpConnections = make(map[uint]net.PacketConn)
-var udpReadBuffers = make(map[uint][]byte)
-var udpWriteTargets = make(map[uint]*net.UDPAddr)
-var udpWriteBuffers = make(map[uint][]byte)
-var nextConnectionID atomic.Uint32
-
-// takeLockAndGenerateNextID generates a new unique ID for a connection or listener.
-// It locks the global lock to ensure thread safety and checks for existing IDs.
-// It returns the new ID and a function to unlock the global lock.
-func takeLockAndGenerateNextID() (newID uint, unlock func()) {
-	lock.Lock()
-	for {
-		id := uint(nextConnectionID.Add(1))
-		_, exists1 := liveConnections[id]
-		_, exists2 := liveListeners[id]
-		if !exists1 && !exists2 {
-			return id, func() {
-				lock.Unlock()
-			}
-		}
+// Close closes all the open handles.
+func (s *Service) Close() {
+	s.ownersLock.Lock()
+	ids := slices.Collect(maps.Keys(s.owners))
+	clear(s.owners)
+	s.ownersLock.Unlock()
+	s.closeHandles(ids)
+}
+
+// udpSocket is an open UDP socket, with the packet being written (between
+// udp/beginPacket and udp/endPacket) and the rest of the packet received.
+type udpSocket struct {
+	*net.UDPConn
+	// peer is the remote address of a connected socket, that only exchanges
+	// packets with it, nil if not connected.
+	peer *net.UDPAddr
+
+	lock        sync.Mutex
+	writing     bool
+	writeTarget *net.UDPAddr
+	writeBuffer []byte
+	readBuffer  []byte
+}
+
+// Stats returns the number of open connections and listeners.
+func (s *Service) Stats() map[string]any {
+	return map[string]any{
+		"tcp_connections": countHandles(&s.liveConnections),
+		"tcp_listeners":   countHandles(&s.liveListeners),
+		"udp_connections": countHandles(&s.liveUdpConnections),
 	}
 }
 
-func tcpConnect(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
-	if len(params) != 2 {
-		res(nil, []any{1, "Invalid number of parameters, expected server address and port"})
+func countHandles(handles *sync.Map) int {
+	n := 0
+	handles.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// storeHandle stores the handle owned by the given client with a new random
+// ID, that is returned. The IDs are not sequential, so that the handles of
+// the other clients can't be guessed.
+func (s *Service) storeHandle(handles *sync.Map, handle any, owner *msgpackrpc.Connection) uint {
+	s.ownersLock.Lock()
+	var id uint
+	for id == 0 || s.owners[id] != nil {
+		id = uint(rand.Int32())
+	}
+	s.owners[id] = &handleOwnership{owner: owner}
+	s.ownersLock.Unlock()
+	handles.Store(id, handle)
+	return id
+}
+
+// loadHandle returns the handle with the given ID, if owned by the client.
+func (s *Service) loadHandle(handles *sync.Map, rpc *msgpackrpc.Connection, id uint) (any, bool) {
+	if !s.ownedBy(id, rpc) {
+		return nil, false
+	}
+	return handles.Load(id)
+}
+
+// takeHandle removes the handle with the given ID, if owned by the client,
+// and returns it to be closed.
+func (s *Service) takeHandle(handles *sync.Map, rpc *msgpackrpc.Connection, id uint) (any, bool) {
+	if !s.ownedBy(id, rpc) {
+		return nil, false
+	}
+	h, ok := handles.LoadAndDelete(id)
+	if ok {
+		s.releaseOwner(id)
+	}
+	return h, ok
+}
+
+func (s *Service) getConnection(rpc *msgpackrpc.Connection, id uint) (net.Conn, bool) {
+	if conn, ok := s.loadHandle(&s.liveConnections, rpc, id); ok {
+		return conn.(net.Conn), true
+	}
+	return nil, false
+}
+
+func (s *Service) getListener(rpc *msgpackrpc.Connection, id uint) (net.Listener, bool) {
+	if listener, ok := s.loadHandle(&s.liveListeners, rpc, id); ok {
+		return listener.(net.Listener), true
+	}
+	return nil, false
+}
+
+func (s *Service) getUDPSocket(rpc *msgpackrpc.Connection, id uint) (*udpSocket, bool) {
+	if socket, ok := s.loadHandle(&s.liveUdpConnections, rpc, id); ok {
+		return socket.(*udpSocket), true
+	}
+	return nil, false
+}
+
+// abortOnCancel interrupts the blocking calls on a handle when the request is
+// canceled, by moving its deadline in the past. The returned function must be
+// called when the blocking call returns, it reports whether the deadline was
+// moved.
+func abortOnCancel(ctx context.Context, setDeadline func(time.Time) error) (done func() bool) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = setDeadline(time.Unix(1, 0))
+	})
+	return func() bool { return !stop() }
+}
+
+// tcpConnect connects to the given server. The optional local address and
+// network interface pin the connection to an uplink.
+func (s *Service) tcpConnect(ctx context.Context, rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) < 2 || len(params) > 4 {
+		res(nil, []any{1, "Invalid number of parameters, expected server address and port[, local address[, network interface]]"})
 		return
 	}
 	serverAddr, ok := params[0].(string)
@@ -97,9 +237,20 @@ func tcpConnect(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Rout
 		return
 	}
 
-	serverAddr = net.JoinHostPort(serverAddr, strconv.FormatUint(uint64(serverPort), 10))
+	binding, errRes := parseOutgoingBinding(params, 2)
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	dialer, err := binding.dialer()
+	if err != nil {
+		res(nil, []any{2, "Failed to resolve local address: " + err.Error()})
+		return
+	}
 
-	conn, err := net.Dial("tcp", serverAddr)
+	span := tracing.StartSpan("tcp connect", tracing.KindClient, tracing.Current(rpc), "server.address", net.JoinHostPort(serverAddr, strconv.FormatUint(uint64(serverPort), 10)))
+	conn, err := s.resolver.dial(ctx, dialer, "tcp", serverAddr, serverPort)
+	span.End(err)
 	if err != nil {
 		res(nil, []any{2, "Failed to connect to server: " + err.Error()})
 		return
@@ -107,13 +258,11 @@ func tcpConnect(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Rout
 
 	// Successfully connected to the server
 
-	id, unlock := takeLockAndGenerateNextID()
-	liveConnections[id] = conn
-	unlock()
+	id := s.storeHandle(&s.liveConnections, conn, rpc)
 	res(id, nil)
 }
 
-func tcpListen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) tcpListen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 2 {
 		res(nil, []any{1, "Invalid number of parameters, expected listen address and port"})
 		return
@@ -137,13 +286,11 @@ func tcpListen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Route
 		return
 	}
 
-	id, unlock := takeLockAndGenerateNextID()
-	liveListeners[id] = listener
-	unlock()
+	id := s.storeHandle(&s.liveListeners, listener, rpc)
 	res(id, nil)
 }
 
-func tcpAccept(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) tcpAccept(ctx context.Context, rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Invalid number of parameters, expected listener ID"})
 		return
@@ -154,16 +301,31 @@ func tcpAccept(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Route
 		return
 	}
 
-	lock.RLock()
-	listener, exists := liveListeners[listenerID]
-	lock.RUnlock()
+	listener, exists := s.getListener(rpc, listenerID)
 
 	if !exists {
 		res(nil, []any{2, fmt.Sprintf("Listener not found for ID: %d", listenerID)})
 		return
 	}
 
+	done := func() bool { return false }
+	if l, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+		// Clear the deadline left by a previous canceled call
+		if err := l.SetDeadline(time.Time{}); err != nil {
+			res(nil, []any{3, "Failed to clear accept deadline: " + err.Error()})
+			return
+		}
+		done = abortOnCancel(ctx, l.SetDeadline)
+	}
 	conn, err := listener.Accept()
+	if done() && (err == nil || errors.Is(err, os.ErrDeadlineExceeded)) {
+		// Nobody waits for the accepted connection
+		if conn != nil {
+			conn.Close()
+		}
+		res(nil, []any{3, "Request canceled"})
+		return
+	}
 	if err != nil {
 		res(nil, []any{3, "Failed to accept connection: " + err.Error()})
 		return
@@ -171,13 +333,11 @@ func tcpAccept(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Route
 
 	// Successfully accepted a connection
 
-	connID, unlock := takeLockAndGenerateNextID()
-	liveConnections[connID] = conn
-	unlock()
+	connID := s.storeHandle(&s.liveConnections, conn, rpc)
 	res(connID, nil)
 }
 
-func tcpClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) tcpClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Invalid number of parameters, expected connection ID"})
 		return
@@ -188,12 +348,7 @@ func tcpClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Router
 		return
 	}
 
-	lock.Lock()
-	conn, existsConn := liveConnections[id]
-	if existsConn {
-		delete(liveConnections, id)
-	}
-	lock.Unlock()
+	v, existsConn := s.takeHandle(&s.liveConnections, rpc, id)
 
 	if !existsConn {
 		res(nil, []any{2, fmt.Sprintf("Connection not found for ID: %d", id)})
@@ -203,14 +358,14 @@ func tcpClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Router
 	// Close the connection if it exists
 	// We do not return an error to the caller if the close operation fails, as it is not critical,
 	// but we only log the error for debugging purposes.
-	if err := conn.Close(); err != nil {
+	if err := v.(net.Conn).Close(); err != nil {
 		res(err.Error(), nil)
 		return
 	}
 	res("", nil)
 }
 
-func tcpCloseListener(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) tcpCloseListener(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Invalid number of parameters, expected listener ID"})
 		return
@@ -221,12 +376,7 @@ func tcpCloseListener(rpc *msgpackrpc.Connection, params []any, res msgpackroute
 		return
 	}
 
-	lock.Lock()
-	listener, existsListener := liveListeners[id]
-	if existsListener {
-		delete(liveListeners, id)
-	}
-	lock.Unlock()
+	v, existsListener := s.takeHandle(&s.liveListeners, rpc, id)
 
 	if !existsListener {
 		res(nil, []any{2, fmt.Sprintf("Listener not found for ID: %d", id)})
@@ -236,14 +386,14 @@ func tcpCloseListener(rpc *msgpackrpc.Connection, params []any, res msgpackroute
 	// Close the listener if it exists
 	// We do not return an error to the caller if the close operation fails, as it is not critical,
 	// but we only log the error for debugging purposes.
-	if err := listener.Close(); err != nil {
+	if err := v.(net.Listener).Close(); err != nil {
 		res(err.Error(), nil)
 		return
 	}
 	res("", nil)
 }
 
-func tcpRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) tcpRead(ctx context.Context, rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 2 && len(params) != 3 {
 		res(nil, []any{1, "Invalid number of parameters, expected (connection ID, max bytes to read[, optional timeout in ms])"})
 		return
@@ -253,9 +403,7 @@ func tcpRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 		res(nil, []any{1, "Invalid parameter type, expected int for connection ID"})
 		return
 	}
-	lock.RLock()
-	conn, ok := liveConnections[id]
-	lock.RUnlock()
+	conn, ok := s.getConnection(rpc, id)
 	if !ok {
 		res(nil, []any{2, fmt.Sprintf("Connection not found for ID: %d", id)})
 		return
@@ -283,8 +431,12 @@ func tcpRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 		res(nil, []any{3, "Failed to set read timeout: " + err.Error()})
 		return
 	}
+	done := abortOnCancel(ctx, conn.SetReadDeadline)
 	n, err := conn.Read(buffer)
-	if errors.Is(err, os.ErrDeadlineExceeded) {
+	if done() && errors.Is(err, os.ErrDeadlineExceeded) {
+		res(nil, []any{3, "Request canceled"})
+		return
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
 		// timeout
 	} else if err != nil {
 		res(nil, []any{3, "Failed to read from connection: " + err.Error()})
@@ -294,7 +446,7 @@ func tcpRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 	res(buffer[:n], nil)
 }
 
-func tcpWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) tcpWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 2 {
 		res(nil, []any{1, "Invalid number of parameters, expected (connection ID, data to write)"})
 		return
@@ -304,9 +456,7 @@ func tcpWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Router
 		res(nil, []any{1, "Invalid parameter type, expected int for connection ID"})
 		return
 	}
-	lock.RLock()
-	conn, ok := liveConnections[id]
-	lock.RUnlock()
+	conn, ok := s.getConnection(rpc, id)
 	if !ok {
 		res(nil, []any{2, fmt.Sprintf("Connection not found for ID: %d", id)})
 		return
@@ -331,10 +481,13 @@ func tcpWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Router
 	res(n, nil)
 }
 
-func tcpConnectSSL(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+// tcpConnectSSL connects to the given server with TLS, trusting the optional
+// PEM certificate instead of the system ones. The optional local address and
+// network interface pin the connection to an uplink.
+func (s *Service) tcpConnectSSL(ctx context.Context, rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	n := len(params)
-	if n < 1 || n > 3 {
-		res(nil, []any{1, "Invalid number of parameters, expected server address, port and optional TLS cert"})
+	if n < 1 || n > 5 {
+		res(nil, []any{1, "Invalid number of parameters, expected server address, port and optional TLS cert, local address and network interface"})
 		return
 	}
 	serverAddr, ok := params[0].(string)
@@ -348,10 +501,8 @@ func tcpConnectSSL(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.R
 		return
 	}
 
-	serverAddr = net.JoinHostPort(serverAddr, strconv.FormatUint(uint64(serverPort), 10))
-
-	var tlsConfig *tls.Config
-	if n == 3 {
+	tlsConfig := &tls.Config{ServerName: serverAddr}
+	if n >= 3 {
 		cert, ok := params[2].(string)
 		if !ok {
 			res(nil, []any{1, "Invalid parameter type, expected string for TLS cert"})
@@ -365,14 +516,34 @@ func tcpConnectSSL(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.R
 				res(nil, []any{1, "Failed to parse TLS certificate"})
 				return
 			}
-			tlsConfig = &tls.Config{
-				MinVersion: tls.VersionTLS12,
-				RootCAs:    certs,
-			}
+			tlsConfig.MinVersion = tls.VersionTLS12
+			tlsConfig.RootCAs = certs
 		}
 	}
 
-	conn, err := tls.Dial("tcp", serverAddr, tlsConfig)
+	binding, errRes := parseOutgoingBinding(params, 3)
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	netDialer, err := binding.dialer()
+	if err != nil {
+		res(nil, []any{2, "Failed to resolve local address: " + err.Error()})
+		return
+	}
+
+	// The host name is resolved by the policy, while the certificate of the
+	// server is verified against the name given by the client
+	span := tracing.StartSpan("tls connect", tracing.KindClient, tracing.Current(rpc), "server.address", net.JoinHostPort(serverAddr, strconv.FormatUint(uint64(serverPort), 10)))
+	rawConn, err := s.resolver.dial(ctx, netDialer, "tcp", serverAddr, serverPort)
+	var conn *tls.Conn
+	if err == nil {
+		conn = tls.Client(rawConn, tlsConfig)
+		if err = conn.HandshakeContext(ctx); err != nil {
+			rawConn.Close()
+		}
+	}
+	span.End(err)
 	if err != nil {
 		res(nil, []any{2, "Failed to connect to server: " + err.Error()})
 		return
@@ -380,15 +551,19 @@ func tcpConnectSSL(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.R
 
 	// Successfully connected to the server
 
-	id, unlock := takeLockAndGenerateNextID()
-	liveConnections[id] = conn
-	unlock()
+	id := s.storeHandle(&s.liveConnections, conn, rpc)
 	res(id, nil)
 }
 
-func udpConnect(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
-	if len(params) != 2 {
-		res(nil, []any{1, "Invalid number of parameters, expected server address and port"})
+// udpConnect opens a UDP socket bound to the given local address and port.
+// If a remote address and port are given too, the socket is connected to
+// that peer: it only receives the packets of the peer, the destination of
+// the packets sent can be omitted in udp/beginPacket, and the ICMP errors
+// (like port unreachable) are reported by the following reads and writes.
+// The optional last parameter binds the socket to a network interface.
+func (s *Service) udpConnect(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) < 2 || len(params) > 5 {
+		res(nil, []any{1, "Invalid number of parameters, expected server address and port[, remote address and port][, network interface]"})
 		return
 	}
 	serverAddr, ok := params[0].(string)
@@ -408,7 +583,47 @@ func udpConnect(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Rout
 		res(nil, []any{2, "Failed to resolve UDP address: " + err.Error()})
 		return
 	}
-	udpConn, err := net.ListenUDP("udp", udpAddr)
+	// The interface is the third parameter of an unconnected socket and the
+	// fifth one of a connected socket
+	var binding outgoingBinding
+	if len(params) == 3 || len(params) == 5 {
+		var errRes []any
+		if binding.iface, errRes = parseInterface(params[len(params)-1]); errRes != nil {
+			res(nil, errRes)
+			return
+		}
+	}
+	var peer *net.UDPAddr
+	if len(params) >= 4 {
+		remoteAddr, ok := params[2].(string)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for remote address"})
+			return
+		}
+		remotePort, ok := msgpackrpc.ToUint(params[3])
+		if !ok || remotePort == 0 || remotePort > 65535 {
+			res(nil, []any{1, "Invalid parameter type, expected uint16 for remote port"})
+			return
+		}
+		if peer, err = s.resolver.resolveUDPAddr(remoteAddr, remotePort); err != nil {
+			res(nil, []any{2, "Failed to resolve remote UDP address: " + err.Error()})
+			return
+		}
+	}
+	var udpConn *net.UDPConn
+	if peer != nil {
+		dialer := net.Dialer{LocalAddr: udpAddr, Control: binding.control}
+		var conn net.Conn
+		if conn, err = dialer.Dial("udp", peer.String()); err == nil {
+			udpConn = conn.(*net.UDPConn)
+		}
+	} else {
+		lc := net.ListenConfig{Control: binding.control}
+		var conn net.PacketConn
+		if conn, err = lc.ListenPacket(context.Background(), "udp", udpAddr.String()); err == nil {
+			udpConn = conn.(*net.UDPConn)
+		}
+	}
 	if err != nil {
 		res(nil, []any{2, "Failed to connect to server: " + err.Error()})
 		return
@@ -416,15 +631,15 @@ func udpConnect(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Rout
 
 	// Successfully opened UDP channel
 
-	id, unlock := takeLockAndGenerateNextID()
-	liveUdpConnections[id] = udpConn
-	unlock()
+	id := s.storeHandle(&s.liveUdpConnections, &udpSocket{UDPConn: udpConn, peer: peer}, rpc)
 	res(id, nil)
 }
 
-func udpBeginPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
-	if len(params) != 3 {
-		res(nil, []any{1, "Invalid number of parameters, expected udpConnId, dest address, dest port"})
+// udpBeginPacket starts a packet to the given destination, that can be
+// omitted for a connected socket.
+func (s *Service) udpBeginPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 && len(params) != 3 {
+		res(nil, []any{1, "Invalid number of parameters, expected udpConnId[, dest address, dest port]"})
 		return
 	}
 	id, ok := msgpackrpc.ToUint(params[0])
@@ -432,35 +647,53 @@ func udpBeginPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.
 		res(nil, []any{1, "Invalid parameter type, expected int for UDP connection ID"})
 		return
 	}
-	targetIP, ok := params[1].(string)
-	if !ok {
-		res(nil, []any{1, "Invalid parameter type, expected string for server address"})
-		return
-	}
-	targetPort, ok := msgpackrpc.ToUint(params[2])
-	if !ok {
-		res(nil, []any{1, "Invalid parameter type, expected uint16 for server port"})
-		return
+	var targetIP string
+	var targetPort uint
+	if len(params) == 3 {
+		if targetIP, ok = params[1].(string); !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for server address"})
+			return
+		}
+		if targetPort, ok = msgpackrpc.ToUint(params[2]); !ok {
+			res(nil, []any{1, "Invalid parameter type, expected uint16 for server port"})
+			return
+		}
 	}
 
-	lock.RLock()
-	defer lock.RUnlock()
-	if _, ok := liveUdpConnections[id]; !ok {
+	socket, ok := s.getUDPSocket(rpc, id)
+	if !ok {
 		res(nil, []any{2, fmt.Sprintf("UDP connection not found for ID: %d", id)})
 		return
 	}
-	targetAddr := net.JoinHostPort(targetIP, fmt.Sprintf("%d", targetPort))
-	addr, err := net.ResolveUDPAddr("udp", targetAddr) // TODO: This is inefficient, implement some caching
-	if err != nil {
-		res(nil, []any{3, "Failed to resolve target address: " + err.Error()})
+	var addr *net.UDPAddr
+	if len(params) == 3 {
+		var err error
+		addr, err = s.resolver.resolveUDPAddr(targetIP, targetPort) // TODO: This is inefficient, implement some caching
+		if err != nil {
+			res(nil, []any{3, "Failed to resolve target address: " + err.Error()})
+			return
+		}
+	}
+	switch {
+	case socket.peer == nil && addr == nil:
+		res(nil, []any{1, "Invalid number of parameters, the destination is required for a socket not connected"})
+		return
+	case socket.peer != nil && addr != nil && !(addr.IP.Equal(socket.peer.IP) && addr.Port == socket.peer.Port):
+		res(nil, []any{3, fmt.Sprintf("UDP connection %d is connected to %s, can't send to %s", id, socket.peer, addr)})
 		return
+	case socket.peer != nil:
+		// The packets of a connected socket are written without destination
+		addr = nil
 	}
-	udpWriteTargets[id] = addr
-	udpWriteBuffers[id] = nil
+	socket.lock.Lock()
+	socket.writing = true
+	socket.writeTarget = addr
+	socket.writeBuffer = nil
+	socket.lock.Unlock()
 	res(true, nil)
 }
 
-func udpWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) udpWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 2 {
 		res(nil, []any{1, "Invalid number of parameters, expected udpConnId, payload"})
 		return
@@ -481,12 +714,14 @@ func udpWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Router
 		}
 	}
 
-	lock.RLock()
-	udpBuffer, ok := udpWriteBuffers[id]
+	socket, ok := s.getUDPSocket(rpc, id)
 	if ok {
-		udpWriteBuffers[id] = append(udpBuffer, data...)
+		socket.lock.Lock()
+		if ok = socket.writing; ok {
+			socket.writeBuffer = append(socket.writeBuffer, data...)
+		}
+		socket.lock.Unlock()
 	}
-	lock.RUnlock()
 	if !ok {
 		res(nil, []any{2, fmt.Sprintf("UDP connection not found for ID: %d", id)})
 		return
@@ -494,7 +729,7 @@ func udpWrite(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Router
 	res(len(data), nil)
 }
 
-func udpEndPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) udpEndPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Invalid number of parameters, expected expected udpConnId"})
 		return
@@ -507,15 +742,14 @@ func udpEndPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Ro
 
 	var udpBuffer []byte
 	var udpAddr *net.UDPAddr
-	lock.RLock()
-	udpConn, connExists := liveUdpConnections[id]
+	udpConn, connExists := s.getUDPSocket(rpc, id)
 	if connExists {
-		udpBuffer, buffExists = udpWriteBuffers[id]
-		udpAddr = udpWriteTargets[id]
-		delete(udpWriteBuffers, id)
-		delete(udpWriteTargets, id)
+		udpConn.lock.Lock()
+		buffExists = udpConn.writing
+		udpBuffer, udpAddr = udpConn.writeBuffer, udpConn.writeTarget
+		udpConn.writing, udpConn.writeBuffer, udpConn.writeTarget = false, nil, nil
+		udpConn.lock.Unlock()
 	}
-	lock.RUnlock()
 	if !connExists {
 		res(nil, []any{2, fmt.Sprintf("UDP connection not found for ID: %d", id)})
 		return
@@ -525,14 +759,21 @@ func udpEndPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Ro
 		return
 	}
 
-	if n, err := udpConn.WriteTo(udpBuffer, udpAddr); err != nil {
+	var n int
+	var err error
+	if udpConn.peer != nil {
+		n, err = udpConn.Write(udpBuffer)
+	} else {
+		n, err = udpConn.WriteTo(udpBuffer, udpAddr)
+	}
+	if err != nil {
 		res(nil, []any{4, "Failed to write to UDP connection: " + err.Error()})
 	} else {
 		res(n, nil)
 	}
 }
 
-func udpAwaitPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) udpAwaitPacket(ctx context.Context, rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 && len(params) != 2 {
 		res(nil, []any{1, "Invalid number of parameters, expected (UDP connection ID[, optional timeout in ms])"})
 		return
@@ -552,9 +793,7 @@ func udpAwaitPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.
 		}
 	}
 
-	lock.RLock()
-	udpConn, ok := liveUdpConnections[id]
-	lock.RUnlock()
+	udpConn, ok := s.getUDPSocket(rpc, id)
 	if !ok {
 		res(nil, []any{2, fmt.Sprintf("UDP connection not found for ID: %d", id)})
 		return
@@ -564,7 +803,12 @@ func udpAwaitPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.
 		return
 	}
 	buffer := make([]byte, 64*1024) // 64 KB buffer
+	done := abortOnCancel(ctx, udpConn.SetReadDeadline)
 	n, addr, err := udpConn.ReadFrom(buffer)
+	if done() && errors.Is(err, os.ErrDeadlineExceeded) {
+		res(nil, []any{3, "Request canceled"})
+		return
+	}
 	if errors.Is(err, os.ErrDeadlineExceeded) {
 		// timeout
 		res(nil, []any{5, "Timeout"})
@@ -587,13 +831,13 @@ func udpAwaitPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.
 		return
 	}
 
-	lock.Lock()
-	udpReadBuffers[id] = buffer[:n]
-	lock.Unlock()
+	udpConn.lock.Lock()
+	udpConn.readBuffer = buffer[:n]
+	udpConn.lock.Unlock()
 	res([]any{n, host, port}, nil)
 }
 
-func udpDropPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) udpDropPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 && len(params) != 2 {
 		res(nil, []any{1, "Invalid number of parameters, expected (UDP connection ID[, optional timeout in ms])"})
 		return
@@ -604,17 +848,15 @@ func udpDropPacket(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.R
 		return
 	}
 
-	lock.RLock()
-	delete(udpReadBuffers, id)
-	lock.RUnlock()
-	if !ok {
-		res(nil, []any{2, fmt.Sprintf("UDP connection not found for ID: %d", id)})
-		return
+	if socket, ok := s.getUDPSocket(rpc, id); ok {
+		socket.lock.Lock()
+		socket.readBuffer = nil
+		socket.lock.Unlock()
 	}
 	res(true, nil)
 }
 
-func udpRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) udpRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 2 && len(params) != 3 {
 		res(nil, []any{1, "Invalid number of parameters, expected (UDP connection ID, max bytes to read)"})
 		return
@@ -630,24 +872,24 @@ func udpRead(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterR
 		return
 	}
 
-	lock.Lock()
-	buffer, exists := udpReadBuffers[id]
-	n := uint(len(buffer))
-	if exists {
+	var buffer []byte
+	if socket, ok := s.getUDPSocket(rpc, id); ok {
+		socket.lock.Lock()
+		buffer = socket.readBuffer
 		// keep the remainder of the buffer for the next read
-		if n > maxBytes {
-			udpReadBuffers[id] = buffer[maxBytes:]
-			n = maxBytes
+		if uint(len(buffer)) > maxBytes {
+			socket.readBuffer = buffer[maxBytes:]
 		} else {
-			delete(udpReadBuffers, id)
+			socket.readBuffer = nil
 		}
+		socket.lock.Unlock()
 	}
-	lock.Unlock()
+	n := min(uint(len(buffer)), maxBytes)
 
 	res(buffer[:n], nil)
 }
 
-func udpClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+func (s *Service) udpClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
 	if len(params) != 1 {
 		res(nil, []any{1, "Invalid number of parameters, expected UDP connection ID"})
 		return
@@ -658,11 +900,7 @@ func udpClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Router
 		return
 	}
 
-	lock.Lock()
-	udpConn, existsConn := liveUdpConnections[id]
-	delete(liveUdpConnections, id)
-	delete(udpReadBuffers, id)
-	lock.Unlock()
+	v, existsConn := s.takeHandle(&s.liveUdpConnections, rpc, id)
 
 	if !existsConn {
 		res(nil, []any{2, fmt.Sprintf("UDP connection not found for ID: %d", id)})
@@ -672,7 +910,7 @@ func udpClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.Router
 	// Close the connection if it exists
 	// We do not return an error to the caller if the close operation fails, as it is not critical,
 	// but we only log the error for debugging purposes.
-	if err := udpConn.Close(); err != nil {
+	if err := v.(*udpSocket).Close(); err != nil {
 		res(err.Error(), nil)
 		return
 	}
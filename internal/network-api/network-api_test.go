@@ -16,11 +16,14 @@
 package networkapi
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
 	"github.com/arduino/arduino-router/msgpackrpc"
 
 	"github.com/stretchr/testify/require"
@@ -158,104 +161,105 @@ const testCert = "-----BEGIN CERTIFICATE-----\n" +
 	"-----END CERTIFICATE-----\n"
 
 func TestTCPNetworkAPI(t *testing.T) {
+	s := New(Options{})
 	var rpc *msgpackrpc.Connection
 	var listID any
-	tcpListen(rpc, []any{"localhost", 9999}, func(res, err any) {
+	s.tcpListen(rpc, []any{"localhost", 9999}, func(res, err any) {
 		listID = res
 		require.Nil(t, err)
-		require.Equal(t, uint(1), listID)
+		require.NotZero(t, listID)
 	})
 
 	var wg sync.WaitGroup
 	wg.Go(func() {
 		var connID any
-		tcpConnect(rpc, []any{"localhost", uint16(9999)}, func(res, err any) {
+		s.tcpConnect(context.Background(), rpc, []any{"localhost", uint16(9999)}, func(res, err any) {
 			require.Nil(t, err)
 			connID = res
 		})
 
-		tcpWrite(rpc, []any{connID, []byte("Hello")}, func(res, err any) {
+		s.tcpWrite(rpc, []any{connID, []byte("Hello")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res)
 		})
 
-		tcpClose(rpc, []any{connID}, func(res, err any) {
+		s.tcpClose(rpc, []any{connID}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, "", res)
 		})
 
-		tcpClose(rpc, []any{connID}, func(res, err any) {
+		s.tcpClose(rpc, []any{connID}, func(res, err any) {
 			require.Equal(t, []any{2, fmt.Sprintf("Connection not found for ID: %d", connID)}, err)
 			require.Nil(t, res)
 		})
 	})
 
 	var connID any
-	tcpAccept(rpc, []any{listID}, func(res, err any) {
+	s.tcpAccept(context.Background(), rpc, []any{listID}, func(res, err any) {
 		require.Nil(t, err)
 		connID = res
 	})
 
-	tcpRead(rpc, []any{connID, 3}, func(res, err any) {
+	s.tcpRead(context.Background(), rpc, []any{connID, 3}, func(res, err any) {
 		require.Nil(t, err)
 		require.Equal(t, []byte("Hel"), res)
 	})
 
-	tcpRead(rpc, []any{connID, 3}, func(res, err any) {
+	s.tcpRead(context.Background(), rpc, []any{connID, 3}, func(res, err any) {
 		require.Nil(t, err)
 		require.Equal(t, []byte("lo"), res)
 	})
 
-	tcpRead(rpc, []any{connID, 3}, func(res, err any) {
+	s.tcpRead(context.Background(), rpc, []any{connID, 3}, func(res, err any) {
 		require.Equal(t, []any{3, "Failed to read from connection: EOF"}, err)
 		require.Nil(t, res)
 	})
 
-	tcpCloseListener(rpc, []any{connID}, func(res, err any) {
+	s.tcpCloseListener(rpc, []any{connID}, func(res, err any) {
 		require.Equal(t, []any{2, fmt.Sprintf("Listener not found for ID: %d", connID)}, err)
 		require.Nil(t, res)
 	})
 
-	tcpClose(rpc, []any{connID}, func(res, err any) {
+	s.tcpClose(rpc, []any{connID}, func(res, err any) {
 		require.Nil(t, err)
 		require.Equal(t, "", res)
 	})
 
-	tcpClose(rpc, []any{listID}, func(res, err any) {
+	s.tcpClose(rpc, []any{listID}, func(res, err any) {
 		require.Equal(t, []any{2, fmt.Sprintf("Connection not found for ID: %d", listID)}, err)
 		require.Nil(t, res)
 	})
 
-	tcpCloseListener(rpc, []any{listID}, func(res, err any) {
+	s.tcpCloseListener(rpc, []any{listID}, func(res, err any) {
 		require.Nil(t, err)
 		require.Equal(t, "", res)
 	})
 
-	tcpClose(rpc, []any{listID}, func(res, err any) {
+	s.tcpClose(rpc, []any{listID}, func(res, err any) {
 		require.Equal(t, []any{2, fmt.Sprintf("Connection not found for ID: %d", listID)}, err)
 		require.Nil(t, res)
 	})
 
-	tcpCloseListener(rpc, []any{listID}, func(res, err any) {
+	s.tcpCloseListener(rpc, []any{listID}, func(res, err any) {
 		require.Equal(t, []any{2, fmt.Sprintf("Listener not found for ID: %d", listID)}, err)
 		require.Nil(t, res)
 	})
 
 	// Test SSL connection
 	var connIDSSL any
-	tcpConnectSSL(rpc, []any{"www.arduino.cc", uint16(443)}, func(res, err any) {
+	s.tcpConnectSSL(context.Background(), rpc, []any{"www.arduino.cc", uint16(443)}, func(res, err any) {
 		require.Nil(t, err)
 		connIDSSL = res
-		require.Equal(t, uint(4), connIDSSL)
+		require.NotZero(t, connIDSSL)
 	})
 
-	tcpClose(rpc, []any{connIDSSL}, func(res, err any) {
+	s.tcpClose(rpc, []any{connIDSSL}, func(res, err any) {
 		require.Nil(t, err)
 		require.Equal(t, "", res)
 	})
 
 	// Test SSL connection with failing certificate verification
-	tcpConnectSSL(rpc, []any{"www.arduino.cc", uint16(443), testCert}, func(res, err any) {
+	s.tcpConnectSSL(context.Background(), rpc, []any{"www.arduino.cc", uint16(443), testCert}, func(res, err any) {
 		require.Equal(t, []any{2, "Failed to connect to server: tls: failed to verify certificate: x509: certificate signed by unknown authority"}, err)
 		require.Nil(t, res)
 	})
@@ -264,82 +268,83 @@ func TestTCPNetworkAPI(t *testing.T) {
 }
 
 func TestUDPNetworkAPI(t *testing.T) {
+	s := New(Options{})
 	var conn1, conn2 any
-	udpConnect(nil, []any{"0.0.0.0", 9800}, func(res, err any) {
+	s.udpConnect(nil, []any{"0.0.0.0", 9800}, func(res, err any) {
 		require.Nil(t, err)
 		conn1 = res
 	})
 
-	udpConnect(nil, []any{"0.0.0.0", 9900}, func(res, err any) {
+	s.udpConnect(nil, []any{"0.0.0.0", 9900}, func(res, err any) {
 		require.Nil(t, err)
 		conn2 = res
 		require.NotEqual(t, conn1, conn2)
 	})
 
 	{
-		udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9900}, func(res, err any) {
+		s.udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9900}, func(res, err any) {
 			require.Nil(t, err)
 			require.True(t, res.(bool))
 		})
-		udpWrite(nil, []any{conn1, []byte("Hello")}, func(res, err any) {
+		s.udpWrite(nil, []any{conn1, []byte("Hello")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res)
 		})
-		udpEndPacket(nil, []any{conn1}, func(res, err any) {
+		s.udpEndPacket(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res)
 		})
 	}
 	{
-		udpAwaitPacket(nil, []any{conn2}, func(res, err any) {
+		s.udpAwaitPacket(context.Background(), nil, []any{conn2}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []any{5, "127.0.0.1", 9800}, res)
 		})
-		udpRead(nil, []any{conn2, 100}, func(res2, err any) {
+		s.udpRead(nil, []any{conn2, 100}, func(res2, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []uint8("Hello"), res2)
 		})
 	}
 	{
-		udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9900}, func(res, err any) {
+		s.udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9900}, func(res, err any) {
 			require.Nil(t, err)
 			require.True(t, res.(bool))
 		})
-		udpWrite(nil, []any{conn1, []byte("On")}, func(res, err any) {
+		s.udpWrite(nil, []any{conn1, []byte("On")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 2, res)
 		})
-		udpWrite(nil, []any{conn1, []byte("e")}, func(res, err any) {
+		s.udpWrite(nil, []any{conn1, []byte("e")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 1, res)
 		})
-		udpEndPacket(nil, []any{conn1}, func(res, err any) {
+		s.udpEndPacket(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res)
 		})
 	}
 	{
-		udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9900}, func(res, err any) {
+		s.udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9900}, func(res, err any) {
 			require.Nil(t, err)
 			require.True(t, res.(bool))
 		})
-		udpWrite(nil, []any{conn1, []byte("Two")}, func(res, err any) {
+		s.udpWrite(nil, []any{conn1, []byte("Two")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res)
 		})
-		udpEndPacket(nil, []any{conn1}, func(res, err any) {
+		s.udpEndPacket(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res)
 		})
 	}
 	{
-		udpAwaitPacket(nil, []any{conn2}, func(res, err any) {
+		s.udpAwaitPacket(context.Background(), nil, []any{conn2}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []any{3, "127.0.0.1", 9800}, res)
 		})
 
 		// A partial read of a packet is allowed
-		udpRead(nil, []any{conn2, 2}, func(res2, err any) {
+		s.udpRead(nil, []any{conn2, 2}, func(res2, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []uint8("On"), res2)
 		})
@@ -347,24 +352,24 @@ func TestUDPNetworkAPI(t *testing.T) {
 	{
 		// Even if the previous packet was only partially read,
 		// the next packet can be received
-		udpAwaitPacket(nil, []any{conn2}, func(res, err any) {
+		s.udpAwaitPacket(context.Background(), nil, []any{conn2}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []any{3, "127.0.0.1", 9800}, res)
 		})
 
-		udpRead(nil, []any{conn2, 100}, func(res2, err any) {
+		s.udpRead(nil, []any{conn2, 100}, func(res2, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []uint8("Two"), res2)
 		})
 	}
 	{
-		udpClose(nil, []any{conn1}, func(res, err any) {
+		s.udpClose(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, "", res)
 		})
 	}
 	{
-		udpClose(nil, []any{conn2}, func(res, err any) {
+		s.udpClose(nil, []any{conn2}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, "", res)
 		})
@@ -372,90 +377,91 @@ func TestUDPNetworkAPI(t *testing.T) {
 }
 
 func TestUDPNetworkUnboundClientAPI(t *testing.T) {
+	s := New(Options{})
 	var conn1, conn2 any
-	udpConnect(nil, []any{"", 0}, func(result, err any) {
+	s.udpConnect(nil, []any{"", 0}, func(result, err any) {
 		conn1 = result
 		require.Nil(t, err)
 	})
 
-	udpConnect(nil, []any{"0.0.0.0", 9901}, func(result, err any) {
+	s.udpConnect(nil, []any{"0.0.0.0", 9901}, func(result, err any) {
 		conn2 = result
 		require.Nil(t, err)
 	})
 	require.NotEqual(t, conn1, conn2)
 
 	{
-		udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9901}, func(res, err any) {
+		s.udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9901}, func(res, err any) {
 			require.Nil(t, err)
 			require.True(t, res.(bool))
 		})
-		udpWrite(nil, []any{conn1, []byte("Hello")}, func(res, err any) {
+		s.udpWrite(nil, []any{conn1, []byte("Hello")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res)
 		})
-		udpEndPacket(nil, []any{conn1}, func(res, err any) {
+		s.udpEndPacket(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res)
 		})
 	}
 	{
-		udpAwaitPacket(nil, []any{conn2}, func(res, err any) {
+		s.udpAwaitPacket(context.Background(), nil, []any{conn2}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res.([]any)[0])
 		})
-		udpRead(nil, []any{conn2, 2}, func(res2, err any) {
+		s.udpRead(nil, []any{conn2, 2}, func(res2, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []uint8("He"), res2)
 		})
-		udpRead(nil, []any{conn2, 20}, func(res2, err any) {
+		s.udpRead(nil, []any{conn2, 20}, func(res2, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []uint8("llo"), res2)
 		})
 	}
 	{
-		udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9901}, func(res, err any) {
+		s.udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9901}, func(res, err any) {
 			require.Nil(t, err)
 			require.True(t, res.(bool))
 		})
-		udpWrite(nil, []any{conn1, []byte("One")}, func(res, err any) {
+		s.udpWrite(nil, []any{conn1, []byte("One")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res)
 		})
-		udpEndPacket(nil, []any{conn1}, func(res, err any) {
+		s.udpEndPacket(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res)
 		})
 	}
 	{
-		udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9901}, func(res, err any) {
+		s.udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9901}, func(res, err any) {
 			require.Nil(t, err)
 			require.True(t, res.(bool))
 		})
-		udpWrite(nil, []any{conn1, []byte("Two")}, func(res, err any) {
+		s.udpWrite(nil, []any{conn1, []byte("Two")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res)
 		})
-		udpEndPacket(nil, []any{conn1}, func(res, err any) {
+		s.udpEndPacket(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res)
 		})
 	}
 	{
-		udpAwaitPacket(nil, []any{conn2}, func(res, err any) {
+		s.udpAwaitPacket(context.Background(), nil, []any{conn2}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res.([]any)[0])
 		})
-		udpRead(nil, []any{conn2, 100}, func(res2, err any) {
+		s.udpRead(nil, []any{conn2, 100}, func(res2, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []uint8("One"), res2)
 		})
 	}
 	{
-		udpAwaitPacket(nil, []any{conn2}, func(res, err any) {
+		s.udpAwaitPacket(context.Background(), nil, []any{conn2}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 3, res.([]any)[0])
 		})
-		udpRead(nil, []any{conn2, 100}, func(res2, err any) {
+		s.udpRead(nil, []any{conn2, 100}, func(res2, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []uint8("Two"), res2)
 		})
@@ -464,49 +470,298 @@ func TestUDPNetworkUnboundClientAPI(t *testing.T) {
 	// Check timeouts
 	go func() {
 		time.Sleep(200 * time.Millisecond)
-		udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9901}, func(res, err any) {
+		s.udpBeginPacket(nil, []any{conn1, "127.0.0.1", 9901}, func(res, err any) {
 			require.Nil(t, err)
 			require.True(t, res.(bool))
 		})
-		udpWrite(nil, []any{conn1, []byte("Three")}, func(res, err any) {
+		s.udpWrite(nil, []any{conn1, []byte("Three")}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res)
 		})
-		udpEndPacket(nil, []any{conn1}, func(res, err any) {
+		s.udpEndPacket(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res)
 		})
 	}()
 	{
 		start := time.Now()
-		udpAwaitPacket(nil, []any{conn2, 10}, func(res, err any) {
+		s.udpAwaitPacket(context.Background(), nil, []any{conn2, 10}, func(res, err any) {
 			require.Less(t, time.Since(start), 20*time.Millisecond)
 			require.Equal(t, []any{5, "Timeout"}, err)
 			require.Nil(t, res)
 		})
 	}
 	{
-		udpAwaitPacket(nil, []any{conn2, 0}, func(res, err any) {
+		s.udpAwaitPacket(context.Background(), nil, []any{conn2, 0}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, 5, res.([]any)[0])
 		})
 
-		udpRead(nil, []any{conn2, 100, 0}, func(res2, err any) {
+		s.udpRead(nil, []any{conn2, 100, 0}, func(res2, err any) {
 			require.Nil(t, err)
 			require.Equal(t, []uint8("Three"), res2)
 		})
 	}
 
 	{
-		udpClose(nil, []any{conn1}, func(res, err any) {
+		s.udpClose(nil, []any{conn1}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, "", res)
 		})
 	}
 	{
-		udpClose(nil, []any{conn2}, func(res, err any) {
+		s.udpClose(nil, []any{conn2}, func(res, err any) {
 			require.Nil(t, err)
 			require.Equal(t, "", res)
 		})
 	}
 }
+
+func TestUDPConnectedSocket(t *testing.T) {
+	s := New(Options{})
+	var server, client any
+	s.udpConnect(nil, []any{"127.0.0.1", 9902}, func(res, err any) {
+		require.Nil(t, err)
+		server = res
+	})
+	s.udpConnect(nil, []any{"127.0.0.1", 0, "127.0.0.1", 9902}, func(res, err any) {
+		require.Nil(t, err)
+		client = res
+	})
+
+	// The destination of the packets can be omitted...
+	s.udpBeginPacket(nil, []any{client}, func(res, err any) {
+		require.Nil(t, err)
+		require.True(t, res.(bool))
+	})
+	s.udpWrite(nil, []any{client, []byte("Hello")}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.udpEndPacket(nil, []any{client}, func(res, err any) {
+		require.Nil(t, err)
+		require.Equal(t, 5, res)
+	})
+	s.udpAwaitPacket(context.Background(), nil, []any{server, 1000}, func(res, err any) {
+		require.Nil(t, err)
+		require.Equal(t, 5, res.([]any)[0])
+	})
+	// ...and it must be the peer if given
+	s.udpBeginPacket(nil, []any{client, "127.0.0.1", 9902}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.udpBeginPacket(nil, []any{client, "127.0.0.1", 9903}, func(_, err any) {
+		require.Equal(t, 3, err.([]any)[0])
+	})
+	// The sockets not connected require the destination
+	s.udpBeginPacket(nil, []any{server}, func(_, err any) {
+		require.Equal(t, 1, err.([]any)[0])
+	})
+
+	// The port unreachable errors are reported
+	s.udpClose(nil, []any{server}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.udpBeginPacket(nil, []any{client}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.udpEndPacket(nil, []any{client}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.udpAwaitPacket(context.Background(), nil, []any{client, 1000}, func(_, err any) {
+		require.Equal(t, 3, err.([]any)[0])
+		require.Contains(t, err.([]any)[1], "connection refused")
+	})
+	s.udpClose(nil, []any{client}, func(_, err any) {
+		require.Nil(t, err)
+	})
+
+	s.udpConnect(nil, []any{"127.0.0.1", 0, "127.0.0.1", 0}, func(_, err any) {
+		require.Equal(t, 1, err.([]any)[0])
+	})
+}
+
+func TestOutgoingBinding(t *testing.T) {
+	s := New(Options{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// The connection is bound to the source address and to the interface
+	s.tcpConnect(context.Background(), nil, []any{"127.0.0.1", port, "127.0.0.2", "lo"}, func(res, err any) {
+		require.Nil(t, err)
+		s.tcpClose(nil, []any{res}, func(_, err any) {
+			require.Nil(t, err)
+		})
+	})
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.2", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+	conn.Close()
+
+	s.tcpConnect(context.Background(), nil, []any{"127.0.0.1", port, "", "nonexistent0"}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+		require.Equal(t, "Unknown network interface: nonexistent0", err.([]any)[1])
+	})
+	s.tcpConnect(context.Background(), nil, []any{"127.0.0.1", port, "not an address"}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	s.tcpConnect(context.Background(), nil, []any{"127.0.0.1", port, 1}, func(_, err any) {
+		require.Equal(t, 1, err.([]any)[0])
+	})
+	s.tcpConnectSSL(context.Background(), nil, []any{"127.0.0.1", port, "", "", "nonexistent0"}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+
+	// The UDP sockets are bound to the interface, both unconnected and
+	// connected
+	var server, client any
+	s.udpConnect(nil, []any{"127.0.0.1", 0, "lo"}, func(res, err any) {
+		require.Nil(t, err)
+		server = res
+	})
+	socket, _ := s.getUDPSocket(nil, server.(uint))
+	serverPort := socket.LocalAddr().(*net.UDPAddr).Port
+	s.udpConnect(nil, []any{"127.0.0.1", 0, "127.0.0.1", serverPort, "lo"}, func(res, err any) {
+		require.Nil(t, err)
+		client = res
+	})
+	s.udpBeginPacket(nil, []any{client}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.udpWrite(nil, []any{client, []byte("Hello")}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.udpEndPacket(nil, []any{client}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.udpAwaitPacket(context.Background(), nil, []any{server, 1000}, func(res, err any) {
+		require.Nil(t, err)
+		require.Equal(t, 5, res.([]any)[0])
+	})
+	for _, id := range []any{server, client} {
+		s.udpClose(nil, []any{id}, func(_, err any) {
+			require.Nil(t, err)
+		})
+	}
+	s.udpConnect(nil, []any{"127.0.0.1", 0, "nonexistent0"}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+}
+
+func TestConcurrentHandles(t *testing.T) {
+	s := New(Options{})
+	// Packets are sent concurrently on different sockets, each one to itself
+	var wg sync.WaitGroup
+	for i := range 4 {
+		port := 9700 + i
+		var id any
+		s.udpConnect(nil, []any{"127.0.0.1", port}, func(res, err any) {
+			require.Nil(t, err)
+			id = res
+		})
+		wg.Go(func() {
+			for range 50 {
+				s.udpBeginPacket(nil, []any{id, "127.0.0.1", port}, func(res, err any) {
+					require.Nil(t, err)
+				})
+				s.udpWrite(nil, []any{id, []byte("ping")}, func(res, err any) {
+					require.Nil(t, err)
+				})
+				s.udpEndPacket(nil, []any{id}, func(res, err any) {
+					require.Nil(t, err)
+				})
+				s.udpAwaitPacket(context.Background(), nil, []any{id, 1000}, func(res, err any) {
+					require.Nil(t, err)
+				})
+				s.udpRead(nil, []any{id, 100}, func(res, err any) {
+					require.Nil(t, err)
+					require.Equal(t, []byte("ping"), res)
+				})
+			}
+			s.udpClose(nil, []any{id}, func(res, err any) {
+				require.Nil(t, err)
+			})
+		})
+	}
+	wg.Wait()
+}
+
+func TestCancelBlockingCalls(t *testing.T) {
+	s := New(Options{})
+	// call runs the handler with a context canceled after a while, and
+	// returns its error
+	call := func(handler msgpackrouter.RouterRequestHandlerWithContext, params ...any) any {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		done := make(chan any, 1)
+		go handler(ctx, nil, params, func(_, err any) { done <- err })
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "the call was not canceled")
+			return nil
+		}
+	}
+	canceled := []any{3, "Request canceled"}
+
+	var listID any
+	s.tcpListen(nil, []any{"127.0.0.1", 0}, func(res, err any) {
+		require.Nil(t, err)
+		listID = res
+	})
+	defer s.tcpCloseListener(nil, []any{listID}, func(_, _ any) {})
+	require.Equal(t, canceled, call(s.tcpAccept, listID))
+
+	// The listener is still usable after a canceled accept
+	listener, ok := s.getListener(nil, listID.(uint))
+	require.True(t, ok)
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	var connID any
+	s.tcpAccept(context.Background(), nil, []any{listID}, func(res, err any) {
+		require.Nil(t, err)
+		connID = res
+	})
+	defer s.tcpClose(nil, []any{connID}, func(_, _ any) {})
+	require.Equal(t, canceled, call(s.tcpRead, connID, 10, 0))
+
+	var udpID any
+	s.udpConnect(nil, []any{"127.0.0.1", 0}, func(res, err any) {
+		require.Nil(t, err)
+		udpID = res
+	})
+	defer s.udpClose(nil, []any{udpID}, func(_, _ any) {})
+	require.Equal(t, canceled, call(s.udpAwaitPacket, udpID))
+}
+
+func TestServiceInstances(t *testing.T) {
+	s1 := New(Options{})
+	s2 := New(Options{})
+
+	var listID any
+	s1.tcpListen(nil, []any{"127.0.0.1", 0}, func(res, err any) {
+		require.Nil(t, err)
+		listID = res
+	})
+	require.Equal(t, 1, s1.Stats()["tcp_listeners"])
+	require.Equal(t, 0, s2.Stats()["tcp_listeners"])
+
+	// The handles of an instance are not visible to the others
+	s2.tcpCloseListener(nil, []any{listID}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+
+	// Closing the instance closes all its handles
+	listener, ok := s1.getListener(nil, listID.(uint))
+	require.True(t, ok)
+	s1.Close()
+	require.Equal(t, 0, s1.Stats()["tcp_listeners"])
+	_, err := listener.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	s1.tcpCloseListener(nil, []any{listID}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+}
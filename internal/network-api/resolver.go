@@ -0,0 +1,202 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package networkapi
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ResolverConfig is the policy resolving the host names of the network API,
+// in the resolver section of the configuration file. The zero value uses the
+// resolver of the system.
+type ResolverConfig struct {
+	// Servers are the DNS servers (address[:port]) queried instead of the
+	// ones of /etc/resolv.conf, in order.
+	Servers []string `yaml:"servers"`
+	// Search are the domains tried, in order, before the host names without
+	// dots.
+	Search []string `yaml:"search"`
+	// Prefer is the address family tried first: "ipv4", "ipv6" or empty for
+	// the order of the DNS response.
+	Prefer string `yaml:"prefer"`
+	// Hosts are the static addresses of host names, that are not looked up.
+	Hosts map[string]string `yaml:"hosts"`
+}
+
+// resolverPolicy resolves the host names as configured by a ResolverConfig.
+type resolverPolicy struct {
+	cfg      ResolverConfig
+	hosts    map[string]net.IP
+	resolver *net.Resolver
+	// nextServer rotates the DNS servers among the retries of the queries.
+	nextServer atomic.Uint32
+}
+
+// newResolverPolicy validates the configuration and returns its policy, or
+// nil if the configuration is empty.
+func newResolverPolicy(cfg ResolverConfig) (*resolverPolicy, error) {
+	if len(cfg.Servers) == 0 && len(cfg.Search) == 0 && cfg.Prefer == "" && len(cfg.Hosts) == 0 {
+		return nil, nil
+	}
+	if cfg.Prefer != "" && cfg.Prefer != "ipv4" && cfg.Prefer != "ipv6" {
+		return nil, fmt.Errorf("invalid resolver preference %q, expected ipv4 or ipv6", cfg.Prefer)
+	}
+	p := &resolverPolicy{cfg: cfg, hosts: map[string]net.IP{}, resolver: net.DefaultResolver}
+	for host, addr := range cfg.Hosts {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address of resolver host %s: %s", host, addr)
+		}
+		p.hosts[canonicalHost(host)] = ip
+	}
+	p.cfg.Servers = slices.Clone(cfg.Servers)
+	for i, server := range p.cfg.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		if _, err := net.ResolveUDPAddr("udp", server); err != nil {
+			return nil, fmt.Errorf("invalid resolver server %s: %w", cfg.Servers[i], err)
+		}
+		p.cfg.Servers[i] = server
+	}
+	if len(cfg.Servers) > 0 {
+		p.resolver = &net.Resolver{PreferGo: true, Dial: p.dialServer}
+	}
+	return p, nil
+}
+
+// canonicalHost returns the host name as found in the static hosts.
+func canonicalHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// dialServer connects to the next configured DNS server, whatever the
+// address chosen by the resolver.
+func (p *resolverPolicy) dialServer(ctx context.Context, network, _ string) (net.Conn, error) {
+	server := p.cfg.Servers[int(p.nextServer.Add(1)-1)%len(p.cfg.Servers)]
+	var d net.Dialer
+	return d.DialContext(ctx, network, server)
+}
+
+// lookup returns the addresses of the host, the preferred family first.
+func (p *resolverPolicy) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var errs []error
+	for _, name := range p.candidates(host) {
+		if ip, ok := p.hosts[canonicalHost(name)]; ok {
+			return []net.IP{ip}, nil
+		}
+		ips, err := p.resolver.LookupIP(ctx, "ip", name)
+		if err == nil {
+			p.sort(ips)
+			return ips, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// candidates returns the names looked up for the host: the host names
+// without dots are tried in the search domains first, as absolute names.
+func (p *resolverPolicy) candidates(host string) []string {
+	if strings.Contains(host, ".") {
+		return []string{host}
+	}
+	names := make([]string, 0, len(p.cfg.Search)+1)
+	for _, domain := range p.cfg.Search {
+		names = append(names, host+"."+strings.Trim(domain, ".")+".")
+	}
+	return append(names, host)
+}
+
+// sort moves the addresses of the preferred family first, keeping the order
+// of the DNS response within each family.
+func (p *resolverPolicy) sort(ips []net.IP) {
+	if p.cfg.Prefer == "" {
+		return
+	}
+	rank := func(ip net.IP) int {
+		if (ip.To4() != nil) == (p.cfg.Prefer == "ipv4") {
+			return 0
+		}
+		return 1
+	}
+	slices.SortStableFunc(ips, func(a, b net.IP) int {
+		return cmp.Compare(rank(a), rank(b))
+	})
+}
+
+// bypassed returns true if the host is resolved by the system: there is no
+// policy, or the host is empty (the local system) or a scoped IPv6 address.
+func (p *resolverPolicy) bypassed(host string) bool {
+	return p == nil || host == "" || strings.Contains(host, "%")
+}
+
+// dial connects to the host with the dialer, trying its addresses in order.
+func (p *resolverPolicy) dial(ctx context.Context, d *net.Dialer, network, host string, port uint) (net.Conn, error) {
+	portStr := strconv.FormatUint(uint64(port), 10)
+	if p.bypassed(host) {
+		return d.DialContext(ctx, network, net.JoinHostPort(host, portStr))
+	}
+	ips, err := p.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), portStr))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// resolveUDPAddr returns the UDP address of the host, the first of the
+// preferred family.
+func (p *resolverPolicy) resolveUDPAddr(host string, port uint) (*net.UDPAddr, error) {
+	portStr := strconv.FormatUint(uint64(port), 10)
+	if p.bypassed(host) {
+		return net.ResolveUDPAddr("udp", net.JoinHostPort(host, portStr))
+	}
+	if port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+	ips, err := p.lookup(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ips[0], Port: int(port)}, nil
+}
@@ -0,0 +1,154 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package networkapi
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolverPolicy(t *testing.T) {
+	s := New(Options{})
+	dns := serveDNS(t, map[string]net.IP{"controller.plant.lan.": net.IPv4(127, 0, 0, 1)})
+	var err error
+	s.resolver, err = newResolverPolicy(ResolverConfig{
+		Servers: []string{dns},
+		Search:  []string{"other.lan", "plant.lan"},
+		Hosts:   map[string]string{"Gateway": "127.0.0.1"},
+	})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// The names are looked up in the search domains on the DNS server, or in
+	// the static hosts
+	for _, host := range []string{"controller", "controller.plant.lan", "gateway", "gateway.", "127.0.0.1"} {
+		s.tcpConnect(context.Background(), nil, []any{host, port}, func(res, err any) {
+			require.Nil(t, err, host)
+			s.tcpClose(nil, []any{res}, func(_, err any) {
+				require.Nil(t, err)
+			})
+		})
+	}
+	s.tcpConnect(context.Background(), nil, []any{"unknown", port}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	s.udpConnect(nil, []any{"127.0.0.1", 0, "controller", 9000}, func(res, err any) {
+		require.Nil(t, err)
+		s.udpBeginPacket(nil, []any{res, "controller", 9000}, func(_, err any) {
+			require.Nil(t, err)
+		})
+		s.udpBeginPacket(nil, []any{res, "gateway", 9001}, func(_, err any) {
+			require.Equal(t, 3, err.([]any)[0])
+		})
+		s.udpClose(nil, []any{res}, func(_, err any) {
+			require.Nil(t, err)
+		})
+	})
+}
+
+func TestResolverPreference(t *testing.T) {
+	v4, v6 := net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")
+	for prefer, expected := range map[string][]net.IP{
+		"":     {v6, v4},
+		"ipv4": {v4, v6},
+		"ipv6": {v6, v4},
+	} {
+		p := &resolverPolicy{cfg: ResolverConfig{Prefer: prefer}}
+		ips := []net.IP{v6, v4}
+		p.sort(ips)
+		require.Equal(t, expected, ips, prefer)
+	}
+}
+
+func TestResolverConfigValidation(t *testing.T) {
+	p, err := newResolverPolicy(ResolverConfig{})
+	require.NoError(t, err)
+	require.Nil(t, p)
+	p, err = newResolverPolicy(ResolverConfig{Servers: []string{"10.0.0.1", "[fd00::1]:5353"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1:53", "[fd00::1]:5353"}, p.cfg.Servers)
+
+	_, err = newResolverPolicy(ResolverConfig{Prefer: "ipv5"})
+	require.ErrorContains(t, err, "ipv5")
+	_, err = newResolverPolicy(ResolverConfig{Hosts: map[string]string{"controller": "not an address"}})
+	require.ErrorContains(t, err, "controller")
+	_, err = newResolverPolicy(ResolverConfig{Servers: []string{"10.0.0.1:dns"}})
+	require.ErrorContains(t, err, "10.0.0.1:dns")
+}
+
+// serveDNS starts a DNS server answering the A queries of the given names,
+// and returns its address.
+func serveDNS(t *testing.T, records map[string]net.IP) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			// The question follows the 12 bytes header: the labels of the
+			// name, the type and the class
+			var name strings.Builder
+			end := 12
+			for end < n && query[end] != 0 {
+				l := int(query[end])
+				name.Write(query[end+1 : end+1+l])
+				name.WriteByte('.')
+				end += l + 1
+			}
+			end += 5
+			qtype := binary.BigEndian.Uint16(query[end-4:])
+			ip, ok := records[strings.ToLower(name.String())]
+
+			resp := append([]byte{}, query[:end]...)
+			resp[2], resp[3] = 0x81, 0x80 // response, recursion available
+			resp[6], resp[7] = 0, 0       // no answers
+			resp[10], resp[11] = 0, 0     // no additional records
+			switch {
+			case !ok:
+				resp[3] |= 3 // name error
+			case qtype == 1:
+				resp[7] = 1
+				resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, ip.To4()...)
+			}
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
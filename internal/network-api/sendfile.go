@@ -0,0 +1,107 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package networkapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// RegisterSendFile registers net/sendFile, that streams the files opened with
+// open into the TCP connections. It must be called after Register.
+func (s *Service) RegisterSendFile(open func(path string) (*os.File, error)) {
+	s.openFile = open
+	_ = s.router.RegisterMethodWithContext("net/sendFile", s.netSendFile)
+}
+
+// netSendFile writes length bytes of the file, starting at offset, to the
+// connection and returns the number of bytes sent. A length of 0 sends the
+// file up to its end. The data is copied by the kernel when possible, and
+// never goes through the client.
+func (s *Service) netSendFile(ctx context.Context, rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) < 2 || len(params) > 4 {
+		res(nil, []any{1, "Invalid number of parameters, expected (connection ID, path[, offset[, length]])"})
+		return
+	}
+	id, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for connection ID"})
+		return
+	}
+	path, ok := params[1].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected string for path"})
+		return
+	}
+	var offset, length uint
+	if len(params) > 2 {
+		if offset, ok = msgpackrpc.ToUint(params[2]); !ok {
+			res(nil, []any{1, "Invalid parameter type, expected uint for offset"})
+			return
+		}
+	}
+	if len(params) > 3 {
+		if length, ok = msgpackrpc.ToUint(params[3]); !ok {
+			res(nil, []any{1, "Invalid parameter type, expected uint for length"})
+			return
+		}
+	}
+	conn, ok := s.getConnection(rpc, id)
+	if !ok {
+		res(nil, []any{2, fmt.Sprintf("Connection not found for ID: %d", id)})
+		return
+	}
+
+	file, err := s.openFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		res(nil, []any{2, "Failed to open file: " + err.Error()})
+		return
+	} else if err != nil {
+		res(nil, []any{3, "Failed to open file: " + err.Error()})
+		return
+	}
+	defer file.Close()
+	if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+		res(nil, []any{3, "Failed to seek file: " + err.Error()})
+		return
+	}
+	var src io.Reader = file
+	if length > 0 {
+		src = io.LimitReader(file, int64(length))
+	}
+
+	// The copy is aborted by moving the write deadline, that is reset
+	// afterwards for the following tcp/write
+	done := abortOnCancel(ctx, conn.SetWriteDeadline)
+	n, err := io.Copy(conn, src)
+	canceled := done()
+	_ = conn.SetWriteDeadline(time.Time{})
+	if canceled && errors.Is(err, os.ErrDeadlineExceeded) {
+		res(nil, []any{3, "Request canceled"})
+		return
+	} else if err != nil {
+		res(nil, []any{3, fmt.Sprintf("Failed to send file after %d bytes: %s", n, err)})
+		return
+	}
+	res(n, nil)
+}
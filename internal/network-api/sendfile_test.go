@@ -0,0 +1,75 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package networkapi
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendFile(t *testing.T) {
+	s := New(Options{})
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>hello</html>"), 0644))
+	s.openFile = func(path string) (*os.File, error) {
+		return os.Open(filepath.Join(dir, path))
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	var id any
+	s.tcpConnect(context.Background(), nil, []any{"127.0.0.1", l.Addr().(*net.TCPAddr).Port}, func(res, err any) {
+		require.Nil(t, err)
+		id = res
+	})
+	peer, err := l.Accept()
+	require.NoError(t, err)
+	defer peer.Close()
+
+	// The whole file, then a range of it
+	s.netSendFile(context.Background(), nil, []any{id, "index.html"}, func(res, err any) {
+		require.Nil(t, err)
+		require.Equal(t, int64(18), res)
+	})
+	s.netSendFile(context.Background(), nil, []any{id, "index.html", 6, 5}, func(res, err any) {
+		require.Nil(t, err)
+		require.Equal(t, int64(5), res)
+	})
+	buf := make([]byte, 23)
+	_, err = io.ReadFull(peer, buf)
+	require.NoError(t, err)
+	require.Equal(t, "<html>hello</html>hello", string(buf))
+
+	s.netSendFile(context.Background(), nil, []any{id, "missing.html"}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	s.netSendFile(context.Background(), nil, []any{9999, "index.html"}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	s.netSendFile(context.Background(), nil, []any{id, 1}, func(_, err any) {
+		require.Equal(t, 1, err.([]any)[0])
+	})
+	s.tcpClose(nil, []any{id}, func(_, err any) {
+		require.Nil(t, err)
+	})
+}
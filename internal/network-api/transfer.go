@@ -0,0 +1,147 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package networkapi
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// handleOwnership is the client owning a handle, that is closed when the
+// client disconnects, and the client it is offered to.
+type handleOwnership struct {
+	owner *msgpackrpc.Connection
+	// offeredTo is the identity or the role of the client that can take
+	// over the handle with net/acceptHandle, empty if not offered.
+	offeredTo string
+}
+
+// ownedBy returns true if the handle is owned by the client.
+func (s *Service) ownedBy(id uint, rpc *msgpackrpc.Connection) bool {
+	s.ownersLock.Lock()
+	defer s.ownersLock.Unlock()
+	o, ok := s.owners[id]
+	return ok && o.owner == rpc
+}
+
+// releaseOwner forgets the owner of a closed handle.
+func (s *Service) releaseOwner(id uint) {
+	s.ownersLock.Lock()
+	defer s.ownersLock.Unlock()
+	delete(s.owners, id)
+}
+
+// closeOwnedBy closes the handles owned by the given client.
+func (s *Service) closeOwnedBy(conn *msgpackrpc.Connection) {
+	s.ownersLock.Lock()
+	var ids []uint
+	for id, o := range s.owners {
+		if o.owner == conn {
+			ids = append(ids, id)
+			delete(s.owners, id)
+		}
+	}
+	s.ownersLock.Unlock()
+	s.closeHandles(ids)
+}
+
+// closeHandles closes the handles with the given IDs, whose owners have
+// already been released.
+func (s *Service) closeHandles(ids []uint) {
+	for _, id := range ids {
+		for _, handles := range []*sync.Map{&s.liveConnections, &s.liveListeners, &s.liveUdpConnections} {
+			if h, ok := handles.LoadAndDelete(id); ok {
+				h.(io.Closer).Close()
+				slog.Info("Closed network handle", "id", id)
+			}
+		}
+	}
+}
+
+// moveOwned moves the handles of a client to its new connection, when it
+// resumes its session.
+func (s *Service) moveOwned(from, to *msgpackrpc.Connection) {
+	s.ownersLock.Lock()
+	defer s.ownersLock.Unlock()
+	for _, o := range s.owners {
+		if o.owner == from {
+			o.owner = to
+		}
+	}
+}
+
+// netTransferHandle offers a handle owned by the caller to another client,
+// identified by its identity (if authenticated) or by its role. The caller
+// keeps owning the handle until the client accepts it with net/acceptHandle.
+// An empty recipient withdraws the offer.
+func (s *Service) netTransferHandle(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (handle, recipient identity or role)"})
+		return
+	}
+	id, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for handle"})
+		return
+	}
+	recipient, ok := params[1].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected string for recipient"})
+		return
+	}
+
+	s.ownersLock.Lock()
+	defer s.ownersLock.Unlock()
+	o, ok := s.owners[id]
+	if !ok || o.owner != rpc {
+		res(nil, []any{2, fmt.Sprintf("Handle not found: %d", id)})
+		return
+	}
+	o.offeredTo = recipient
+	res(true, nil)
+}
+
+// netAcceptHandle takes over a handle offered to the caller: from now on the
+// handle is closed when the caller disconnects, instead of the former owner.
+func (s *Service) netAcceptHandle(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected handle"})
+		return
+	}
+	id, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for handle"})
+		return
+	}
+	info, _ := s.router.ConnectionInfo(rpc)
+
+	s.ownersLock.Lock()
+	defer s.ownersLock.Unlock()
+	o, ok := s.owners[id]
+	if !ok || o.offeredTo == "" || (o.offeredTo != info.Identity && o.offeredTo != info.Role) {
+		res(nil, []any{2, fmt.Sprintf("Handle not offered: %d", id)})
+		return
+	}
+	o.owner = rpc
+	o.offeredTo = ""
+	slog.Info("Network handle transferred", "id", id, "identity", info.Identity, "role", info.Role)
+	res(true, nil)
+}
@@ -0,0 +1,119 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package networkapi
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+func TestTransferHandle(t *testing.T) {
+	r := msgpackrouter.New(0)
+	s := New(Options{})
+	require.NoError(t, s.Register(r))
+	helperEnd, routerEnd := net.Pipe()
+	helper, helperClosed := r.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Transport: "unix", Role: msgpackrouter.RoleLocalService})
+	mcuEnd, routerEnd := net.Pipe()
+	mcu, mcuClosed := r.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Transport: "serial", Role: msgpackrouter.RoleMCU})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	var id any
+	s.tcpConnect(context.Background(), helper, []any{"127.0.0.1", l.Addr().(*net.TCPAddr).Port}, func(res, err any) {
+		require.Nil(t, err)
+		id = res
+	})
+
+	// The handle must be offered by its owner before being accepted
+	s.netAcceptHandle(mcu, []any{id}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	s.netTransferHandle(mcu, []any{id, "mcu"}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	s.netTransferHandle(helper, []any{id, "mcu"}, func(res, err any) {
+		require.Nil(t, err)
+		require.Equal(t, true, res)
+	})
+	s.netAcceptHandle(mcu, []any{id}, func(res, err any) {
+		require.Nil(t, err)
+		require.Equal(t, true, res)
+	})
+	s.netAcceptHandle(mcu, []any{id}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+
+	// The handle survives the former owner, and it is closed with the new one
+	helperEnd.Close()
+	<-helperClosed
+	_, ok := s.getConnection(mcu, id.(uint))
+	require.True(t, ok)
+	mcuEnd.Close()
+	<-mcuClosed
+	_, ok = s.getConnection(mcu, id.(uint))
+	require.False(t, ok)
+	require.NotContains(t, s.owners, id)
+}
+
+func TestHandleOwnership(t *testing.T) {
+	r := msgpackrouter.New(0)
+	s := New(Options{})
+	require.NoError(t, s.Register(r))
+	ownerEnd, routerEnd := net.Pipe()
+	defer ownerEnd.Close()
+	owner, _ := r.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Transport: "unix", Role: msgpackrouter.RoleLocalService})
+	otherEnd, routerEnd := net.Pipe()
+	defer otherEnd.Close()
+	other, _ := r.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Transport: "unix", Role: msgpackrouter.RoleLocalService})
+
+	var listID, udpID any
+	s.tcpListen(owner, []any{"127.0.0.1", 0}, func(res, err any) {
+		require.Nil(t, err)
+		listID = res
+	})
+	s.udpConnect(owner, []any{"127.0.0.1", 0}, func(res, err any) {
+		require.Nil(t, err)
+		udpID = res
+	})
+	require.NotEqual(t, listID, udpID)
+
+	// The handles of another client can't be used or closed, as if they
+	// didn't exist
+	s.udpBeginPacket(other, []any{udpID, "127.0.0.1", 9}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	s.udpClose(other, []any{udpID}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	s.tcpCloseListener(other, []any{listID}, func(_, err any) {
+		require.Equal(t, 2, err.([]any)[0])
+	})
+	_, ok := s.getListener(owner, listID.(uint))
+	require.True(t, ok)
+
+	s.udpClose(owner, []any{udpID}, func(_, err any) {
+		require.Nil(t, err)
+	})
+	s.tcpCloseListener(owner, []any{listID}, func(_, err any) {
+		require.Nil(t, err)
+	})
+}
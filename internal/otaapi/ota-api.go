@@ -0,0 +1,244 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package otaapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// ProgressMethod is the notification method used to report the progress of
+// a download to the client that requested it, with the URL, the number of
+// bytes received and the total size (-1 if unknown) as parameters.
+const ProgressMethod = "ota/progress"
+
+// progressInterval is the minimum interval between progress notifications.
+const progressInterval = time.Second
+
+// applyTimeout is the maximum duration of the apply command.
+const applyTimeout = 10 * time.Minute
+
+// Config is the configuration of the OTA API.
+type Config struct {
+	// Dir is the directory where the images are downloaded.
+	Dir string
+	// ApplyCommand is the command run by ota/apply, with the path of the
+	// image appended as last argument (empty = ota/apply disabled).
+	ApplyCommand string
+}
+
+var config Config
+var httpClient = http.DefaultClient
+
+var lock sync.Mutex
+var images = make(map[uint]string)
+var nextImageID uint
+var activeDownloads int
+
+// Register registers the OTA API methods with the router.
+func Register(router *msgpackrouter.Router, cfg Config) error {
+	if err := os.MkdirAll(cfg.Dir, 0750); err != nil {
+		return fmt.Errorf("failed to create OTA directory: %w", err)
+	}
+	config = cfg
+	_ = router.RegisterMethod("ota/fetch", otaFetch)
+	_ = router.RegisterMethod("ota/apply", otaApply)
+	return nil
+}
+
+// Stats returns the number of downloads in progress and of the downloaded
+// images.
+func Stats() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return map[string]any{
+		"downloads": activeDownloads,
+		"images":    len(images),
+	}
+}
+
+// progressWriter sends the progress notifications of a download.
+type progressWriter struct {
+	conn     *msgpackrpc.Connection
+	url      string
+	total    int64
+	received int64
+	last     time.Time
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	p.received += int64(len(data))
+	if now := time.Now(); now.Sub(p.last) >= progressInterval || p.received == p.total {
+		p.last = now
+		p.notify()
+	}
+	return len(data), nil
+}
+
+func (p *progressWriter) notify() {
+	if err := p.conn.SendNotification(ProgressMethod, p.url, p.received, p.total); err != nil {
+		slog.Debug("Failed to send OTA progress", "url", p.url, "err", err)
+	}
+}
+
+// otaFetch downloads the image from the HTTPS URL, verifies its SHA-256
+// hash and returns the handle to pass to ota/apply. The progress is sent
+// to the caller with ProgressMethod notifications.
+func otaFetch(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (url, sha256)"})
+		return
+	}
+	imageURL, ok := params[0].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected string for url"})
+		return
+	}
+	if u, err := url.Parse(imageURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		res(nil, []any{1, "Invalid url, expected an https URL"})
+		return
+	}
+	hashHex, ok := params[1].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected string for sha256"})
+		return
+	}
+	expectedHash, err := hex.DecodeString(hashHex)
+	if err != nil || len(expectedHash) != sha256.Size {
+		res(nil, []any{1, "Invalid sha256, expected 64 hex digits"})
+		return
+	}
+
+	lock.Lock()
+	activeDownloads++
+	lock.Unlock()
+	defer func() {
+		lock.Lock()
+		activeDownloads--
+		lock.Unlock()
+	}()
+
+	slog.Info("Downloading OTA image", "url", imageURL)
+	path, err := download(rpc, imageURL, expectedHash)
+	if err != nil {
+		slog.Error("Failed to download OTA image", "url", imageURL, "err", err)
+		res(nil, []any{3, "Failed to download image: " + err.Error()})
+		return
+	}
+
+	lock.Lock()
+	nextImageID++
+	id := nextImageID
+	images[id] = path
+	lock.Unlock()
+	slog.Info("Downloaded OTA image", "url", imageURL, "path", path, "id", id)
+	res(id, nil)
+}
+
+// download saves the image in the OTA directory and returns its path, the
+// file is removed if the download fails or the hash does not match.
+func download(rpc *msgpackrpc.Connection, imageURL string, expectedHash []byte) (string, error) {
+	resp, err := httpClient.Get(imageURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+
+	f, err := os.CreateTemp(config.Dir, "image-*")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	progress := &progressWriter{conn: rpc, url: imageURL, total: resp.ContentLength, last: time.Now()}
+	progress.notify()
+	_, err = io.Copy(io.MultiWriter(f, hash, progress), resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !bytes.Equal(hash.Sum(nil), expectedHash) {
+		err = errors.New("sha256 mismatch")
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// otaApply runs the apply command on the downloaded image and removes the
+// image if the command succeeds.
+func otaApply(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected image handle"})
+		return
+	}
+	id, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for image handle"})
+		return
+	}
+	lock.Lock()
+	path, ok := images[id]
+	lock.Unlock()
+	if !ok {
+		res(nil, []any{2, fmt.Sprintf("OTA image not found for handle: %d", id)})
+		return
+	}
+	args := strings.Fields(config.ApplyCommand)
+	if len(args) == 0 {
+		res(nil, []any{3, "No apply command configured"})
+		return
+	}
+	args = append(args, path)
+
+	slog.Warn("Applying OTA image", "id", id, "command", strings.Join(args, " "))
+	ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
+		}
+		slog.Error("Failed to apply OTA image", "id", id, "err", msg)
+		res(nil, []any{3, "Failed to apply image: " + msg})
+		return
+	}
+
+	lock.Lock()
+	delete(images, id)
+	lock.Unlock()
+	os.Remove(path)
+	res(true, nil)
+}
@@ -0,0 +1,112 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package otaapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, rpc *msgpackrpc.Connection, params ...any) (any, any) {
+	var result, reqErr any
+	handler(rpc, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestOTA(t *testing.T) {
+	image := []byte("FIRMWARE IMAGE")
+	hash := sha256.Sum256(image)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(image)
+	}))
+	defer server.Close()
+	httpClient = server.Client()
+
+	dir := t.TempDir()
+	applied := filepath.Join(dir, "applied")
+	script := filepath.Join(dir, "apply.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\ncp \"$1\" "+applied+"\n"), 0700))
+	require.NoError(t, Register(msgpackrouter.New(0), Config{Dir: filepath.Join(dir, "ota")}))
+
+	routerSide, clientSide := net.Pipe()
+	caller := msgpackrpc.NewConnection(routerSide, routerSide, nil, nil, nil)
+	defer caller.Close()
+	progress := make(chan []any, 10)
+	client := msgpackrpc.NewConnection(clientSide, clientSide, nil, func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		if method == ProgressMethod {
+			progress <- params
+		}
+	}, func(err error) {})
+	go client.Run()
+	defer client.Close()
+
+	_, reqErr := call(otaFetch, caller, "http://example.com/image.bin", hex.EncodeToString(hash[:]))
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(otaFetch, caller, server.URL+"/image.bin", "1234")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(otaFetch, caller, server.URL+"/missing.bin", hex.EncodeToString(hash[:]))
+	require.Equal(t, 3, reqErr.([]any)[0])
+	_, reqErr = call(otaFetch, caller, server.URL+"/image.bin", hex.EncodeToString(make([]byte, sha256.Size)))
+	require.Equal(t, []any{3, "Failed to download image: sha256 mismatch"}, reqErr)
+	files, err := os.ReadDir(filepath.Join(dir, "ota"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	for len(progress) > 0 {
+		<-progress
+	}
+	handle, reqErr := call(otaFetch, caller, server.URL+"/image.bin", hex.EncodeToString(hash[:]))
+	require.Nil(t, reqErr)
+	require.Equal(t, map[string]any{"downloads": 0, "images": 1}, Stats())
+	start := <-progress
+	require.EqualValues(t, 0, start[1])
+	require.EqualValues(t, len(image), start[2])
+	end := <-progress
+	require.EqualValues(t, len(image), end[1])
+
+	_, reqErr = call(otaApply, caller, 99)
+	require.Equal(t, 2, reqErr.([]any)[0])
+	_, reqErr = call(otaApply, caller, handle)
+	require.Equal(t, []any{3, "No apply command configured"}, reqErr)
+	config.ApplyCommand = "false"
+	_, reqErr = call(otaApply, caller, handle)
+	require.Equal(t, 3, reqErr.([]any)[0])
+
+	// The apply command receives the path of the image as last argument
+	config.ApplyCommand = script
+	res, reqErr := call(otaApply, caller, handle)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	data, err := os.ReadFile(applied)
+	require.NoError(t, err)
+	require.Equal(t, image, data)
+	require.Equal(t, map[string]any{"downloads": 0, "images": 0}, Stats())
+}
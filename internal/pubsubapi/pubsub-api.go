@@ -0,0 +1,351 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package pubsubapi
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// MessageMethod is the notification method used to deliver the messages
+// published on a topic to the subscribers, with the subscription handle, the
+// topic and the payload as parameters.
+const MessageMethod = "pubsub/message"
+
+// maxRetained is the maximum number of topics with a retained message.
+const maxRetained = 1024
+
+// filter selects the messages delivered to a subscription.
+type filter struct {
+	// minInterval is the minimum time between two messages of the same
+	// topic, the messages published in between are dropped.
+	minInterval time.Duration
+	// match are the key-value pairs that the payload (a map) must contain.
+	match map[string]any
+}
+
+// subscription receives the messages published on the topics matching its
+// pattern, that passed its filter.
+type subscription struct {
+	owner   *msgpackrpc.Connection
+	pattern string
+	filter  filter
+	// lastSent is the time of the last message delivered for each topic.
+	lastSent map[string]time.Time
+}
+
+var lock sync.Mutex
+var subscriptions = make(map[uint]*subscription)
+var nextSubscriptionID uint
+
+// retained are the last messages published with the retain flag, by topic.
+var retained = make(map[string]any)
+
+var published atomic.Uint64
+var delivered atomic.Uint64
+var filtered atomic.Uint64
+
+// Register registers the pub/sub API methods with the router.
+func Register(router *msgpackrouter.Router) {
+	_ = router.RegisterMethod("pubsub/subscribe", pubsubSubscribe)
+	_ = router.RegisterMethod("pubsub/unsubscribe", pubsubUnsubscribe)
+	_ = router.RegisterMethod("pubsub/publish", pubsubPublish)
+	router.OnConnectionClosed(unsubscribeAll)
+	router.OnConnectionResumed(moveSubscriptions)
+}
+
+// Stats returns the number of active subscriptions and the message counters.
+func Stats() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return map[string]any{
+		"subscriptions": len(subscriptions),
+		"retained":      len(retained),
+		"published":     published.Load(),
+		"delivered":     delivered.Load(),
+		"filtered":      filtered.Load(),
+	}
+}
+
+// Retained returns a copy of the retained messages, by topic.
+func Retained() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return maps.Clone(retained)
+}
+
+// RestoreRetained adds the given retained messages, for example from a
+// snapshot of the state saved before a reboot. The nil payloads are ignored,
+// and the topics beyond the maximum number of retained topics are dropped.
+func RestoreRetained(messages map[string]any) {
+	lock.Lock()
+	defer lock.Unlock()
+	for topic, payload := range messages {
+		if _, exists := retained[topic]; payload == nil || (!exists && len(retained) >= maxRetained) {
+			continue
+		}
+		retained[topic] = payload
+	}
+}
+
+// moveSubscriptions moves the subscriptions of a client to its new
+// connection, when it resumes its session.
+func moveSubscriptions(from, to *msgpackrpc.Connection) {
+	lock.Lock()
+	defer lock.Unlock()
+	for _, s := range subscriptions {
+		if s.owner == from {
+			s.owner = to
+		}
+	}
+}
+
+// unsubscribeAll removes the subscriptions of the given client.
+func unsubscribeAll(conn *msgpackrpc.Connection) {
+	lock.Lock()
+	defer lock.Unlock()
+	for id, s := range subscriptions {
+		if s.owner == conn {
+			delete(subscriptions, id)
+		}
+	}
+}
+
+// MatchesTopic returns true if the topic matches the pattern of a
+// subscription: a pattern ending with "*" matches all the topics with the
+// given prefix.
+func MatchesTopic(pattern, topic string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(topic, prefix)
+	}
+	return pattern == topic
+}
+
+// parseFilter parses the filter of a subscription, a map with the optional
+// "min_interval" (in milliseconds) and "match" (map of the key-value pairs
+// that the payload must contain) keys.
+func parseFilter(value any) (filter, bool) {
+	var f filter
+	m, ok := value.(map[string]any)
+	if !ok {
+		return f, false
+	}
+	for key, v := range m {
+		switch key {
+		case "min_interval":
+			ms, ok := msgpackrpc.ToUint(v)
+			if !ok {
+				return f, false
+			}
+			f.minInterval = time.Duration(ms) * time.Millisecond
+		case "match":
+			if f.match, ok = v.(map[string]any); !ok {
+				return f, false
+			}
+		default:
+			return f, false
+		}
+	}
+	return f, true
+}
+
+// accepts returns true if the message passes the filter of the
+// subscription, and records its delivery.
+func (s *subscription) accepts(topic string, payload any, now time.Time) bool {
+	if len(s.filter.match) > 0 {
+		m, ok := payload.(map[string]any)
+		if !ok {
+			return false
+		}
+		for key, expected := range s.filter.match {
+			if value, ok := m[key]; !ok || !sameValue(value, expected) {
+				return false
+			}
+		}
+	}
+	if s.filter.minInterval > 0 {
+		if last, ok := s.lastSent[topic]; ok && now.Sub(last) < s.filter.minInterval {
+			return false
+		}
+		s.lastSent[topic] = now
+	}
+	return true
+}
+
+// sameValue compares two decoded values, the integers are compared by value
+// regardless of the size they have been encoded with.
+func sameValue(a, b any) bool {
+	if x, ok := msgpackrpc.ToInt(a); ok {
+		y, ok := msgpackrpc.ToInt(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// pubsubSubscribe subscribes the client to the topics matching the given
+// pattern, optionally with a filter. It returns the handle of the
+// subscription. The retained messages of the matching topics that pass the
+// filter are sent to the client right after the response.
+func pubsubSubscribe(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 && len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (topic pattern[, filter])"})
+		return
+	}
+	pattern, ok := params[0].(string)
+	if !ok || pattern == "" {
+		res(nil, []any{1, "Invalid parameter type, expected string for topic pattern"})
+		return
+	}
+	var f filter
+	if len(params) == 2 {
+		if f, ok = parseFilter(params[1]); !ok {
+			res(nil, []any{1, "Invalid parameter, expected filter map with min_interval (ms) and match keys"})
+			return
+		}
+	}
+
+	s := &subscription{owner: rpc, pattern: pattern, filter: f, lastSent: make(map[string]time.Time)}
+	type message struct {
+		topic   string
+		payload any
+	}
+	var messages []message
+	now := time.Now()
+	lock.Lock()
+	nextSubscriptionID++
+	id := nextSubscriptionID
+	subscriptions[id] = s
+	for topic, payload := range retained {
+		if MatchesTopic(pattern, topic) && s.accepts(topic, payload, now) {
+			messages = append(messages, message{topic, payload})
+		}
+	}
+	lock.Unlock()
+
+	slog.Info("Started pub/sub subscription", "pattern", pattern, "id", id)
+	res(id, nil)
+	for _, m := range messages {
+		if err := rpc.SendNotification(MessageMethod, id, m.topic, m.payload); err != nil {
+			slog.Debug("Failed to deliver retained pub/sub message", "topic", m.topic, "id", id, "err", err)
+			return
+		}
+		delivered.Add(1)
+	}
+}
+
+// pubsubUnsubscribe removes the subscription with the given handle.
+func pubsubUnsubscribe(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected subscription handle"})
+		return
+	}
+	id, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for subscription handle"})
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	s, ok := subscriptions[id]
+	if !ok || s.owner != rpc {
+		res(nil, []any{2, fmt.Sprintf("Subscription not found for handle: %d", id)})
+		return
+	}
+	delete(subscriptions, id)
+	res(true, nil)
+}
+
+// pubsubPublish delivers the payload published on the topic to the
+// subscriptions whose pattern and filter match it. With the retain flag the
+// payload is also kept as the last value of the topic, sent to the future
+// subscribers, and a nil payload removes it. It may be sent as a
+// notification, as a request it returns the number of deliveries.
+func pubsubPublish(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 && len(params) != 3 {
+		res(nil, []any{1, "Invalid number of parameters, expected (topic, payload[, retain])"})
+		return
+	}
+	topic, ok := params[0].(string)
+	if !ok || topic == "" {
+		res(nil, []any{1, "Invalid parameter type, expected string for topic"})
+		return
+	}
+	payload := params[1]
+	retain := false
+	if len(params) == 3 {
+		if retain, ok = params[2].(bool); !ok {
+			res(nil, []any{1, "Invalid parameter type, expected bool for retain flag"})
+			return
+		}
+	}
+	if retain {
+		lock.Lock()
+		_, exists := retained[topic]
+		switch {
+		case payload == nil:
+			delete(retained, topic)
+		case !exists && len(retained) >= maxRetained:
+			lock.Unlock()
+			res(nil, []any{3, fmt.Sprintf("Too many retained topics, at most %d are allowed", maxRetained)})
+			return
+		default:
+			retained[topic] = payload
+		}
+		lock.Unlock()
+		if payload == nil {
+			res(0, nil)
+			return
+		}
+	}
+	published.Add(1)
+
+	type delivery struct {
+		id    uint
+		owner *msgpackrpc.Connection
+	}
+	var deliveries []delivery
+	now := time.Now()
+	lock.Lock()
+	for id, s := range subscriptions {
+		if !MatchesTopic(s.pattern, topic) {
+			continue
+		}
+		if !s.accepts(topic, payload, now) {
+			filtered.Add(1)
+			continue
+		}
+		deliveries = append(deliveries, delivery{id, s.owner})
+	}
+	lock.Unlock()
+
+	for _, d := range deliveries {
+		if err := d.owner.SendNotification(MessageMethod, d.id, topic, payload); err != nil {
+			slog.Debug("Failed to deliver pub/sub message", "topic", topic, "id", d.id, "err", err)
+			continue
+		}
+		delivered.Add(1)
+	}
+	res(len(deliveries), nil)
+}
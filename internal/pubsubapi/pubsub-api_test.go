@@ -0,0 +1,160 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package pubsubapi
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, rpc *msgpackrpc.Connection, params ...any) (any, any) {
+	var result, reqErr any
+	handler(rpc, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+// newSubscriber returns the router side of a client connection, and the
+// channel where the messages delivered to the client are sent.
+func newSubscriber(t *testing.T) (*msgpackrpc.Connection, chan []any) {
+	routerSide, clientSide := net.Pipe()
+	owner := msgpackrpc.NewConnection(routerSide, routerSide, nil, nil, nil)
+	t.Cleanup(func() { owner.Close() })
+	messages := make(chan []any, 10)
+	client := msgpackrpc.NewConnection(clientSide, clientSide, nil, func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		if method == MessageMethod {
+			messages <- params
+		}
+	}, func(err error) {})
+	go client.Run()
+	t.Cleanup(func() { client.Close() })
+	return owner, messages
+}
+
+func TestPubSub(t *testing.T) {
+	sub, messages := newSubscriber(t)
+	publisher := new(msgpackrpc.Connection)
+
+	_, reqErr := call(pubsubSubscribe, sub, 1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(pubsubSubscribe, sub, "sensor/*", map[string]any{"unknown": 1})
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(pubsubPublish, publisher, "sensor/temp")
+	require.Equal(t, 1, reqErr.([]any)[0])
+
+	handle, reqErr := call(pubsubSubscribe, sub, "sensor/*")
+	require.Nil(t, reqErr)
+	n, reqErr := call(pubsubPublish, publisher, "sensor/temp", 21.5)
+	require.Nil(t, reqErr)
+	require.Equal(t, 1, n)
+	n, _ = call(pubsubPublish, publisher, "network/status", "up")
+	require.Equal(t, 0, n)
+	select {
+	case params := <-messages:
+		require.EqualValues(t, handle, params[0])
+		require.Equal(t, []any{"sensor/temp", 21.5}, params[1:])
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "no message received")
+	}
+
+	_, reqErr = call(pubsubUnsubscribe, publisher, handle)
+	require.Equal(t, 2, reqErr.([]any)[0])
+	_, reqErr = call(pubsubUnsubscribe, sub, handle)
+	require.Nil(t, reqErr)
+	n, _ = call(pubsubPublish, publisher, "sensor/temp", 22.0)
+	require.Equal(t, 0, n)
+}
+
+func TestPubSubFilters(t *testing.T) {
+	sub, _ := newSubscriber(t)
+	publisher := new(msgpackrpc.Connection)
+	defer unsubscribeAll(sub)
+
+	// The payload must contain the matching keys
+	_, reqErr := call(pubsubSubscribe, sub, "sensor/temp", map[string]any{"match": map[string]any{"unit": "C", "probe": int8(1)}})
+	require.Nil(t, reqErr)
+	n, _ := call(pubsubPublish, publisher, "sensor/temp", map[string]any{"unit": "C", "probe": uint16(1), "value": 21})
+	require.Equal(t, 1, n)
+	n, _ = call(pubsubPublish, publisher, "sensor/temp", map[string]any{"unit": "F", "probe": 1, "value": 70})
+	require.Equal(t, 0, n)
+	n, _ = call(pubsubPublish, publisher, "sensor/temp", 21)
+	require.Equal(t, 0, n)
+	unsubscribeAll(sub)
+
+	// At most one message per topic every min_interval
+	_, reqErr = call(pubsubSubscribe, sub, "sensor/*", map[string]any{"min_interval": 100})
+	require.Nil(t, reqErr)
+	n, _ = call(pubsubPublish, publisher, "sensor/temp", 1)
+	require.Equal(t, 1, n)
+	n, _ = call(pubsubPublish, publisher, "sensor/temp", 2)
+	require.Equal(t, 0, n)
+	n, _ = call(pubsubPublish, publisher, "sensor/humidity", 3)
+	require.Equal(t, 1, n)
+	time.Sleep(150 * time.Millisecond)
+	n, _ = call(pubsubPublish, publisher, "sensor/temp", 4)
+	require.Equal(t, 1, n)
+	require.EqualValues(t, 3, Stats()["filtered"])
+}
+
+func TestPubSubRetained(t *testing.T) {
+	publisher := new(msgpackrpc.Connection)
+	_, reqErr := call(pubsubPublish, publisher, "network/status", "up", "yes")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(pubsubPublish, publisher, "network/status", "up", true)
+	require.Nil(t, reqErr)
+	_, reqErr = call(pubsubPublish, publisher, "network/rssi", -60, false)
+	require.Nil(t, reqErr)
+
+	// A late subscriber gets the last retained value right away
+	sub, messages := newSubscriber(t)
+	defer unsubscribeAll(sub)
+	handle, reqErr := call(pubsubSubscribe, sub, "network/*")
+	require.Nil(t, reqErr)
+	select {
+	case params := <-messages:
+		require.EqualValues(t, handle, params[0])
+		require.Equal(t, []any{"network/status", "up"}, params[1:])
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "no retained message received")
+	}
+	require.EqualValues(t, 1, Stats()["retained"])
+	require.Equal(t, map[string]any{"network/status": "up"}, Retained())
+
+	// A nil payload removes the retained value
+	_, reqErr = call(pubsubPublish, publisher, "network/status", nil, true)
+	require.Nil(t, reqErr)
+	require.EqualValues(t, 0, Stats()["retained"])
+	_, reqErr = call(pubsubSubscribe, sub, "network/*")
+	require.Nil(t, reqErr)
+	select {
+	case params := <-messages:
+		require.Fail(t, "unexpected message", params)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPubSubRestoreRetained(t *testing.T) {
+	RestoreRetained(map[string]any{"device/name": "kitchen", "device/removed": nil})
+	require.Equal(t, map[string]any{"device/name": "kitchen"}, Retained())
+	_, reqErr := call(pubsubPublish, new(msgpackrpc.Connection), "device/name", nil, true)
+	require.Nil(t, reqErr)
+	require.Empty(t, Retained())
+}
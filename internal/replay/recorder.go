@@ -0,0 +1,147 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package replay records the sessions of a router (the frames exchanged on
+// all its connections, with their timing) and replays them against a router
+// instance, to turn the routing bugs reported from the field into regression
+// tests.
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+// Event types
+const (
+	// EventOpen is the connection of a client to the router.
+	EventOpen = "open"
+	// EventIn are the bytes received by the router from a client.
+	EventIn = "in"
+	// EventOut are the bytes sent by the router to a client.
+	EventOut = "out"
+	// EventClose is the disconnection of a client.
+	EventClose = "close"
+)
+
+// Event is an event of a recorded session, stored as a line of JSON.
+type Event struct {
+	// Conn is the number of the connection, in the order they are opened.
+	Conn int `json:"conn"`
+	// Time is the time elapsed since the start of the recording.
+	Time time.Duration `json:"t"`
+	Type string        `json:"type"`
+	Data []byte        `json:"data,omitempty"`
+	// Transport, RemoteAddr and Role are the metadata of the connection,
+	// set in the EventOpen events.
+	Transport  string `json:"transport,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Role       string `json:"role,omitempty"`
+}
+
+// Recorder writes the events of the connections of a router to a stream, as
+// they happen, so that a session is not lost if the router crashes.
+type Recorder struct {
+	mutex    sync.Mutex
+	enc      *json.Encoder
+	start    time.Time
+	lastConn int
+	err      error
+}
+
+// NewRecorder creates a Recorder writing the events to w. Use Record to
+// record the connections of a router.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w), start: time.Now()}
+}
+
+// Record records the connections accepted by the router from now on.
+func (rec *Recorder) Record(router *msgpackrouter.Router) {
+	router.SetConnectionWrapper(rec.Wrap)
+}
+
+// Wrap returns a stream that records the traffic of conn.
+func (rec *Recorder) Wrap(conn io.ReadWriteCloser, info msgpackrouter.ConnectionInfo) io.ReadWriteCloser {
+	rec.mutex.Lock()
+	rec.lastConn++
+	id := rec.lastConn
+	rec.mutex.Unlock()
+	rec.write(Event{Conn: id, Type: EventOpen, Transport: info.Transport, RemoteAddr: info.RemoteAddr, Role: info.Role})
+	return &recordingConn{ReadWriteCloser: conn, rec: rec, id: id}
+}
+
+// Err returns the first error writing the events, the events following an
+// error are discarded.
+func (rec *Recorder) Err() error {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return rec.err
+}
+
+func (rec *Recorder) write(event Event) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.err != nil {
+		return
+	}
+	event.Time = time.Since(rec.start)
+	rec.err = rec.enc.Encode(event)
+}
+
+// recordingConn is a connection whose traffic is recorded.
+type recordingConn struct {
+	io.ReadWriteCloser
+	rec      *Recorder
+	id       int
+	closedIn sync.Once
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if n > 0 {
+		c.rec.write(Event{Conn: c.id, Type: EventIn, Data: b[:n]})
+	}
+	if errors.Is(err, io.EOF) {
+		c.closedIn.Do(func() { c.rec.write(Event{Conn: c.id, Type: EventClose}) })
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	// Record the bytes before writing them, otherwise the answer of the
+	// client could be recorded before them
+	c.rec.write(Event{Conn: c.id, Type: EventOut, Data: b})
+	return c.ReadWriteCloser.Write(b)
+}
+
+// Load reads the events of a session recorded by a Recorder.
+func Load(r io.Reader) ([]Event, error) {
+	var events []Event
+	dec := json.NewDecoder(r)
+	for {
+		var event Event
+		if err := dec.Decode(&event); errors.Is(err, io.EOF) {
+			return events, nil
+		} else if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
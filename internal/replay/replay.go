@@ -0,0 +1,183 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+// Options are the options of a replay.
+type Options struct {
+	// Speed is the speed factor of the replay compared to the recording (2
+	// is twice as fast), 0 replays the session as fast as possible.
+	Speed float64
+	// Timeout is the maximum time waited for each message expected from the
+	// router, 5 seconds if zero.
+	Timeout time.Duration
+}
+
+// step is a step of a replay: the bytes sent by a client, a message
+// expected from the router, or the disconnection of a client.
+type step struct {
+	event Event
+	// msg is the message expected from the router in a EventOut step
+	msg any
+}
+
+// Run replays the recorded events against the router, which must have the
+// same methods and settings of the recorded one: the bytes received from the
+// clients are sent again, in the recorded order, and the messages sent by
+// the router are compared with the recorded ones. The bytes of each client
+// are sent only after receiving the messages recorded before them, so the
+// replay is deterministic even if it is faster than the recording. Run
+// returns an error describing the first difference.
+func Run(router *msgpackrouter.Router, events []Event, opts Options) error {
+	steps, err := plan(events)
+	if err != nil {
+		return err
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	conns := map[int]*replayConn{}
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	start := time.Now()
+	for i, s := range steps {
+		if opts.Speed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(s.event.Time) / opts.Speed))))
+		}
+		if s.event.Type == EventOpen {
+			conns[s.event.Conn] = openReplayConn(router, s.event)
+			continue
+		}
+		c, ok := conns[s.event.Conn]
+		if !ok {
+			return fmt.Errorf("event %d: connection %d not opened", i, s.event.Conn)
+		}
+		switch s.event.Type {
+		case EventIn:
+			if _, err := c.client.Write(s.event.Data); err != nil {
+				return fmt.Errorf("event %d: writing to connection %d: %w", i, s.event.Conn, err)
+			}
+		case EventClose:
+			c.Close()
+		case EventOut:
+			select {
+			case msg := <-c.msgs:
+				if !reflect.DeepEqual(msg, s.msg) {
+					return fmt.Errorf("event %d: connection %d: expected message %v, got %v", i, s.event.Conn, s.msg, msg)
+				}
+			case err := <-c.errs:
+				return fmt.Errorf("event %d: connection %d: expected message %v, got error %w", i, s.event.Conn, s.msg, err)
+			case <-time.After(opts.Timeout):
+				return fmt.Errorf("event %d: connection %d: expected message %v, got nothing", i, s.event.Conn, s.msg)
+			}
+		}
+	}
+
+	// Check that the router did not send more messages than recorded
+	time.Sleep(10 * time.Millisecond)
+	for id, c := range conns {
+		select {
+		case msg := <-c.msgs:
+			return fmt.Errorf("connection %d: unexpected message %v", id, msg)
+		default:
+		}
+	}
+	return nil
+}
+
+// plan converts the recorded events into the steps of a replay, splitting
+// the bytes sent by the router into messages.
+func plan(events []Event) ([]step, error) {
+	var steps []step
+	pending := map[int]*bytes.Buffer{}
+	for i, event := range events {
+		if event.Type != EventOut {
+			steps = append(steps, step{event: event})
+			continue
+		}
+		buf, ok := pending[event.Conn]
+		if !ok {
+			buf = &bytes.Buffer{}
+			pending[event.Conn] = buf
+		}
+		buf.Write(event.Data)
+		for buf.Len() > 0 {
+			r := bytes.NewReader(buf.Bytes())
+			msg, err := msgpack.NewDecoder(r).DecodeInterface()
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// The message continues in the next event
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("event %d: invalid message sent to connection %d: %w", i, event.Conn, err)
+			}
+			buf.Next(buf.Len() - r.Len())
+			steps = append(steps, step{event: event, msg: msg})
+		}
+	}
+	return steps, nil
+}
+
+// replayConn is the client side of a replayed connection.
+type replayConn struct {
+	client net.Conn
+	msgs   chan any
+	errs   chan error
+}
+
+// openReplayConn connects a client to the router, with the metadata of the
+// recorded connection.
+func openReplayConn(router *msgpackrouter.Router, event Event) *replayConn {
+	client, server := net.Pipe()
+	c := &replayConn{client: client, msgs: make(chan any, 1024), errs: make(chan error, 1)}
+	router.AcceptConnectionWithInfo(server, msgpackrouter.ConnectionInfo{
+		Transport:  event.Transport,
+		RemoteAddr: event.RemoteAddr,
+		Role:       event.Role,
+	})
+	go func() {
+		dec := msgpack.NewDecoder(client)
+		for {
+			msg, err := dec.DecodeInterface()
+			if err != nil {
+				c.errs <- err
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+func (c *replayConn) Close() {
+	c.client.Close()
+}
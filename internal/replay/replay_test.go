@@ -0,0 +1,111 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package replay_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/internal/replay"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// newRouter returns a router with an internal method returning the version,
+// where the MCU role can call all the methods.
+func newRouter(t *testing.T, version string) *msgpackrouter.Router {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleMCU, nil)
+	require.NoError(t, router.RegisterMethod("$/version", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res(version, nil)
+	}))
+	return router
+}
+
+// connect connects a client to the router, the channel is closed when the
+// router closes the connection.
+func connect(router *msgpackrouter.Router, info msgpackrouter.ConnectionInfo, handler msgpackrpc.RequestHandler) (*msgpackrpc.Connection, <-chan struct{}) {
+	client, server := net.Pipe()
+	_, closed := router.AcceptConnectionWithInfo(server, info)
+	conn := msgpackrpc.NewConnection(client, client, handler, nil, nil)
+	go conn.Run()
+	return conn, closed
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	// Record a session
+	var session bytes.Buffer
+	router := newRouter(t, "1.0")
+	rec := replay.NewRecorder(&session)
+	rec.Record(router)
+
+	mcu, mcuClosed := connect(router, msgpackrouter.ConnectionInfo{Transport: "serial", Role: msgpackrouter.RoleMCU},
+		func(_ msgpackrpc.FunctionLogger, _ string, params []any, res msgpackrpc.ResponseHandler) {
+			a, _ := msgpackrpc.ToInt(params[0])
+			b, _ := msgpackrpc.ToInt(params[1])
+			res(a+b, nil)
+		})
+	_, reqErr, err := mcu.SendRequest(t.Context(), "$/register", "sum")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+
+	client, clientClosed := connect(router, msgpackrouter.ConnectionInfo{Transport: "unix"}, nil)
+	result, _, err := client.SendRequest(t.Context(), "sum", 1, 2)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, result)
+	result, _, err = client.SendRequest(t.Context(), "$/version")
+	require.NoError(t, err)
+	require.Equal(t, "1.0", result)
+	_, reqErr, err = client.SendRequest(t.Context(), "missing")
+	require.NoError(t, err)
+	require.NotNil(t, reqErr)
+	client.Close()
+	mcu.Close()
+	<-clientClosed
+	<-mcuClosed
+	require.NoError(t, rec.Err())
+
+	events, err := replay.Load(&session)
+	require.NoError(t, err)
+	require.Equal(t, replay.EventOpen, events[0].Type)
+	require.Equal(t, "serial", events[0].Transport)
+	require.Equal(t, msgpackrouter.RoleMCU, events[0].Role)
+
+	// The replay against the same router succeeds
+	require.NoError(t, replay.Run(newRouter(t, "1.0"), events, replay.Options{}))
+	require.NoError(t, replay.Run(newRouter(t, "1.0"), events, replay.Options{Speed: 1}))
+
+	// A different behavior is detected
+	err = replay.Run(newRouter(t, "2.0"), events, replay.Options{})
+	require.ErrorContains(t, err, "expected message")
+	require.ErrorContains(t, err, "2.0")
+}
+
+func TestReplaySplitMessages(t *testing.T) {
+	// A response of the router split in two writes
+	response := []byte{0x94, 0x01, 0x01, 0xc0, 0xa3, 'a', 'b', 'c'}
+	events := []replay.Event{
+		{Conn: 1, Type: replay.EventOpen},
+		{Conn: 1, Type: replay.EventIn, Data: []byte{0x94, 0x00, 0x01, 0xa9, '$', '/', 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x90}},
+		{Conn: 1, Type: replay.EventOut, Data: response[:5]},
+		{Conn: 1, Type: replay.EventOut, Data: response[5:]},
+	}
+	require.NoError(t, replay.Run(newRouter(t, "abc"), events, replay.Options{}))
+	require.ErrorContains(t, replay.Run(newRouter(t, "abd"), events, replay.Options{}), "expected message")
+}
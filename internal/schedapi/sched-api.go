@@ -0,0 +1,256 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package schedapi implements the sched/* methods, that let the clients
+// schedule calls performed periodically by the router, so that the timers
+// do not need to run on the MCU and keep running if the client restarts.
+package schedapi
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// minInterval is the minimum interval between two runs of a schedule.
+const minInterval = 10 * time.Millisecond
+
+// maxSchedules is the maximum number of schedules.
+const maxSchedules = 64
+
+// schedule calls a method periodically, and optionally publishes its result
+// on a pub/sub topic.
+type schedule struct {
+	method   string
+	params   []any
+	interval time.Duration
+	topic    string
+	// owner is the client that added the schedule, the only one allowed
+	// to list and remove it. It is identified by its identity and role,
+	// since the schedule outlives its connection.
+	owner scheduleOwner
+	// conn is the connection to the router used for the calls, with the
+	// role and the ACL of the client that added the schedule.
+	conn *msgpackrpc.Connection
+	stop chan struct{}
+
+	runs      uint64
+	errors    uint64
+	lastError string
+}
+
+// scheduleOwner identifies the client that added a schedule.
+type scheduleOwner struct {
+	identity string
+	role     string
+}
+
+// ownerOf returns the owner identifying the client of the connection.
+func ownerOf(rpc *msgpackrpc.Connection) scheduleOwner {
+	info, _ := router.ConnectionInfo(rpc)
+	return scheduleOwner{identity: info.Identity, role: info.Role}
+}
+
+var router *msgpackrouter.Router
+var lock sync.Mutex
+var schedules = make(map[uint]*schedule)
+
+// Register registers the scheduler API methods with the router.
+func Register(r *msgpackrouter.Router) {
+	router = r
+	_ = router.RegisterMethod("sched/add", schedAdd)
+	_ = router.RegisterMethod("sched/remove", schedRemove)
+	_ = router.RegisterMethod("sched/list", schedList)
+}
+
+// Stats returns the number of schedules.
+func Stats() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return map[string]any{
+		"schedules": len(schedules),
+	}
+}
+
+// schedAdd schedules a call of the method every interval ms, with the given
+// params (an array, empty by default). If a topic is given, the result of
+// each call is published on it with pubsub/publish. The calls are performed
+// with the permissions of the caller, and the schedule is kept after the
+// caller disconnects. It returns the handle of the schedule.
+func schedAdd(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) < 2 || len(params) > 4 {
+		res(nil, []any{1, "Invalid number of parameters, expected (method, interval ms[, params[, topic]])"})
+		return
+	}
+	method, ok := params[0].(string)
+	if !ok || method == "" {
+		res(nil, []any{1, "Invalid parameter type, expected string for method"})
+		return
+	}
+	ms, ok := msgpackrpc.ToUint(params[1])
+	if !ok || time.Duration(ms)*time.Millisecond < minInterval {
+		res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected interval in ms (at least %d)", minInterval.Milliseconds())})
+		return
+	}
+	s := &schedule{method: method, interval: time.Duration(ms) * time.Millisecond, owner: ownerOf(rpc), stop: make(chan struct{})}
+	if len(params) >= 3 && params[2] != nil {
+		if s.params, ok = params[2].([]any); !ok {
+			res(nil, []any{1, "Invalid parameter type, expected array for the params of the method"})
+			return
+		}
+	}
+	if len(params) == 4 {
+		if s.topic, ok = params[3].(string); !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for topic"})
+			return
+		}
+	}
+
+	lock.Lock()
+	if len(schedules) >= maxSchedules {
+		lock.Unlock()
+		res(nil, []any{3, fmt.Sprintf("Too many schedules, at most %d are allowed", maxSchedules)})
+		return
+	}
+	// The handles are not sequential, so that the schedules of the other
+	// clients can't be guessed.
+	var id uint
+	for id == 0 || schedules[id] != nil {
+		id = uint(rand.Int32())
+	}
+	schedules[id] = s
+	lock.Unlock()
+
+	// The calls go through the router like the ones of the caller
+	info, _ := router.ConnectionInfo(rpc)
+	clientEnd, routerEnd := net.Pipe()
+	router.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{
+		Transport:  "sched",
+		RemoteAddr: fmt.Sprintf("schedule %d", id),
+		ACL:        info.ACL,
+		Identity:   info.Identity,
+		Role:       info.Role,
+	})
+	s.conn = msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go s.conn.Run()
+
+	slog.Info("Started schedule", "id", id, "method", method, "interval", s.interval, "topic", s.topic)
+	res(id, nil)
+	go s.run(id)
+}
+
+func (s *schedule) run(id uint) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		// The ticker drops the ticks while a call is pending, so that a
+		// slow method is not called again before it returns.
+		ctx, cancel := context.WithTimeout(context.Background(), max(s.interval, time.Second))
+		result, reqErr, err := s.conn.SendRequest(ctx, s.method, s.params...)
+		cancel()
+		if err == nil && reqErr == nil && s.topic != "" {
+			err = s.conn.SendNotification("pubsub/publish", s.topic, result)
+		}
+
+		lock.Lock()
+		s.runs++
+		switch {
+		case err != nil:
+			s.errors++
+			s.lastError = err.Error()
+		case reqErr != nil:
+			s.errors++
+			s.lastError = fmt.Sprint(reqErr)
+		}
+		lock.Unlock()
+		if err != nil || reqErr != nil {
+			slog.Debug("Scheduled call failed", "id", id, "method", s.method, "err", err, "req_err", reqErr)
+		}
+	}
+}
+
+// schedRemove removes the schedule with the given handle, if added by the
+// caller.
+func schedRemove(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected schedule handle"})
+		return
+	}
+	id, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for schedule handle"})
+		return
+	}
+	lock.Lock()
+	s, ok := schedules[id]
+	if ok && s.owner == ownerOf(rpc) {
+		delete(schedules, id)
+	} else {
+		ok = false
+	}
+	lock.Unlock()
+	if !ok {
+		res(nil, []any{2, fmt.Sprintf("Schedule not found for handle: %d", id)})
+		return
+	}
+	close(s.stop)
+	s.conn.Close()
+	res(true, nil)
+}
+
+// schedList returns the schedules added by the caller, with their counters.
+func schedList(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 0 {
+		res(nil, []any{1, "Invalid number of parameters, expected no parameters"})
+		return
+	}
+	owner := ownerOf(rpc)
+	lock.Lock()
+	ids := make([]uint, 0, len(schedules))
+	for id, s := range schedules {
+		if s.owner == owner {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	list := make([]any, 0, len(ids))
+	for _, id := range ids {
+		s := schedules[id]
+		list = append(list, map[string]any{
+			"handle":     id,
+			"method":     s.method,
+			"interval":   s.interval.Milliseconds(),
+			"topic":      s.topic,
+			"runs":       s.runs,
+			"errors":     s.errors,
+			"last_error": s.lastError,
+		})
+	}
+	lock.Unlock()
+	res(list, nil)
+}
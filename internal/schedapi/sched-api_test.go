@@ -0,0 +1,114 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package schedapi
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestSchedule(t *testing.T) {
+	r := msgpackrouter.New(0)
+	Register(r)
+	var calls atomic.Int64
+	require.NoError(t, r.RegisterMethod("sensor/read", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		res([]any{calls.Add(1), params}, nil)
+	}))
+	published := make(chan []any, 100)
+	require.NoError(t, r.RegisterMethod("pubsub/publish", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		published <- params
+		res(1, nil)
+	}))
+
+	clientEnd, routerEnd := net.Pipe()
+	r.AcceptConnection(routerEnd)
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+
+	_, reqErr, err := client.SendRequest(t.Context(), "sched/add", "sensor/read", 1)
+	require.NoError(t, err)
+	require.Equal(t, int8(1), reqErr.([]any)[0])
+	_, reqErr, err = client.SendRequest(t.Context(), "sched/add", "sensor/read", 20, "x")
+	require.NoError(t, err)
+	require.Equal(t, int8(1), reqErr.([]any)[0])
+
+	handle, reqErr, err := client.SendRequest(t.Context(), "sched/add", "sensor/read", 20, []any{"temp"}, "sensor/temp")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+
+	// The schedule keeps running after the client disconnects
+	client.Close()
+	select {
+	case params := <-published:
+		require.Equal(t, "sensor/temp", params[0])
+		require.Equal(t, []any{"temp"}, params[1].([]any)[1])
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "no result published")
+	}
+	require.Eventually(t, func() bool { return calls.Load() >= 3 }, 2*time.Second, 10*time.Millisecond)
+
+	// Another client can neither see nor remove the schedule
+	intruderEnd, routerEnd := net.Pipe()
+	r.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Identity: "intruder"})
+	intruder := msgpackrpc.NewConnection(intruderEnd, intruderEnd, nil, nil, nil)
+	go intruder.Run()
+	defer intruder.Close()
+	list, reqErr, err := intruder.SendRequest(t.Context(), "sched/list")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Empty(t, list)
+	_, reqErr, err = intruder.SendRequest(t.Context(), "sched/remove", handle)
+	require.NoError(t, err)
+	require.Equal(t, int8(2), reqErr.([]any)[0])
+	require.Equal(t, map[string]any{"schedules": 1}, Stats())
+
+	// The client that added the schedule manages it after reconnecting
+	clientEnd, routerEnd = net.Pipe()
+	r.AcceptConnection(routerEnd)
+	client = msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+	defer client.Close()
+	list, reqErr, err = client.SendRequest(t.Context(), "sched/list")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Len(t, list, 1)
+	entry := list.([]any)[0].(map[string]any)
+	require.EqualValues(t, handle, entry["handle"])
+	require.Equal(t, "sensor/read", entry["method"])
+	require.EqualValues(t, 20, entry["interval"])
+	require.NotZero(t, entry["runs"])
+	require.Zero(t, entry["errors"])
+
+	removed, reqErr, err := client.SendRequest(t.Context(), "sched/remove", handle)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, removed)
+	_, reqErr, err = client.SendRequest(t.Context(), "sched/remove", handle)
+	require.NoError(t, err)
+	require.Equal(t, int8(2), reqErr.([]any)[0])
+	require.Equal(t, map[string]any{"schedules": 0}, Stats())
+
+	stopped := calls.Load()
+	time.Sleep(100 * time.Millisecond)
+	require.LessOrEqual(t, calls.Load(), stopped+1)
+}
@@ -0,0 +1,88 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+const (
+	// DefaultReopenBackoffMin is the default delay before the first retry
+	// to open the serial port.
+	DefaultReopenBackoffMin = time.Second
+	// DefaultReopenBackoffMax is the default upper bound of the delay
+	// between two retries to open the serial port.
+	DefaultReopenBackoffMax = time.Minute
+)
+
+// lastError is the last failure to open the serial port (guarded by serialLock).
+var lastError struct {
+	err      string
+	time     time.Time
+	attempts int
+}
+
+// reopenDelay returns the delay before the given retry attempt (starting
+// from 1): the delay doubles at every attempt, from minDelay up to maxDelay,
+// and a random jitter in the range [delay/2, delay] is applied.
+func reopenDelay(attempt int, minDelay, maxDelay time.Duration) time.Duration {
+	if minDelay <= 0 {
+		minDelay = DefaultReopenBackoffMin
+	}
+	maxDelay = max(maxDelay, minDelay)
+	delay := minDelay
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxDelay)
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+// setLastError records a failure to open the serial port.
+func setLastError(err error, attempts int) {
+	serialLock.Lock()
+	lastError.err = err.Error()
+	lastError.time = time.Now()
+	lastError.attempts = attempts
+	serialLock.Unlock()
+}
+
+// serialLastError returns the last failure to open the serial port.
+func serialLastError(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 0 {
+		res(nil, []any{1, "Invalid number of parameters, expected no parameters"})
+		return
+	}
+
+	serialLock.Lock()
+	last := lastError
+	serialLock.Unlock()
+
+	var errTime string
+	if !last.time.IsZero() {
+		errTime = last.time.Format(time.RFC3339)
+	}
+	res(map[string]any{
+		"error":    last.err,
+		"time":     errTime,
+		"attempts": last.attempts,
+	}, nil)
+}
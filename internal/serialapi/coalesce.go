@@ -0,0 +1,97 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// coalesceMaxSize is the amount of pending data that is written right away,
+// without waiting for the coalesce delay.
+const coalesceMaxSize = 4096
+
+// coalescingStream batches the data written to the Upstream within a delay
+// in a single write, to reduce the USB CDC packets sent for many small
+// messages (for example the notifications). A write error is returned by the
+// next Write call.
+type coalescingStream struct {
+	io.ReadWriteCloser
+	delay time.Duration
+
+	lock    sync.Mutex
+	pending []byte
+	timer   *time.Timer
+	err     error
+}
+
+func newCoalescingStream(upstream io.ReadWriteCloser, delay time.Duration) *coalescingStream {
+	s := &coalescingStream{
+		ReadWriteCloser: upstream,
+		delay:           delay,
+	}
+	s.timer = time.AfterFunc(delay, s.flush)
+	s.timer.Stop()
+	return s
+}
+
+func (s *coalescingStream) Write(p []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.err; err != nil {
+		s.err = nil
+		return 0, err
+	}
+	if len(s.pending) == 0 {
+		s.timer.Reset(s.delay)
+	}
+	s.pending = append(s.pending, p...)
+	if len(s.pending) >= coalesceMaxSize {
+		s.timer.Stop()
+		if err := s.flushLocked(); err != nil {
+			s.err = nil
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes the pending data to the Upstream.
+func (s *coalescingStream) flush() {
+	s.lock.Lock()
+	_ = s.flushLocked()
+	s.lock.Unlock()
+}
+
+func (s *coalescingStream) flushLocked() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	_, err := s.ReadWriteCloser.Write(s.pending)
+	s.pending = s.pending[:0]
+	if err != nil {
+		s.err = err
+	}
+	return err
+}
+
+// Close writes the pending data and closes the Upstream.
+func (s *coalescingStream) Close() error {
+	s.timer.Stop()
+	s.flush()
+	return s.ReadWriteCloser.Close()
+}
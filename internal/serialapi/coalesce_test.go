@@ -0,0 +1,90 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingWriter records the Write calls of the underlying stream.
+type recordingWriter struct {
+	nopReadWriteCloser
+	lock   sync.Mutex
+	writes [][]byte
+	err    error
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.writes = append(w.writes, bytes.Clone(p))
+	return len(p), nil
+}
+
+func (w *recordingWriter) Writes() [][]byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writes
+}
+
+func TestCoalescingStream(t *testing.T) {
+	upstream := &recordingWriter{}
+	s := newCoalescingStream(upstream, 20*time.Millisecond)
+
+	// The small messages are batched in a single write
+	for _, msg := range []string{"one", "two", "three"} {
+		n, err := s.Write([]byte(msg))
+		require.NoError(t, err)
+		require.Equal(t, len(msg), n)
+	}
+	require.Empty(t, upstream.Writes())
+	require.Eventually(t, func() bool { return len(upstream.Writes()) == 1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, []byte("onetwothree"), upstream.Writes()[0])
+
+	// Large messages are written right away
+	_, err := s.Write(make([]byte, coalesceMaxSize))
+	require.NoError(t, err)
+	require.Len(t, upstream.Writes(), 2)
+
+	// The pending data is written on close
+	_, err = s.Write([]byte("last"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	require.Len(t, upstream.Writes(), 3)
+	require.Equal(t, []byte("last"), upstream.Writes()[2])
+}
+
+func TestCoalescingStreamWriteError(t *testing.T) {
+	upstream := &recordingWriter{err: errors.New("port closed")}
+	s := newCoalescingStream(upstream, time.Millisecond)
+
+	_, err := s.Write([]byte("lost"))
+	require.NoError(t, err)
+	// The error of the delayed write is returned by the next write
+	require.Eventually(t, func() bool {
+		_, err := s.Write([]byte("next"))
+		return err != nil
+	}, time.Second, 5*time.Millisecond)
+}
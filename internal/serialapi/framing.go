@@ -0,0 +1,214 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// Framing modes for the serial link
+const (
+	FramingNone = "none"
+	FramingCOBS = "cobs"
+)
+
+// maxFrameSize is the maximum size of an encoded frame, longer frames are dropped.
+const maxFrameSize = 64 * 1024
+
+var errInvalidFrame = errors.New("invalid frame")
+
+var errFrameTooLong = errors.New("frame too long")
+
+func parseFraming(framing string) (string, error) {
+	switch framing {
+	case "", FramingNone:
+		return FramingNone, nil
+	case FramingCOBS:
+		return FramingCOBS, nil
+	default:
+		return "", fmt.Errorf("invalid framing: %s", framing)
+	}
+}
+
+// cobsStream wraps each message written to the Upstream in a frame made of
+// the COBS encoding of the message followed by its CRC16, terminated by a
+// zero byte. Each Write call must contain exactly one message.
+// Frames received with a bad CRC are dropped, the zero delimiter allows the
+// reader to resynchronize on the next frame.
+type cobsStream struct {
+	Upstream io.ReadWriteCloser
+	// OnFrameError is called when an invalid frame is dropped
+	OnFrameError func(error)
+
+	in      *bufio.Reader
+	pending []byte
+}
+
+func newCOBSStream(upstream io.ReadWriteCloser, readBufferSize int, onFrameError func(error)) *cobsStream {
+	return &cobsStream{
+		Upstream:     upstream,
+		OnFrameError: onFrameError,
+		in:           bufio.NewReaderSize(upstream, readBufferSize),
+	}
+}
+
+// NewFramingReader returns a reader of the messages read from r, a stream
+// captured from a serial link using the given framing. The invalid frames
+// are dropped.
+func NewFramingReader(r io.Reader, framing string) (io.Reader, error) {
+	framing, err := parseFraming(framing)
+	if err != nil {
+		return nil, err
+	}
+	if framing == FramingNone {
+		return r, nil
+	}
+	return &cobsStream{in: bufio.NewReader(r)}, nil
+}
+
+func (s *cobsStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		frame, err := s.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		payload, err := decodeFrame(frame)
+		if err != nil {
+			slog.Debug("Dropped invalid serial frame", "err", err)
+			if s.OnFrameError != nil {
+				s.OnFrameError(err)
+			}
+			continue
+		}
+		s.pending = payload
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// readFrame reads the data up to the next zero delimiter, excluding it. The
+// frames longer than maxFrameSize are dropped.
+func (s *cobsStream) readFrame() ([]byte, error) {
+	var frame []byte
+	tooLong := false
+	for {
+		chunk, err := s.in.ReadSlice(0)
+		if !tooLong && len(frame)+len(chunk) <= maxFrameSize {
+			frame = append(frame, chunk...)
+		} else {
+			// Skip the data up to the next delimiter
+			tooLong = true
+			frame = nil
+		}
+		if err == nil {
+			if !tooLong {
+				return frame[:len(frame)-1], nil
+			}
+			slog.Debug("Dropped invalid serial frame", "err", errFrameTooLong)
+			if s.OnFrameError != nil {
+				s.OnFrameError(errFrameTooLong)
+			}
+			tooLong = false
+			continue
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+}
+
+func (s *cobsStream) Write(p []byte) (int, error) {
+	if _, err := s.Upstream.Write(encodeFrame(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *cobsStream) Close() error {
+	return s.Upstream.Close()
+}
+
+// encodeFrame returns the COBS encoding of payload+CRC16, followed by a zero delimiter.
+func encodeFrame(payload []byte) []byte {
+	crc := crc16(payload)
+	data := make([]byte, 0, len(payload)+2)
+	data = append(data, payload...)
+	data = append(data, byte(crc>>8), byte(crc))
+
+	out := make([]byte, 1, len(data)+len(data)/254+2)
+	codeIdx := 0
+	code := byte(1)
+	for _, b := range data {
+		if b != 0 {
+			out = append(out, b)
+			code++
+		}
+		if b == 0 || code == 0xFF {
+			out[codeIdx] = code
+			codeIdx = len(out)
+			out = append(out, 0)
+			code = 1
+		}
+	}
+	out[codeIdx] = code
+	return append(out, 0)
+}
+
+// decodeFrame decodes a COBS frame (without delimiter) and checks its CRC16.
+func decodeFrame(frame []byte) ([]byte, error) {
+	data := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); {
+		code := int(frame[i])
+		if code == 0 || i+code > len(frame) {
+			return nil, errInvalidFrame
+		}
+		data = append(data, frame[i+1:i+code]...)
+		i += code
+		if code < 0xFF && i < len(frame) {
+			data = append(data, 0)
+		}
+	}
+	if len(data) < 2 {
+		return nil, errInvalidFrame
+	}
+	payload := data[:len(data)-2]
+	crc := uint16(data[len(data)-2])<<8 | uint16(data[len(data)-1])
+	if crc16(payload) != crc {
+		return nil, fmt.Errorf("%w: CRC mismatch", errInvalidFrame)
+	}
+	return payload, nil
+}
+
+// crc16 computes the CRC-16/CCITT-FALSE of data.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
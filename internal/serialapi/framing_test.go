@@ -0,0 +1,92 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCOBSFrameEncoding(t *testing.T) {
+	payloads := [][]byte{
+		{},
+		{0},
+		{0, 0},
+		{1, 2, 0, 3},
+		bytes.Repeat([]byte{0x11}, 254),
+		bytes.Repeat([]byte{0x22}, 255),
+		bytes.Repeat([]byte{0x33, 0}, 600),
+	}
+	for _, payload := range payloads {
+		frame := encodeFrame(payload)
+		require.Equal(t, byte(0), frame[len(frame)-1])
+		require.NotContains(t, frame[:len(frame)-1], byte(0))
+		decoded, err := decodeFrame(frame[:len(frame)-1])
+		require.NoError(t, err)
+		require.Equal(t, payload, decoded)
+	}
+
+	// 0x29B1 is the CRC-16/CCITT-FALSE check value
+	require.Equal(t, uint16(0x29B1), crc16([]byte("123456789")))
+}
+
+func TestCOBSStream(t *testing.T) {
+	wire := &nopReadWriteCloser{}
+	wire.Write(encodeFrame([]byte("Hello")))
+	corrupted := encodeFrame([]byte("World"))
+	corrupted[2] ^= 0x01
+	wire.Write(corrupted)
+	wire.Write([]byte{0x55, 0x66, 0x00}) // line noise
+	wire.Write(encodeFrame([]byte("Arduino")))
+
+	frameErrors := 0
+	rx := newCOBSStream(wire, DefaultReadBufferSize, func(error) { frameErrors++ })
+	data, err := io.ReadAll(rx)
+	require.NoError(t, err)
+	require.Equal(t, "HelloArduino", string(data))
+	require.Equal(t, 2, frameErrors)
+
+	// A frame longer than 64 KiB is dropped up to its delimiter
+	wire = &nopReadWriteCloser{}
+	wire.Write(bytes.Repeat([]byte{0x55}, maxFrameSize))
+	wire.Write([]byte{0x00})
+	wire.Write(encodeFrame([]byte("Hello")))
+	frameErrors = 0
+	rx = newCOBSStream(wire, DefaultReadBufferSize, func(error) { frameErrors++ })
+	data, err = io.ReadAll(rx)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(data))
+	require.Equal(t, 1, frameErrors)
+
+	wire = &nopReadWriteCloser{}
+	wire.Write(bytes.Repeat([]byte{0x55}, 2*maxFrameSize))
+	wire.Write([]byte{0x00})
+	wire.Write(encodeFrame([]byte("Arduino")))
+	r, err := NewFramingReader(wire, FramingCOBS)
+	require.NoError(t, err)
+	data, err = io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "Arduino", string(data))
+
+	out := &nopReadWriteCloser{}
+	n, err := newCOBSStream(out, DefaultReadBufferSize, nil).Write([]byte{1, 0, 2})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Equal(t, encodeFrame([]byte{1, 0, 2}), out.Bytes())
+}
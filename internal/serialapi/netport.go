@@ -0,0 +1,494 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+)
+
+// Prefixes of the addresses of the serial ports reached through the network
+const (
+	// rawTCPPrefix is a serial server forwarding the bytes as they are
+	// (for example ser2net in raw mode, or an emulator).
+	rawTCPPrefix = "tcp://"
+	// rfc2217Prefix is a serial server implementing the Telnet Com Port
+	// Control Option (RFC 2217), where the line settings can be changed.
+	rfc2217Prefix = "rfc2217://"
+)
+
+// netPortDialTimeout is the timeout to connect to a serial server.
+const netPortDialTimeout = 10 * time.Second
+
+// isNetworkPortAddr reports whether the address is a serial port reached
+// through the network.
+func isNetworkPortAddr(address string) bool {
+	return strings.HasPrefix(address, rawTCPPrefix) || strings.HasPrefix(address, rfc2217Prefix)
+}
+
+// openPort opens the serial port with the given address: a local device, a
+// serial server or a new pseudo-terminal.
+func openPort(address string, mode *serial.Mode) (serial.Port, error) {
+	if link, ok := strings.CutPrefix(address, ptyPrefix); ok {
+		return openPTY(link)
+	}
+	if host, ok := strings.CutPrefix(address, rawTCPPrefix); ok {
+		conn, err := net.DialTimeout("tcp", host, netPortDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &netPort{conn: conn}, nil
+	}
+	if host, ok := strings.CutPrefix(address, rfc2217Prefix); ok {
+		conn, err := net.DialTimeout("tcp", host, netPortDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		port := newRFC2217Port(conn)
+		if err := port.SetMode(mode); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return port, nil
+	}
+	return serial.Open(address, mode)
+}
+
+// CheckPort verifies that the serial port with the given address can be
+// opened, without opening it (opening a local device may reset the MCU): the
+// local device must be readable and writable, the serial server must accept
+// the connections and /dev/ptmx must be accessible for a pseudo-terminal.
+func CheckPort(address string) error {
+	if _, ok := strings.CutPrefix(address, ptyPrefix); ok {
+		return unix.Access("/dev/ptmx", unix.R_OK|unix.W_OK)
+	}
+	if isNetworkPortAddr(address) {
+		host := strings.TrimPrefix(strings.TrimPrefix(address, rawTCPPrefix), rfc2217Prefix)
+		conn, err := net.DialTimeout("tcp", host, netPortDialTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if _, err := os.Stat(address); err != nil {
+		return err
+	}
+	if err := unix.Access(address, unix.R_OK|unix.W_OK); err != nil {
+		return fmt.Errorf("access to %s: %w", address, err)
+	}
+	return nil
+}
+
+// setFlowControl enables or disables the hardware flow control of the port.
+func setFlowControl(port serial.Port, portAddr string, enabled bool) error {
+	if p, ok := port.(interface{ setFlowControl(bool) error }); ok {
+		return p.setFlowControl(enabled)
+	}
+	return setHardwareFlowControl(portAddr, enabled)
+}
+
+var errNotSupportedOnRawTCP = errors.New("not supported on a raw TCP serial port")
+
+// netPort is a serial port reached through a raw TCP connection: the bytes
+// are forwarded as they are, and the line settings can't be changed.
+type netPort struct {
+	conn        net.Conn
+	readTimeout time.Duration
+}
+
+func (p *netPort) SetMode(mode *serial.Mode) error {
+	// The line settings are fixed by the serial server
+	return nil
+}
+
+func (p *netPort) Read(b []byte) (int, error) {
+	return readWithTimeout(p.conn, p.readTimeout, p.conn.Read, b)
+}
+
+// readWithTimeout calls read with the read timeout of a serial port: when the
+// timeout expires no error is returned, as for the local serial ports.
+func readWithTimeout(conn interface{ SetReadDeadline(time.Time) error }, timeout time.Duration, read func([]byte) (int, error), b []byte) (int, error) {
+	if timeout <= 0 {
+		return read(b)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	n, err := read(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, nil
+	}
+	return n, err
+}
+
+func (p *netPort) Write(b []byte) (int, error) {
+	return p.conn.Write(b)
+}
+
+func (p *netPort) Drain() error {
+	return nil
+}
+
+func (p *netPort) ResetInputBuffer() error {
+	return nil
+}
+
+func (p *netPort) ResetOutputBuffer() error {
+	return nil
+}
+
+func (p *netPort) SetDTR(dtr bool) error {
+	return errNotSupportedOnRawTCP
+}
+
+func (p *netPort) SetRTS(rts bool) error {
+	return errNotSupportedOnRawTCP
+}
+
+func (p *netPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return nil, errNotSupportedOnRawTCP
+}
+
+func (p *netPort) SetReadTimeout(t time.Duration) error {
+	p.readTimeout = t
+	return nil
+}
+
+func (p *netPort) Close() error {
+	return p.conn.Close()
+}
+
+func (p *netPort) Break(time.Duration) error {
+	return errNotSupportedOnRawTCP
+}
+
+func (p *netPort) setFlowControl(enabled bool) error {
+	if enabled {
+		return errNotSupportedOnRawTCP
+	}
+	return nil
+}
+
+// Telnet commands and options used by RFC 2217
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptionBinary  = 0
+	telnetOptionSGA     = 3
+	telnetOptionComPort = 44
+)
+
+// RFC 2217 commands sent by the client, the server answers with the same
+// code plus 100.
+const (
+	comPortSetBaudRate  = 1
+	comPortSetDataSize  = 2
+	comPortSetParity    = 3
+	comPortSetStopSize  = 4
+	comPortSetControl   = 5
+	comPortPurgeData    = 12
+	comPortNotifyModem  = 107
+	comPortControlNoFC  = 1
+	comPortControlHWFC  = 3
+	comPortBreakOn      = 5
+	comPortBreakOff     = 6
+	comPortDTROn        = 8
+	comPortDTROff       = 9
+	comPortRTSOn        = 11
+	comPortRTSOff       = 12
+	comPortPurgeRx      = 1
+	comPortPurgeTx      = 2
+	comPortModemCTS     = 0x10
+	comPortModemDSR     = 0x20
+	comPortModemRI      = 0x40
+	comPortModemDCD     = 0x80
+	comPortModemUnknown = -1
+)
+
+// rfc2217Port is a serial port reached through a Telnet connection with the
+// Com Port Control Option (RFC 2217). The commands are sent without waiting
+// for the answers of the server.
+type rfc2217Port struct {
+	conn        net.Conn
+	in          *bufio.Reader
+	readTimeout time.Duration
+
+	writeLock sync.Mutex
+
+	// state of the Telnet decoder, used only by Read
+	subnegotiation []byte
+	inSubneg       bool
+
+	modemLock  sync.Mutex
+	modemState int
+}
+
+func newRFC2217Port(conn net.Conn) *rfc2217Port {
+	p := &rfc2217Port{
+		conn:       conn,
+		in:         bufio.NewReader(conn),
+		modemState: comPortModemUnknown,
+	}
+	// The negotiation is completed by the answers of the server, that are
+	// handled by Read: the data sent before are not altered.
+	_ = p.sendCommand(
+		telnetIAC, telnetWILL, telnetOptionBinary,
+		telnetIAC, telnetDO, telnetOptionBinary,
+		telnetIAC, telnetDO, telnetOptionSGA,
+		telnetIAC, telnetWILL, telnetOptionComPort,
+	)
+	return p
+}
+
+// sendCommand writes the given Telnet command.
+func (p *rfc2217Port) sendCommand(cmd ...byte) error {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	_, err := p.conn.Write(cmd)
+	return err
+}
+
+// sendComPortCommand sends a Com Port Control Option subnegotiation.
+func (p *rfc2217Port) sendComPortCommand(code byte, value ...byte) error {
+	cmd := []byte{telnetIAC, telnetSB, telnetOptionComPort, code}
+	cmd = appendTelnetEscaped(cmd, value)
+	cmd = append(cmd, telnetIAC, telnetSE)
+	return p.sendCommand(cmd...)
+}
+
+// appendTelnetEscaped appends data to buf, doubling the IAC bytes.
+func appendTelnetEscaped(buf []byte, data []byte) []byte {
+	for _, b := range data {
+		if b == telnetIAC {
+			buf = append(buf, telnetIAC)
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+func (p *rfc2217Port) SetMode(mode *serial.Mode) error {
+	var parity byte
+	switch mode.Parity {
+	case serial.NoParity:
+		parity = 1
+	case serial.OddParity:
+		parity = 2
+	case serial.EvenParity:
+		parity = 3
+	case serial.MarkParity:
+		parity = 4
+	case serial.SpaceParity:
+		parity = 5
+	default:
+		return fmt.Errorf("invalid parity: %v", mode.Parity)
+	}
+	var stopSize byte
+	switch mode.StopBits {
+	case serial.OneStopBit:
+		stopSize = 1
+	case serial.TwoStopBits:
+		stopSize = 2
+	case serial.OnePointFiveStopBits:
+		stopSize = 3
+	default:
+		return fmt.Errorf("invalid stop bits: %v", mode.StopBits)
+	}
+	dataBits := mode.DataBits
+	if dataBits == 0 {
+		dataBits = 8
+	}
+	if err := p.sendComPortCommand(comPortSetBaudRate, binary.BigEndian.AppendUint32(nil, uint32(mode.BaudRate))...); err != nil { //nolint:gosec
+		return err
+	}
+	if err := p.sendComPortCommand(comPortSetDataSize, byte(dataBits)); err != nil { //nolint:gosec
+		return err
+	}
+	if err := p.sendComPortCommand(comPortSetParity, parity); err != nil {
+		return err
+	}
+	return p.sendComPortCommand(comPortSetStopSize, stopSize)
+}
+
+func (p *rfc2217Port) Read(b []byte) (int, error) {
+	return readWithTimeout(p.conn, p.readTimeout, p.readData, b)
+}
+
+// readData reads the data available, removing the Telnet commands. It
+// blocks until at least one data byte is read.
+func (p *rfc2217Port) readData(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		if n > 0 && p.in.Buffered() == 0 {
+			break
+		}
+		c, err := p.in.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		if c != telnetIAC {
+			if p.inSubneg {
+				p.subnegotiation = append(p.subnegotiation, c)
+			} else {
+				b[n] = c
+				n++
+			}
+			continue
+		}
+		cmd, err := p.in.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		switch cmd {
+		case telnetIAC:
+			if p.inSubneg {
+				p.subnegotiation = append(p.subnegotiation, c)
+			} else {
+				b[n] = c
+				n++
+			}
+		case telnetSB:
+			p.inSubneg = true
+			p.subnegotiation = p.subnegotiation[:0]
+		case telnetSE:
+			p.inSubneg = false
+			p.handleSubnegotiation(p.subnegotiation)
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			option, err := p.in.ReadByte()
+			if err != nil {
+				return n, err
+			}
+			p.handleNegotiation(cmd, option)
+		}
+	}
+	return n, nil
+}
+
+// handleNegotiation refuses the Telnet options requested by the server,
+// except the ones requested by the client.
+func (p *rfc2217Port) handleNegotiation(cmd, option byte) {
+	switch option {
+	case telnetOptionBinary, telnetOptionSGA, telnetOptionComPort:
+		return
+	}
+	switch cmd {
+	case telnetWILL:
+		_ = p.sendCommand(telnetIAC, telnetDONT, option)
+	case telnetDO:
+		_ = p.sendCommand(telnetIAC, telnetWONT, option)
+	}
+}
+
+// handleSubnegotiation keeps the modem state notified by the server.
+func (p *rfc2217Port) handleSubnegotiation(data []byte) {
+	if len(data) == 3 && data[0] == telnetOptionComPort && data[1] == comPortNotifyModem {
+		p.modemLock.Lock()
+		p.modemState = int(data[2])
+		p.modemLock.Unlock()
+	}
+}
+
+// Write sends the data, escaping the IAC bytes.
+func (p *rfc2217Port) Write(b []byte) (int, error) {
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+	if _, err := p.conn.Write(appendTelnetEscaped(make([]byte, 0, len(b)+8), b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *rfc2217Port) Drain() error {
+	return nil
+}
+
+func (p *rfc2217Port) ResetInputBuffer() error {
+	return p.sendComPortCommand(comPortPurgeData, comPortPurgeRx)
+}
+
+func (p *rfc2217Port) ResetOutputBuffer() error {
+	return p.sendComPortCommand(comPortPurgeData, comPortPurgeTx)
+}
+
+func (p *rfc2217Port) SetDTR(dtr bool) error {
+	if dtr {
+		return p.sendComPortCommand(comPortSetControl, comPortDTROn)
+	}
+	return p.sendComPortCommand(comPortSetControl, comPortDTROff)
+}
+
+func (p *rfc2217Port) SetRTS(rts bool) error {
+	if rts {
+		return p.sendComPortCommand(comPortSetControl, comPortRTSOn)
+	}
+	return p.sendComPortCommand(comPortSetControl, comPortRTSOff)
+}
+
+// GetModemStatusBits returns the last modem state notified by the server.
+func (p *rfc2217Port) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	p.modemLock.Lock()
+	state := p.modemState
+	p.modemLock.Unlock()
+	if state == comPortModemUnknown {
+		return nil, errors.New("modem state not notified by the serial server")
+	}
+	return &serial.ModemStatusBits{
+		CTS: state&comPortModemCTS != 0,
+		DSR: state&comPortModemDSR != 0,
+		RI:  state&comPortModemRI != 0,
+		DCD: state&comPortModemDCD != 0,
+	}, nil
+}
+
+func (p *rfc2217Port) SetReadTimeout(t time.Duration) error {
+	p.readTimeout = t
+	return nil
+}
+
+func (p *rfc2217Port) Close() error {
+	return p.conn.Close()
+}
+
+func (p *rfc2217Port) Break(d time.Duration) error {
+	if err := p.sendComPortCommand(comPortSetControl, comPortBreakOn); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.sendComPortCommand(comPortSetControl, comPortBreakOff)
+}
+
+func (p *rfc2217Port) setFlowControl(enabled bool) error {
+	if enabled {
+		return p.sendComPortCommand(comPortSetControl, comPortControlHWFC)
+	}
+	return p.sendComPortCommand(comPortSetControl, comPortControlNoFC)
+}
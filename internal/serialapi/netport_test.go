@@ -0,0 +1,157 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.bug.st/serial"
+)
+
+// serialServer accepts a single connection on a local TCP port.
+func serialServer(t *testing.T) (string, <-chan net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			t.Cleanup(func() { conn.Close() })
+			accepted <- conn
+		}
+	}()
+	return l.Addr().String(), accepted
+}
+
+// readExactly reads len(expected) bytes from conn and checks them.
+func readExactly(t *testing.T, conn net.Conn, expected []byte) {
+	buf := make([]byte, len(expected))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf)
+}
+
+func TestRawTCPPort(t *testing.T) {
+	require.True(t, isNetworkPortAddr("tcp://localhost:2000"))
+	require.False(t, isNetworkPortAddr("/dev/ttyACM0"))
+
+	addr, accepted := serialServer(t)
+	port, err := openPort("tcp://"+addr, &serial.Mode{BaudRate: 115200})
+	require.NoError(t, err)
+	defer port.Close()
+	server := <-accepted
+
+	// The bytes are forwarded as they are
+	_, err = port.Write([]byte{1, 2, 0xff})
+	require.NoError(t, err)
+	readExactly(t, server, []byte{1, 2, 0xff})
+	_, err = server.Write([]byte{3, 0xff})
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(port, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{3, 0xff}, buf)
+
+	// Reads time out like on a local port
+	require.NoError(t, port.SetReadTimeout(10*time.Millisecond))
+	n, err := port.Read(buf)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	require.Error(t, port.SetDTR(true))
+	require.NoError(t, setFlowControl(port, "tcp://"+addr, false))
+	require.Error(t, setFlowControl(port, "tcp://"+addr, true))
+}
+
+func TestRFC2217Port(t *testing.T) {
+	addr, accepted := serialServer(t)
+	port, err := openPort("rfc2217://"+addr, &serial.Mode{BaudRate: 115200, Parity: serial.EvenParity, StopBits: serial.TwoStopBits})
+	require.NoError(t, err)
+	defer port.Close()
+	server := <-accepted
+
+	// Negotiation and line settings
+	readExactly(t, server, []byte{
+		telnetIAC, telnetWILL, telnetOptionBinary,
+		telnetIAC, telnetDO, telnetOptionBinary,
+		telnetIAC, telnetDO, telnetOptionSGA,
+		telnetIAC, telnetWILL, telnetOptionComPort,
+		telnetIAC, telnetSB, telnetOptionComPort, comPortSetBaudRate, 0x00, 0x01, 0xc2, 0x00, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetOptionComPort, comPortSetDataSize, 8, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetOptionComPort, comPortSetParity, 3, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetOptionComPort, comPortSetStopSize, 2, telnetIAC, telnetSE,
+	})
+
+	// The Telnet commands are removed from the data, and the unknown
+	// options are refused
+	_, err = server.Write([]byte{
+		telnetIAC, telnetDO, telnetOptionComPort,
+		'a',
+		telnetIAC, telnetWILL, 1, // echo
+		telnetIAC, telnetIAC,
+		telnetIAC, telnetSB, telnetOptionComPort, comPortNotifyModem, comPortModemCTS | comPortModemDCD, telnetIAC, telnetSE,
+		'b',
+	})
+	require.NoError(t, err)
+	var data []byte
+	buf := make([]byte, 16)
+	for len(data) < 3 {
+		n, err := port.Read(buf)
+		require.NoError(t, err)
+		data = append(data, buf[:n]...)
+	}
+	require.Equal(t, []byte{'a', 0xff, 'b'}, data)
+	readExactly(t, server, []byte{telnetIAC, telnetDONT, 1})
+	bits, err := port.GetModemStatusBits()
+	require.NoError(t, err)
+	require.Equal(t, &serial.ModemStatusBits{CTS: true, DCD: true}, bits)
+
+	// The IAC bytes of the data are escaped
+	n, err := port.Write([]byte{1, 0xff, 2})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	readExactly(t, server, []byte{1, 0xff, 0xff, 2})
+
+	require.NoError(t, port.SetDTR(false))
+	require.NoError(t, setFlowControl(port, "rfc2217://"+addr, true))
+	readExactly(t, server, []byte{
+		telnetIAC, telnetSB, telnetOptionComPort, comPortSetControl, comPortDTROff, telnetIAC, telnetSE,
+		telnetIAC, telnetSB, telnetOptionComPort, comPortSetControl, comPortControlHWFC, telnetIAC, telnetSE,
+	})
+}
+
+func TestCheckPort(t *testing.T) {
+	addr, _ := serialServer(t)
+	require.NoError(t, CheckPort("tcp://"+addr))
+	require.NoError(t, CheckPort("rfc2217://"+addr))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := l.Addr().String()
+	l.Close()
+	require.Error(t, CheckPort("tcp://"+closed))
+
+	device := filepath.Join(t.TempDir(), "ttyACM0")
+	require.Error(t, CheckPort(device))
+	require.NoError(t, os.WriteFile(device, nil, 0600))
+	require.NoError(t, CheckPort(device))
+}
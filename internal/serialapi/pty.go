@@ -0,0 +1,180 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+)
+
+// ptyPrefix is the prefix of the address of a pseudo-terminal created by
+// the router, optionally followed by the path of a symlink to its slave.
+const ptyPrefix = "pty:"
+
+var errNotSupportedOnPTY = errors.New("not supported on a pseudo-terminal")
+
+// ptyPort is the master side of a pseudo-terminal: the clients (for example
+// an MCU simulator) open the slave side as a serial device.
+type ptyPort struct {
+	master *os.File
+	// slave is kept open, so that the reads of the master don't fail when
+	// the client closes the slave.
+	slave       *os.File
+	link        string
+	readTimeout time.Duration
+}
+
+// openPTY creates a pseudo-terminal in raw mode. If link is not empty, a
+// symlink to the slave is created at the given path.
+func openPTY(link string) (*ptyPort, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	slavePath, err := unlockPTY(master)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	p := &ptyPort{master: master, slave: slave}
+	if err := setRawMode(int(slave.Fd())); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if link != "" {
+		_ = os.Remove(link)
+		if err := os.Symlink(slavePath, link); err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.link = link
+	}
+	slog.Info("Created pseudo-terminal", "path", slavePath, "link", link)
+	return p, nil
+}
+
+// unlockPTY unlocks the slave of the pseudo-terminal and returns its path.
+func unlockPTY(master *os.File) (string, error) {
+	rawConn, err := master.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var n int
+	var ioctlErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		if ioctlErr = unix.IoctlSetPointerInt(int(fd), unix.TIOCSPTLCK, 0); ioctlErr == nil {
+			n, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPTN)
+		}
+	}); err != nil {
+		return "", err
+	}
+	if ioctlErr != nil {
+		return "", ioctlErr
+	}
+	return fmt.Sprintf("/dev/pts/%d", n), nil
+}
+
+// setRawMode disables the processing of the characters by the terminal, as
+// cfmakeraw(3).
+func setRawMode(fd int) error {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
+
+func (p *ptyPort) SetMode(mode *serial.Mode) error {
+	// The line settings have no effect on a pseudo-terminal
+	return nil
+}
+
+func (p *ptyPort) Read(b []byte) (int, error) {
+	return readWithTimeout(p.master, p.readTimeout, p.master.Read, b)
+}
+
+func (p *ptyPort) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+func (p *ptyPort) Drain() error {
+	return nil
+}
+
+func (p *ptyPort) ResetInputBuffer() error {
+	return nil
+}
+
+func (p *ptyPort) ResetOutputBuffer() error {
+	return nil
+}
+
+func (p *ptyPort) SetDTR(dtr bool) error {
+	return errNotSupportedOnPTY
+}
+
+func (p *ptyPort) SetRTS(rts bool) error {
+	return errNotSupportedOnPTY
+}
+
+func (p *ptyPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return nil, errNotSupportedOnPTY
+}
+
+func (p *ptyPort) SetReadTimeout(t time.Duration) error {
+	p.readTimeout = t
+	return nil
+}
+
+// Close closes the pseudo-terminal and removes the symlink to its slave.
+func (p *ptyPort) Close() error {
+	if p.link != "" {
+		if target, err := os.Readlink(p.link); err == nil && target == p.slave.Name() {
+			_ = os.Remove(p.link)
+		}
+	}
+	p.slave.Close()
+	return p.master.Close()
+}
+
+func (p *ptyPort) Break(time.Duration) error {
+	return errNotSupportedOnPTY
+}
+
+func (p *ptyPort) setFlowControl(enabled bool) error {
+	if enabled {
+		return errNotSupportedOnPTY
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.bug.st/serial"
+)
+
+func TestPTYPort(t *testing.T) {
+	link := filepath.Join(t.TempDir(), "mcu")
+	port, err := openPort("pty:"+link, &serial.Mode{BaudRate: 115200})
+	if err != nil {
+		t.Skipf("pseudo-terminals not available: %v", err)
+	}
+
+	// The simulator opens the slave through the symlink
+	mcu, err := os.OpenFile(link, os.O_RDWR, 0)
+	require.NoError(t, err)
+
+	// The bytes are not altered by the terminal
+	data := []byte{'a', '\n', '\r', 0x03, 0xff}
+	_, err = port.Write(data)
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(mcu, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	_, err = mcu.Write(data)
+	require.NoError(t, err)
+	_, err = io.ReadFull(port, buf)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// The port survives the simulator closing the slave
+	require.NoError(t, mcu.Close())
+	require.NoError(t, port.SetReadTimeout(10*time.Millisecond))
+	n, err := port.Read(buf)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	require.Error(t, port.SetDTR(true))
+
+	// Close wakes up a pending read
+	require.NoError(t, port.SetReadTimeout(0))
+	readErr := make(chan error)
+	go func() {
+		_, err := port.Read(buf)
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, port.Close())
+	select {
+	case err := <-readErr:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "read not interrupted by Close")
+	}
+	_, err = os.Lstat(link)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,936 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+	"golang.org/x/sys/unix"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/internal/tracing"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// DefaultVIDPIDFilters matches the USB vendor IDs used by Arduino boards.
+var DefaultVIDPIDFilters = []string{"2341:*", "2A03:*"}
+
+// DefaultReadBufferSize is the default size of the buffer used to read from
+// the serial port, it holds about 80ms of data at 2 Mbaud.
+const DefaultReadBufferSize = 16 * 1024
+
+// discoveryInterval is the polling interval used to detect a matching
+// serial port when auto-discovery is enabled.
+const discoveryInterval = time.Second
+
+// Config is the serial link configuration.
+type Config struct {
+	// PortAddr is the address of the serial port to open. It is ignored
+	// if AutoDiscover is set.
+	PortAddr    string
+	BaudRate    int
+	Parity      string
+	StopBits    string
+	FlowControl string
+	// AutoDiscover enables the enumeration of the serial ports to find
+	// the first USB port matching one of the VIDPIDFilters.
+	AutoDiscover bool
+	// VIDPIDFilters is a list of "VID:PID" patterns, where both VID and PID
+	// are hexadecimal numbers or "*" to match any value.
+	VIDPIDFilters []string
+	// Framing is the framing used around the messages on the serial link,
+	// FramingNone or FramingCOBS.
+	Framing string
+	// StatsLogInterval is the interval between two logs of the link
+	// statistics, 0 disables the periodic logging.
+	StatsLogInterval time.Duration
+	// ReopenBackoffMin and ReopenBackoffMax are the bounds of the exponential
+	// backoff used to retry opening the serial port after a failure.
+	ReopenBackoffMin time.Duration
+	ReopenBackoffMax time.Duration
+	// ReopenMaxRetries is the number of consecutive failures after which the
+	// router stops retrying until the next $/serial/open, 0 means unlimited.
+	ReopenMaxRetries int
+	// ReadBufferSize is the size of the buffer used to read from the serial
+	// port, 0 means DefaultReadBufferSize.
+	ReadBufferSize int
+	// CoalesceDelay is the time the messages written to the serial port are
+	// held to be sent together in a single write, 0 disables the batching.
+	CoalesceDelay time.Duration
+}
+
+var cfg Config
+var serialLock sync.Mutex
+var serialOpened = sync.NewCond(&serialLock)
+var serialClosed = sync.NewCond(&serialLock)
+var serialCloseSignal = make(chan struct{})
+var attachedPortAddr string
+var activePort serial.Port
+var activeCoalescer *coalescingStream
+var portMode serial.Mode
+var portFlowControl bool
+var stats linkStats
+
+// linkStats holds the traffic counters of the serial link.
+type linkStats struct {
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	readErrors  atomic.Uint64
+	writeErrors atomic.Uint64
+	frameErrors atomic.Uint64
+	openCount   atomic.Uint64
+
+	// Counters of the connections already closed, and the currently open
+	// connection (guarded by serialLock).
+	closedConnStats msgpackrpc.ConnectionStats
+	activeConn      *msgpackrpc.Connection
+	openedAt        time.Time
+	bytesInAtOpen   uint64
+	bytesOutAtOpen  uint64
+}
+
+// Register the Serial API methods and start the serial connection loop
+func Register(router *msgpackrouter.Router, c Config) error {
+	for _, filter := range c.VIDPIDFilters {
+		if _, _, err := parseVIDPIDFilter(filter); err != nil {
+			return err
+		}
+	}
+	parity, err := parseParity(c.Parity)
+	if err != nil {
+		return err
+	}
+	stopBits, err := parseStopBits(c.StopBits)
+	if err != nil {
+		return err
+	}
+	flowControl, err := parseFlowControl(c.FlowControl)
+	if err != nil {
+		return err
+	}
+	if c.Framing, err = parseFraming(c.Framing); err != nil {
+		return err
+	}
+	if c.ReopenBackoffMin <= 0 {
+		c.ReopenBackoffMin = DefaultReopenBackoffMin
+	}
+	if c.ReopenBackoffMax <= 0 {
+		c.ReopenBackoffMax = DefaultReopenBackoffMax
+	}
+	if c.ReopenBackoffMax < c.ReopenBackoffMin {
+		return fmt.Errorf("invalid serial reopen backoff: max %s is lower than min %s", c.ReopenBackoffMax, c.ReopenBackoffMin)
+	}
+	if c.ReopenMaxRetries < 0 {
+		return fmt.Errorf("invalid serial reopen max retries: %d", c.ReopenMaxRetries)
+	}
+	if c.ReadBufferSize < 0 {
+		return fmt.Errorf("invalid serial read buffer size: %d", c.ReadBufferSize)
+	} else if c.ReadBufferSize == 0 {
+		c.ReadBufferSize = DefaultReadBufferSize
+	}
+	if c.CoalesceDelay < 0 {
+		return fmt.Errorf("invalid serial coalesce delay: %s", c.CoalesceDelay)
+	}
+	cfg = c
+	portMode = serial.Mode{
+		BaudRate: c.BaudRate,
+		DataBits: 8,
+		StopBits: stopBits,
+		Parity:   parity,
+	}
+	portFlowControl = flowControl
+
+	if err := router.RegisterMethod("$/serial/open", serialOpen); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/serial/close", serialClose); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/serial/config", serialConfig); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/serial/list", serialList); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/serial/status", serialStatus); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/serial/setDTR", serialSetDTR); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/serial/setRTS", serialSetRTS); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/serial/resetMCU", serialResetMCU); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/serial/lastError", serialLastError); err != nil {
+		return err
+	}
+	go connectionLoop(router)
+	if c.StatsLogInterval > 0 {
+		go statsLogLoop(c.StatsLogInterval)
+	}
+	return nil
+}
+
+// Stats returns the statistics of the serial link.
+func Stats() map[string]any {
+	serialLock.Lock()
+	frames := stats.closedConnStats
+	if stats.activeConn != nil {
+		current := stats.activeConn.Stats()
+		frames.FramesIn += current.FramesIn
+		frames.FramesOut += current.FramesOut
+		frames.DecodeErrors += current.DecodeErrors
+	}
+	open := activePort != nil
+	openedAt := stats.openedAt
+	bytesInAtOpen := stats.bytesInAtOpen
+	bytesOutAtOpen := stats.bytesOutAtOpen
+	serialLock.Unlock()
+
+	bytesIn := stats.bytesIn.Load()
+	bytesOut := stats.bytesOut.Load()
+	reopenCount := uint64(0)
+	if openCount := stats.openCount.Load(); openCount > 1 {
+		reopenCount = openCount - 1
+	}
+
+	// The effective throughput is the average since the port was opened
+	throughputIn, throughputOut := 0.0, 0.0
+	if open {
+		if elapsed := time.Since(openedAt).Seconds(); elapsed > 0 {
+			throughputIn = float64(bytesIn-bytesInAtOpen) / elapsed
+			throughputOut = float64(bytesOut-bytesOutAtOpen) / elapsed
+		}
+	}
+
+	return map[string]any{
+		"open":           open,
+		"bytes_in":       bytesIn,
+		"bytes_out":      bytesOut,
+		"read_errors":    stats.readErrors.Load(),
+		"write_errors":   stats.writeErrors.Load(),
+		"frame_errors":   stats.frameErrors.Load(),
+		"frames_in":      frames.FramesIn,
+		"frames_out":     frames.FramesOut,
+		"decode_errors":  frames.DecodeErrors,
+		"reopen_count":   reopenCount,
+		"throughput_in":  throughputIn,
+		"throughput_out": throughputOut,
+	}
+}
+
+// statsLogLoop periodically logs the link statistics, along with the
+// throughput measured in the last interval.
+func statsLogLoop(interval time.Duration) {
+	lastBytesIn := stats.bytesIn.Load()
+	lastBytesOut := stats.bytesOut.Load()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s := Stats()
+		bytesIn := stats.bytesIn.Load()
+		bytesOut := stats.bytesOut.Load()
+		slog.Info("Serial link statistics",
+			"open", s["open"],
+			"frames_in", s["frames_in"],
+			"frames_out", s["frames_out"],
+			"decode_errors", s["decode_errors"],
+			"read_errors", s["read_errors"],
+			"write_errors", s["write_errors"],
+			"reopen_count", s["reopen_count"],
+			"throughput_in", float64(bytesIn-lastBytesIn)/interval.Seconds(),
+			"throughput_out", float64(bytesOut-lastBytesOut)/interval.Seconds(),
+		)
+		lastBytesIn, lastBytesOut = bytesIn, bytesOut
+	}
+}
+
+// isValidPortAddr checks if address is the serial port handled by the router.
+func isValidPortAddr(address string) bool {
+	if !cfg.AutoDiscover {
+		return address == cfg.PortAddr
+	}
+	serialLock.Lock()
+	defer serialLock.Unlock()
+	return attachedPortAddr != "" && address == attachedPortAddr
+}
+
+func serialOpen(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters"})
+		return
+	}
+	address, ok := params[0].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type"})
+		return
+	}
+	slog.Info("Request for opening serial port", "serial", address)
+	if !isValidPortAddr(address) {
+		res(nil, []any{1, "Invalid serial port address"})
+		return
+	}
+	serialOpened.L.Lock()
+	if serialCloseSignal == nil { // check if already opened
+		serialCloseSignal = make(chan struct{})
+		serialOpened.Broadcast()
+	}
+	serialOpened.L.Unlock()
+	res(true, nil)
+}
+
+func serialClose(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters"})
+		return
+	}
+	address, ok := params[0].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type"})
+		return
+	}
+	slog.Info("Request for closing serial port", "serial", address)
+	if !isValidPortAddr(address) {
+		res(nil, []any{1, "Invalid serial port address"})
+		return
+	}
+	serialClosed.L.Lock()
+	if serialCloseSignal != nil { // check if already closed
+		close(serialCloseSignal)
+		serialCloseSignal = nil
+		serialClosed.Wait()
+	}
+	serialClosed.L.Unlock()
+	res(true, nil)
+}
+
+// serialConfig changes the serial port parameters. The parameters are:
+// baud rate and optionally parity, stop bits and flow control.
+// The new settings are applied to the open port after the response has
+// been sent, so a caller on the serial link itself receives the response
+// with the previous settings.
+func serialConfig(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) < 1 || len(params) > 4 {
+		res(nil, []any{1, "Invalid number of parameters, expected (baud rate[, parity[, stop bits[, flow control]]])"})
+		return
+	}
+	baudRate, ok := msgpackrpc.ToUint(params[0])
+	if !ok || baudRate == 0 {
+		res(nil, []any{1, "Invalid parameter type, expected positive int for baud rate"})
+		return
+	}
+
+	serialLock.Lock()
+	mode := portMode
+	flowControl := portFlowControl
+	serialLock.Unlock()
+	mode.BaudRate = int(baudRate) //nolint:gosec
+
+	if len(params) > 1 {
+		parityStr, ok := params[1].(string)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for parity"})
+			return
+		}
+		parity, err := parseParity(parityStr)
+		if err != nil {
+			res(nil, []any{1, err.Error()})
+			return
+		}
+		mode.Parity = parity
+	}
+	if len(params) > 2 {
+		stopBitsStr := fmt.Sprint(params[2])
+		stopBits, err := parseStopBits(stopBitsStr)
+		if err != nil {
+			res(nil, []any{1, err.Error()})
+			return
+		}
+		mode.StopBits = stopBits
+	}
+	if len(params) > 3 {
+		flowControlStr, ok := params[3].(string)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for flow control"})
+			return
+		}
+		fc, err := parseFlowControl(flowControlStr)
+		if err != nil {
+			res(nil, []any{1, err.Error()})
+			return
+		}
+		flowControl = fc
+	}
+
+	serialLock.Lock()
+	portMode = mode
+	portFlowControl = flowControl
+	port := activePort
+	coalescer := activeCoalescer
+	portAddr := attachedPortAddr
+	serialLock.Unlock()
+
+	res(true, nil)
+
+	if port == nil {
+		// The settings will be applied when the port is opened
+		return
+	}
+	if coalescer != nil {
+		// Send the response before changing the settings
+		coalescer.flush()
+	}
+	_ = port.Drain()
+	if err := port.SetMode(&mode); err != nil {
+		slog.Error("Failed to change serial port settings", "serial", portAddr, "err", err)
+		return
+	}
+	if err := setFlowControl(port, portAddr, flowControl); err != nil {
+		slog.Error("Failed to change serial port flow control", "serial", portAddr, "err", err)
+		return
+	}
+	slog.Info("Changed serial port settings", "serial", portAddr, "baudrate", mode.BaudRate, "parity", mode.Parity, "stopbits", mode.StopBits, "rtscts", flowControl)
+}
+
+// serialList returns the serial ports available in the system, flagging
+// the one configured in the router and the one currently attached.
+func serialList(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 0 {
+		res(nil, []any{1, "Invalid number of parameters, expected no parameters"})
+		return
+	}
+
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		res(nil, []any{3, "Failed to enumerate serial ports: " + err.Error()})
+		return
+	}
+
+	serialLock.Lock()
+	attached := ""
+	if activePort != nil {
+		attached = attachedPortAddr
+	}
+	serialLock.Unlock()
+
+	list := []any{}
+	configuredFound := false
+	for _, port := range ports {
+		configured := !cfg.AutoDiscover && port.Name == cfg.PortAddr
+		if cfg.AutoDiscover {
+			configured = port.IsUSB && matchVIDPID(cfg.VIDPIDFilters, port.VID, port.PID)
+		}
+		configuredFound = configuredFound || port.Name == cfg.PortAddr
+		list = append(list, map[string]any{
+			"address":    port.Name,
+			"usb":        port.IsUSB,
+			"vid":        port.VID,
+			"pid":        port.PID,
+			"serial":     port.SerialNumber,
+			"product":    port.Product,
+			"configured": configured,
+			"attached":   port.Name == attached,
+		})
+	}
+	if !cfg.AutoDiscover && !configuredFound {
+		// The configured port may not be enumerable (for example an
+		// on-board UART), list it anyway.
+		list = append(list, map[string]any{
+			"address":    cfg.PortAddr,
+			"usb":        false,
+			"configured": true,
+			"attached":   cfg.PortAddr == attached,
+		})
+	}
+	res(list, nil)
+}
+
+// serialStatus returns the state of the serial link.
+func serialStatus(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 0 {
+		res(nil, []any{1, "Invalid number of parameters, expected no parameters"})
+		return
+	}
+
+	serialLock.Lock()
+	open := activePort != nil
+	address := cfg.PortAddr
+	if cfg.AutoDiscover {
+		address = attachedPortAddr
+	}
+	mode := portMode
+	flowControl := portFlowControl
+	serialLock.Unlock()
+
+	res(map[string]any{
+		"address":      address,
+		"open":         open,
+		"baudrate":     mode.BaudRate,
+		"parity":       parityName(mode.Parity),
+		"stopbits":     stopBitsName(mode.StopBits),
+		"flowcontrol":  flowControlName(flowControl),
+		"bytes_in":     stats.bytesIn.Load(),
+		"bytes_out":    stats.bytesOut.Load(),
+		"read_errors":  stats.readErrors.Load(),
+		"write_errors": stats.writeErrors.Load(),
+	}, nil)
+}
+
+func serialSetDTR(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	serialSetControlLine(params, res, "DTR", serial.Port.SetDTR)
+}
+
+func serialSetRTS(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	serialSetControlLine(params, res, "RTS", serial.Port.SetRTS)
+}
+
+func serialSetControlLine(params []any, res msgpackrouter.RouterResponseHandler, line string, set func(serial.Port, bool) error) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected " + line + " state"})
+		return
+	}
+	state, ok := params[0].(bool)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected bool for " + line + " state"})
+		return
+	}
+
+	serialLock.Lock()
+	port := activePort
+	serialLock.Unlock()
+	if port == nil {
+		res(nil, []any{2, "Serial port not open"})
+		return
+	}
+
+	if err := set(port, state); err != nil {
+		res(nil, []any{3, "Failed to set " + line + ": " + err.Error()})
+		return
+	}
+	res(true, nil)
+}
+
+// serialResetMCU resets the microcontroller by pulsing the DTR and RTS
+// lines. The optional parameter is the pulse duration in ms.
+func serialResetMCU(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) > 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected ([optional pulse duration in ms])"})
+		return
+	}
+	pulse := 100 * time.Millisecond
+	if len(params) == 1 {
+		ms, ok := msgpackrpc.ToUint(params[0])
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected uint for pulse duration in ms"})
+			return
+		}
+		pulse = time.Duration(ms) * time.Millisecond
+	}
+
+	if err := ResetMCU(pulse); errors.Is(err, errPortNotOpen) {
+		res(nil, []any{2, "Serial port not open"})
+		return
+	} else if err != nil {
+		res(nil, []any{3, "Failed to reset MCU: " + err.Error()})
+		return
+	}
+	res(true, nil)
+}
+
+// errPortNotOpen is returned by ResetMCU if the serial port is not open.
+var errPortNotOpen = errors.New("serial port not open")
+
+// ResetMCU resets the microcontroller by pulling the DTR and RTS lines low
+// and releasing them after the given pulse duration.
+func ResetMCU(pulse time.Duration) error {
+	serialLock.Lock()
+	port := activePort
+	portAddr := attachedPortAddr
+	serialLock.Unlock()
+	if port == nil {
+		return errPortNotOpen
+	}
+
+	slog.Info("Resetting MCU", "serial", portAddr, "pulse", pulse)
+	setLines := func(state bool) error {
+		if err := port.SetDTR(state); err != nil {
+			return err
+		}
+		return port.SetRTS(state)
+	}
+	if err := setLines(false); err != nil {
+		return err
+	}
+	time.Sleep(pulse)
+	return setLines(true)
+}
+
+func parseParity(parity string) (serial.Parity, error) {
+	switch strings.ToLower(parity) {
+	case "", "none":
+		return serial.NoParity, nil
+	case "odd":
+		return serial.OddParity, nil
+	case "even":
+		return serial.EvenParity, nil
+	case "mark":
+		return serial.MarkParity, nil
+	case "space":
+		return serial.SpaceParity, nil
+	default:
+		return serial.NoParity, fmt.Errorf("invalid parity: %s", parity)
+	}
+}
+
+func parseStopBits(stopBits string) (serial.StopBits, error) {
+	switch stopBits {
+	case "", "1":
+		return serial.OneStopBit, nil
+	case "1.5":
+		return serial.OnePointFiveStopBits, nil
+	case "2":
+		return serial.TwoStopBits, nil
+	default:
+		return serial.OneStopBit, fmt.Errorf("invalid stop bits: %s", stopBits)
+	}
+}
+
+// parseFlowControl returns true if hardware (RTS/CTS) flow control is requested.
+func parseFlowControl(flowControl string) (bool, error) {
+	switch strings.ToLower(flowControl) {
+	case "", "none":
+		return false, nil
+	case "rtscts":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid flow control: %s", flowControl)
+	}
+}
+
+func parityName(parity serial.Parity) string {
+	switch parity {
+	case serial.OddParity:
+		return "odd"
+	case serial.EvenParity:
+		return "even"
+	case serial.MarkParity:
+		return "mark"
+	case serial.SpaceParity:
+		return "space"
+	default:
+		return "none"
+	}
+}
+
+func stopBitsName(stopBits serial.StopBits) string {
+	switch stopBits {
+	case serial.OnePointFiveStopBits:
+		return "1.5"
+	case serial.TwoStopBits:
+		return "2"
+	default:
+		return "1"
+	}
+}
+
+func flowControlName(rtscts bool) string {
+	if rtscts {
+		return "rtscts"
+	}
+	return "none"
+}
+
+// setHardwareFlowControl enables or disables RTS/CTS flow control on the
+// given tty. The serial library does not expose this setting, but since the
+// termios settings are per-device they can be changed through another fd.
+func setHardwareFlowControl(portAddr string, enabled bool) error {
+	fd, err := unix.Open(portAddr, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		termios.Cflag |= unix.CRTSCTS
+	} else {
+		termios.Cflag &^= unix.CRTSCTS
+	}
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
+
+func connectionLoop(router *msgpackrouter.Router) {
+	attempts := 0
+	for {
+		serialOpened.L.Lock()
+		for serialCloseSignal == nil {
+			serialClosed.Broadcast()
+			serialOpened.Wait()
+		}
+		close := serialCloseSignal
+		serialOpened.L.Unlock()
+
+		portAddr := cfg.PortAddr
+		if cfg.AutoDiscover {
+			if addr, err := discoverPort(cfg.VIDPIDFilters); err != nil {
+				slog.Error("Failed to enumerate serial ports", "err", err)
+				time.Sleep(discoveryInterval)
+				continue
+			} else if addr == "" {
+				time.Sleep(discoveryInterval)
+				continue
+			} else {
+				portAddr = addr
+			}
+		}
+
+		serialLock.Lock()
+		mode := portMode
+		flowControl := portFlowControl
+		serialLock.Unlock()
+
+		if attempts == 0 {
+			slog.Info("Opening serial connection", "serial", portAddr, "baudrate", mode.BaudRate)
+		}
+		serialPort, err := openPort(portAddr, &mode)
+		if err != nil {
+			attempts++
+			setLastError(err, attempts)
+			if cfg.ReopenMaxRetries > 0 && attempts > cfg.ReopenMaxRetries {
+				slog.Error("Failed to open serial port, giving up until the next $/serial/open", "serial", portAddr, "attempts", attempts, "err", err)
+				attempts = 0
+				serialLock.Lock()
+				if serialCloseSignal == close {
+					serialCloseSignal = nil
+				}
+				serialLock.Unlock()
+				continue
+			}
+			delay := reopenDelay(attempts, cfg.ReopenBackoffMin, cfg.ReopenBackoffMax)
+			if attempts == 1 {
+				slog.Info("Serial port unavailable, retrying with backoff", "serial", portAddr, "err", err, "retry_in", delay)
+			} else {
+				slog.Debug("Failed to open serial port", "serial", portAddr, "attempts", attempts, "err", err, "retry_in", delay)
+			}
+			select {
+			case <-time.After(delay):
+			case <-close:
+				attempts = 0
+			}
+			continue
+		}
+		if attempts > 0 {
+			slog.Info("Serial port available again", "serial", portAddr, "attempts", attempts)
+			attempts = 0
+		}
+		if flowControl {
+			if err := setFlowControl(serialPort, portAddr, true); err != nil {
+				slog.Error("Failed to enable serial port flow control", "serial", portAddr, "err", err)
+			}
+		}
+		slog.Info("Opened serial connection", "serial", portAddr)
+		stats.openCount.Add(1)
+		var link io.ReadWriteCloser = &statsStream{Upstream: serialPort}
+		var coalescer *coalescingStream
+		if cfg.CoalesceDelay > 0 {
+			coalescer = newCoalescingStream(link, cfg.CoalesceDelay)
+			link = coalescer
+		}
+		if cfg.Framing == FramingCOBS {
+			link = newCOBSStream(link, cfg.ReadBufferSize, func(error) { stats.frameErrors.Add(1) })
+		} else {
+			link = newBufferedStream(link, cfg.ReadBufferSize)
+		}
+		wr := &MsgpackDebugStream{Name: portAddr, Upstream: link}
+		conn, routerExit := router.AcceptConnectionWithInfo(wr, msgpackrouter.ConnectionInfo{Transport: "serial", RemoteAddr: portAddr, Role: msgpackrouter.RoleMCU})
+		serialLock.Lock()
+		attachedPortAddr = portAddr
+		activePort = serialPort
+		activeCoalescer = coalescer
+		stats.activeConn = conn
+		stats.openedAt = time.Now()
+		stats.bytesInAtOpen = stats.bytesIn.Load()
+		stats.bytesOutAtOpen = stats.bytesOut.Load()
+		serialLock.Unlock()
+		router.BroadcastNotification(conn, "$/serial/opened", portAddr)
+
+		// wait for the close command from RPC or for a failure of the serial port (routerExit)
+		select {
+		case <-routerExit:
+			slog.Info("Serial port failed connection")
+		case <-close:
+		}
+
+		// in any case, wait for the router to drop the connection
+		serialLock.Lock()
+		activePort = nil
+		activeCoalescer = nil
+		serialLock.Unlock()
+		serialPort.Close()
+		<-routerExit
+
+		serialLock.Lock()
+		connStats := conn.Stats()
+		stats.closedConnStats.FramesIn += connStats.FramesIn
+		stats.closedConnStats.FramesOut += connStats.FramesOut
+		stats.closedConnStats.DecodeErrors += connStats.DecodeErrors
+		stats.activeConn = nil
+		serialLock.Unlock()
+		router.BroadcastNotification(nil, "$/serial/closed", portAddr)
+	}
+}
+
+// discoverPort returns the address of the first USB serial port matching
+// one of the given VID:PID filters, or an empty string if none is found.
+func discoverPort(filters []string) (string, error) {
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+	for _, port := range ports {
+		if !port.IsUSB {
+			continue
+		}
+		if matchVIDPID(filters, port.VID, port.PID) {
+			slog.Debug("Discovered serial port", "serial", port.Name, "vid", port.VID, "pid", port.PID)
+			return port.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// parseVIDPIDFilter splits a "VID:PID" filter in its components. The PID
+// may be omitted, in that case it matches any value.
+func parseVIDPIDFilter(filter string) (vid, pid string, err error) {
+	vid, pid, hasPID := strings.Cut(filter, ":")
+	if !hasPID {
+		pid = "*"
+	}
+	if vid == "" || pid == "" {
+		return "", "", fmt.Errorf("invalid VID:PID filter: %s", filter)
+	}
+	return strings.ToUpper(vid), strings.ToUpper(pid), nil
+}
+
+func matchVIDPID(filters []string, vid, pid string) bool {
+	vid = strings.ToUpper(vid)
+	pid = strings.ToUpper(pid)
+	for _, filter := range filters {
+		filterVID, filterPID, err := parseVIDPIDFilter(filter)
+		if err != nil {
+			continue
+		}
+		if (filterVID == "*" || filterVID == vid) && (filterPID == "*" || filterPID == pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// statsStream updates the link statistics with the traffic going
+// through the Upstream stream.
+type statsStream struct {
+	Upstream io.ReadWriteCloser
+}
+
+func (s *statsStream) Read(p []byte) (n int, err error) {
+	n, err = s.Upstream.Read(p)
+	stats.bytesIn.Add(uint64(n)) //nolint:gosec
+	if err != nil {
+		stats.readErrors.Add(1)
+	}
+	return n, err
+}
+
+func (s *statsStream) Write(p []byte) (n int, err error) {
+	span := tracing.StartSpan("serial write", tracing.KindInternal, nil, "bytes", len(p))
+	n, err = s.Upstream.Write(p)
+	span.End(err)
+	stats.bytesOut.Add(uint64(n)) //nolint:gosec
+	if err != nil {
+		stats.writeErrors.Add(1)
+	}
+	return n, err
+}
+
+func (s *statsStream) Close() error {
+	return s.Upstream.Close()
+}
+
+// bufferedStream reads from the Upstream through a buffer: the serial port
+// is read in large chunks instead of with the small reads done while
+// decoding the messages.
+type bufferedStream struct {
+	io.ReadWriteCloser
+	in *bufio.Reader
+}
+
+func newBufferedStream(upstream io.ReadWriteCloser, size int) *bufferedStream {
+	return &bufferedStream{
+		ReadWriteCloser: upstream,
+		in:              bufio.NewReaderSize(upstream, size),
+	}
+}
+
+func (s *bufferedStream) Read(p []byte) (int, error) {
+	return s.in.Read(p)
+}
+
+type MsgpackDebugStream struct {
+	Upstream io.ReadWriteCloser
+	Name     string
+}
+
+func (d *MsgpackDebugStream) Read(p []byte) (n int, err error) {
+	n, err = d.Upstream.Read(p)
+	if err != nil {
+		slog.Debug("Read error from "+d.Name, "err", err)
+	} else {
+		slog.Debug("Read from "+d.Name, "data", hex.EncodeToString(p[:n]))
+	}
+	return n, err
+}
+
+func (d *MsgpackDebugStream) Write(p []byte) (n int, err error) {
+	n, err = d.Upstream.Write(p)
+	if err != nil {
+		slog.Debug("Write error to "+d.Name, "err", err)
+	} else {
+		slog.Debug("Write to  "+d.Name, "data", hex.EncodeToString(p[:n]))
+	}
+	return n, err
+}
+
+func (d *MsgpackDebugStream) Close() error {
+	return d.Upstream.Close()
+}
@@ -0,0 +1,214 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package serialapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.bug.st/serial"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+func TestVIDPIDMatching(t *testing.T) {
+	require.True(t, matchVIDPID(DefaultVIDPIDFilters, "2341", "0070"))
+	require.True(t, matchVIDPID(DefaultVIDPIDFilters, "2a03", "0043"))
+	require.False(t, matchVIDPID(DefaultVIDPIDFilters, "10C4", "EA60"))
+
+	filters := []string{"10c4:ea60", "1A86"}
+	require.True(t, matchVIDPID(filters, "10C4", "EA60"))
+	require.False(t, matchVIDPID(filters, "10C4", "EA61"))
+	require.True(t, matchVIDPID(filters, "1a86", "7523"))
+	require.False(t, matchVIDPID(nil, "2341", "0070"))
+
+	_, _, err := parseVIDPIDFilter(":0070")
+	require.Error(t, err)
+	_, _, err = parseVIDPIDFilter("2341:")
+	require.Error(t, err)
+}
+
+func TestSerialSettingsParsing(t *testing.T) {
+	parity, err := parseParity("Even")
+	require.NoError(t, err)
+	require.Equal(t, serial.EvenParity, parity)
+	_, err = parseParity("foo")
+	require.Error(t, err)
+
+	stopBits, err := parseStopBits("1.5")
+	require.NoError(t, err)
+	require.Equal(t, serial.OnePointFiveStopBits, stopBits)
+	_, err = parseStopBits("3")
+	require.Error(t, err)
+
+	rtscts, err := parseFlowControl("rtscts")
+	require.NoError(t, err)
+	require.True(t, rtscts)
+	rtscts, err = parseFlowControl("")
+	require.NoError(t, err)
+	require.False(t, rtscts)
+	_, err = parseFlowControl("xonxoff")
+	require.Error(t, err)
+}
+
+type nopReadWriteCloser struct {
+	bytes.Buffer
+}
+
+func (*nopReadWriteCloser) Close() error { return nil }
+
+func TestSerialStatus(t *testing.T) {
+	s := &statsStream{Upstream: &nopReadWriteCloser{}}
+	_, err := s.Write([]byte("Hello"))
+	require.NoError(t, err)
+	_, err = s.Read(make([]byte, 3))
+	require.NoError(t, err)
+	_, err = s.Read(make([]byte, 3))
+	require.NoError(t, err)
+	_, err = s.Read(make([]byte, 3))
+	require.ErrorIs(t, err, io.EOF)
+
+	serialStatus(nil, []any{}, func(result, err any) {
+		require.Nil(t, err)
+		status := result.(map[string]any)
+		require.Equal(t, false, status["open"])
+		require.Equal(t, uint64(5), status["bytes_in"])
+		require.Equal(t, uint64(5), status["bytes_out"])
+		require.Equal(t, uint64(1), status["read_errors"])
+	})
+	serialStatus(nil, []any{1}, func(result, err any) {
+		require.Nil(t, result)
+		require.Equal(t, []any{1, "Invalid number of parameters, expected no parameters"}, err)
+	})
+}
+
+// controlPort records the changes of the control lines of a serial port.
+type controlPort struct {
+	serial.Port
+	calls []string
+	err   error
+}
+
+func (p *controlPort) SetDTR(dtr bool) error {
+	p.calls = append(p.calls, fmt.Sprintf("DTR %v", dtr))
+	return p.err
+}
+
+func (p *controlPort) SetRTS(rts bool) error {
+	p.calls = append(p.calls, fmt.Sprintf("RTS %v", rts))
+	return p.err
+}
+
+func TestSerialControlLines(t *testing.T) {
+	defer func(p serial.Port) { activePort = p }(activePort)
+	broken := errors.New("broken")
+
+	tests := []struct {
+		name    string
+		handler msgpackrouter.RouterRequestHandler
+		params  []any
+		port    *controlPort
+		result  any
+		err     any
+		calls   []string
+	}{
+		{"SetDTRNoParams", serialSetDTR, []any{}, &controlPort{}, nil, []any{1, "Invalid number of parameters, expected DTR state"}, nil},
+		{"SetDTRInvalidType", serialSetDTR, []any{1}, &controlPort{}, nil, []any{1, "Invalid parameter type, expected bool for DTR state"}, nil},
+		{"SetDTRNotOpen", serialSetDTR, []any{true}, nil, nil, []any{2, "Serial port not open"}, nil},
+		{"SetDTR", serialSetDTR, []any{true}, &controlPort{}, true, nil, []string{"DTR true"}},
+		{"SetDTRFailure", serialSetDTR, []any{false}, &controlPort{err: broken}, nil, []any{3, "Failed to set DTR: broken"}, []string{"DTR false"}},
+		{"SetRTSTooManyParams", serialSetRTS, []any{true, false}, &controlPort{}, nil, []any{1, "Invalid number of parameters, expected RTS state"}, nil},
+		{"SetRTSInvalidType", serialSetRTS, []any{"on"}, &controlPort{}, nil, []any{1, "Invalid parameter type, expected bool for RTS state"}, nil},
+		{"SetRTSNotOpen", serialSetRTS, []any{false}, nil, nil, []any{2, "Serial port not open"}, nil},
+		{"SetRTS", serialSetRTS, []any{false}, &controlPort{}, true, nil, []string{"RTS false"}},
+		{"SetRTSFailure", serialSetRTS, []any{true}, &controlPort{err: broken}, nil, []any{3, "Failed to set RTS: broken"}, []string{"RTS true"}},
+		{"ResetMCUTooManyParams", serialResetMCU, []any{1, 2}, &controlPort{}, nil, []any{1, "Invalid number of parameters, expected ([optional pulse duration in ms])"}, nil},
+		{"ResetMCUInvalidType", serialResetMCU, []any{"10"}, &controlPort{}, nil, []any{1, "Invalid parameter type, expected uint for pulse duration in ms"}, nil},
+		{"ResetMCUNegativePulse", serialResetMCU, []any{-1}, &controlPort{}, nil, []any{1, "Invalid parameter type, expected uint for pulse duration in ms"}, nil},
+		{"ResetMCUNotOpen", serialResetMCU, []any{}, nil, nil, []any{2, "Serial port not open"}, nil},
+		{"ResetMCU", serialResetMCU, []any{1}, &controlPort{}, true, nil, []string{"DTR false", "RTS false", "DTR true", "RTS true"}},
+		{"ResetMCUFailure", serialResetMCU, []any{1}, &controlPort{err: broken}, nil, []any{3, "Failed to reset MCU: broken"}, []string{"DTR false"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serialLock.Lock()
+			activePort = nil
+			if test.port != nil {
+				activePort = test.port
+			}
+			serialLock.Unlock()
+
+			var result, reqErr any
+			test.handler(nil, test.params, func(r, e any) { result, reqErr = r, e })
+			require.Equal(t, test.result, result)
+			require.Equal(t, test.err, reqErr)
+			if test.port != nil {
+				require.Equal(t, test.calls, test.port.calls)
+			}
+		})
+	}
+}
+
+func TestReopenDelay(t *testing.T) {
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, delay := range expected {
+		for range 20 {
+			d := reopenDelay(i+1, time.Second, 10*time.Second)
+			require.GreaterOrEqual(t, d, delay/2)
+			require.LessOrEqual(t, d, delay)
+		}
+	}
+}
+
+// countingReader counts the Read calls of the underlying stream.
+type countingReader struct {
+	nopReadWriteCloser
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.nopReadWriteCloser.Read(p)
+}
+
+func TestBufferedStream(t *testing.T) {
+	upstream := &countingReader{}
+	upstream.Write(bytes.Repeat([]byte{0xAA}, 1000))
+	s := newBufferedStream(upstream, 256)
+
+	// The small reads are served from the buffer
+	var data []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := s.Read(buf)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		data = append(data, buf[:n]...)
+	}
+	require.Len(t, data, 1000)
+	require.Equal(t, 5, upstream.reads)
+
+	_, err := s.Write([]byte("Hello"))
+	require.NoError(t, err)
+	require.Equal(t, "Hello", upstream.String())
+}
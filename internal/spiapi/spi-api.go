@@ -0,0 +1,285 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package spiapi
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// ioctl requests from <linux/spi/spidev.h>
+const (
+	spiIOCWrMode        = 0x40016b01
+	spiIOCWrBitsPerWord = 0x40016b03
+	spiIOCWrMaxSpeedHz  = 0x40046b04
+	spiIOCMessage1      = 0x40206b00
+)
+
+// Default settings of the SPI devices
+const (
+	DefaultSpeedHz     = 1000000
+	DefaultBitsPerWord = 8
+)
+
+// maxTransferSize is the maximum number of bytes of a single transfer (the
+// default buffer size of the spidev driver).
+const maxTransferSize = 4096
+
+// devicePath is the format of the path of the SPI devices, with the bus
+// number and the chip select.
+var devicePath = "/dev/spidev%d.%d"
+
+// device is an SPI device opened by a client.
+type device struct {
+	file        *os.File
+	owner       *msgpackrpc.Connection
+	speedHz     uint32
+	bitsPerWord uint8
+	lock        sync.Mutex
+}
+
+var lock sync.Mutex
+var openDevices = make(map[uint]*device)
+var nextDeviceID uint
+
+// Register registers the SPI API methods with the router.
+func Register(router *msgpackrouter.Router) {
+	_ = router.RegisterMethod("spi/open", spiOpen)
+	_ = router.RegisterMethod("spi/transfer", spiTransfer)
+	_ = router.RegisterMethod("spi/close", spiClose)
+	router.OnConnectionClosed(closeOwnedBy)
+}
+
+// Stats returns the number of open SPI devices.
+func Stats() map[string]any {
+	lock.Lock()
+	defer lock.Unlock()
+	return map[string]any{
+		"open_devices": len(openDevices),
+	}
+}
+
+// closeOwnedBy closes the devices opened by the given client.
+func closeOwnedBy(conn *msgpackrpc.Connection) {
+	lock.Lock()
+	defer lock.Unlock()
+	for id, d := range openDevices {
+		if d.owner == conn {
+			d.file.Close()
+			delete(openDevices, id)
+			slog.Info("Closed SPI device of disconnected client", "id", id)
+		}
+	}
+}
+
+// getDevice returns the device with the given ID, if opened by the client.
+func getDevice(rpc *msgpackrpc.Connection, param any) (uint, *device, any) {
+	id, ok := msgpackrpc.ToUint(param)
+	if !ok {
+		return 0, nil, []any{1, "Invalid parameter type, expected int for device handle"}
+	}
+	lock.Lock()
+	d, ok := openDevices[id]
+	lock.Unlock()
+	if !ok || d.owner != rpc {
+		return 0, nil, []any{2, fmt.Sprintf("SPI device not found for handle: %d", id)}
+	}
+	return id, d, nil
+}
+
+func ioctl(fd uintptr, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// spiOpen opens the SPI device /dev/spidevBUS.CS and returns its handle, that
+// can only be used by the calling client. The optional parameters are the
+// SPI mode (0-3), the clock speed in Hz and the bits per word.
+func spiOpen(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) < 2 || len(params) > 5 {
+		res(nil, []any{1, "Invalid number of parameters, expected (bus number, chip select[, mode[, speed in Hz[, bits per word]]])"})
+		return
+	}
+	busNum, ok := msgpackrpc.ToUint(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for SPI bus number"})
+		return
+	}
+	cs, ok := msgpackrpc.ToUint(params[1])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for chip select"})
+		return
+	}
+	var mode uint8
+	speedHz := uint32(DefaultSpeedHz)
+	bitsPerWord := uint8(DefaultBitsPerWord)
+	if len(params) > 2 {
+		if m, ok := msgpackrpc.ToUint(params[2]); !ok || m > 3 {
+			res(nil, []any{1, "Invalid parameter, expected SPI mode (0-3)"})
+			return
+		} else {
+			mode = uint8(m)
+		}
+	}
+	if len(params) > 3 {
+		if s, ok := msgpackrpc.ToUint(params[3]); !ok || s == 0 || s > 0xFFFFFFFF {
+			res(nil, []any{1, "Invalid parameter, expected speed in Hz"})
+			return
+		} else {
+			speedHz = uint32(s)
+		}
+	}
+	if len(params) > 4 {
+		if b, ok := msgpackrpc.ToUint(params[4]); !ok || b == 0 || b > 32 {
+			res(nil, []any{1, "Invalid parameter, expected bits per word (1-32)"})
+			return
+		} else {
+			bitsPerWord = uint8(b)
+		}
+	}
+
+	path := fmt.Sprintf(devicePath, busNum, cs)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		res(nil, []any{3, "Failed to open SPI device: " + err.Error()})
+		return
+	}
+	fd := f.Fd()
+	if err := ioctl(fd, spiIOCWrMode, unsafe.Pointer(&mode)); err != nil {
+		f.Close()
+		res(nil, []any{3, "Failed to set SPI mode: " + err.Error()})
+		return
+	}
+	if err := ioctl(fd, spiIOCWrBitsPerWord, unsafe.Pointer(&bitsPerWord)); err != nil {
+		f.Close()
+		res(nil, []any{3, "Failed to set SPI bits per word: " + err.Error()})
+		return
+	}
+	if err := ioctl(fd, spiIOCWrMaxSpeedHz, unsafe.Pointer(&speedHz)); err != nil {
+		f.Close()
+		res(nil, []any{3, "Failed to set SPI speed: " + err.Error()})
+		return
+	}
+
+	lock.Lock()
+	nextDeviceID++
+	id := nextDeviceID
+	openDevices[id] = &device{file: f, owner: rpc, speedHz: speedHz, bitsPerWord: bitsPerWord}
+	lock.Unlock()
+	slog.Info("Opened SPI device", "path", path, "id", id, "mode", mode, "speed_hz", speedHz, "bits_per_word", bitsPerWord)
+	res(id, nil)
+}
+
+// spiClose closes the SPI device with the given handle.
+func spiClose(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected device handle"})
+		return
+	}
+	id, d, errRes := getDevice(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	lock.Lock()
+	delete(openDevices, id)
+	lock.Unlock()
+	d.file.Close()
+	res(true, nil)
+}
+
+// spiIOCTransfer is struct spi_ioc_transfer from <linux/spi/spidev.h>
+type spiIOCTransfer struct {
+	txBuf          uint64
+	rxBuf          uint64
+	len            uint32
+	speedHz        uint32
+	delayUsecs     uint16
+	bitsPerWord    uint8
+	csChange       uint8
+	txNbits        uint8
+	rxNbits        uint8
+	wordDelayUsecs uint8
+	pad            uint8
+}
+
+// spiTransfer sends the data to the device and returns the bytes received
+// at the same time (full-duplex). The optional parameter overrides the clock
+// speed in Hz for this transfer.
+func spiTransfer(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 && len(params) != 3 {
+		res(nil, []any{1, "Invalid number of parameters, expected (device handle, data to send[, speed in Hz])"})
+		return
+	}
+	_, d, errRes := getDevice(rpc, params[0])
+	if errRes != nil {
+		res(nil, errRes)
+		return
+	}
+	tx, ok := params[1].([]byte)
+	if !ok {
+		if s, ok := params[1].(string); ok {
+			tx = []byte(s)
+		} else {
+			res(nil, []any{1, "Invalid parameter type, expected []byte or string for data to send"})
+			return
+		}
+	}
+	if len(tx) == 0 || len(tx) > maxTransferSize {
+		res(nil, []any{1, fmt.Sprintf("Invalid data size, expected 1 to %d bytes", maxTransferSize)})
+		return
+	}
+	speedHz := d.speedHz
+	if len(params) == 3 {
+		if s, ok := msgpackrpc.ToUint(params[2]); !ok || s == 0 || s > 0xFFFFFFFF {
+			res(nil, []any{1, "Invalid parameter, expected speed in Hz"})
+			return
+		} else {
+			speedHz = uint32(s)
+		}
+	}
+
+	rx := make([]byte, len(tx))
+	transfer := spiIOCTransfer{
+		txBuf:       uint64(uintptr(unsafe.Pointer(&tx[0]))),
+		rxBuf:       uint64(uintptr(unsafe.Pointer(&rx[0]))),
+		len:         uint32(len(tx)), //nolint:gosec
+		speedHz:     speedHz,
+		bitsPerWord: d.bitsPerWord,
+	}
+
+	d.lock.Lock()
+	err := ioctl(d.file.Fd(), spiIOCMessage1, unsafe.Pointer(&transfer))
+	d.lock.Unlock()
+	runtime.KeepAlive(tx)
+	runtime.KeepAlive(rx)
+	if err != nil {
+		res(nil, []any{3, "Failed to transfer on SPI device: " + err.Error()})
+		return
+	}
+	res(rx, nil)
+}
@@ -0,0 +1,91 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package spiapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, rpc *msgpackrpc.Connection, params ...any) (any, any) {
+	var result, reqErr any
+	handler(rpc, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestSPIParams(t *testing.T) {
+	dir := t.TempDir()
+	devicePath = filepath.Join(dir, "spidev%d.%d")
+	// A regular file does not support the spidev ioctls, so the
+	// configuration of the device fails.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "spidev0.0"), nil, 0600))
+
+	owner := new(msgpackrpc.Connection)
+
+	_, reqErr := call(spiOpen, owner, 0)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(spiOpen, owner, 0, 0, 4)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(spiOpen, owner, 0, 0, 0, 1000000, 33)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(spiOpen, owner, 0, 1)
+	require.Equal(t, 3, reqErr.([]any)[0])
+	_, reqErr = call(spiOpen, owner, 0, 0, 3, 500000)
+	require.Equal(t, 3, reqErr.([]any)[0])
+	require.Equal(t, map[string]any{"open_devices": 0}, Stats())
+}
+
+func TestSPIHandles(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "spidev")
+	require.NoError(t, err)
+
+	owner := new(msgpackrpc.Connection)
+	other := new(msgpackrpc.Connection)
+
+	lock.Lock()
+	nextDeviceID++
+	handle := nextDeviceID
+	openDevices[handle] = &device{file: f, owner: owner, speedHz: DefaultSpeedHz, bitsPerWord: DefaultBitsPerWord}
+	lock.Unlock()
+	require.Equal(t, map[string]any{"open_devices": 1}, Stats())
+
+	// Only the owner can use the device
+	_, reqErr := call(spiTransfer, other, handle, []byte{1})
+	require.Equal(t, 2, reqErr.([]any)[0])
+	_, reqErr = call(spiTransfer, owner, handle, []byte{})
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(spiTransfer, owner, handle, make([]byte, maxTransferSize+1))
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(spiTransfer, owner, handle, []byte{1}, 0)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(spiTransfer, owner, handle, []byte{1})
+	require.Equal(t, 3, reqErr.([]any)[0])
+
+	_, reqErr = call(spiClose, other, handle)
+	require.Equal(t, 2, reqErr.([]any)[0])
+	closeOwnedBy(other)
+	require.Equal(t, map[string]any{"open_devices": 1}, Stats())
+	closeOwnedBy(owner)
+	require.Equal(t, map[string]any{"open_devices": 0}, Stats())
+	_, reqErr = call(spiClose, owner, handle)
+	require.Equal(t, 2, reqErr.([]any)[0])
+}
@@ -0,0 +1,174 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package sysapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// Host configuration files
+var (
+	localtimePath  = "/etc/localtime"
+	localeConfPath = "/etc/locale.conf"
+)
+
+// Commands changing the host configuration, the new value is appended
+var (
+	setTimezoneCommand = []string{"timedatectl", "set-timezone"}
+	setLocaleCommand   = []string{"localectl", "set-locale"}
+)
+
+// validLocale matches the locale names, e.g. en_US.UTF-8 or sr_RS@latin.
+var validLocale = regexp.MustCompile(`^[A-Za-z]{2,3}(_[A-Za-z0-9]+)?(\.[A-Za-z0-9-]+)?(@[A-Za-z0-9]+)?$|^C(\.UTF-8)?$|^POSIX$`)
+
+// registerHost registers the host configuration methods with the router.
+func registerHost(router *msgpackrouter.Router) {
+	_ = router.RegisterMethod("sys/env", sysEnv)
+	_ = router.RegisterMethod("sys/timezone", sysTimezone)
+	_ = router.RegisterMethod("sys/locale", sysLocale)
+}
+
+// sysEnv returns the value of the environment variable of the router, if in
+// the allow list.
+func sysEnv(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected variable name"})
+		return
+	}
+	name, ok := params[0].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected string for variable name"})
+		return
+	}
+	if !slices.Contains(config.EnvAllowList, name) {
+		res(nil, []any{1, "Environment variable not allowed: " + name})
+		return
+	}
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		res(nil, []any{2, "Environment variable not set: " + name})
+		return
+	}
+	res(value, nil)
+}
+
+// sysTimezone returns the timezone of the host, or sets it if a timezone
+// name (e.g. "Europe/Rome") is given.
+func sysTimezone(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	switch len(params) {
+	case 0:
+		tz, err := currentTimezone()
+		if err != nil {
+			res(nil, []any{3, "Failed to read timezone: " + err.Error()})
+			return
+		}
+		res(tz, nil)
+	case 1:
+		tz, ok := params[0].(string)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for timezone"})
+			return
+		}
+		if _, err := time.LoadLocation(tz); err != nil || tz == "" || tz == "Local" {
+			res(nil, []any{1, "Unknown timezone: " + tz})
+			return
+		}
+		slog.Info("Setting timezone", "timezone", tz)
+		if err := runCommand(append(slices.Clone(setTimezoneCommand), tz)...); err != nil {
+			res(nil, []any{3, "Failed to set timezone: " + err.Error()})
+			return
+		}
+		res(true, nil)
+	default:
+		res(nil, []any{1, "Invalid number of parameters, expected ([timezone])"})
+	}
+}
+
+// currentTimezone returns the timezone name from the /etc/localtime link.
+func currentTimezone() (string, error) {
+	target, err := os.Readlink(localtimePath)
+	if err != nil {
+		return "", err
+	}
+	_, tz, ok := strings.Cut(filepath.ToSlash(target), "zoneinfo/")
+	if !ok {
+		return "", fmt.Errorf("unexpected localtime link: %s", target)
+	}
+	return tz, nil
+}
+
+// sysLocale returns the system locale (LANG) of the host, or sets it if a
+// locale name (e.g. "it_IT.UTF-8") is given.
+func sysLocale(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	switch len(params) {
+	case 0:
+		locale, err := currentLocale()
+		if err != nil {
+			res(nil, []any{3, "Failed to read locale: " + err.Error()})
+			return
+		}
+		res(locale, nil)
+	case 1:
+		locale, ok := params[0].(string)
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected string for locale"})
+			return
+		}
+		if !validLocale.MatchString(locale) {
+			res(nil, []any{1, "Invalid locale: " + locale})
+			return
+		}
+		slog.Info("Setting locale", "locale", locale)
+		if err := runCommand(append(slices.Clone(setLocaleCommand), "LANG="+locale)...); err != nil {
+			res(nil, []any{3, "Failed to set locale: " + err.Error()})
+			return
+		}
+		res(true, nil)
+	default:
+		res(nil, []any{1, "Invalid number of parameters, expected ([locale])"})
+	}
+}
+
+// currentLocale returns the LANG setting of /etc/locale.conf.
+func currentLocale() (string, error) {
+	f, err := os.Open(localeConfPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "LANG="); ok {
+			return strings.Trim(value, `"'`), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("LANG not set")
+}
@@ -0,0 +1,86 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package sysapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, params ...any) (any, any) {
+	var result, reqErr any
+	handler(new(msgpackrpc.Connection), params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestEnv(t *testing.T) {
+	config = Config{EnvAllowList: []string{"ROUTER_TEST_VAR", "ROUTER_TEST_UNSET"}}
+	t.Setenv("ROUTER_TEST_VAR", "value")
+	t.Setenv("ROUTER_TEST_SECRET", "secret")
+
+	res, reqErr := call(sysEnv, "ROUTER_TEST_VAR")
+	require.Nil(t, reqErr)
+	require.Equal(t, "value", res)
+	_, reqErr = call(sysEnv, "ROUTER_TEST_UNSET")
+	require.Equal(t, 2, reqErr.([]any)[0])
+	_, reqErr = call(sysEnv, "ROUTER_TEST_SECRET")
+	require.Equal(t, 1, reqErr.([]any)[0])
+}
+
+func TestTimezoneAndLocale(t *testing.T) {
+	dir := t.TempDir()
+	localtimePath = filepath.Join(dir, "localtime")
+	localeConfPath = filepath.Join(dir, "locale.conf")
+	log := filepath.Join(dir, "log")
+	setTimezoneCommand = []string{"sh", "-c", `echo "$0" > ` + log}
+	setLocaleCommand = []string{"sh", "-c", `echo "$0" > ` + log}
+
+	_, reqErr := call(sysTimezone)
+	require.Equal(t, 3, reqErr.([]any)[0])
+	require.NoError(t, os.Symlink("/usr/share/zoneinfo/Europe/Rome", localtimePath))
+	res, reqErr := call(sysTimezone)
+	require.Nil(t, reqErr)
+	require.Equal(t, "Europe/Rome", res)
+
+	_, reqErr = call(sysTimezone, "Nowhere/City")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	res, reqErr = call(sysTimezone, "UTC")
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	data, err := os.ReadFile(log)
+	require.NoError(t, err)
+	require.Equal(t, "UTC\n", string(data))
+
+	require.NoError(t, os.WriteFile(localeConfPath, []byte("# Locale\nLANG=\"it_IT.UTF-8\"\nLC_TIME=C\n"), 0600))
+	res, reqErr = call(sysLocale)
+	require.Nil(t, reqErr)
+	require.Equal(t, "it_IT.UTF-8", res)
+
+	_, reqErr = call(sysLocale, "en_US.UTF-8; reboot")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	res, reqErr = call(sysLocale, "en_US.UTF-8")
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	data, err = os.ReadFile(log)
+	require.NoError(t, err)
+	require.Equal(t, "LANG=en_US.UTF-8\n", string(data))
+}
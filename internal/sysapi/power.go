@@ -0,0 +1,77 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package sysapi
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// powerCommands are the commands that perform the power transitions. They
+// only queue the transition, so that the response can reach the caller
+// before the router is stopped.
+var powerCommands = map[string][]string{
+	"reboot":   {"systemctl", "--no-block", "reboot"},
+	"poweroff": {"systemctl", "--no-block", "poweroff"},
+	"suspend":  {"systemctl", "--no-block", "suspend"},
+}
+
+// registerPower registers the power control methods with the router.
+func registerPower(router *msgpackrouter.Router) {
+	_ = router.RegisterMethod("sys/reboot", powerHandler(router, "reboot"))
+	_ = router.RegisterMethod("sys/poweroff", powerHandler(router, "poweroff"))
+	_ = router.RegisterMethod("sys/suspend", powerHandler(router, "suspend"))
+}
+
+// powerAllowed returns true if the caller may request a power transition:
+// only the MCU and the local processes running as one of the configured UIDs
+// are allowed.
+func powerAllowed(router *msgpackrouter.Router, rpc *msgpackrpc.Connection) bool {
+	info, ok := router.ConnectionInfo(rpc)
+	if !ok {
+		return false
+	}
+	if info.Role == msgpackrouter.RoleMCU {
+		return true
+	}
+	return info.PeerCredentials != nil && slices.Contains(config.PowerUIDs, info.PeerCredentials.UID)
+}
+
+// powerHandler returns the handler of the given power transition.
+func powerHandler(router *msgpackrouter.Router, transition string) msgpackrouter.RouterRequestHandler {
+	return func(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		if !powerAllowed(router, rpc) {
+			res(nil, []any{msgpackrouter.ErrCodeMethodNotAllowed, "Power transitions are allowed only to the MCU and to the configured local users"})
+			return
+		}
+		if len(params) != 0 {
+			res(nil, []any{1, "Invalid number of parameters, expected none"})
+			return
+		}
+		command := powerCommands[transition]
+		slog.Warn("Power transition requested", "transition", transition, "command", strings.Join(command, " "))
+		if err := runCommand(command...); err != nil {
+			slog.Error("Power transition failed", "transition", transition, "err", err)
+			res(nil, []any{3, "Failed to " + transition + ": " + err.Error()})
+			return
+		}
+		res(true, nil)
+	}
+}
@@ -0,0 +1,76 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package sysapi
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestPower(t *testing.T) {
+	defer func(c map[string][]string) { powerCommands = c }(powerCommands)
+	powerCommands = map[string][]string{
+		"reboot":   {"true"},
+		"poweroff": {"sh", "-c", "echo 'Access denied' >&2; exit 1"},
+	}
+
+	defer func(c Config) { config = c }(config)
+	config = Config{PowerUIDs: []int{1000}}
+
+	router := msgpackrouter.New(0)
+	mcu := acceptConnection(t, router, msgpackrouter.ConnectionInfo{Transport: "serial", Role: msgpackrouter.RoleMCU})
+	allowedUser := acceptConnection(t, router, msgpackrouter.ConnectionInfo{Transport: "unix", Role: msgpackrouter.RoleLocalService, PeerCredentials: &msgpackrouter.PeerCredentials{PID: 10, UID: 1000, GID: 1000}})
+	otherUser := acceptConnection(t, router, msgpackrouter.ConnectionInfo{Transport: "unix", Role: msgpackrouter.RoleLocalService, PeerCredentials: &msgpackrouter.PeerCredentials{PID: 11, UID: 1001, GID: 1001}})
+	tcpService := acceptConnection(t, router, msgpackrouter.ConnectionInfo{Transport: "tcp", Role: msgpackrouter.RoleLocalService})
+
+	var result, reqErr any
+	res := func(r, e any) { result, reqErr = r, e }
+
+	powerHandler(router, "reboot")(mcu, []any{}, res)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+
+	powerHandler(router, "reboot")(allowedUser, []any{}, res)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, result)
+
+	powerHandler(router, "reboot")(mcu, []any{1}, res)
+	require.Equal(t, 1, reqErr.([]any)[0])
+
+	powerHandler(router, "poweroff")(mcu, []any{}, res)
+	require.Equal(t, []any{3, "Failed to poweroff: Access denied"}, reqErr)
+
+	// The other local services are not allowed
+	for _, conn := range []*msgpackrpc.Connection{otherUser, tcpService, new(msgpackrpc.Connection)} {
+		result, reqErr = nil, nil
+		powerHandler(router, "reboot")(conn, []any{}, res)
+		require.Nil(t, result)
+		require.Equal(t, msgpackrouter.ErrCodeMethodNotAllowed, reqErr.([]any)[0])
+	}
+}
+
+// acceptConnection connects a client to the router with the given info.
+func acceptConnection(t *testing.T, router *msgpackrouter.Router, info msgpackrouter.ConnectionInfo) *msgpackrpc.Connection {
+	clientEnd, routerEnd := net.Pipe()
+	t.Cleanup(func() { clientEnd.Close() })
+	conn, _ := router.AcceptConnectionWithInfo(routerEnd, info)
+	return conn
+}
@@ -0,0 +1,64 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package sysapi
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+// commandTimeout is the maximum duration of the system commands.
+const commandTimeout = 10 * time.Second
+
+// DefaultEnvAllowList are the environment variables readable with sys/env
+// by default.
+var DefaultEnvAllowList = []string{"LANG", "TZ"}
+
+// Config is the configuration of the system API.
+type Config struct {
+	// EnvAllowList are the environment variables readable with sys/env.
+	EnvAllowList []string
+	// PowerUIDs are the UIDs of the local processes, connected to the Unix
+	// socket, allowed to request the power transitions besides the MCU.
+	PowerUIDs []int
+}
+
+var config Config
+
+// Register registers the system API methods with the router.
+func Register(router *msgpackrouter.Router, cfg Config) {
+	config = cfg
+	registerPower(router)
+	registerHost(router)
+}
+
+// runCommand runs the command and returns its output as error if it fails.
+func runCommand(args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package telemetryapi provides the telemetry/ methods: the MCU pushes
+// structured samples, that the router timestamps and buffers in a file so
+// that the clients can download them later, separately from the raw text
+// stream of the monitor.
+package telemetryapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// defaultQueryLimit and maxQueryLimit are the default and the maximum number
+// of samples returned by telemetry/query.
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+// Options are the settings of the Telemetry API.
+type Options struct {
+	// File is the file where the samples are appended, rotated to File+".1"
+	// when it exceeds MaxFileSize.
+	File string
+	// MaxFileSize is the maximum size in bytes of the file.
+	MaxFileSize int64
+}
+
+// sample is a buffered telemetry sample, stored as a MessagePack array.
+type sample struct {
+	_msgpack struct{} `msgpack:",as_array"` //nolint:unused
+
+	// Seq is the sequence number of the sample, increasing across the
+	// restarts of the router.
+	Seq uint64
+	// Time is the time the sample was received in milliseconds since the
+	// epoch.
+	Time int64
+	// Data is the map pushed by the MCU.
+	Data msgpack.RawMessage
+}
+
+// Service is an instance of the Telemetry API, buffering the samples in its
+// file.
+type Service struct {
+	opts Options
+
+	lock     sync.Mutex
+	file     *os.File
+	fileSize int64
+	lastSeq  uint64
+
+	pushed      atomic.Uint64
+	writeErrors atomic.Uint64
+}
+
+// New creates an instance of the Telemetry API with the given options.
+func New(opts Options) *Service {
+	return &Service{opts: opts}
+}
+
+// Register opens the file of the samples, and registers the Telemetry API
+// methods. The sequence numbers go on from the last sample of the file.
+func (s *Service) Register(router *msgpackrouter.Router) error {
+	if err := os.MkdirAll(filepath.Dir(s.opts.File), 0750); err != nil {
+		return fmt.Errorf("failed to create telemetry directory: %w", err)
+	}
+	f, err := os.OpenFile(s.opts.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open telemetry file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open telemetry file: %w", err)
+	}
+	s.lock.Lock()
+	s.file = f
+	s.fileSize = info.Size()
+	if samples := s.readSamples(); len(samples) > 0 {
+		s.lastSeq = samples[len(samples)-1].Seq
+	}
+	s.lock.Unlock()
+	_ = router.RegisterMethod("telemetry/push", s.push)
+	_ = router.RegisterMethod("telemetry/query", s.query)
+	return nil
+}
+
+// Close closes the file of the samples, the samples pushed afterwards are
+// rejected.
+func (s *Service) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// Stats returns the number of samples pushed, of the failed writes, the
+// size of the file and the sequence number of the last sample.
+func (s *Service) Stats() map[string]any {
+	s.lock.Lock()
+	size, lastSeq := s.fileSize, s.lastSeq
+	s.lock.Unlock()
+	return map[string]any{
+		"samples":      s.pushed.Load(),
+		"write_errors": s.writeErrors.Load(),
+		"file_size":    size,
+		"last_seq":     lastSeq,
+	}
+}
+
+// push implements telemetry/push: it stores the map passed as parameter,
+// with the current time, and returns its sequence number.
+func (s *Service) push(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected the sample"})
+		return
+	}
+	switch params[0].(type) {
+	case map[string]any, map[any]any:
+	default:
+		res(nil, []any{1, "Invalid parameter type, expected map for the sample"})
+		return
+	}
+	data, err := msgpack.Marshal(params[0])
+	if err != nil {
+		res(nil, []any{1, "Invalid sample: " + err.Error()})
+		return
+	}
+	seq, err := s.write(time.Now(), data)
+	if err != nil {
+		s.writeErrors.Add(1)
+		res(nil, []any{3, "Failed to store the sample: " + err.Error()})
+		return
+	}
+	s.pushed.Add(1)
+	res(seq, nil)
+}
+
+// write appends the sample to the file, rotating it if needed, and returns
+// its sequence number.
+func (s *Service) write(now time.Time, data []byte) (uint64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return 0, errors.New("telemetry file closed")
+	}
+	encoded, err := msgpack.Marshal(&sample{Seq: s.lastSeq + 1, Time: now.UnixMilli(), Data: data})
+	if err != nil {
+		return 0, err
+	}
+	if s.fileSize > 0 && s.fileSize+int64(len(encoded)) > s.opts.MaxFileSize {
+		if err := s.rotate(); err != nil {
+			slog.Warn("Failed to rotate telemetry file", "file", s.opts.File, "err", err)
+			return 0, err
+		}
+	}
+	n, err := s.file.Write(encoded)
+	s.fileSize += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	s.lastSeq++
+	return s.lastSeq, nil
+}
+
+// rotate renames the file to File+".1", replacing the previous one, and
+// starts a new file. It must be called with the lock held.
+func (s *Service) rotate() error {
+	s.file.Close()
+	s.file = nil
+	if err := os.Rename(s.opts.File, s.opts.File+".1"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.opts.File, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.fileSize = 0
+	return nil
+}
+
+// readSamples returns the samples of the files, from the oldest. The
+// incomplete sample at the end of a file, written when the router was
+// stopped, is ignored. It must be called with the lock held.
+func (s *Service) readSamples() []sample {
+	var samples []sample
+	for _, path := range []string{s.opts.File + ".1", s.opts.File} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		d := msgpack.NewDecoder(bytes.NewReader(data))
+		for {
+			var e sample
+			if err := d.Decode(&e); err != nil {
+				if !errors.Is(err, io.EOF) {
+					slog.Debug("Invalid telemetry sample", "file", path, "err", err)
+				}
+				break
+			}
+			samples = append(samples, e)
+		}
+	}
+	return samples
+}
+
+// query implements telemetry/query: it returns the samples with a sequence
+// number greater than after (0 by default), from the oldest, at most limit
+// (100 by default). A client downloads all the samples calling it again
+// with the sequence number of the last sample received.
+func (s *Service) query(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) > 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected ([after[, limit]])"})
+		return
+	}
+	var after uint64
+	if len(params) >= 1 {
+		a, ok := msgpackrpc.ToUint(params[0])
+		if !ok {
+			res(nil, []any{1, "Invalid parameter type, expected positive int for the sequence number"})
+			return
+		}
+		after = uint64(a)
+	}
+	limit := defaultQueryLimit
+	if len(params) == 2 {
+		l, ok := msgpackrpc.ToUint(params[1])
+		if !ok || l == 0 || l > maxQueryLimit {
+			res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected limit between 1 and %d", maxQueryLimit)})
+			return
+		}
+		limit = int(l) //nolint:gosec
+	}
+
+	s.lock.Lock()
+	samples := s.readSamples()
+	s.lock.Unlock()
+	result := []any{}
+	for _, e := range samples {
+		if e.Seq <= after {
+			continue
+		}
+		if len(result) == limit {
+			break
+		}
+		data, err := msgpackrpc.RawMessage(e.Data).Decode()
+		if err != nil {
+			continue
+		}
+		result = append(result, map[string]any{
+			"seq":    e.Seq,
+			"time":   time.UnixMilli(e.Time).UTC().Format(time.RFC3339Nano),
+			"sample": data,
+		})
+	}
+	res(result, nil)
+}
@@ -0,0 +1,133 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package telemetryapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, params ...any) (any, any) {
+	var result, reqErr any
+	handler(nil, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestTelemetry(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "telemetry", "samples")
+	s := New(Options{File: file, MaxFileSize: 1 << 20})
+	require.NoError(t, s.Register(msgpackrouter.New(0)))
+
+	// The samples are timestamped and numbered
+	before := time.Now().Truncate(time.Millisecond)
+	seq, reqErr := call(s.push, map[string]any{"temp": 21.5})
+	require.Nil(t, reqErr)
+	require.Equal(t, uint64(1), seq)
+	seq, reqErr = call(s.push, map[string]any{"led": "on"})
+	require.Nil(t, reqErr)
+	require.Equal(t, uint64(2), seq)
+
+	result, reqErr := call(s.query)
+	require.Nil(t, reqErr)
+	samples := result.([]any)
+	require.Len(t, samples, 2)
+	first := samples[0].(map[string]any)
+	require.Equal(t, uint64(1), first["seq"])
+	require.Equal(t, map[string]any{"temp": 21.5}, first["sample"])
+	received, err := time.Parse(time.RFC3339Nano, first["time"].(string))
+	require.NoError(t, err)
+	require.False(t, received.Before(before))
+
+	// The samples after a sequence number are returned, at most limit
+	result, reqErr = call(s.query, 1, 10)
+	require.Nil(t, reqErr)
+	require.Len(t, result, 1)
+	require.Equal(t, uint64(2), result.([]any)[0].(map[string]any)["seq"])
+	result, _ = call(s.query, 0, 1)
+	require.Len(t, result, 1)
+	result, _ = call(s.query, 2)
+	require.Equal(t, []any{}, result)
+	require.Equal(t, uint64(2), s.Stats()["samples"])
+	s.Close()
+	_, reqErr = call(s.push, map[string]any{"temp": 22})
+	require.Equal(t, 3, reqErr.([]any)[0])
+
+	// The samples are kept across the restarts, and the sequence numbers go
+	// on from the last one
+	s = New(Options{File: file, MaxFileSize: 1 << 20})
+	require.NoError(t, s.Register(msgpackrouter.New(0)))
+	defer s.Close()
+	seq, reqErr = call(s.push, map[string]any{"temp": 22})
+	require.Nil(t, reqErr)
+	require.Equal(t, uint64(3), seq)
+	result, _ = call(s.query)
+	require.Len(t, result, 3)
+}
+
+func TestTelemetryParams(t *testing.T) {
+	s := New(Options{File: filepath.Join(t.TempDir(), "samples"), MaxFileSize: 1 << 20})
+	require.NoError(t, s.Register(msgpackrouter.New(0)))
+	defer s.Close()
+	_, reqErr := call(s.push)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.push, "text")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.query, "x")
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.query, 0, 0)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(s.query, 0, 1, 2)
+	require.Equal(t, 1, reqErr.([]any)[0])
+}
+
+func TestTelemetryRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "samples")
+	s := New(Options{File: file, MaxFileSize: 100})
+	require.NoError(t, s.Register(msgpackrouter.New(0)))
+	defer s.Close()
+
+	for range 20 {
+		_, reqErr := call(s.push, map[string]any{"temp": 21.5})
+		require.Nil(t, reqErr)
+	}
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Size(), int64(100))
+	_, err = os.Stat(file + ".1")
+	require.NoError(t, err)
+
+	// The oldest samples are dropped, the others are still returned
+	result, reqErr := call(s.query)
+	require.Nil(t, reqErr)
+	samples := result.([]any)
+	require.Less(t, len(samples), 20)
+	require.Equal(t, uint64(20), samples[len(samples)-1].(map[string]any)["seq"])
+
+	// An incomplete sample at the end of the file is ignored
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x93, 0xcf})
+	require.NoError(t, err)
+	f.Close()
+	result, _ = call(s.query)
+	require.Len(t, result, len(samples))
+}
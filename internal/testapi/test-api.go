@@ -0,0 +1,159 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package testapi implements the test/* methods, deterministic endpoints
+// used to validate the RPC client implementations (for example an MCU
+// firmware) against the router.
+package testapi
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// BurstMethod is the notification method used to send the notifications
+// requested with test/burst, with the sequence number (starting from 0) and
+// the payload as parameters.
+const BurstMethod = "test/notification"
+
+// maxDelay is the maximum delay of test/delay.
+const maxDelay = time.Minute
+
+// maxBurstCount is the maximum number of notifications of test/burst.
+const maxBurstCount = 10000
+
+// maxPayloadSize is the maximum size of the payload of test/burst.
+const maxPayloadSize = 64 * 1024
+
+var activeBursts atomic.Int64
+
+// Register registers the test API methods with the router.
+func Register(router *msgpackrouter.Router) {
+	_ = router.RegisterMethod("test/echo", testEcho)
+	_ = router.RegisterMethodWithContext("test/delay", testDelay)
+	_ = router.RegisterMethod("test/error", testError)
+	_ = router.RegisterMethod("test/burst", testBurst)
+}
+
+// Stats returns the number of test/burst in progress.
+func Stats() map[string]any {
+	return map[string]any{
+		"active_bursts": activeBursts.Load(),
+	}
+}
+
+// testEcho returns its params.
+func testEcho(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	res(params, nil)
+}
+
+// testDelay returns after the given number of ms, with the optional second
+// param as result (true by default).
+func testDelay(ctx context.Context, _ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 && len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (delay in ms[, result])"})
+		return
+	}
+	ms, ok := msgpackrpc.ToUint(params[0])
+	if !ok || time.Duration(ms)*time.Millisecond > maxDelay {
+		res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected delay in ms (at most %d)", maxDelay.Milliseconds())})
+		return
+	}
+	var result any = true
+	if len(params) == 2 {
+		result = params[1]
+	}
+
+	go func() {
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+			res(result, nil)
+		case <-ctx.Done():
+			res(nil, []any{3, "Request canceled"})
+		}
+	}()
+}
+
+// testError fails with the given error code and message.
+func testError(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 {
+		res(nil, []any{1, "Invalid number of parameters, expected (error code, message)"})
+		return
+	}
+	code, ok := msgpackrpc.ToInt(params[0])
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected int for error code"})
+		return
+	}
+	message, ok := params[1].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected string for message"})
+		return
+	}
+	res(nil, []any{code, message})
+}
+
+// testBurst sends the given number of BurstMethod notifications to the
+// caller, one every given number of ms (0 = as fast as possible), with a
+// payload of the given size (0 by default). The payload bytes are the
+// offsets modulo 256. It returns before the notifications are sent.
+func testBurst(rpc *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 2 && len(params) != 3 {
+		res(nil, []any{1, "Invalid number of parameters, expected (count, interval in ms[, payload size])"})
+		return
+	}
+	count, ok := msgpackrpc.ToUint(params[0])
+	if !ok || count > maxBurstCount {
+		res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected count (at most %d)", maxBurstCount)})
+		return
+	}
+	ms, ok := msgpackrpc.ToUint(params[1])
+	if !ok || time.Duration(ms)*time.Millisecond > maxDelay {
+		res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected interval in ms (at most %d)", maxDelay.Milliseconds())})
+		return
+	}
+	size := uint(0)
+	if len(params) == 3 {
+		if size, ok = msgpackrpc.ToUint(params[2]); !ok || size > maxPayloadSize {
+			res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected payload size (at most %d)", maxPayloadSize)})
+			return
+		}
+	}
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	res(true, nil)
+	activeBursts.Add(1)
+	go func() {
+		defer activeBursts.Add(-1)
+		interval := time.Duration(ms) * time.Millisecond
+		for seq := range count {
+			if seq > 0 && interval > 0 {
+				time.Sleep(interval)
+			}
+			// Stop if the caller is disconnected
+			if err := rpc.SendNotification(BurstMethod, seq, payload); err != nil {
+				return
+			}
+		}
+	}()
+}
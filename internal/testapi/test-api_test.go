@@ -0,0 +1,122 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package testapi
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func call(handler msgpackrouter.RouterRequestHandler, rpc *msgpackrpc.Connection, params ...any) (any, any) {
+	var result, reqErr any
+	handler(rpc, params, func(r, e any) { result, reqErr = r, e })
+	return result, reqErr
+}
+
+func TestEchoAndError(t *testing.T) {
+	res, reqErr := call(testEcho, nil, 1, "two", []byte{3})
+	require.Nil(t, reqErr)
+	require.Equal(t, []any{1, "two", []byte{3}}, res)
+
+	res, reqErr = call(testError, nil, 42, "failure")
+	require.Nil(t, res)
+	require.Equal(t, []any{42, "failure"}, reqErr)
+	_, reqErr = call(testError, nil, "42", "failure")
+	require.Equal(t, 1, reqErr.([]any)[0])
+}
+
+func TestDelay(t *testing.T) {
+	delay := func(ctx context.Context, params ...any) (any, any) {
+		done := make(chan []any, 1)
+		testDelay(ctx, nil, params, func(r, e any) { done <- []any{r, e} })
+		select {
+		case r := <-done:
+			return r[0], r[1]
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no response")
+			return nil, nil
+		}
+	}
+
+	start := time.Now()
+	res, reqErr := delay(context.Background(), 50, "late")
+	require.Nil(t, reqErr)
+	require.Equal(t, "late", res)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	res, reqErr = delay(context.Background(), 0)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+
+	_, reqErr = delay(context.Background(), maxDelay.Milliseconds()+1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+
+	// A canceled request returns immediately
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, reqErr = delay(ctx, maxDelay.Milliseconds())
+	require.Equal(t, []any{3, "Request canceled"}, reqErr)
+}
+
+func TestBurst(t *testing.T) {
+	routerSide, clientSide := net.Pipe()
+	caller := msgpackrpc.NewConnection(routerSide, routerSide, nil, nil, nil)
+	notifications := make(chan []any, 10)
+	client := msgpackrpc.NewConnection(clientSide, clientSide, nil, func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		if method == BurstMethod {
+			notifications <- params
+		}
+	}, func(err error) {})
+	go client.Run()
+	defer client.Close()
+
+	_, reqErr := call(testBurst, caller, maxBurstCount+1, 0)
+	require.Equal(t, 1, reqErr.([]any)[0])
+	_, reqErr = call(testBurst, caller, 1, 0, maxPayloadSize+1)
+	require.Equal(t, 1, reqErr.([]any)[0])
+
+	res, reqErr := call(testBurst, caller, 3, 1, 300)
+	require.Nil(t, reqErr)
+	require.Equal(t, true, res)
+	for seq := range 3 {
+		select {
+		case params := <-notifications:
+			require.Len(t, params, 2)
+			require.EqualValues(t, seq, params[0])
+			payload := params[1].([]byte)
+			require.Len(t, payload, 300)
+			require.Equal(t, byte(299%256), payload[299])
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "notification not received")
+		}
+	}
+
+	// The burst stops when the caller disconnects
+	_, reqErr = call(testBurst, caller, maxBurstCount, 10)
+	require.Nil(t, reqErr)
+	<-notifications
+	caller.Close()
+	require.Eventually(t, func() bool {
+		return Stats()["active_bursts"] == int64(0)
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,198 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// exportQueueSize is the number of spans that can be queued for export,
+	// further spans are dropped.
+	exportQueueSize = 2048
+	// exportBatchSize is the maximum number of spans sent in a single request.
+	exportBatchSize = 256
+	// exportInterval is the maximum delay before the queued spans are sent.
+	exportInterval = 5 * time.Second
+)
+
+type endedSpan struct {
+	*Span
+	end time.Time
+	err string
+}
+
+type exporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	queue       chan endedSpan
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+func newExporter(endpoint string, serviceName string) *exporter {
+	return &exporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan endedSpan, exportQueueSize),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+func (e *exporter) export(s endedSpan) {
+	select {
+	case e.queue <- s:
+	default:
+		slog.Debug("Tracing queue full, span dropped", "span", s.name)
+	}
+}
+
+func (e *exporter) stop() {
+	close(e.done)
+	<-e.stopped
+}
+
+func (e *exporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []endedSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			slog.Warn("Failed to export traces", "url", e.url, "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.done:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *exporter) send(batch []endedSpan) error {
+	data, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// encode returns the OTLP/JSON ExportTraceServiceRequest for the given spans.
+func (e *exporter) encode(batch []endedSpan) map[string]any {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		s.lock.Lock()
+		attrs := encodeAttributes(s.attrs)
+		s.lock.Unlock()
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              int(s.kind),
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        attrs,
+		}
+		if s.parentID != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			span["status"] = map[string]any{"code": 2, "message": s.err}
+		}
+		spans = append(spans, span)
+	}
+	return map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": encodeAttributes([]any{"service.name", e.serviceName}),
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{"name": "github.com/arduino/arduino-router"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func encodeAttributes(kv []any) []any {
+	attrs := make([]any, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var value map[string]any
+		switch v := kv[i+1].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case uint64:
+			value = map[string]any{"intValue": strconv.FormatUint(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		attrs = append(attrs, map[string]any{"key": key, "value": value})
+	}
+	return attrs
+}
@@ -0,0 +1,171 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package tracing records OpenTelemetry spans and exports them to an OTLP
+// collector using the OTLP/HTTP protocol with JSON encoding.
+package tracing
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind is the kind of a span, as defined by OpenTelemetry.
+type Kind int
+
+// Span kinds
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is an operation being traced. A nil *Span is valid and does nothing,
+// it is returned by StartSpan when tracing is disabled.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     Kind
+	start    time.Time
+
+	lock  sync.Mutex
+	attrs []any
+	ended bool
+}
+
+var exp atomic.Pointer[exporter]
+
+// current holds the span of the request being handled by a connection.
+var current sync.Map
+
+// Enable starts exporting the spans to the OTLP/HTTP collector at the given
+// endpoint (for example "http://localhost:4318").
+func Enable(endpoint string, serviceName string) {
+	e := newExporter(endpoint, serviceName)
+	if old := exp.Swap(e); old != nil {
+		old.stop()
+	}
+	go e.run()
+}
+
+// Disable stops exporting the spans, the pending spans are flushed.
+func Disable() {
+	if old := exp.Swap(nil); old != nil {
+		old.stop()
+	}
+}
+
+// Enabled returns true if the spans are being exported.
+func Enabled() bool {
+	return exp.Load() != nil
+}
+
+// StartSpan starts a new span, child of parent if not nil. The attributes
+// are given as key-value pairs. It returns nil if tracing is disabled.
+func StartSpan(name string, kind Kind, parent *Span, attrs ...any) *Span {
+	if !Enabled() {
+		return nil
+	}
+	s := &Span{
+		name:  name,
+		kind:  kind,
+		start: time.Now(),
+		attrs: attrs,
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return s
+}
+
+// SetAttributes adds the given key-value pairs to the span attributes.
+func (s *Span) SetAttributes(attrs ...any) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.lock.Unlock()
+}
+
+// End ends the span, err is the error of the operation (nil if successful).
+func (s *Span) End(err any) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.lock.Unlock()
+
+	e := exp.Load()
+	if e == nil {
+		return
+	}
+	var errMsg string
+	if err != nil {
+		errMsg = fmt.Sprint(err)
+		if errMsg == "" {
+			errMsg = "error"
+		}
+	}
+	e.export(endedSpan{Span: s, end: time.Now(), err: errMsg})
+}
+
+// TraceID returns the hex encoded trace ID of the span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", s.traceID)
+}
+
+// SetCurrent sets s as the span of the request being handled by the given
+// connection, and returns a function to restore the previous one.
+func SetCurrent(conn any, s *Span) (restore func()) {
+	if s == nil {
+		return func() {}
+	}
+	prev, hadPrev := current.Swap(conn, s)
+	return func() {
+		if hadPrev {
+			current.Store(conn, prev)
+		} else {
+			current.Delete(conn)
+		}
+	}
+}
+
+// Current returns the span of the request being handled by the given
+// connection, or nil. If the connection handles several requests
+// concurrently the span of the latest one is returned.
+func Current(conn any) *Span {
+	if s, ok := current.Load(conn); ok {
+		return s.(*Span)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracing(t *testing.T) {
+	// Disabled tracing returns nil spans, that can be used safely
+	span := StartSpan("disabled", KindServer, nil)
+	require.Nil(t, span)
+	span.SetAttributes("key", "value")
+	span.End(nil)
+
+	var lock sync.Mutex
+	var requests []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var req map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		lock.Lock()
+		requests = append(requests, req)
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	Enable(server.URL, "test-service")
+	parent := StartSpan("$/version", KindServer, nil, "rpc.method", "$/version")
+	require.NotNil(t, parent)
+	conn := new(int)
+	restore := SetCurrent(conn, parent)
+	require.Equal(t, parent, Current(conn))
+	child := StartSpan("tcp connect", KindClient, Current(conn), "bytes", 42)
+	child.End(errors.New("connection refused"))
+	restore()
+	require.Nil(t, Current(conn))
+	parent.End(nil)
+	parent.End(nil) // ending twice is ignored
+	Disable()       // flushes the pending spans
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, requests, 1)
+	resourceSpans := requests[0]["resourceSpans"].([]any)[0].(map[string]any)
+	require.Equal(t,
+		[]any{map[string]any{"key": "service.name", "value": map[string]any{"stringValue": "test-service"}}},
+		resourceSpans["resource"].(map[string]any)["attributes"])
+	spans := resourceSpans["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	require.Len(t, spans, 2)
+
+	c := spans[0].(map[string]any)
+	p := spans[1].(map[string]any)
+	require.Equal(t, "tcp connect", c["name"])
+	require.Equal(t, float64(KindClient), c["kind"])
+	require.Equal(t, parent.TraceID(), c["traceId"])
+	require.Equal(t, p["spanId"], c["parentSpanId"])
+	require.Equal(t, map[string]any{"code": float64(2), "message": "connection refused"}, c["status"])
+	require.Equal(t, []any{map[string]any{"key": "bytes", "value": map[string]any{"intValue": "42"}}}, c["attributes"])
+
+	require.Equal(t, "$/version", p["name"])
+	require.Equal(t, float64(KindServer), p["kind"])
+	require.Equal(t, parent.TraceID(), p["traceId"])
+	require.NotContains(t, p, "parentSpanId")
+	require.NotContains(t, p, "status")
+}
@@ -0,0 +1,179 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// logLevel is the current log level.
+var logLevel slog.LevelVar
+
+// setupLogging configures the default logger with the given format ("text"
+// or "json") and output file (stderr if empty).
+func setupLogging(cfg Config) error {
+	var out io.Writer = os.Stderr
+	if cfg.LogFile != "" {
+		f, err := newRotatingFile(cfg.LogFile, int64(cfg.LogMaxSizeMB)*1024*1024, cfg.LogMaxBackups)
+		if err != nil {
+			return fmt.Errorf("opening log file: %w", err)
+		}
+		out = f
+	}
+
+	logLevel.Set(cfg.LogLevel)
+	switch cfg.LogFormat {
+	case "text":
+		log.SetOutput(out)
+		slog.SetLogLoggerLevel(cfg.LogLevel)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: &logLevel})))
+	default:
+		return fmt.Errorf("invalid log format: %s", cfg.LogFormat)
+	}
+	return nil
+}
+
+// setLogLevel changes the log level at runtime and returns the previous level.
+func setLogLevel(level slog.Level) slog.Level {
+	previous := logLevel.Level()
+	logLevel.Set(level)
+	slog.SetLogLoggerLevel(level)
+	if previous != level {
+		slog.Log(context.Background(), max(level, slog.LevelInfo), "Log level changed", "level", level, "previous", previous)
+	}
+	return previous
+}
+
+// toggleDebugLogOnSignal switches the log level between Info and Debug each
+// time the given signal is received.
+func toggleDebugLogOnSignal(sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	go func() {
+		for range signals {
+			if logLevel.Level() == slog.LevelDebug {
+				setLogLevel(slog.LevelInfo)
+			} else {
+				setLogLevel(slog.LevelDebug)
+			}
+		}
+	}()
+}
+
+// logSetLevel implements $/log/setLevel: it changes the log level to the
+// given one ("debug", "info", "warn" or "error") and returns the previous.
+func logSetLevel(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	if len(params) != 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected log level"})
+		return
+	}
+	name, ok := params[0].(string)
+	if !ok {
+		res(nil, []any{1, "Invalid parameter type, expected string"})
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		res(nil, []any{1, "Invalid log level: " + name})
+		return
+	}
+	previous := setLogLevel(level)
+	res(strings.ToLower(previous.String()), nil)
+}
+
+// rotatingFile is a log file that is rotated when it exceeds maxSize bytes.
+// The rotated files are renamed with the suffixes .1, .2... (.1 being the
+// most recent) and at most maxBackups of them are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	if r.maxBackups > 0 {
+		_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
@@ -0,0 +1,75 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "router.log")
+	f, err := newRotatingFile(path, 10, 2)
+	require.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	read := func(path string) string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(data)
+	}
+	require.Equal(t, "fourth\n", read(path))
+	require.Equal(t, "third\n", read(path+".1"))
+	require.Equal(t, "second\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+
+	// Lines longer than the maximum size are written anyway
+	_, err = f.Write([]byte(strings.Repeat("x", 20)))
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("x", 20), read(path))
+}
+
+func TestLogSetLevel(t *testing.T) {
+	t.Cleanup(func() { setLogLevel(slog.LevelInfo) })
+	setLogLevel(slog.LevelInfo)
+
+	var result, resErr any
+	res := func(r any, e any) { result, resErr = r, e }
+	logSetLevel(nil, []any{"debug"}, res)
+	require.Nil(t, resErr)
+	require.Equal(t, "info", result)
+	require.Equal(t, slog.LevelDebug, logLevel.Level())
+
+	logSetLevel(nil, []any{"WARN"}, res)
+	require.Nil(t, resErr)
+	require.Equal(t, "debug", result)
+	require.Equal(t, slog.LevelWarn, logLevel.Level())
+
+	logSetLevel(nil, []any{"verbose"}, res)
+	require.Equal(t, []any{1, "Invalid log level: verbose"}, resErr)
+	logSetLevel(nil, []any{}, res)
+	require.NotNil(t, resErr)
+}
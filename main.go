@@ -16,27 +16,37 @@
 package main
 
 import (
-	"cmp"
-	"encoding/hex"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log/slog"
-	"net"
 	"os"
 	"os/signal"
-	"sync"
+	"slices"
 	"syscall"
 	"time"
 
+	"github.com/arduino/arduino-router/internal/adcapi"
+	"github.com/arduino/arduino-router/internal/cloudapi"
+	"github.com/arduino/arduino-router/internal/fsapi"
 	"github.com/arduino/arduino-router/internal/hciapi"
+	"github.com/arduino/arduino-router/internal/i2capi"
+	"github.com/arduino/arduino-router/internal/logsapi"
 	"github.com/arduino/arduino-router/internal/monitorapi"
 	"github.com/arduino/arduino-router/internal/msgpackrouter"
 	networkapi "github.com/arduino/arduino-router/internal/network-api"
+	"github.com/arduino/arduino-router/internal/otaapi"
+	"github.com/arduino/arduino-router/internal/pubsubapi"
+	"github.com/arduino/arduino-router/internal/replay"
+	"github.com/arduino/arduino-router/internal/schedapi"
+	"github.com/arduino/arduino-router/internal/serialapi"
+	"github.com/arduino/arduino-router/internal/spiapi"
+	"github.com/arduino/arduino-router/internal/sysapi"
+	"github.com/arduino/arduino-router/internal/telemetryapi"
+	"github.com/arduino/arduino-router/internal/testapi"
+	"github.com/arduino/arduino-router/internal/tracing"
 	"github.com/arduino/arduino-router/msgpackrpc"
 
 	"github.com/spf13/cobra"
-	"go.bug.st/f"
-	"go.bug.st/serial"
 )
 
 // Version will be set a build time with -ldflags
@@ -45,42 +55,238 @@ var Version string = "0.0.0-dev"
 // Server configuration
 type Config struct {
 	LogLevel                    slog.Level
+	LogFormat                   string
+	LogFile                     string
+	LogMaxSizeMB                int
+	LogMaxBackups               int
+	OTLPEndpoint                string
 	ListenTCPAddr               string
-	ListenUnixAddr              string
+	ListenTCPProfile            string
+	ListenTCPRole               string
+	ListenTLSAddr               string
+	ListenTLSProfile            string
+	ListenTLSRole               string
+	ListenVsockAddr             string
+	ListenVsockProfile          string
+	ListenVsockRole             string
+	ListenWebSocketAddr         string
+	ListenWebSocketProfile      string
+	ListenWebSocketRole         string
+	ListenHTTPAddr              string
+	ListenHTTPProfile           string
+	ListenHTTPRole              string
+	ListenGRPCAddr              string
+	ListenGRPCProfile           string
+	ListenGRPCRole              string
+	TLSCertFile                 string
+	TLSKeyFile                  string
+	TLSClientCAFile             string
+	AuthToken                   string
+	AuthTokenFile               string
+	Upstream                    string
+	UpstreamToken               string
+	UpstreamRole                string
+	UpstreamPrefix              string
+	ListenUnixAddrs             []string
+	ListenUnixProfile           string
+	ListenUnixRole              string
+	Listeners                   []ListenerConfig
+	ACLProfiles                 map[string][]string
+	Roles                       map[string][]string
+	SizeLimits                  map[string]int
+	Cache                       map[string]time.Duration
+	Resolver                    networkapi.ResolverConfig
+	Faults                      []FaultConfig
+	MQTTBridge                  *MQTTBridgeConfig
+	UnixSocketMode              string
+	UnixSocketOwner             string
+	UnixSocketGroup             string
 	SerialPortAddr              string
 	SerialBaudRate              int
-	MonitorPortAddr             string
+	SerialParity                string
+	SerialStopBits              string
+	SerialFlowControl           string
+	SerialAutoDiscover          bool
+	SerialVIDPIDFilters         []string
+	SerialFraming               string
+	SerialStatsLogInterval      time.Duration
+	SerialReopenBackoffMin      time.Duration
+	SerialReopenBackoffMax      time.Duration
+	SerialReopenMaxRetries      int
+	SerialReadBufferSize        int
+	SerialCoalesceDelay         time.Duration
+	MonitorPortAddrs            []string
+	MonitorEcho                 bool
+	FSRoot                      string
+	OTADir                      string
+	OTAApplyCommand             string
+	WatchdogCommand             string
+	CloudBroker                 string
+	CloudCredentialsFile        string
+	TestAPI                     bool
+	SysEnvAllowList             []string
+	SysPowerUIDs                []int
 	MaxPendingRequestsPerClient int
+	ConcurrentRequests          bool
+	ErrorLimit                  int
+	ErrorLimitWindow            time.Duration
+	ErrorLimitDisconnect        bool
+	SlowRequestThreshold        time.Duration
+	RequestCeiling              time.Duration
+	SessionGracePeriod          time.Duration
+	FaultInjection              bool
+	EnableModules               []string
+	Plugins                     []string
+	ServicesDir                 string
+	DisableModules              []string
+	RecordSessionFile           string
+	User                        string
+	Group                       string
+	KeepCapabilities            []string
+	Sandbox                     bool
+	StateFile                   string
+	RequestLogFile              string
+	RequestLogSampleRate        float64
+	RequestLogMaxPayload        int
+	RequestLogMaxSizeMB         int
+	TelemetryFile               string
+	TelemetryMaxSizeMB          int
 }
 
 func main() {
 	var cfg Config
 	var verbose bool
+	var configFile string
+	var preflightMode bool
 	cmd := &cobra.Command{
 		Use:  "arduino-router",
 		Long: "Arduino router for msgpack RPC service protocol",
 		Run: func(cmd *cobra.Command, args []string) {
+			socketFromFlag := cmd.Flags().Changed("unix-port")
+			if err := loadConfig(cmd.Flags(), configFile, &cfg); err != nil {
+				slog.Error("Failed to load configuration", "err", err)
+				os.Exit(1)
+			}
 			if verbose {
 				cfg.LogLevel = slog.LevelDebug
 			} else {
 				cfg.LogLevel = slog.LevelInfo
 			}
-			if !cmd.Flags().Changed("unix-port") {
-				cfg.ListenUnixAddr = cmp.Or(os.Getenv("ARDUINO_ROUTER_SOCKET"), cfg.ListenUnixAddr)
+			if !socketFromFlag {
+				if socket := os.Getenv("ARDUINO_ROUTER_SOCKET"); socket != "" {
+					cfg.ListenUnixAddrs = []string{socket}
+				}
+			}
+			// The monitor configuration of the state snapshot applies unless
+			// it is set explicitly
+			state, err := loadState(cfg.StateFile)
+			if err != nil {
+				slog.Error("Failed to load state", "err", err)
+				os.Exit(1)
+			}
+			if state != nil && state.Monitor != nil && !cmd.Flags().Changed("monitor-port") {
+				cfg.MonitorPortAddrs = state.Monitor.addresses()
+			}
+			if preflightMode {
+				os.Exit(printPreflight(os.Stdout, cfg))
 			}
-			if err := startRouter(cfg); err != nil {
+			if err := startRouter(cfg, state); err != nil {
 				slog.Error("Failed to start router", "err", err)
 				os.Exit(1)
 			}
 		},
 	}
+	cmd.Flags().StringVarP(&configFile, "config", "c", "", "Configuration file (YAML)")
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "Enable verbose logging")
+	cmd.Flags().BoolVarP(&preflightMode, "preflight", "", false, "Check the serial port, the HCI permissions, the socket paths and the ports, print a JSON report and exit (status 1 if a check fails)")
+	cmd.Flags().StringVarP(&cfg.LogFormat, "log-format", "", "text", "Log format (text, json)")
+	cmd.Flags().StringVarP(&cfg.LogFile, "log-file", "", "", "Log to the given file instead of stderr")
+	cmd.Flags().IntVarP(&cfg.LogMaxSizeMB, "log-max-size", "", 10, "Maximum size in MB of the log file before it is rotated (0 = no rotation)")
+	cmd.Flags().IntVarP(&cfg.LogMaxBackups, "log-max-backups", "", 3, "Number of rotated log files to keep")
+	cmd.Flags().StringVarP(&cfg.OTLPEndpoint, "otlp-endpoint", "", "", "OTLP/HTTP collector endpoint where the traces are exported, e.g. http://localhost:4318 (empty = tracing disabled)")
 	cmd.Flags().StringVarP(&cfg.ListenTCPAddr, "listen-port", "l", "", "Listening port for RPC services")
-	cmd.Flags().StringVarP(&cfg.ListenUnixAddr, "unix-port", "u", "/var/run/arduino-router.sock", "Listening port for RPC services")
-	cmd.Flags().StringVarP(&cfg.SerialPortAddr, "serial-port", "p", "", "Serial port address")
+	cmd.Flags().StringSliceVarP(&cfg.ListenUnixAddrs, "unix-port", "u", []string{"/var/run/arduino-router.sock"}, "Listening Unix sockets for RPC services (a path, or @NAME for the abstract namespace)")
+	cmd.Flags().StringVarP(&cfg.ListenTCPProfile, "listen-port-profile", "", "", "ACL profile of the TCP listener (empty = allow all methods)")
+	cmd.Flags().StringVarP(&cfg.ListenTCPRole, "listen-port-role", "", "", "Role of the TCP listener clients (empty = local-service on a loopback address, remote otherwise)")
+	cmd.Flags().StringVarP(&cfg.ListenTLSAddr, "listen-tls", "", "", "Listening port for RPC services over TLS")
+	cmd.Flags().StringVarP(&cfg.ListenTLSProfile, "listen-tls-profile", "", "", "ACL profile of the TLS listener (empty = allow all methods)")
+	cmd.Flags().StringVarP(&cfg.ListenTLSRole, "listen-tls-role", "", msgpackrouter.RoleRemote, "Role of the TLS listener clients")
+	cmd.Flags().StringVarP(&cfg.ListenVsockAddr, "listen-vsock", "", "", "Listening vsock port for RPC services of virtual machines, as PORT or CID:PORT")
+	cmd.Flags().StringVarP(&cfg.ListenVsockProfile, "listen-vsock-profile", "", "", "ACL profile of the vsock listener (empty = allow all methods)")
+	cmd.Flags().StringVarP(&cfg.ListenVsockRole, "listen-vsock-role", "", msgpackrouter.RoleLocalService, "Role of the vsock listener clients")
+	cmd.Flags().StringVarP(&cfg.ListenWebSocketAddr, "listen-websocket", "", "", "Listening port for RPC services over WebSocket")
+	cmd.Flags().StringVarP(&cfg.ListenWebSocketProfile, "listen-websocket-profile", "", "", "ACL profile of the WebSocket listener (empty = allow all methods)")
+	cmd.Flags().StringVarP(&cfg.ListenWebSocketRole, "listen-websocket-role", "", msgpackrouter.RoleRemote, "Role of the WebSocket listener clients")
+	cmd.Flags().StringVarP(&cfg.ListenHTTPAddr, "listen-http", "", "", "Listening port of the HTTP gateway, calling the methods with POST /rpc/<method> and JSON params")
+	cmd.Flags().StringVarP(&cfg.ListenHTTPProfile, "listen-http-profile", "", "", "ACL profile of the HTTP gateway (empty = allow all methods)")
+	cmd.Flags().StringVarP(&cfg.ListenHTTPRole, "listen-http-role", "", msgpackrouter.RoleRemote, "Role of the HTTP gateway clients")
+	cmd.Flags().StringVarP(&cfg.ListenGRPCAddr, "listen-grpc", "", "", "Listening port of the gRPC gateway (see proto/router.proto), over HTTP/2 without TLS")
+	cmd.Flags().StringVarP(&cfg.ListenGRPCProfile, "listen-grpc-profile", "", "", "ACL profile of the gRPC gateway (empty = allow all methods)")
+	cmd.Flags().StringVarP(&cfg.ListenGRPCRole, "listen-grpc-role", "", msgpackrouter.RoleRemote, "Role of the gRPC gateway clients")
+	cmd.Flags().StringVarP(&cfg.TLSCertFile, "tls-cert", "", "/var/lib/arduino-router/tls/cert.pem", "TLS certificate file (a self-signed certificate is generated if missing)")
+	cmd.Flags().StringVarP(&cfg.TLSKeyFile, "tls-key", "", "/var/lib/arduino-router/tls/key.pem", "TLS private key file (generated with the self-signed certificate if missing)")
+	cmd.Flags().StringVarP(&cfg.TLSClientCAFile, "tls-client-ca", "", "", "CA certificates used to verify the TLS client certificates (empty = client certificates not required)")
+	cmd.Flags().StringVarP(&cfg.AuthToken, "auth-token", "", "", "Shared token required to the clients not connected to the Unix socket (sent with $/auth)")
+	cmd.Flags().StringVarP(&cfg.AuthTokenFile, "auth-token-file", "", "", "File with the per-client tokens required to the clients not connected to the Unix socket, one \"identity token\" per line")
+	cmd.Flags().StringVarP(&cfg.Upstream, "upstream", "", "", "Address of an upstream router (HOST:PORT or unix:PATH) where the methods not available locally are forwarded")
+	cmd.Flags().StringVarP(&cfg.UpstreamToken, "upstream-token", "", "", "Token sent with $/auth to the upstream router (empty = no authentication)")
+	cmd.Flags().StringVarP(&cfg.UpstreamRole, "upstream-role", "", msgpackrouter.RoleRemote, "Role of the requests received from the upstream router")
+	cmd.Flags().StringVarP(&cfg.UpstreamPrefix, "upstream-prefix", "", "", "Prefix of the methods forwarded to the upstream router, removed before forwarding (empty = all the methods)")
+	cmd.Flags().StringVarP(&cfg.ListenUnixProfile, "unix-port-profile", "", "", "ACL profile of the Unix socket listener (empty = allow all methods)")
+	cmd.Flags().StringVarP(&cfg.ListenUnixRole, "unix-port-role", "", msgpackrouter.RoleLocalService, "Role of the Unix socket listener clients")
+	cmd.Flags().StringVarP(&cfg.UnixSocketMode, "unix-socket-mode", "", "0666", "File mode of the Unix socket (octal)")
+	cmd.Flags().StringVarP(&cfg.UnixSocketOwner, "unix-socket-owner", "", "", "Owner of the Unix socket (user name or UID)")
+	cmd.Flags().StringVarP(&cfg.UnixSocketGroup, "unix-socket-group", "", "", "Group of the Unix socket (group name or GID)")
+	cmd.Flags().StringVarP(&cfg.SerialPortAddr, "serial-port", "p", "", "Serial port address, tcp://HOST:PORT and rfc2217://HOST:PORT for a serial server, or pty:[LINK] for a new pseudo-terminal")
 	cmd.Flags().IntVarP(&cfg.SerialBaudRate, "serial-baudrate", "b", 115200, "Serial port baud rate")
-	cmd.Flags().StringVarP(&cfg.MonitorPortAddr, "monitor-port", "m", "127.0.0.1:7500", "Listening port for MCU monitor proxy")
-	cmd.Flags().IntVarP(&cfg.MaxPendingRequestsPerClient, "max-pending-requests", "", 25, "Maximum number of pending requests per client connection (0 = unlimited)")
+	cmd.Flags().StringVarP(&cfg.SerialParity, "serial-parity", "", "none", "Serial port parity (none, odd, even, mark, space)")
+	cmd.Flags().StringVarP(&cfg.SerialStopBits, "serial-stopbits", "", "1", "Serial port stop bits (1, 1.5, 2)")
+	cmd.Flags().StringVarP(&cfg.SerialFlowControl, "serial-flowcontrol", "", "none", "Serial port flow control (none, rtscts)")
+	cmd.Flags().BoolVarP(&cfg.SerialAutoDiscover, "serial-autodiscover", "", false, "Automatically attach to the first serial port matching the VID:PID filters")
+	cmd.Flags().StringSliceVarP(&cfg.SerialVIDPIDFilters, "serial-vidpid", "", serialapi.DefaultVIDPIDFilters, "VID:PID filters for serial port auto-discovery (use * as wildcard)")
+	cmd.Flags().StringVarP(&cfg.SerialFraming, "serial-framing", "", serialapi.FramingNone, "Framing of the messages on the serial link (none, cobs)")
+	cmd.Flags().DurationVarP(&cfg.SerialStatsLogInterval, "serial-stats-interval", "", 5*time.Minute, "Interval between logs of the serial link statistics (0 = disabled)")
+	cmd.Flags().DurationVarP(&cfg.SerialReopenBackoffMin, "serial-reopen-backoff-min", "", serialapi.DefaultReopenBackoffMin, "Initial delay before retrying to open the serial port")
+	cmd.Flags().DurationVarP(&cfg.SerialReopenBackoffMax, "serial-reopen-backoff-max", "", serialapi.DefaultReopenBackoffMax, "Maximum delay between retries to open the serial port")
+	cmd.Flags().IntVarP(&cfg.SerialReopenMaxRetries, "serial-reopen-max-retries", "", 0, "Maximum number of consecutive retries to open the serial port (0 = unlimited)")
+	cmd.Flags().IntVarP(&cfg.SerialReadBufferSize, "serial-read-buffer", "", serialapi.DefaultReadBufferSize, "Size in bytes of the buffer used to read from the serial port")
+	cmd.Flags().DurationVarP(&cfg.SerialCoalesceDelay, "serial-coalesce-delay", "", 0, "Delay used to batch the messages written to the serial port in a single write (0 = disabled)")
+	cmd.Flags().StringSliceVarP(&cfg.MonitorPortAddrs, "monitor-port", "m", []string{"127.0.0.1:7500"}, "Listening addresses for MCU monitor proxy (port 0 = any free port, empty = monitor disabled)")
+	cmd.Flags().BoolVarP(&cfg.MonitorEcho, "monitor-echo", "", false, "Mirror the data sent by each monitor client to the other clients")
+	cmd.Flags().StringVarP(&cfg.FSRoot, "fs-root", "", "", "Directory accessible with the filesystem API, for example /var/lib/arduino-router/fs (empty = filesystem API disabled)")
+	cmd.Flags().StringVarP(&cfg.OTADir, "ota-dir", "", "", "Directory where the OTA images are downloaded, for example /var/lib/arduino-router/ota (empty = OTA API disabled)")
+	cmd.Flags().StringVarP(&cfg.OTAApplyCommand, "ota-apply-command", "", "", "Command applying an OTA image, called with the image path as last argument (empty = ota/apply disabled)")
+	cmd.Flags().StringVarP(&cfg.WatchdogCommand, "watchdog-command", "", "", "Command run when the MCU watchdog expires (empty = reset the MCU with the DTR and RTS lines of the serial port)")
+	cmd.Flags().StringVarP(&cfg.CloudBroker, "cloud-broker", "", cloudapi.DefaultBroker, "MQTT broker of the Arduino IoT Cloud")
+	cmd.Flags().StringVarP(&cfg.CloudCredentialsFile, "cloud-credentials", "", "", "File where the Arduino IoT Cloud credentials are stored, for example /var/lib/arduino-router/cloud.yaml (empty = cloud API disabled)")
+	cmd.Flags().BoolVarP(&cfg.TestAPI, "test-api", "", false, "Enable the test/* methods, used to validate the RPC client implementations")
+	cmd.Flags().StringSliceVarP(&cfg.EnableModules, "enable-modules", "", nil, "API modules to enable (network, hci, i2c, spi, adc, pubsub, sched, sys, monitor, log, stats, watchdog, serial, fs, ota, cloud, logs, telemetry, test), empty for all")
+	cmd.Flags().StringSliceVarP(&cfg.DisableModules, "disable-modules", "", nil, "API modules to disable, their methods fail with a \"module disabled\" error")
+	cmd.Flags().StringSliceVarP(&cfg.Plugins, "plugins", "", nil, "Executables of the plugins to launch, providing additional API modules")
+	cmd.Flags().StringVarP(&cfg.ServicesDir, "services-dir", "", "/etc/arduino-router/services.d", "Directory with the manifests of the sidecar services launched and supervised by the router")
+	cmd.Flags().StringSliceVarP(&cfg.SysEnvAllowList, "sys-env-allow", "", sysapi.DefaultEnvAllowList, "Environment variables that can be read with sys/env")
+	cmd.Flags().IntSliceVarP(&cfg.SysPowerUIDs, "sys-power-uid", "", nil, "UIDs of the local processes, connected to the Unix socket, allowed to call sys/reboot, sys/poweroff and sys/suspend besides the MCU")
+	cmd.Flags().IntVarP(&cfg.MaxPendingRequestsPerClient, "max-pending-requests", "", 25, "Maximum number of requests of a client connection handled concurrently with --concurrent-requests (0 = unlimited)")
+	cmd.Flags().BoolVarP(&cfg.ConcurrentRequests, "concurrent-requests", "", false, "Handle the requests of each client connection concurrently, they may complete out of order (default = one at a time, in order)")
+	cmd.Flags().IntVarP(&cfg.ErrorLimit, "error-limit", "", 50, "Maximum number of errors (invalid params, unknown or not allowed methods, authentication failures) of a network client in --error-limit-window, before it is throttled (0 = no limit)")
+	cmd.Flags().DurationVarP(&cfg.ErrorLimitWindow, "error-limit-window", "", 10*time.Second, "Window of --error-limit, also the duration of the throttling")
+	cmd.Flags().BoolVarP(&cfg.ErrorLimitDisconnect, "error-limit-disconnect", "", false, "Disconnect the network clients exceeding --error-limit instead of throttling them")
+	cmd.Flags().DurationVarP(&cfg.SlowRequestThreshold, "slow-request-threshold", "", time.Second, "Log the forwarded requests with a round trip longer than this (0 = disabled)")
+	cmd.Flags().DurationVarP(&cfg.RequestCeiling, "request-ceiling", "", 10*time.Minute, "Fail the forwarded requests still waiting for a response after this (0 = disabled)")
+	cmd.Flags().DurationVarP(&cfg.SessionGracePeriod, "session-grace-period", "", 30*time.Second, "How long the state of a disconnected client that started a session is kept, waiting for the client to resume it (0 = sessions disabled)")
+	cmd.Flags().StringVarP(&cfg.RecordSessionFile, "record-session", "", "", "Record the traffic of all the connections to the given file, to be replayed in a regression test (for debugging only)")
+	cmd.Flags().StringVarP(&cfg.User, "user", "", "", "User (name or UID) the router switches to after opening the listeners and the devices (empty = keep running as the current user)")
+	cmd.Flags().StringVarP(&cfg.Group, "group", "", "", "Group (name or GID) the router switches to with --user (empty = primary group of the user)")
+	cmd.Flags().StringSliceVarP(&cfg.KeepCapabilities, "keep-capabilities", "", []string{"net_raw", "net_admin"}, "Capabilities kept after switching to --user (net_raw, net_admin, net_bind_service, sys_rawio)")
+	cmd.Flags().BoolVarP(&cfg.Sandbox, "sandbox", "", false, "Restrict the system calls and the filesystem access of the router to what the enabled modules need (seccomp and Landlock)")
+	cmd.Flags().StringVarP(&cfg.RequestLogFile, "request-log", "", "", "File where a sample of the requests is logged, read with logs/query (empty = request logs disabled)")
+	cmd.Flags().Float64VarP(&cfg.RequestLogSampleRate, "request-log-sample-rate", "", 0.1, "Fraction of the requests logged in --request-log (0 to 1)")
+	cmd.Flags().IntVarP(&cfg.RequestLogMaxPayload, "request-log-max-payload", "", 256, "Maximum size in bytes of the params stored in --request-log, the larger ones are logged only with their size")
+	cmd.Flags().IntVarP(&cfg.RequestLogMaxSizeMB, "request-log-max-size", "", 1, "Maximum size in MB of --request-log before it is rotated")
+	cmd.Flags().StringVarP(&cfg.TelemetryFile, "telemetry-file", "", "", "File where the telemetry samples pushed by the MCU are buffered (empty = telemetry API disabled)")
+	cmd.Flags().IntVarP(&cfg.TelemetryMaxSizeMB, "telemetry-max-size", "", 4, "Maximum size in MB of --telemetry-file before it is rotated")
+	cmd.Flags().StringVarP(&cfg.StateFile, "state-file", "", "", "Snapshot of the state returned by $/state/export (MessagePack or JSON), restored at startup")
+	cmd.Flags().BoolVarP(&cfg.FaultInjection, "fault-injection", "", false, "Inject the faults of the configuration file and of $/debug/faults in the forwarded messages (for testing only)")
 	cmd.AddCommand(&cobra.Command{
 		Use:  "version",
 		Long: "Print version information",
@@ -88,204 +294,513 @@ func main() {
 			fmt.Println("Arduino Router " + Version)
 		},
 	})
+	cmd.AddCommand(newHealthcheckCommand())
+	cmd.AddCommand(newSniffCommand())
+	cmd.AddCommand(newDumpCommand())
 
 	if err := cmd.Execute(); err != nil {
 		slog.Error("Error executing command.", "error", err)
 	}
 }
 
-type MsgpackDebugStream struct {
-	Upstream io.ReadWriteCloser
-	Name     string
-}
-
-func (d *MsgpackDebugStream) Read(p []byte) (n int, err error) {
-	n, err = d.Upstream.Read(p)
-	if err != nil {
-		slog.Debug("Read error from "+d.Name, "err", err)
-	} else {
-		slog.Debug("Read from "+d.Name, "data", hex.EncodeToString(p[:n]))
+func startRouter(cfg Config, state *stateSnapshot) error {
+	startTime := time.Now()
+	if err := setupLogging(cfg); err != nil {
+		return err
 	}
-	return n, err
-}
+	toggleDebugLogOnSignal(syscall.SIGUSR1)
 
-func (d *MsgpackDebugStream) Write(p []byte) (n int, err error) {
-	n, err = d.Upstream.Write(p)
+	// Take over the listeners and the clients of the previous process after
+	// a hot restart
+	handover, err := loadHandover()
 	if err != nil {
-		slog.Debug("Write error to "+d.Name, "err", err)
-	} else {
-		slog.Debug("Write to  "+d.Name, "data", hex.EncodeToString(p[:n]))
+		return err
 	}
-	return n, err
-}
 
-func (d *MsgpackDebugStream) Close() error {
-	return d.Upstream.Close()
-}
-
-func startRouter(cfg Config) error {
-	slog.SetLogLoggerLevel(cfg.LogLevel)
+	if cfg.OTLPEndpoint != "" {
+		tracing.Enable(cfg.OTLPEndpoint, "arduino-router")
+		defer tracing.Disable()
+		slog.Info("Exporting traces", "endpoint", cfg.OTLPEndpoint)
+	}
 
-	var listeners []net.Listener
+	listenerConfigs := configuredListeners(cfg)
 
-	// Open listening TCP socket
-	if cfg.ListenTCPAddr != "" {
-		if l, err := net.Listen("tcp", cfg.ListenTCPAddr); err != nil {
-			return fmt.Errorf("failed to listen on TCP port %s: %w", cfg.ListenTCPAddr, err)
+	// Load the TLS certificates if required by any listener
+	var tlsConfig *tls.Config
+	if slices.ContainsFunc(listenerConfigs, func(lc ListenerConfig) bool { return lc.Network == "tls" }) {
+		if c, err := tlsServerConfig(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile); err != nil {
+			return err
 		} else {
-			slog.Info("Listening on TCP socket", "listen_addr", cfg.ListenTCPAddr)
-			listeners = append(listeners, l)
+			tlsConfig = c
 		}
 	}
 
-	// Open listening UNIX socket
-	if cfg.ListenUnixAddr != "" {
-		_ = os.Remove(cfg.ListenUnixAddr) // Remove the socket file if it exists
-		if l, err := net.Listen("unix", cfg.ListenUnixAddr); err != nil {
-			return fmt.Errorf("failed to listen on UNIX socket %s: %w", cfg.ListenUnixAddr, err)
-		} else {
-			slog.Info("Listening on Unix socket", "listen_addr", cfg.ListenUnixAddr)
-			listeners = append(listeners, l)
+	// Setup the roles
+	roles := defaultRoles()
+	for role, patterns := range cfg.Roles {
+		roles[role] = append(msgpackrouter.ACL{}, patterns...)
+	}
+
+	// Load the authentication tokens
+	auth, err := newTokenAuth(cfg.AuthToken, cfg.AuthTokenFile)
+	if err != nil {
+		return err
+	}
+	if err := auth.checkRoles(roles); err != nil {
+		return err
+	}
+	if cfg.Upstream != "" {
+		if _, ok := roles[cfg.UpstreamRole]; !ok {
+			return fmt.Errorf("unknown role for upstream router %s: %s", cfg.Upstream, cfg.UpstreamRole)
 		}
+	}
+
+	var errorLimit *msgpackrouter.ErrorLimit
+	if cfg.ErrorLimit > 0 {
+		errorLimit = &msgpackrouter.ErrorLimit{MaxErrors: cfg.ErrorLimit, Window: cfg.ErrorLimitWindow, Disconnect: cfg.ErrorLimitDisconnect}
+	}
 
-		// Allow `arduino` user to write to a socket file owned by `root`
-		if err := os.Chmod(cfg.ListenUnixAddr, 0666); err != nil {
+	// Open listening sockets
+	var listeners []*listener
+	for _, lc := range listenerConfigs {
+		if lc.Role == "" {
+			lc.Role = defaultListenerRole(lc.Network, lc.Address)
+		}
+		if _, ok := roles[lc.Role]; !ok {
+			return fmt.Errorf("unknown role for listener %s: %s", lc.Address, lc.Role)
+		}
+		l, err := handover.openListener(lc, cfg, tlsConfig)
+		if err != nil {
 			return err
 		}
+		if l.network != "unix" {
+			l.auth = auth
+			l.errorLimit = errorLimit
+		}
+		listeners = append(listeners, l)
 	}
+	handover.closeUnusedListeners()
 
 	// Run router
 	router := msgpackrouter.New(cfg.MaxPendingRequestsPerClient)
+	router.SetConcurrentRequests(cfg.ConcurrentRequests)
+	router.SetSlowRequestThreshold(cfg.SlowRequestThreshold)
+	router.SetRequestCeiling(cfg.RequestCeiling)
+	router.SetSessionGracePeriod(cfg.SessionGracePeriod)
+	router.SetDrainExempt(drainExempt)
+	toggleDrainOnSignal(router, syscall.SIGUSR2)
+	if cfg.RecordSessionFile != "" {
+		f, err := os.OpenFile(cfg.RecordSessionFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("creating session recording: %w", err)
+		}
+		defer f.Close()
+		slog.Warn("Recording the traffic of all the connections", "file", cfg.RecordSessionFile)
+		replay.NewRecorder(f).Record(router)
+	}
+	for role, acl := range roles {
+		router.SetRole(role, acl)
+	}
+	handover.restoreMethods(router)
+	state.restoreReservations(router)
+	for pattern, size := range cfg.SizeLimits {
+		router.SetSizeLimit(pattern, size)
+	}
+	for pattern, ttl := range cfg.Cache {
+		router.SetCacheTTL(pattern, ttl)
+	}
+	if cfg.FaultInjection {
+		rules, err := faultRules(cfg.Faults)
+		if err != nil {
+			return fmt.Errorf("invalid fault injection settings: %w", err)
+		}
+		router.SetFaults(rules)
+		if err := router.RegisterMethod("$/debug/faults", faultsHandler(router)); err != nil {
+			slog.Error("Failed to register fault injection API", "err", err)
+		}
+	} else if len(cfg.Faults) > 0 {
+		slog.Warn("Faults configured but --fault-injection is not enabled, ignoring them")
+	}
+
+	// API modules enabled, reported by $/version
+	selection, err := newModuleSelection(cfg.EnableModules, cfg.DisableModules)
+	if err != nil {
+		return err
+	}
+	router.SetDisabledMethods(selection.disabledMethods())
+	serialEnabled := (cfg.SerialPortAddr != "" || cfg.SerialAutoDiscover) && selection.allowed("serial")
+	monitorEnabled := len(cfg.MonitorPortAddrs) > 0 && selection.allowed("monitor")
+	var modules []string
+	for _, module := range []string{"network", "hci", "i2c", "spi", "adc", "pubsub", "sched", "sys", "monitor", "log", "stats", "watchdog"} {
+		if module == "monitor" && !monitorEnabled {
+			continue
+		}
+		if selection.allowed(module) {
+			modules = append(modules, module)
+		}
+	}
+	if serialEnabled {
+		modules = append(modules, "serial")
+	}
 
 	// Register TCP network API methods
-	networkapi.Register(router)
+	var network *networkapi.Service
+	if selection.allowed("network") {
+		network = networkapi.New(networkapi.Options{Resolver: cfg.Resolver})
+		if err := network.Register(router); err != nil {
+			return fmt.Errorf("invalid resolver settings: %w", err)
+		}
+	}
 
 	// Register HCI API methods
-	hciapi.Register(router)
+	var hci *hciapi.Service
+	if selection.allowed("hci") {
+		hci = hciapi.New(hciapi.Options{Open: hciapi.OpenUserChannel})
+		hci.Register(router)
+	}
+
+	// Register I2C API methods
+	if selection.allowed("i2c") {
+		i2capi.Register(router)
+	}
+
+	// Register SPI API methods
+	if selection.allowed("spi") {
+		spiapi.Register(router)
+	}
+
+	// Register ADC API methods
+	if selection.allowed("adc") {
+		adcapi.Register(router)
+	}
+
+	// Register pub/sub API methods
+	if selection.allowed("pubsub") {
+		pubsubapi.Register(router)
+		state.restoreRetained()
+	}
+
+	// Register scheduler API methods
+	if selection.allowed("sched") {
+		schedapi.Register(router)
+	}
+
+	// Register system API methods
+	if selection.allowed("sys") {
+		sysapi.Register(router, sysapi.Config{EnvAllowList: cfg.SysEnvAllowList, PowerUIDs: cfg.SysPowerUIDs})
+	}
+
+	// Register filesystem API methods
+	if cfg.FSRoot != "" && selection.allowed("fs") {
+		if err := fsapi.Register(router, cfg.FSRoot); err != nil {
+			slog.Error("Failed to register filesystem API", "err", err)
+		} else {
+			modules = append(modules, "fs")
+			if selection.allowed("network") {
+				network.RegisterSendFile(fsapi.Open)
+			}
+		}
+	}
+
+	// Register OTA API methods
+	if cfg.OTADir != "" && selection.allowed("ota") {
+		if err := otaapi.Register(router, otaapi.Config{Dir: cfg.OTADir, ApplyCommand: cfg.OTAApplyCommand}); err != nil {
+			slog.Error("Failed to register OTA API", "err", err)
+		} else {
+			modules = append(modules, "ota")
+		}
+	}
+
+	// Register cloud API methods
+	if cfg.CloudCredentialsFile != "" && selection.allowed("cloud") {
+		if err := cloudapi.Register(router, cloudapi.Config{Broker: cfg.CloudBroker, CredentialsFile: cfg.CloudCredentialsFile}); err != nil {
+			slog.Error("Failed to register cloud API", "err", err)
+		} else {
+			modules = append(modules, "cloud")
+		}
+	}
+
+	// Register request logs API methods
+	if cfg.RequestLogFile != "" && selection.allowed("logs") {
+		if err := logsapi.Register(router, logsapi.Config{
+			File:           cfg.RequestLogFile,
+			SampleRate:     cfg.RequestLogSampleRate,
+			MaxPayloadSize: cfg.RequestLogMaxPayload,
+			MaxFileSize:    int64(cfg.RequestLogMaxSizeMB) * 1024 * 1024,
+		}); err != nil {
+			slog.Error("Failed to register request logs API", "err", err)
+		} else {
+			modules = append(modules, "logs")
+		}
+	}
+
+	// Register telemetry API methods
+	var telemetry *telemetryapi.Service
+	if cfg.TelemetryFile != "" && selection.allowed("telemetry") {
+		telemetry = telemetryapi.New(telemetryapi.Options{
+			File:        cfg.TelemetryFile,
+			MaxFileSize: int64(cfg.TelemetryMaxSizeMB) * 1024 * 1024,
+		})
+		if err := telemetry.Register(router); err != nil {
+			slog.Error("Failed to register telemetry API", "err", err)
+			telemetry = nil
+		} else {
+			modules = append(modules, "telemetry")
+		}
+	}
 
-	// Register monitor version API methods
+	// Register test API methods
+	if cfg.TestAPI && selection.allowed("test") {
+		testapi.Register(router)
+		modules = append(modules, "test")
+	}
+
+	// Register monitor API methods
+	var monitor *monitorapi.Service
+	monitorAddrs := []string{}
+	if monitorEnabled {
+		if listeners, err := listenMonitor(cfg.MonitorPortAddrs); err != nil {
+			slog.Error("Failed to start monitor listener", "err", err)
+		} else {
+			monitor = monitorapi.New(monitorapi.Options{Listeners: listeners, Echo: cfg.MonitorEcho})
+			monitor.Register(router)
+			monitorAddrs = monitor.Addrs()
+			slog.Info("Monitor listening", "addresses", monitorAddrs)
+		}
+	}
+
+	// Register version API methods
 	if err := router.RegisterMethod("$/version", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
-		res(Version, nil)
+		res(versionInfo(modules), nil)
 	}); err != nil {
 		slog.Error("Failed to register version API", "err", err)
 	}
 
-	// Register monitor API methods
-	if err := monitorapi.Register(router, cfg.MonitorPortAddr); err != nil {
-		slog.Error("Failed to register monitor API", "err", err)
+	// Register configuration API methods
+	if err := router.RegisterMethod("$/config/get", configGetHandler(effectiveSettings(&cfg, modules, monitorAddrs))); err != nil {
+		slog.Error("Failed to register configuration API", "err", err)
+	}
+
+	// Register capabilities API methods
+	if err := router.RegisterMethod("$/capabilities", capabilitiesHandler); err != nil {
+		slog.Error("Failed to register capabilities API", "err", err)
+	}
+
+	// Register ping API methods
+	if err := router.RegisterMethod("$/ping", pingHandler); err != nil {
+		slog.Error("Failed to register ping API", "err", err)
+	}
+
+	// Register heartbeat API methods
+	if err := registerHeartbeat(router); err != nil {
+		slog.Error("Failed to register heartbeat API", "err", err)
+	}
+
+	// Register drain API methods
+	if err := router.RegisterMethod("$/drain", drainHandler(router)); err != nil {
+		slog.Error("Failed to register drain API", "err", err)
+	}
+
+	// Register state API methods
+	if err := router.RegisterMethod("$/state/export", stateExportHandler(router, &cfg, modules)); err != nil {
+		slog.Error("Failed to register state API", "err", err)
+	}
+
+	// Register compression API methods
+	if err := router.RegisterMethod("$/compression", compressionHandler(router)); err != nil {
+		slog.Error("Failed to register compression API", "err", err)
 	}
 
 	// Open serial port if specified
-	if cfg.SerialPortAddr != "" {
-		var serialLock sync.Mutex
-		var serialOpened = sync.NewCond(&serialLock)
-		var serialClosed = sync.NewCond(&serialLock)
-		var serialCloseSignal = make(chan struct{})
-		err := router.RegisterMethod("$/serial/open", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
-			if len(params) != 1 {
-				res(nil, []any{1, "Invalid number of parameters"})
-				return
+	if serialEnabled {
+		if err := serialapi.Register(router, serialapi.Config{
+			PortAddr:         cfg.SerialPortAddr,
+			BaudRate:         cfg.SerialBaudRate,
+			Parity:           cfg.SerialParity,
+			StopBits:         cfg.SerialStopBits,
+			FlowControl:      cfg.SerialFlowControl,
+			AutoDiscover:     cfg.SerialAutoDiscover,
+			VIDPIDFilters:    cfg.SerialVIDPIDFilters,
+			Framing:          cfg.SerialFraming,
+			StatsLogInterval: cfg.SerialStatsLogInterval,
+			ReopenBackoffMin: cfg.SerialReopenBackoffMin,
+			ReopenBackoffMax: cfg.SerialReopenBackoffMax,
+			ReopenMaxRetries: cfg.SerialReopenMaxRetries,
+			ReadBufferSize:   cfg.SerialReadBufferSize,
+			CoalesceDelay:    cfg.SerialCoalesceDelay,
+		}); err != nil {
+			return fmt.Errorf("failed to setup serial port: %w", err)
+		}
+	}
+
+	// Register watchdog API methods
+	if selection.allowed("watchdog") {
+		if err := registerWatchdog(router, newWatchdog(watchdogAction(cfg.WatchdogCommand))); err != nil {
+			slog.Error("Failed to register watchdog API", "err", err)
+		}
+	}
+
+	// Start the MQTT bridge of the pub/sub topics
+	var bridge *mqttBridge
+	if cfg.MQTTBridge != nil {
+		if !selection.allowed("pubsub") {
+			slog.Warn("MQTT bridge configured but the pubsub module is disabled, ignoring it")
+		} else if dial, err := mqttBridgeDialer(*cfg.MQTTBridge); err != nil {
+			slog.Error("Failed to start MQTT bridge", "err", err)
+		} else if b, err := startMQTTBridge(router, *cfg.MQTTBridge, dial); err != nil {
+			slog.Error("Failed to start MQTT bridge", "err", err)
+		} else {
+			bridge = b
+		}
+	}
+
+	// Register log API methods
+	if selection.allowed("log") {
+		if err := router.RegisterMethod("$/log/setLevel", logSetLevel); err != nil {
+			slog.Error("Failed to register log API", "err", err)
+		}
+	}
+
+	// Register statistics API methods
+	if selection.allowed("stats") {
+		if err := router.RegisterMethod("$/stats", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+			stats := map[string]any{
+				"version":        Version,
+				"uptime_seconds": int64(time.Since(startTime).Seconds()),
+				"router":         router.Stats(),
 			}
-			address, ok := params[0].(string)
-			if !ok {
-				res(nil, []any{1, "Invalid parameter type"})
-				return
+			for module, moduleStats := range map[string]func() map[string]any{
+				"network": network.Stats,
+				"hci":     hci.Stats,
+				"i2c":     i2capi.Stats,
+				"spi":     spiapi.Stats,
+				"adc":     adcapi.Stats,
+				"pubsub":  pubsubapi.Stats,
+				"sched":   schedapi.Stats,
+			} {
+				if slices.Contains(modules, module) {
+					stats[module] = moduleStats()
+				}
 			}
-			slog.Info("Request for opening serial port", "serial", address)
-			if address != cfg.SerialPortAddr {
-				res(nil, []any{1, "Invalid serial port address"})
-				return
+			if monitor != nil {
+				stats["monitor"] = monitor.Stats()
 			}
-			serialOpened.L.Lock()
-			if serialCloseSignal == nil { // check if already opened
-				serialCloseSignal = make(chan struct{})
-				serialOpened.Broadcast()
+			if serialEnabled {
+				stats["serial"] = serialapi.Stats()
 			}
-			serialOpened.L.Unlock()
-			res(true, nil)
-		})
-		f.Assert(err == nil, "Failed to register $/serial/open method")
-		err = router.RegisterMethod("$/serial/close", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
-			if len(params) != 1 {
-				res(nil, []any{1, "Invalid number of parameters"})
-				return
+			if slices.Contains(modules, "fs") {
+				stats["fs"] = fsapi.Stats()
 			}
-			address, ok := params[0].(string)
-			if !ok {
-				res(nil, []any{1, "Invalid parameter type"})
-				return
+			if slices.Contains(modules, "ota") {
+				stats["ota"] = otaapi.Stats()
 			}
-			slog.Info("Request for closing serial port", "serial", address)
-			if address != cfg.SerialPortAddr {
-				res(nil, []any{1, "Invalid serial port address"})
-				return
+			if slices.Contains(modules, "cloud") {
+				stats["cloud"] = cloudapi.Stats()
 			}
-			serialClosed.L.Lock()
-			if serialCloseSignal != nil { // check if already closed
-				close(serialCloseSignal)
-				serialCloseSignal = nil
-				serialClosed.Wait()
+			if slices.Contains(modules, "logs") {
+				stats["logs"] = logsapi.Stats()
 			}
-			serialClosed.L.Unlock()
-			res(true, nil)
-		})
-		f.Assert(err == nil, "Failed to register $/serial/close method")
-		go func() {
-			for {
-				serialOpened.L.Lock()
-				for serialCloseSignal == nil {
-					serialClosed.Broadcast()
-					serialOpened.Wait()
-				}
-				close := serialCloseSignal
-				serialOpened.L.Unlock()
-
-				slog.Info("Opening serial connection", "serial", cfg.SerialPortAddr)
-				serialPort, err := serial.Open(cfg.SerialPortAddr, &serial.Mode{
-					BaudRate: cfg.SerialBaudRate,
-					DataBits: 8,
-					StopBits: serial.OneStopBit,
-					Parity:   serial.NoParity,
-				})
-				if err != nil {
-					slog.Error("Failed to open serial port. Retrying in 5 seconds...", "serial", cfg.SerialPortAddr, "err", err)
-					time.Sleep(5 * time.Second)
-					continue
-				}
-				slog.Info("Opened serial connection", "serial", cfg.SerialPortAddr)
-				wr := &MsgpackDebugStream{Name: cfg.SerialPortAddr, Upstream: serialPort}
-
-				// wait for the close command from RPC or for a failure of the serial port (routerExit)
-				routerExit := router.Accept(wr)
-				select {
-				case <-routerExit:
-					slog.Info("Serial port failed connection")
-				case <-close:
-				}
-
-				// in any case, wait for the router to drop the connection
-				serialPort.Close()
-				<-routerExit
+			if telemetry != nil {
+				stats["telemetry"] = telemetry.Stats()
 			}
-		}()
+			if slices.Contains(modules, "test") {
+				stats["test"] = testapi.Stats()
+			}
+			if bridge != nil {
+				stats["mqtt_bridge"] = bridge.stats()
+			}
+			res(stats, nil)
+		}); err != nil {
+			slog.Error("Failed to register stats API", "err", err)
+		}
 	}
 
-	// Wait for incoming connections on all listeners
-	for _, l := range listeners {
-		go func() {
-			for {
-				conn, err := l.Accept()
-				if err != nil {
-					slog.Error("Failed to accept connection", "err", err)
-					break
-				}
+	// Load the manifests of the sidecar services
+	var manifests []ServiceManifest
+	if cfg.ServicesDir != "" {
+		if manifests, err = loadServiceManifests(cfg.ServicesDir); err != nil {
+			return err
+		}
+	}
 
-				slog.Info("Accepted connection", "addr", conn.RemoteAddr())
-				router.Accept(conn)
-			}
-		}()
+	// Drop the privileges, after opening the listeners and the devices and
+	// before launching the plugins
+	if cfg.User != "" {
+		if handover != nil && os.Geteuid() != 0 {
+			// The process started by a hot restart inherits the user
+			slog.Info("Privileges already dropped", "uid", os.Geteuid())
+		} else if err := dropPrivileges(cfg.User, cfg.Group, cfg.KeepCapabilities); err != nil {
+			return fmt.Errorf("failed to drop privileges: %w", err)
+		}
+	} else if cfg.Group != "" {
+		return fmt.Errorf("--group requires --user")
+	}
+	restart := newHotRestart(router, listeners)
+	if cfg.Sandbox {
+		policy := newSandboxPolicy(cfg, modules, manifests)
+		if err := applySandbox(policy); err != nil {
+			return fmt.Errorf("failed to enable the sandbox: %w", err)
+		}
+		if !policy.Exec {
+			restart.unavailable = "the sandbox does not allow to run commands"
+		}
+	}
+
+	// Launch the plugins, after the built-in methods are registered
+	for _, path := range cfg.Plugins {
+		if err := startPlugin(router, path); err != nil {
+			slog.Error("Failed to start plugin", "err", err)
+		}
+	}
+
+	// Launch the sidecar services
+	var services []*service
+	for _, manifest := range manifests {
+		services = append(services, startService(router, manifest))
+	}
+
+	// Register services API methods
+	if err := router.RegisterMethod("$/services", servicesHandler(services)); err != nil {
+		slog.Error("Failed to register services API", "err", err)
 	}
 
+	// Start the gateways, after all the methods are registered
+	if cfg.ListenHTTPAddr != "" {
+		gateway, err := newHTTPGateway(router, cfg, cfg.ListenHTTPProfile, cfg.ListenHTTPRole, roles, auth)
+		if err != nil {
+			return err
+		}
+		server, err := listenHTTPGateway(cfg.ListenHTTPAddr, gateway)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+	}
+	if cfg.ListenGRPCAddr != "" {
+		gateway, err := newHTTPGateway(router, cfg, cfg.ListenGRPCProfile, cfg.ListenGRPCRole, roles, auth)
+		if err != nil {
+			return err
+		}
+		server, err := listenGRPCGateway(cfg.ListenGRPCAddr, &grpcGateway{*gateway})
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+	}
+
+	// Connect to the upstream router, forwarding the methods not available locally
+	if cfg.Upstream != "" {
+		startUpstream(router, cfg.Upstream, cfg.UpstreamToken, cfg.UpstreamRole, cfg.UpstreamPrefix, upstreamDialer(cfg.Upstream))
+	}
+
+	// Serve the clients handed over by the previous process, and wait for
+	// incoming connections on all listeners
+	restart.adopt(handover)
+	for i := range listeners {
+		go restart.serve(i)
+	}
+	restartOnSignal(restart, syscall.SIGHUP)
+
 	// Sleep forever until interrupted
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
@@ -298,6 +813,18 @@ func startRouter(cfg Config) error {
 			slog.Error("Failed to close listener", "err", err)
 		}
 	}
+	if network != nil {
+		network.Close()
+	}
+	if hci != nil {
+		hci.Close()
+	}
+	if monitor != nil {
+		monitor.Close()
+	}
+	if telemetry != nil {
+		telemetry.Close()
+	}
 
 	return nil
 }
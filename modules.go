@@ -0,0 +1,86 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// moduleMethods are the patterns of the methods of each API module, that
+// can be enabled or disabled with --enable-modules and --disable-modules.
+var moduleMethods = map[string][]string{
+	"network":   {"tcp/*", "udp/*", "net/*"},
+	"hci":       {"hci/*"},
+	"i2c":       {"i2c/*"},
+	"spi":       {"spi/*"},
+	"adc":       {"adc/*"},
+	"pubsub":    {"pubsub/*"},
+	"sched":     {"sched/*"},
+	"sys":       {"sys/*"},
+	"monitor":   {"mon/*"},
+	"log":       {"$/log/*"},
+	"stats":     {"$/stats"},
+	"watchdog":  {"$/watchdog/*"},
+	"serial":    {"$/serial/*"},
+	"fs":        {"fs/*"},
+	"ota":       {"ota/*"},
+	"cloud":     {"cloud/*"},
+	"logs":      {"logs/*"},
+	"telemetry": {"telemetry/*"},
+	"test":      {"test/*"},
+}
+
+// moduleSelection are the API modules allowed by --enable-modules and
+// --disable-modules.
+type moduleSelection struct {
+	enable  []string
+	disable []string
+}
+
+// newModuleSelection checks the names of the modules to enable (empty for
+// all the modules) and to disable.
+func newModuleSelection(enable, disable []string) (moduleSelection, error) {
+	for _, module := range slices.Concat(enable, disable) {
+		if _, ok := moduleMethods[module]; !ok {
+			return moduleSelection{}, fmt.Errorf("unknown module: %s", module)
+		}
+	}
+	return moduleSelection{enable: enable, disable: disable}, nil
+}
+
+// allowed returns true if the module is allowed, the modules that need a
+// setting (like fs or serial) are enabled only if it is set too.
+func (m moduleSelection) allowed(module string) bool {
+	if len(m.enable) > 0 && !slices.Contains(m.enable, module) {
+		return false
+	}
+	return !slices.Contains(m.disable, module)
+}
+
+// disabledMethods returns the patterns of the methods of the modules that
+// are not allowed.
+func (m moduleSelection) disabledMethods() []string {
+	var patterns []string
+	for module, methods := range moduleMethods {
+		if !m.allowed(module) {
+			patterns = append(patterns, methods...)
+		}
+	}
+	sort.Strings(patterns)
+	return patterns
+}
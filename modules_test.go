@@ -0,0 +1,47 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleSelection(t *testing.T) {
+	all, err := newModuleSelection(nil, nil)
+	require.NoError(t, err)
+	require.True(t, all.allowed("hci"))
+	require.Empty(t, all.disabledMethods())
+
+	selection, err := newModuleSelection(nil, []string{"hci", "network"})
+	require.NoError(t, err)
+	require.False(t, selection.allowed("hci"))
+	require.True(t, selection.allowed("i2c"))
+	require.Equal(t, []string{"hci/*", "net/*", "tcp/*", "udp/*"}, selection.disabledMethods())
+
+	// Only the enabled modules are allowed, minus the disabled ones
+	selection, err = newModuleSelection([]string{"network", "sys", "stats"}, []string{"sys"})
+	require.NoError(t, err)
+	require.True(t, selection.allowed("network"))
+	require.False(t, selection.allowed("sys"))
+	require.False(t, selection.allowed("monitor"))
+	require.Contains(t, selection.disabledMethods(), "mon/*")
+	require.NotContains(t, selection.disabledMethods(), "$/stats")
+
+	_, err = newModuleSelection([]string{"bluetooth"}, nil)
+	require.EqualError(t, err, "unknown module: bluetooth")
+}
@@ -0,0 +1,359 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/mqtt"
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/internal/pubsubapi"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+const (
+	// mqttBridgeKeepAlive is the keep-alive interval of the MQTT session.
+	mqttBridgeKeepAlive = 60 * time.Second
+	// mqttBridgeMaxBackoff is the maximum delay between connection attempts.
+	mqttBridgeMaxBackoff = time.Minute
+	// mqttBridgeMaxEchoes is the maximum number of messages waiting to be
+	// recognized as echoes.
+	mqttBridgeMaxEchoes = 1024
+)
+
+// MQTTBridgeConfig is the configuration of the bridge mirroring the pub/sub
+// topics to an MQTT broker, in the mqtt-bridge section of the configuration
+// file.
+type MQTTBridgeConfig struct {
+	// Broker is the URL of the broker: mqtt://HOST:PORT, or mqtts://HOST:PORT
+	// for TLS.
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client-id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// CAFile are the CA certificates verifying the broker, empty for the
+	// system ones.
+	CAFile string `yaml:"ca-file"`
+	// CertFile and KeyFile are the client certificate, if required by the
+	// broker.
+	CertFile string `yaml:"cert-file"`
+	KeyFile  string `yaml:"key-file"`
+	// Prefix is prepended to the pub/sub topics to get the MQTT topics.
+	Prefix string `yaml:"prefix"`
+	// Publish are the patterns of the pub/sub topics published to the broker.
+	Publish []string `yaml:"publish"`
+	// Subscribe are the patterns of the pub/sub topics received from the
+	// broker and published to the router.
+	Subscribe []string `yaml:"subscribe"`
+}
+
+// mqttBridge mirrors the pub/sub topics to an MQTT broker: it is a client of
+// the router, subscribed to the topics published to the broker, that
+// publishes the messages received from the broker. The payloads are JSON
+// encoded on the broker side.
+type mqttBridge struct {
+	cfg  MQTTBridgeConfig
+	dial func() (net.Conn, error)
+	conn *msgpackrpc.Connection
+
+	lock   sync.Mutex
+	client *mqtt.Client
+	// echoes counts the messages forwarded in each direction that come back
+	// from the other side, by direction, topic and payload, so that they are
+	// not forwarded again.
+	echoes map[string]int
+
+	published atomic.Uint64
+	received  atomic.Uint64
+}
+
+// startMQTTBridge connects the bridge to the router, and starts the session
+// with the broker, opened with dial, in background, reconnecting when it
+// drops.
+func startMQTTBridge(router *msgpackrouter.Router, cfg MQTTBridgeConfig, dial func() (net.Conn, error)) (*mqttBridge, error) {
+	if len(cfg.Publish) == 0 && len(cfg.Subscribe) == 0 {
+		return nil, errors.New("no topics to publish or subscribe")
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "arduino-router"
+	}
+	b := &mqttBridge{cfg: cfg, dial: dial, echoes: map[string]int{}}
+
+	clientEnd, routerEnd := net.Pipe()
+	router.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{
+		Transport:  "mqtt-bridge",
+		RemoteAddr: cfg.Broker,
+		Role:       msgpackrouter.RoleLocalService,
+	})
+	b.conn = msgpackrpc.NewConnection(clientEnd, clientEnd, nil, b.handleNotification, nil)
+	go b.conn.Run()
+	for _, pattern := range cfg.Publish {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, reqErr, err := b.conn.SendRequest(ctx, "pubsub/subscribe", pattern)
+		cancel()
+		if err == nil && reqErr != nil {
+			err = fmt.Errorf("%v", reqErr)
+		}
+		if err != nil {
+			b.conn.Close()
+			return nil, fmt.Errorf("subscribing to pub/sub topics %s: %w", pattern, err)
+		}
+	}
+
+	go b.run()
+	return b, nil
+}
+
+// mqttBridgeDialer returns the function opening the connections to the
+// broker.
+func mqttBridgeDialer(cfg MQTTBridgeConfig) (func() (net.Conn, error), error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid MQTT broker URL: %s", cfg.Broker)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		return func() (net.Conn, error) {
+			return dialer.Dial("tcp", u.Host)
+		}, nil
+	case "mqtts", "ssl", "tls":
+		tlsConfig := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if cfg.CAFile != "" {
+			pem, err := os.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading MQTT broker CA file: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in MQTT broker CA file %s", cfg.CAFile)
+			}
+		}
+		if cfg.CertFile != "" || cfg.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading MQTT client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		return func() (net.Conn, error) {
+			return tls.DialWithDialer(dialer, "tcp", u.Host, tlsConfig)
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid MQTT broker URL scheme: %s (expected mqtt or mqtts)", u.Scheme)
+	}
+}
+
+// run keeps the session with the broker, reconnecting with exponential
+// backoff.
+func (b *mqttBridge) run() {
+	backoff := time.Second
+	for {
+		connected, err := b.session()
+		if connected {
+			backoff = time.Second
+		}
+		slog.Warn("MQTT bridge disconnected", "broker", b.cfg.Broker, "err", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, mqttBridgeMaxBackoff)
+	}
+}
+
+// session connects to the broker, subscribes to the topics received from
+// the broker and forwards the messages until the connection drops. It
+// returns true if the connection was established.
+func (b *mqttBridge) session() (bool, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return false, err
+	}
+	client, err := mqtt.Dial(conn, b.cfg.ClientID, b.cfg.Username, b.cfg.Password, mqttBridgeKeepAlive)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+	for _, pattern := range b.cfg.Subscribe {
+		if err := client.Subscribe(b.mqttFilter(pattern)); err != nil {
+			client.Close()
+			return false, err
+		}
+	}
+	b.lock.Lock()
+	b.client = client
+	b.lock.Unlock()
+	slog.Info("MQTT bridge connected", "broker", b.cfg.Broker)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(mqttBridgeKeepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_ = client.Ping()
+			}
+		}
+	}()
+	err = client.ReadLoop(b.handleMQTTMessage)
+	close(done)
+	b.lock.Lock()
+	b.client = nil
+	b.lock.Unlock()
+	client.Close()
+	return true, err
+}
+
+// connected returns true if the session with the broker is established.
+func (b *mqttBridge) connected() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.client != nil
+}
+
+// mqttFilter returns the MQTT topic filter of a pub/sub topic pattern. The
+// MQTT wildcard # only matches whole levels, so the filter may be wider
+// than the pattern: the received topics are matched again with the pattern.
+func (b *mqttBridge) mqttFilter(pattern string) string {
+	base, wildcard := strings.CutSuffix(pattern, "*")
+	if !wildcard {
+		return b.cfg.Prefix + pattern
+	}
+	return b.cfg.Prefix + base[:strings.LastIndex(base, "/")+1] + "#"
+}
+
+// handleNotification publishes to the broker the pub/sub messages of the
+// topics subscribed by the bridge.
+func (b *mqttBridge) handleNotification(_ msgpackrpc.FunctionLogger, method string, params []any) {
+	if method != pubsubapi.MessageMethod || len(params) != 3 {
+		return
+	}
+	topic, ok := params[1].(string)
+	if !ok {
+		return
+	}
+	payload, err := encodeJSON(params[2])
+	if err != nil {
+		slog.Debug("MQTT bridge cannot encode the payload", "topic", topic, "err", err)
+		return
+	}
+	if b.isEcho("in", topic, payload) {
+		return
+	}
+
+	b.lock.Lock()
+	client := b.client
+	b.lock.Unlock()
+	if client == nil {
+		return
+	}
+	if matchesAny(b.cfg.Subscribe, topic) {
+		// The broker will send the message back to the bridge
+		b.expectEcho("out", topic, payload)
+	}
+	if err := client.Publish(b.cfg.Prefix+topic, payload); err != nil {
+		slog.Debug("MQTT bridge failed to publish", "topic", topic, "err", err)
+		return
+	}
+	b.published.Add(1)
+}
+
+// handleMQTTMessage publishes to the router the messages received from the
+// broker. The payloads that are not valid JSON are published as binary.
+func (b *mqttBridge) handleMQTTMessage(mqttTopic string, data []byte) {
+	topic, ok := strings.CutPrefix(mqttTopic, b.cfg.Prefix)
+	if !ok || !matchesAny(b.cfg.Subscribe, topic) {
+		return
+	}
+	if b.isEcho("out", topic, data) {
+		return
+	}
+	var payload any = data
+	if v, err := decodeJSON(data); err == nil {
+		payload = v
+	}
+	if matchesAny(b.cfg.Publish, topic) {
+		// The subscription of the bridge will receive the message back
+		b.expectEcho("in", topic, data)
+	}
+	if err := b.conn.SendNotification("pubsub/publish", topic, payload); err != nil {
+		slog.Debug("MQTT bridge failed to publish to the router", "topic", topic, "err", err)
+		return
+	}
+	b.received.Add(1)
+}
+
+// expectEcho records a message forwarded by the bridge that will come back
+// from the other side.
+func (b *mqttBridge) expectEcho(direction, topic string, payload []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.echoes) >= mqttBridgeMaxEchoes {
+		// Some echoes were lost, do not grow forever
+		clear(b.echoes)
+	}
+	b.echoes[direction+"\x00"+topic+"\x00"+string(payload)]++
+}
+
+// isEcho returns true, once per expectEcho, if the message was forwarded by
+// the bridge.
+func (b *mqttBridge) isEcho(direction, topic string, payload []byte) bool {
+	key := direction + "\x00" + topic + "\x00" + string(payload)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n, ok := b.echoes[key]
+	if !ok {
+		return false
+	}
+	if n <= 1 {
+		delete(b.echoes, key)
+	} else {
+		b.echoes[key] = n - 1
+	}
+	return true
+}
+
+// stats returns the state of the bridge reported by $/stats.
+func (b *mqttBridge) stats() map[string]any {
+	return map[string]any{
+		"connected": b.connected(),
+		"published": b.published.Load(),
+		"received":  b.received.Load(),
+	}
+}
+
+// matchesAny returns true if the topic matches any of the pub/sub patterns.
+func matchesAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if pubsubapi.MatchesTopic(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
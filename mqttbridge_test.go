@@ -0,0 +1,127 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/mqtt"
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/internal/pubsubapi"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestMQTTBridge(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleLocalService, nil)
+	pubsubapi.Register(router)
+
+	brokerConns := make(chan net.Conn, 10)
+	dial := func() (net.Conn, error) {
+		bridgeSide, brokerSide := net.Pipe()
+		brokerConns <- brokerSide
+		return bridgeSide, nil
+	}
+	bridge, err := startMQTTBridge(router, MQTTBridgeConfig{
+		Broker:    "mqtt://broker:1883",
+		Prefix:    "devices/board1/",
+		Publish:   []string{"sensor/*"},
+		Subscribe: []string{"cmd/*", "sensor/*"},
+	}, dial)
+	require.NoError(t, err)
+
+	// The bridge connects and subscribes to the topics received from the
+	// broker
+	conn := <-brokerConns
+	defer conn.Close()
+	broker := mqtt.NewClient(conn)
+	header, body, err := broker.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, byte(mqtt.Connect<<4), header)
+	require.Contains(t, string(body), "arduino-router")
+	require.NoError(t, broker.WritePacket(mqtt.ConnAck<<4, []byte{0, 0}))
+	_, body, err = broker.ReadPacket()
+	require.NoError(t, err)
+	require.Contains(t, string(body), "devices/board1/cmd/#")
+	_, body, err = broker.ReadPacket()
+	require.NoError(t, err)
+	require.Contains(t, string(body), "devices/board1/sensor/#")
+	require.Eventually(t, bridge.connected, time.Second, 10*time.Millisecond)
+
+	messages := make(chan []any, 10)
+	clientEnd, routerEnd := net.Pipe()
+	router.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Role: msgpackrouter.RoleLocalService})
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+		if method == pubsubapi.MessageMethod {
+			messages <- params[1:]
+		}
+	}, nil)
+	go client.Run()
+	defer client.Close()
+	for _, pattern := range []string{"cmd/*", "sensor/*"} {
+		_, reqErr, err := client.SendRequest(t.Context(), "pubsub/subscribe", pattern)
+		require.NoError(t, err)
+		require.Nil(t, reqErr)
+	}
+
+	// The messages of the published topics are sent to the broker...
+	_, _, err = client.SendRequest(t.Context(), "pubsub/publish", "sensor/temp", map[string]any{"value": 21})
+	require.NoError(t, err)
+	require.Equal(t, []any{"sensor/temp", map[string]any{"value": int8(21)}}, <-messages)
+	header, body, err = broker.ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, byte(mqtt.Publish<<4), header)
+	topicLen := int(binary.BigEndian.Uint16(body))
+	require.Equal(t, "devices/board1/sensor/temp", string(body[2:2+topicLen]))
+	require.Equal(t, `{"value":21}`, string(body[2+topicLen:]))
+
+	// ...and not published again when the broker sends them back
+	require.NoError(t, broker.Publish("devices/board1/sensor/temp", []byte(`{"value":21}`)))
+
+	// The messages of the subscribed topics are published to the router
+	require.NoError(t, broker.Publish("devices/board1/cmd/led", []byte(`true`)))
+	require.Equal(t, []any{"cmd/led", true}, <-messages)
+	require.NoError(t, broker.Publish("devices/board1/cmd/raw", []byte("not json")))
+	require.Equal(t, []any{"cmd/raw", []byte("not json")}, <-messages)
+	require.NoError(t, broker.Publish("devices/board1/other", []byte(`1`)))
+	require.NoError(t, broker.Publish("devices/board1/cmd/last", []byte(`1`)))
+	require.Equal(t, []any{"cmd/last", int8(1)}, <-messages)
+	require.Empty(t, messages)
+
+	// The counter is updated after the message is sent to the router
+	require.Eventually(t, func() bool {
+		return bridge.stats()["received"] == uint64(3)
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, map[string]any{"connected": true, "published": uint64(1), "received": uint64(3)}, bridge.stats())
+}
+
+func TestMQTTBridgeFilter(t *testing.T) {
+	b := &mqttBridge{cfg: MQTTBridgeConfig{Prefix: "p/"}}
+	require.Equal(t, "p/cmd/led", b.mqttFilter("cmd/led"))
+	require.Equal(t, "p/cmd/#", b.mqttFilter("cmd/*"))
+	require.Equal(t, "p/cmd/#", b.mqttFilter("cmd/le*"))
+	require.Equal(t, "p/#", b.mqttFilter("*"))
+
+	_, err := mqttBridgeDialer(MQTTBridgeConfig{Broker: "http://broker"})
+	require.Error(t, err)
+	_, err = mqttBridgeDialer(MQTTBridgeConfig{Broker: "mqtts://broker:8883"})
+	require.NoError(t, err)
+}
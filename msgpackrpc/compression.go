@@ -0,0 +1,178 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CompressionDeflate is the DEFLATE (RFC 1951) compression of the messages.
+const CompressionDeflate = "deflate"
+
+// compressionExtTypes are the MessagePack extension types used to send the
+// compressed messages, for each compression algorithm.
+var compressionExtTypes = map[string]byte{
+	CompressionDeflate: 1,
+}
+
+// maxDecompressedSize is the maximum size of a compressed message once
+// decompressed, to protect against decompression bombs.
+const maxDecompressedSize = 16 * 1024 * 1024
+
+// SetCompression enables the compression of the outgoing messages: the
+// messages that are at least minSize bytes long are compressed with the
+// given algorithm, if this makes them smaller. A compressed message is sent
+// as a MessagePack extension value, whose type identifies the algorithm,
+// containing the compressed message. An empty algorithm disables the
+// compression.
+// The incoming compressed messages are accepted only after the compression
+// has been enabled once, since it must be negotiated with the other side:
+// before that they are rejected as invalid packets, so that an unknown peer
+// can't make the connection decompress large messages.
+func (c *Connection) SetCompression(algorithm string, minSize int) error {
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	if algorithm == "" {
+		c.compressor = nil
+		return nil
+	}
+	extType, ok := compressionExtTypes[algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported compression: %s", algorithm)
+	}
+	w, err := flate.NewWriter(nil, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	c.compressor = &compressor{extType: extType, minSize: minSize, w: w}
+	c.decompression.Store(true)
+	return nil
+}
+
+// Compression returns the compression algorithm of the outgoing messages and
+// the minimum size of the compressed messages, the algorithm is empty if the
+// compression is disabled.
+func (c *Connection) Compression() (string, int) {
+	c.outMutex.Lock()
+	defer c.outMutex.Unlock()
+	if c.compressor == nil {
+		return "", 0
+	}
+	for algorithm, extType := range compressionExtTypes {
+		if extType == c.compressor.extType {
+			return algorithm, c.compressor.minSize
+		}
+	}
+	return "", 0
+}
+
+// compressor compresses the outgoing messages.
+type compressor struct {
+	extType byte
+	minSize int
+	w       *flate.Writer
+	buf     bytes.Buffer
+}
+
+// compress returns the message wrapped in a compressed extension value, or
+// the message as is if it's too small or it doesn't shrink.
+func (z *compressor) compress(msg []byte) []byte {
+	if len(msg) < z.minSize {
+		return msg
+	}
+	z.buf.Reset()
+	// Reserve the room for the longest extension header
+	z.buf.Write(make([]byte, 6))
+	z.w.Reset(&z.buf)
+	if _, err := z.w.Write(msg); err != nil {
+		return msg
+	}
+	if err := z.w.Close(); err != nil {
+		return msg
+	}
+	data := z.buf.Bytes()
+	n := len(data) - 6
+	var header []byte
+	switch {
+	case n <= 0xFF:
+		header = []byte{0xC7, byte(n)}
+	case n <= 0xFFFF:
+		header = binary.BigEndian.AppendUint16([]byte{0xC8}, uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint32([]byte{0xC9}, uint32(n))
+	}
+	header = append(header, z.extType)
+	res := data[6-len(header):]
+	copy(res, header)
+	if len(res) >= len(msg) {
+		return msg
+	}
+	return res
+}
+
+// decompress returns the message contained in a compressed extension
+// value. The boolean is false if data is not an extension value.
+func decompress(data []byte) ([]byte, bool, error) {
+	if len(data) == 0 {
+		return nil, false, nil
+	}
+	var size, headerLen int
+	switch data[0] {
+	case 0xC7:
+		headerLen = 3
+	case 0xC8:
+		headerLen = 4
+	case 0xC9:
+		headerLen = 6
+	case 0xD4, 0xD5, 0xD6, 0xD7, 0xD8:
+		size, headerLen = 1<<(data[0]-0xD4), 2
+	default:
+		return nil, false, nil
+	}
+	if len(data) < headerLen {
+		return nil, true, fmt.Errorf("invalid extension value")
+	}
+	switch data[0] {
+	case 0xC7:
+		size = int(data[1])
+	case 0xC8:
+		size = int(binary.BigEndian.Uint16(data[1:]))
+	case 0xC9:
+		size = int(binary.BigEndian.Uint32(data[1:]))
+	}
+	extType := data[headerLen-1]
+	payload := data[headerLen:]
+	if len(payload) != size {
+		return nil, true, fmt.Errorf("invalid extension value")
+	}
+	if extType != compressionExtTypes[CompressionDeflate] {
+		return nil, true, fmt.Errorf("unsupported compressed message, extension type %d", extType)
+	}
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+	msg, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, true, fmt.Errorf("can't decompress message: %w", err)
+	}
+	if len(msg) > maxDecompressedSize {
+		return nil, true, fmt.Errorf("decompressed message too large")
+	}
+	return msg, true, nil
+}
@@ -16,6 +16,8 @@
 package msgpackrpc
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -34,25 +36,82 @@ const (
 	messageTypeNotification = 2
 )
 
+// CancelRequestMethod is the notification sent to the other side when an
+// outgoing request is canceled, its only parameter is the msgid of the
+// canceled request.
+const CancelRequestMethod = "$/cancelRequest"
+
+// errCodeInvalidParams is the error code of the response to a request whose
+// params can't be decoded, as used by the router.
+const errCodeInvalidParams = 1
+
 // Connection is a MessagePack-RPC connection
 type Connection struct {
 	in                  io.ReadCloser
 	out                 io.WriteCloser
+	outBuffer           bytes.Buffer
 	outEncoder          *msgpack.Encoder
 	outMutex            sync.Mutex
+	compressor          *compressor
 	errorHandler        ErrorHandler
-	requestHandler      RequestHandler
-	notificationHandler NotificationHandler
+	requestHandler      RawRequestHandler
+	notificationHandler RawNotificationHandler
 	logger              Logger
+	concurrent          bool
+	workers             chan struct{}
+
+	// decompression is set once the compression has been negotiated, the
+	// compressed messages received before are rejected.
+	decompression atomic.Bool
+
+	// inReader and inDecoder decode the header of the incoming messages,
+	// they are used only by the Run loop.
+	inReader  bytes.Reader
+	inDecoder *msgpack.Decoder
+	// input buffers the incoming stream, it is set by Run.
+	input *inputRecorder
+
+	activeInRequests      map[MessageID]context.CancelFunc
+	activeInRequestsMutex sync.Mutex
 
 	activeOutRequests      map[MessageID]*outRequest
 	activeOutRequestsMutex sync.Mutex
 	lastOutRequestsIndex   atomic.Uint32
+
+	framesIn     atomic.Uint64
+	framesOut    atomic.Uint64
+	decodeErrors atomic.Uint64
+
+	metadata      map[any]any
+	metadataMutex sync.Mutex
+}
+
+// ConnectionStats holds the counters of the messages exchanged on a Connection.
+type ConnectionStats struct {
+	FramesIn     uint64
+	FramesOut    uint64
+	DecodeErrors uint64
+	// PendingRequests is the number of outgoing requests waiting for a response.
+	PendingRequests int
 }
 
 type outRequest struct {
 	res    ResponseHandler
 	method string
+	// raw is true if the result must be passed to res as a RawMessage
+	raw  bool
+	sent time.Time
+}
+
+// ExpiredRequestError is the error passed to the ResponseHandler of an
+// outgoing request completed by ExpireRequests.
+type ExpiredRequestError struct {
+	Method string
+	Age    time.Duration
+}
+
+func (e *ExpiredRequestError) Error() string {
+	return fmt.Sprintf("no response to %s after %s", e.Method, e.Age.Round(time.Millisecond))
 }
 
 // RequestHandler handles requests from a MessagePack-RPC Connection.
@@ -66,15 +125,24 @@ type ResponseHandler func(result any, err any)
 // NotificationHandler handles notifications from a MessagePack-RPC Connection.
 type NotificationHandler func(logger FunctionLogger, method string, params []any)
 
+// RawRequestHandler handles requests from a MessagePack-RPC Connection
+// created with NewRawConnection, the params are not decoded.
+// The context is canceled when the other side cancels the request with
+// CancelRequestMethod, or when the connection is closed.
+type RawRequestHandler func(ctx context.Context, logger FunctionLogger, method string, params RawMessage, res ResponseHandler)
+
+// RawNotificationHandler handles notifications from a MessagePack-RPC
+// Connection created with NewRawConnection, the params are not decoded.
+type RawNotificationHandler func(logger FunctionLogger, method string, params RawMessage)
+
 // ErrorHandler handles errors from a MessagePack-RPC Connection.
 // It is called when an error occurs while reading from the connection or when
 // sending a request or notification.
 type ErrorHandler func(error)
 
 // NewConnection creates a new MessagePack-RPC Connection handler.
+// Each message is sent to out with a single Write call.
 func NewConnection(in io.ReadCloser, out io.WriteCloser, requestHandler RequestHandler, notificationHandler NotificationHandler, errorHandler ErrorHandler) *Connection {
-	outEncoder := msgpack.NewEncoder(out)
-	outEncoder.UseCompactInts(true)
 	if requestHandler == nil {
 		requestHandler = func(logger FunctionLogger, method string, params []any, res ResponseHandler) {
 			res(nil, fmt.Errorf("method not implemented: %s", method))
@@ -85,21 +153,64 @@ func NewConnection(in io.ReadCloser, out io.WriteCloser, requestHandler RequestH
 			// ignore notifications
 		}
 	}
+	var c *Connection
+	c = NewRawConnection(in, out,
+		func(_ context.Context, logger FunctionLogger, method string, params RawMessage, res ResponseHandler) {
+			if decoded, err := params.DecodeArray(); err != nil {
+				c.decodeErrors.Add(1)
+				c.errorHandler(fmt.Errorf("invalid request params: %w", err))
+				res(nil, []any{errCodeInvalidParams, "invalid request params: " + err.Error()})
+			} else {
+				requestHandler(logger, method, decoded, res)
+			}
+		},
+		func(logger FunctionLogger, method string, params RawMessage) {
+			if decoded, err := params.DecodeArray(); err != nil {
+				c.decodeErrors.Add(1)
+				c.errorHandler(fmt.Errorf("invalid notification params: %w", err))
+			} else {
+				notificationHandler(logger, method, decoded)
+			}
+		},
+		errorHandler)
+	return c
+}
+
+// NewRawConnection creates a new MessagePack-RPC Connection handler that
+// passes the params of the incoming requests and notifications to the
+// handlers without decoding them, so that they can be forwarded with
+// SendRawRequestWithAsyncResult and SendRawNotification.
+// Each message is sent to out with a single Write call.
+func NewRawConnection(in io.ReadCloser, out io.WriteCloser, requestHandler RawRequestHandler, notificationHandler RawNotificationHandler, errorHandler ErrorHandler) *Connection {
+	if requestHandler == nil {
+		requestHandler = func(_ context.Context, logger FunctionLogger, method string, params RawMessage, res ResponseHandler) {
+			res(nil, fmt.Errorf("method not implemented: %s", method))
+		}
+	}
+	if notificationHandler == nil {
+		notificationHandler = func(logger FunctionLogger, method string, params RawMessage) {
+			// ignore notifications
+		}
+	}
 	if errorHandler == nil {
 		errorHandler = func(err error) {
 			// ignore errors
 		}
 	}
-	return &Connection{
+	c := &Connection{
 		in:                  in,
 		out:                 out,
-		outEncoder:          outEncoder,
 		requestHandler:      requestHandler,
 		notificationHandler: notificationHandler,
 		errorHandler:        errorHandler,
+		activeInRequests:    map[MessageID]context.CancelFunc{},
 		activeOutRequests:   map[MessageID]*outRequest{},
 		logger:              NullLogger{},
 	}
+	c.outEncoder = msgpack.NewEncoder(&c.outBuffer)
+	c.inDecoder = msgpack.NewDecoder(&c.inReader)
+	c.outEncoder.UseCompactInts(true)
+	return c
 }
 
 // SetLogger sets the logger for the connection.
@@ -109,73 +220,142 @@ func (c *Connection) SetLogger(l Logger) {
 	c.logger = l
 }
 
+// SetMaxWorkers makes the handlers of the incoming requests run
+// concurrently, each in its own goroutine, at most n at a time (0 =
+// unlimited). When all the workers are busy the connection stops reading
+// until a handler returns. The handlers may then complete in a different
+// order than the requests were received, so this must be enabled only if
+// the client does not rely on the order of its requests.
+// By default the requests are handled one at a time, in order, by the Run
+// loop. The notifications are always handled in order by the Run loop.
+// It is NOT safe to call this method while the connection is running.
+func (c *Connection) SetMaxWorkers(n int) {
+	c.concurrent = true
+	if n > 0 {
+		c.workers = make(chan struct{}, n)
+	} else {
+		c.workers = nil
+	}
+}
+
+// Stats returns the counters of the messages exchanged on the connection.
+func (c *Connection) Stats() ConnectionStats {
+	c.activeOutRequestsMutex.Lock()
+	pending := len(c.activeOutRequests)
+	c.activeOutRequestsMutex.Unlock()
+	return ConnectionStats{
+		FramesIn:        c.framesIn.Load(),
+		FramesOut:       c.framesOut.Load(),
+		DecodeErrors:    c.decodeErrors.Load(),
+		PendingRequests: pending,
+	}
+}
+
 func (c *Connection) Run() {
-	in := msgpack.NewDecoder(c.in)
+	defer c.cancelIncomingRequests()
+	c.input = newInputRecorder(c.in)
+	in := msgpack.NewDecoder(c.input)
 	for {
-		var data []any
 		start := time.Now()
-		if v, err := in.DecodeInterface(); err != nil {
+		// The whole packet is read at once, only its header is decoded
+		// here: the params and the results are decoded when needed.
+		data, err := in.DecodeRaw()
+		if err != nil {
 			c.errorHandler(fmt.Errorf("can't read packet: %w", err))
 			return // unrecoverable
-		} else if s, ok := v.([]any); !ok {
-			c.errorHandler(fmt.Errorf("invalid packet, expected array, got: %T", v))
-			continue // ignore invalid packets
-		} else {
-			data = s
 		}
+		c.input.consumed()
 		elapsed := time.Since(start)
 		c.logger.LogIncomingDataDelay(elapsed)
-
-		if err := c.processIncomingMessage(data); err != nil {
+		c.framesIn.Add(1)
+
+		// Without compression a compressed message is not an array, and it
+		// is rejected as an invalid packet
+		if c.decompression.Load() {
+			if msg, compressed, err := decompress(data); err != nil {
+				c.decodeErrors.Add(1)
+				c.errorHandler(err)
+				continue
+			} else if compressed {
+				data = msg
+			}
+		}
+		if err := c.processIncomingMessage(RawMessage(data)); err != nil {
+			c.decodeErrors.Add(1)
 			c.errorHandler(err)
 		}
 	}
 }
 
-func (c *Connection) processIncomingMessage(data []any) error {
-	if len(data) < 3 {
+// UnreadInput returns the bytes read from the input but not processed yet,
+// including the beginning of a message not received completely. It must be
+// called after Run returns, for example to hand the stream over to another
+// process after stopping Run with a read deadline.
+func (c *Connection) UnreadInput() []byte {
+	if c.input == nil {
+		return nil
+	}
+	return c.input.unread()
+}
+
+func (c *Connection) processIncomingMessage(data RawMessage) error {
+	// The header decoder is reused for all the messages, the elements of
+	// the header are decoded to their concrete types to avoid boxing them.
+	c.inReader.Reset(data)
+	dec := c.inDecoder
+	dec.Reset(&c.inReader)
+	// rest returns the last element of the packet, without decoding it
+	rest := func() RawMessage {
+		return data[len(data)-c.inReader.Len():]
+	}
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid packet, expected array")
+	}
+	if n < 3 {
 		return fmt.Errorf("invalid packet, expected array with at least 3 elements")
 	}
 
-	msgType, ok := ToInt(data[0])
-	if !ok {
-		return fmt.Errorf("invalid packet, expected int as first element, got %T", data[0])
+	msgType, err := dec.DecodeInt()
+	if err != nil {
+		return fmt.Errorf("invalid packet, expected int as first element")
 	}
 
 	switch msgType {
 	case messageTypeRequest:
-		if len(data) != 4 {
+		if n != 4 {
 			return fmt.Errorf("invalid request, expected array with 4 elements")
 		}
-		if id, ok := ToUint(data[1]); !ok {
+		if id, err := dec.DecodeUint(); err != nil {
 			return fmt.Errorf("invalid request, expected msgid (uint) as second element")
-		} else if method, ok := data[2].(string); !ok {
+		} else if method, err := dec.DecodeString(); err != nil {
 			return fmt.Errorf("invalid request, expected method (string) as third element")
-		} else if params, ok := data[3].([]any); !ok {
+		} else if params := rest(); !params.isArray() {
 			return fmt.Errorf("invalid request, expected params (array) as fourth element")
 		} else {
 			c.handleIncomingRequest(MessageID(id), method, params)
 		}
 		return nil
 	case messageTypeResponse:
-		if len(data) != 4 {
+		if n != 4 {
 			return fmt.Errorf("invalid response, expected array with 4 elements")
 		}
-		if id, ok := ToUint(data[1]); !ok {
+		if id, err := dec.DecodeUint(); err != nil {
 			return fmt.Errorf("invalid response, expected msgid (uint) as second element")
+		} else if reqError, err := dec.DecodeInterface(); err != nil {
+			return fmt.Errorf("invalid response, can't decode error: %w", err)
 		} else {
-			reqError := data[2]
-			reqResult := data[3]
-			c.handleIncomingResponse(MessageID(id), reqError, reqResult)
+			c.handleIncomingResponse(MessageID(id), reqError, rest())
 		}
 		return nil
 	case messageTypeNotification:
-		if len(data) != 3 {
+		if n != 3 {
 			return fmt.Errorf("invalid notification, expected array with 3 elements")
 		}
-		if method, ok := data[1].(string); !ok {
+		if method, err := dec.DecodeString(); err != nil {
 			return fmt.Errorf("invalid notification, expected method (string) as second element")
-		} else if params, ok := data[2].([]any); !ok {
+		} else if params := rest(); !params.isArray() {
 			return fmt.Errorf("invalid notification, expected params (array) as third element")
 		} else {
 			c.handleIncomingNotification(method, params)
@@ -186,29 +366,89 @@ func (c *Connection) processIncomingMessage(data []any) error {
 	}
 }
 
-func (c *Connection) handleIncomingRequest(id MessageID, method string, params []any) {
-	logger := c.logger.LogIncomingRequest(id, method, params)
+// loggedParams returns the decoded params for the logger, they are decoded
+// only if a logger is set.
+func (c *Connection) loggedParams(params RawMessage) []any {
+	if _, ok := c.logger.(NullLogger); ok {
+		return nil
+	}
+	decoded, _ := params.DecodeArray()
+	return decoded
+}
+
+func (c *Connection) handleIncomingRequest(id MessageID, method string, params RawMessage) {
+	logger := c.logger.LogIncomingRequest(id, method, c.loggedParams(params))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.activeInRequestsMutex.Lock()
+	c.activeInRequests[id] = cancel
+	c.activeInRequestsMutex.Unlock()
 
 	// This callback may be called by another goroutine, because the request handler
 	// may want to process the request asynchronously.
 	cb := func(reqResult, reqError any) {
+		c.activeInRequestsMutex.Lock()
+		delete(c.activeInRequests, id)
+		c.activeInRequestsMutex.Unlock()
+		cancel()
 		c.logger.LogOutgoingResponse(id, method, reqResult, reqError)
 
-		if err := c.send(messageTypeResponse, id, reqError, reqResult); err != nil {
+		if err := c.send(messageTypeResponse, id, "", reqError, reqResult); err != nil {
 			c.errorHandler(fmt.Errorf("error sending response: %w", err))
 			c.Close()
 		}
 	}
 
-	c.requestHandler(logger, method, params, cb)
+	if !c.concurrent {
+		c.requestHandler(ctx, logger, method, params, cb)
+		return
+	}
+	if c.workers == nil {
+		go c.requestHandler(ctx, logger, method, params, cb)
+		return
+	}
+	c.workers <- struct{}{}
+	go func() {
+		defer func() { <-c.workers }()
+		c.requestHandler(ctx, logger, method, params, cb)
+	}()
 }
 
-func (c *Connection) handleIncomingNotification(method string, params []any) {
-	logger := c.logger.LogIncomingNotification(method, params)
+// cancelIncomingRequest cancels the context of the incoming request with the
+// given ID, if it's still being handled.
+func (c *Connection) cancelIncomingRequest(id MessageID) {
+	c.activeInRequestsMutex.Lock()
+	cancel, ok := c.activeInRequests[id]
+	c.activeInRequestsMutex.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// cancelIncomingRequests cancels the context of all the incoming requests
+// still being handled, it's called when the connection is closed.
+func (c *Connection) cancelIncomingRequests() {
+	c.activeInRequestsMutex.Lock()
+	defer c.activeInRequestsMutex.Unlock()
+	for _, cancel := range c.activeInRequests {
+		cancel()
+	}
+}
+
+func (c *Connection) handleIncomingNotification(method string, params RawMessage) {
+	if method == CancelRequestMethod {
+		if decoded, err := params.DecodeArray(); err == nil && len(decoded) == 1 {
+			if id, ok := ToUint(decoded[0]); ok {
+				c.logger.LogIncomingCancelRequest(MessageID(id))
+				c.cancelIncomingRequest(MessageID(id))
+			}
+		}
+	}
+	logger := c.logger.LogIncomingNotification(method, c.loggedParams(params))
 	c.notificationHandler(logger, method, params)
 }
 
-func (c *Connection) handleIncomingResponse(id MessageID, reqError any, reqResult any) {
+func (c *Connection) handleIncomingResponse(id MessageID, reqError any, rawResult RawMessage) {
 	c.activeOutRequestsMutex.Lock()
 	req, ok := c.activeOutRequests[id]
 	if ok {
@@ -221,6 +461,15 @@ func (c *Connection) handleIncomingResponse(id MessageID, reqError any, reqResul
 		return
 	}
 
+	var reqResult any = rawResult
+	if !req.raw {
+		if v, err := rawResult.Decode(); err != nil {
+			c.decodeErrors.Add(1)
+			c.errorHandler(fmt.Errorf("invalid result in response '%v': %w", id, err))
+		} else {
+			reqResult = v
+		}
+	}
 	c.logger.LogIncomingResponse(id, req.method, reqResult, reqError)
 
 	req.res(reqResult, reqError)
@@ -231,9 +480,14 @@ func (c *Connection) Close() {
 	_ = c.out.Close()
 }
 
-func (c *Connection) sendRequest(method string, params []any, res ResponseHandler) (MessageID, error) {
-	if params == nil {
+func (c *Connection) sendRequest(method string, params []any, raw RawMessage, res ResponseHandler) (MessageID, error) {
+	var encodedParams any = params
+	if raw != nil {
+		encodedParams = raw
+		params = c.loggedParams(raw)
+	} else if params == nil {
 		params = []any{}
+		encodedParams = params
 	}
 	id := MessageID(c.lastOutRequestsIndex.Add(1))
 
@@ -241,12 +495,14 @@ func (c *Connection) sendRequest(method string, params []any, res ResponseHandle
 	c.activeOutRequests[id] = &outRequest{
 		method: method,
 		res:    res,
+		raw:    raw != nil,
+		sent:   time.Now(),
 	}
 	c.activeOutRequestsMutex.Unlock()
 
 	c.logger.LogOutgoingRequest(id, method, params)
 
-	if err := c.send(messageTypeRequest, id, method, params); err != nil {
+	if err := c.send(messageTypeRequest, id, method, encodedParams); err != nil {
 		c.activeOutRequestsMutex.Lock()
 		delete(c.activeOutRequests, id)
 		c.activeOutRequestsMutex.Unlock()
@@ -256,32 +512,134 @@ func (c *Connection) sendRequest(method string, params []any, res ResponseHandle
 	return id, nil
 }
 
+// SendRequestWithAsyncResult sends a request and returns without waiting
+// for the response: res is called by the Run loop when the response arrives.
+// res must not block, since no other message is read until it returns.
+// No goroutine is used to wait for the response, so any number of requests
+// may be pending at the same time.
 func (c *Connection) SendRequestWithAsyncResult(res ResponseHandler, method string, params ...any) error {
-	_, err := c.sendRequest(method, params, res)
+	_, err := c.sendRequest(method, params, nil, res)
 	return err
 }
 
-func (c *Connection) SendRequest(ctx context.Context, method string, params ...any) (any, any, error) {
-	var reqResult, reqError any
-	done := make(chan struct{})
-	id, err := c.sendRequest(method, params, func(result any, err any) {
-		reqResult = result
-		reqError = err
-		close(done)
+// SendRawRequestWithAsyncResult sends a request with the already encoded
+// params (an array), as received by a RawRequestHandler. The result is
+// passed to res as a RawMessage, so that it can be forwarded as is.
+func (c *Connection) SendRawRequestWithAsyncResult(res ResponseHandler, method string, params RawMessage) error {
+	if !params.isArray() {
+		return fmt.Errorf("invalid params, expected array")
+	}
+	_, err := c.sendRequest(method, nil, params, res)
+	return err
+}
+
+// PendingRequest is a request sent with SendRequestAsync.
+type PendingRequest struct {
+	conn   *Connection
+	id     MessageID
+	done   chan struct{}
+	result any
+	err    any
+}
+
+// SendRequestAsync sends a request and returns without waiting for the
+// response: the returned PendingRequest is completed when the response
+// arrives. It can be used to wait for several responses with a select,
+// without using a goroutine for each of them.
+func (c *Connection) SendRequestAsync(method string, params ...any) (*PendingRequest, error) {
+	req := &PendingRequest{conn: c, done: make(chan struct{})}
+	id, err := c.sendRequest(method, params, nil, func(result any, err any) {
+		req.result = result
+		req.err = err
+		close(req.done)
 	})
+	if err != nil {
+		return nil, err
+	}
+	req.id = id
+	return req, nil
+}
+
+// Done returns a channel closed when the response of the request arrives.
+func (r *PendingRequest) Done() <-chan struct{} {
+	return r.done
+}
+
+// Result returns the result and the error of the request. It must be called
+// after the channel returned by Done is closed.
+func (r *PendingRequest) Result() (result any, err any) {
+	return r.result, r.err
+}
+
+// Cancel discards the response of the request, if not received yet, and
+// sends CancelRequestMethod to the other side. After Cancel the channel
+// returned by Done may never be closed.
+func (r *PendingRequest) Cancel() {
+	r.conn.cancelRequest(r.id)
+}
+
+// SendRequest sends a request and waits for its response. If ctx is canceled
+// before the response arrives, the request is canceled and ctx.Err() is
+// returned.
+func (c *Connection) SendRequest(ctx context.Context, method string, params ...any) (any, any, error) {
+	req, err := c.SendRequestAsync(method, params...)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	select {
-	case <-done:
+	case <-req.Done():
 		// OK
 	case <-ctx.Done():
-		c.logger.LogOutgoingCancelRequest(id)
+		req.Cancel()
 		return nil, nil, ctx.Err()
 	}
 
-	return reqResult, reqError, nil
+	result, reqError := req.Result()
+	return result, reqError, nil
+}
+
+// cancelRequest discards the response of the given outgoing request, and
+// notifies the other side that the request has been canceled.
+func (c *Connection) cancelRequest(id MessageID) {
+	c.activeOutRequestsMutex.Lock()
+	req, ok := c.activeOutRequests[id]
+	if ok {
+		// Keep the request, so that a late response is silently dropped
+		req.res = func(any, any) {}
+	}
+	c.activeOutRequestsMutex.Unlock()
+	if !ok {
+		// The response has already been received
+		return
+	}
+
+	c.logger.LogOutgoingCancelRequest(id)
+	if err := c.send(messageTypeNotification, 0, CancelRequestMethod, []any{id}); err != nil {
+		c.errorHandler(fmt.Errorf("sending cancel request: %w", err))
+	}
+}
+
+// ExpireRequests completes the outgoing requests waiting for a response for
+// longer than maxAge with an *ExpiredRequestError, and returns how many
+// requests expired. A late response of an expired request is reported to the
+// ErrorHandler, as a response to an unknown request.
+func (c *Connection) ExpireRequests(maxAge time.Duration) int {
+	now := time.Now()
+	var expired []*outRequest
+	c.activeOutRequestsMutex.Lock()
+	for id, req := range c.activeOutRequests {
+		if now.Sub(req.sent) > maxAge {
+			delete(c.activeOutRequests, id)
+			expired = append(expired, req)
+		}
+	}
+	c.activeOutRequestsMutex.Unlock()
+
+	for _, req := range expired {
+		req.res(nil, &ExpiredRequestError{Method: req.method, Age: now.Sub(req.sent)})
+	}
+	return len(expired)
 }
 
 func (c *Connection) SendNotification(method string, params ...any) error {
@@ -291,24 +649,141 @@ func (c *Connection) SendNotification(method string, params ...any) error {
 
 	c.logger.LogOutgoingNotification(method, params)
 
-	if err := c.send(messageTypeNotification, method, params); err != nil {
+	if err := c.send(messageTypeNotification, 0, method, params); err != nil {
+		return fmt.Errorf("sending notification: %w", err)
+	}
+	return nil
+}
+
+// SendRawNotification sends a notification with the already encoded params
+// (an array), as received by a RawNotificationHandler.
+func (c *Connection) SendRawNotification(method string, params RawMessage) error {
+	if !params.isArray() {
+		return fmt.Errorf("invalid params, expected array")
+	}
+
+	c.logger.LogOutgoingNotification(method, c.loggedParams(params))
+
+	if err := c.send(messageTypeNotification, 0, method, params); err != nil {
 		return fmt.Errorf("sending notification: %w", err)
 	}
 	return nil
 }
 
-func (c *Connection) send(data ...any) error {
+// send sends a message with a single Write call. The header of the message
+// (the type, the msgid of requests and responses and the method of requests
+// and notifications) is encoded directly, to avoid boxing it, and it is
+// followed by the given elements.
+func (c *Connection) send(msgType int, id MessageID, method string, elems ...any) error {
 	start := time.Now()
 
 	c.outMutex.Lock()
-	err := c.outEncoder.Encode(data)
+	c.outBuffer.Reset()
+	err := c.encodeMessage(msgType, id, method, elems)
+	if err == nil {
+		msg := c.outBuffer.Bytes()
+		if c.compressor != nil {
+			msg = c.compressor.compress(msg)
+		}
+		_, err = c.out.Write(msg)
+	}
 	c.outMutex.Unlock()
 	if err != nil {
 		return err
 	}
+	c.framesOut.Add(1)
 
 	elapsed := time.Since(start)
 
 	c.logger.LogOutgoingDataDelay(elapsed)
 	return nil
 }
+
+func (c *Connection) encodeMessage(msgType int, id MessageID, method string, elems []any) error {
+	enc := c.outEncoder
+	hasID := msgType != messageTypeNotification
+	hasMethod := msgType != messageTypeResponse
+	n := 1 + len(elems)
+	if hasID {
+		n++
+	}
+	if hasMethod {
+		n++
+	}
+	if err := enc.EncodeArrayLen(n); err != nil {
+		return err
+	}
+	if err := enc.EncodeInt(int64(msgType)); err != nil {
+		return err
+	}
+	if hasID {
+		if err := enc.EncodeUint(uint64(id)); err != nil {
+			return err
+		}
+	}
+	if hasMethod {
+		if err := enc.EncodeString(method); err != nil {
+			return err
+		}
+	}
+	for _, e := range elems {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inputRecorder buffers the incoming stream and keeps the bytes of the
+// message being decoded, so that the unprocessed input can be retrieved when
+// the decoding is interrupted.
+type inputRecorder struct {
+	r       *bufio.Reader
+	partial []byte
+}
+
+// maxRecorderCapacity is the capacity of the buffer of the partial message
+// kept between the messages, the buffers of the larger messages are released.
+const maxRecorderCapacity = 64 * 1024
+
+func newInputRecorder(in io.Reader) *inputRecorder {
+	return &inputRecorder{r: bufio.NewReader(in)}
+}
+
+func (i *inputRecorder) Read(p []byte) (int, error) {
+	n, err := i.r.Read(p)
+	i.partial = append(i.partial, p[:n]...)
+	return n, err
+}
+
+func (i *inputRecorder) ReadByte() (byte, error) {
+	b, err := i.r.ReadByte()
+	if err == nil {
+		i.partial = append(i.partial, b)
+	}
+	return b, err
+}
+
+func (i *inputRecorder) UnreadByte() error {
+	if err := i.r.UnreadByte(); err != nil {
+		return err
+	}
+	i.partial = i.partial[:len(i.partial)-1]
+	return nil
+}
+
+// consumed discards the bytes of the message just decoded.
+func (i *inputRecorder) consumed() {
+	if cap(i.partial) > maxRecorderCapacity {
+		i.partial = nil
+	} else {
+		i.partial = i.partial[:0]
+	}
+}
+
+// unread returns the bytes of the message being decoded followed by the
+// buffered bytes.
+func (i *inputRecorder) unread() []byte {
+	buffered, _ := i.r.Peek(i.r.Buffered())
+	return append(bytes.Clone(i.partial), buffered...)
+}
@@ -0,0 +1,159 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type discardCloser struct{ io.Writer }
+
+func (discardCloser) Close() error { return nil }
+
+// encodeMessage returns the MessagePack encoding of the message.
+func encodeMessage(tb testing.TB, msg ...any) RawMessage {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.UseCompactInts(true)
+	if err := enc.Encode(msg); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// benchmarkConnection returns a connection writing to nowhere, whose raw
+// handlers answer immediately.
+func benchmarkConnection() *Connection {
+	return NewRawConnection(io.NopCloser(nil), discardCloser{io.Discard},
+		func(_ context.Context, logger FunctionLogger, method string, params RawMessage, res ResponseHandler) {
+			res(nil, nil)
+		},
+		func(logger FunctionLogger, method string, params RawMessage) {},
+		nil)
+}
+
+func BenchmarkSendNotification(b *testing.B) {
+	conn := benchmarkConnection()
+	payload := make([]byte, 256)
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := conn.SendNotification("tcp/write", 1, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendRawNotification(b *testing.B) {
+	conn := benchmarkConnection()
+	params := encodeMessage(b, 1, make([]byte, 256))
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := conn.SendRawNotification("tcp/write", params); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcessIncomingMessage(b *testing.B) {
+	payload := make([]byte, 256)
+	messages := map[string]RawMessage{
+		"request":      encodeMessage(b, messageTypeRequest, 1234, "tcp/write", []any{1, payload}),
+		"notification": encodeMessage(b, messageTypeNotification, "tcp/write", []any{1, payload}),
+	}
+	for name, msg := range messages {
+		b.Run(name, func(b *testing.B) {
+			conn := benchmarkConnection()
+			b.ReportAllocs()
+			for b.Loop() {
+				if err := conn.processIncomingMessage(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("response", func(b *testing.B) {
+		conn := benchmarkConnection()
+		msg := encodeMessage(b, messageTypeResponse, 1, nil, payload)
+		res := func(result, err any) {}
+		b.ReportAllocs()
+		for b.Loop() {
+			conn.activeOutRequests[1] = &outRequest{method: "tcp/read", res: res, raw: true}
+			if err := conn.processIncomingMessage(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecodeArray(b *testing.B) {
+	params := encodeMessage(b, 1, make([]byte, 256))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := params.DecodeArray(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestAllocationBudget checks the allocations of the hot path of a raw
+// connection, to catch regressions that the benchmarks would only show.
+func TestAllocationBudget(t *testing.T) {
+	payload := make([]byte, 256)
+	conn := benchmarkConnection()
+	request := encodeMessage(t, messageTypeRequest, 1234, "tcp/write", []any{1, payload})
+	notification := encodeMessage(t, messageTypeNotification, "tcp/write", []any{1, payload})
+	response := encodeMessage(t, messageTypeResponse, 1, nil, payload)
+	params := encodeMessage(t, 1, payload)
+	res := func(result, err any) {}
+
+	tests := []struct {
+		name   string
+		budget float64
+		run    func() error
+	}{
+		// One of the allocations of a request is its cancelable context
+		{"request", 9, func() error {
+			return conn.processIncomingMessage(request)
+		}},
+		{"notification", 4, func() error {
+			return conn.processIncomingMessage(notification)
+		}},
+		{"response", 3, func() error {
+			conn.activeOutRequests[1] = &outRequest{method: "tcp/read", res: res, raw: true}
+			return conn.processIncomingMessage(response)
+		}},
+		{"raw notification", 2, func() error {
+			return conn.SendRawNotification("tcp/write", params)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allocs := testing.AllocsPerRun(100, func() {
+				if err := test.run(); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if allocs > test.budget {
+				t.Errorf("%v allocations, the budget is %v", allocs, test.budget)
+			}
+		})
+	}
+}
@@ -16,10 +16,16 @@
 package msgpackrpc
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/djherbis/buffer"
 	"github.com/djherbis/nio/v3"
@@ -115,10 +121,504 @@ func TestRPCConnection(t *testing.T) {
 		wg.Wait()
 	}
 
+	{ // Test canceled outgoing request
+		ctx, cancel := context.WithCancel(t.Context())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := conn.SendRequest(ctx, "slow")
+			require.ErrorIs(t, err, context.Canceled)
+		}()
+		msg, err := d.DecodeSlice() // Grab the SendRequest
+		require.NoError(t, err)
+		require.Equal(t, []any{int64(0), int64(2), "slow", []any{}}, msg)
+		cancel()
+		msg, err = d.DecodeSlice() // Grab the cancel notification
+		require.NoError(t, err)
+		require.Equal(t, []any{int64(2), CancelRequestMethod, []any{int64(2)}}, msg)
+		wg.Wait()
+		// The late response is silently dropped
+		send(messageTypeResponse, 2, nil, true)
+	}
+
 	{ // Test invalid response
 		wg.Add(1)
 		send(1, 999, 10, nil)
 		wg.Wait()
 		require.Equal(t, "error=invalid ID in request response '999': double answer or request not sent", requestError)
 	}
+
+	{ // Test invalid packet
+		wg.Add(1)
+		send(1, 999)
+		wg.Wait()
+		require.Equal(t, "error=invalid packet, expected array with at least 3 elements", requestError)
+	}
+
+	require.Equal(t, ConnectionStats{FramesIn: 7, FramesOut: 5, DecodeErrors: 1}, conn.Stats())
+}
+
+func TestRawForwarding(t *testing.T) {
+	in, testdataIn := nio.Pipe(buffer.New(1024))
+	testdataOut, out := nio.Pipe(buffer.New(1024))
+	d := msgpack.NewDecoder(testdataOut)
+	d.UseLooseInterfaceDecoding(true)
+
+	var conn *Connection
+	conn = NewRawConnection(
+		in, out,
+		func(_ context.Context, logger FunctionLogger, method string, params RawMessage, res ResponseHandler) {
+			// Forward the request back to the other side, the result is
+			// sent back to the caller as is
+			require.NoError(t, conn.SendRawRequestWithAsyncResult(func(result, err any) {
+				require.IsType(t, RawMessage{}, result)
+				res(result, err)
+			}, "forwarded/"+method, params))
+		},
+		func(logger FunctionLogger, method string, params RawMessage) {
+			require.NoError(t, conn.SendRawNotification("forwarded/"+method, params))
+		},
+		nil,
+	)
+	t.Cleanup(conn.Close)
+	go conn.Run()
+
+	enc := msgpack.NewEncoder(testdataIn)
+	enc.UseCompactInts(true)
+	send := func(msg ...any) {
+		require.NoError(t, enc.Encode(msg))
+	}
+	payload := make([]byte, 300)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	// The payload must be forwarded as bin 16, the loose decoder would
+	// return it as a string anyway
+	binPayload := append([]byte{0xc5, 0x01, 0x2c}, payload...)
+	recv := func() ([]any, []byte) {
+		raw, err := d.DecodeRaw()
+		require.NoError(t, err)
+		rd := msgpack.NewDecoder(bytes.NewReader(raw))
+		rd.UseLooseInterfaceDecoding(true)
+		msg, err := rd.DecodeSlice()
+		require.NoError(t, err)
+		return msg, raw
+	}
+
+	send(messageTypeRequest, MessageID(7), "tcp/write", []any{1, payload})
+	msg, raw := recv()
+	require.Equal(t, []any{int64(0), int64(1), "forwarded/tcp/write", []any{int64(1), string(payload)}}, msg)
+	require.True(t, bytes.HasSuffix(raw, binPayload))
+	send(messageTypeResponse, 1, nil, map[string]any{"written": 100})
+	msg, _ = recv()
+	require.Equal(t, []any{int64(1), int64(7), nil, map[string]any{"written": int64(100)}}, msg)
+
+	send(messageTypeNotification, "log", []any{"hello", payload})
+	msg, raw = recv()
+	require.Equal(t, []any{int64(2), "forwarded/log", []any{"hello", string(payload)}}, msg)
+	require.True(t, bytes.HasSuffix(raw, binPayload))
+
+	require.Error(t, conn.SendRawNotification("invalid", RawMessage{0x01}))
+}
+
+func TestIncomingRequestCanceled(t *testing.T) {
+	in, testdataIn := nio.Pipe(buffer.New(1024))
+	testdataOut, out := nio.Pipe(buffer.New(1024))
+	d := msgpack.NewDecoder(testdataOut)
+	d.UseLooseInterfaceDecoding(true)
+
+	conn := NewRawConnection(
+		in, out,
+		func(ctx context.Context, logger FunctionLogger, method string, params RawMessage, res ResponseHandler) {
+			// Block until the request is canceled
+			<-ctx.Done()
+			res(nil, ctx.Err().Error())
+		},
+		nil,
+		nil,
+	)
+	conn.SetMaxWorkers(2)
+	go conn.Run()
+
+	enc := msgpack.NewEncoder(testdataIn)
+	enc.UseCompactInts(true)
+	send := func(msg ...any) {
+		require.NoError(t, enc.Encode(msg))
+	}
+
+	send(messageTypeRequest, MessageID(1), "tcp/accept", []any{1})
+	send(messageTypeRequest, MessageID(2), "tcp/accept", []any{2})
+	send(messageTypeNotification, CancelRequestMethod, []any{2})
+	msg, err := d.DecodeSlice()
+	require.NoError(t, err)
+	require.Equal(t, []any{int64(1), int64(2), "context canceled", nil}, msg)
+
+	// The pending requests are canceled when the connection is closed
+	canceled := make(chan struct{})
+	conn.activeInRequestsMutex.Lock()
+	cancel := conn.activeInRequests[1]
+	conn.activeInRequests[1] = func() { cancel(); close(canceled) }
+	conn.activeInRequestsMutex.Unlock()
+	testdataIn.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		require.FailNow(t, "the request was not canceled")
+	}
+}
+
+func TestAsyncRequests(t *testing.T) {
+	in, testdataIn := nio.Pipe(buffer.New(1024))
+	testdataOut, out := nio.Pipe(buffer.New(1024))
+	d := msgpack.NewDecoder(testdataOut)
+	d.UseLooseInterfaceDecoding(true)
+
+	conn := NewConnection(in, out, nil, nil, nil)
+	t.Cleanup(conn.Close)
+	go conn.Run()
+
+	enc := msgpack.NewEncoder(testdataIn)
+	enc.UseCompactInts(true)
+	send := func(msg ...any) {
+		require.NoError(t, enc.Encode(msg))
+	}
+	receive := func() []any {
+		msg, err := d.DecodeSlice()
+		require.NoError(t, err)
+		return msg
+	}
+
+	first, err := conn.SendRequestAsync("first", 1)
+	require.NoError(t, err)
+	require.Equal(t, []any{int64(0), int64(1), "first", []any{int64(1)}}, receive())
+	second, err := conn.SendRequestAsync("second", 2)
+	require.NoError(t, err)
+	require.Equal(t, []any{int64(0), int64(2), "second", []any{int64(2)}}, receive())
+	results := make(chan any, 1)
+	require.NoError(t, conn.SendRequestWithAsyncResult(func(result, err any) {
+		results <- result
+	}, "third"))
+	require.Equal(t, []any{int64(0), int64(3), "third", []any{}}, receive())
+
+	// The responses may arrive in any order
+	send(messageTypeResponse, 2, nil, "two")
+	select {
+	case <-second.Done():
+	case <-first.Done():
+		require.FailNow(t, "unexpected response of the first request")
+	case <-time.After(time.Second):
+		require.FailNow(t, "response not received")
+	}
+	result, reqErr := second.Result()
+	require.Equal(t, "two", result)
+	require.Nil(t, reqErr)
+
+	send(messageTypeResponse, 3, nil, "three")
+	require.Equal(t, "three", <-results)
+
+	// A canceled request is notified to the other side, and its late
+	// response is discarded
+	first.Cancel()
+	require.Equal(t, []any{int64(2), CancelRequestMethod, []any{int64(1)}}, receive())
+	send(messageTypeResponse, 1, nil, "one")
+	select {
+	case <-first.Done():
+		require.FailNow(t, "response of a canceled request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Zero(t, conn.Stats().PendingRequests)
+}
+
+func TestMaxWorkers(t *testing.T) {
+	in, testdataIn := nio.Pipe(buffer.New(1024))
+	testdataOut, out := nio.Pipe(buffer.New(1024))
+	d := msgpack.NewDecoder(testdataOut)
+	d.UseLooseInterfaceDecoding(true)
+
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	conn := NewConnection(
+		in, out,
+		func(logger FunctionLogger, method string, params []any, res ResponseHandler) {
+			started <- method
+			<-release
+			res(method, nil)
+		},
+		nil, nil,
+	)
+	conn.SetMaxWorkers(2)
+	t.Cleanup(conn.Close)
+	go conn.Run()
+
+	enc := msgpack.NewEncoder(testdataIn)
+	for i, method := range []string{"a", "b", "c"} {
+		require.NoError(t, enc.Encode([]any{messageTypeRequest, i + 1, method, []any{}}))
+	}
+
+	// Only two requests are handled at the same time
+	require.ElementsMatch(t, []string{"a", "b"}, []string{<-started, <-started})
+	select {
+	case method := <-started:
+		require.Fail(t, "too many concurrent requests", method)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	require.Equal(t, "c", <-started)
+	close(release)
+
+	results := map[any]bool{}
+	for range 3 {
+		msg, err := d.DecodeSlice()
+		require.NoError(t, err)
+		results[msg[3]] = true
+	}
+	require.Equal(t, map[any]bool{"a": true, "b": true, "c": true}, results)
+}
+
+func TestRequestsOrder(t *testing.T) {
+	start := func(t *testing.T, setup func(conn *Connection)) (chan string, chan struct{}) {
+		in, testdataIn := nio.Pipe(buffer.New(1024))
+		_, out := nio.Pipe(buffer.New(1024))
+		started := make(chan string, 10)
+		release := make(chan struct{})
+		conn := NewConnection(
+			in, out,
+			func(logger FunctionLogger, method string, params []any, res ResponseHandler) {
+				started <- method
+				<-release
+				res(method, nil)
+			},
+			nil, nil,
+		)
+		setup(conn)
+		t.Cleanup(conn.Close)
+		go conn.Run()
+
+		enc := msgpack.NewEncoder(testdataIn)
+		for i, method := range []string{"a", "b", "c"} {
+			require.NoError(t, enc.Encode([]any{messageTypeRequest, i + 1, method, []any{}}))
+		}
+		return started, release
+	}
+
+	t.Run("InOrderByDefault", func(t *testing.T) {
+		started, release := start(t, func(*Connection) {})
+		for _, method := range []string{"a", "b", "c"} {
+			require.Equal(t, method, <-started)
+			select {
+			case other := <-started:
+				require.Fail(t, "request handled before the previous one", other)
+			case <-time.After(20 * time.Millisecond):
+			}
+			release <- struct{}{}
+		}
+	})
+
+	t.Run("UnlimitedWorkers", func(t *testing.T) {
+		started, release := start(t, func(conn *Connection) { conn.SetMaxWorkers(0) })
+		require.ElementsMatch(t, []string{"a", "b", "c"}, []string{<-started, <-started, <-started})
+		close(release)
+	})
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	io.WriteCloser
+	n atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.WriteCloser.Write(p)
+}
+
+func TestCompression(t *testing.T) {
+	aIn, bOut := nio.Pipe(buffer.New(64 * 1024))
+	bIn, aOut := nio.Pipe(buffer.New(64 * 1024))
+	wire := &countingWriter{WriteCloser: aOut}
+
+	a := NewConnection(aIn, wire, nil, nil, nil)
+	b := NewConnection(bIn, bOut,
+		func(logger FunctionLogger, method string, params []any, res ResponseHandler) {
+			res(params[0], nil)
+		}, nil, nil)
+	t.Cleanup(a.Close)
+	t.Cleanup(b.Close)
+	go a.Run()
+	go b.Run()
+
+	// The compression is negotiated on both sides
+	require.Error(t, a.SetCompression("lz4", 0))
+	require.NoError(t, a.SetCompression(CompressionDeflate, 64))
+	require.NoError(t, b.SetCompression(CompressionDeflate, 64))
+	algorithm, minSize := a.Compression()
+	require.Equal(t, CompressionDeflate, algorithm)
+	require.Equal(t, 64, minSize)
+
+	// Large messages are compressed, and decompressed by the other side
+	payload := strings.Repeat("-----BEGIN CERTIFICATE-----\n", 100)
+	result, reqErr, err := a.SendRequest(t.Context(), "echo", payload)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, payload, result)
+	require.Less(t, wire.n.Load(), int64(len(payload)/4))
+
+	// Small messages are sent as they are
+	wire.n.Store(0)
+	result, _, err = a.SendRequest(t.Context(), "echo", "hi")
+	require.NoError(t, err)
+	require.Equal(t, "hi", result)
+	require.Equal(t, int64(12), wire.n.Load())
+
+	// The compressed replies are still decompressed after disabling the
+	// compression of the outgoing messages
+	require.NoError(t, a.SetCompression("", 0))
+	algorithm, _ = a.Compression()
+	require.Empty(t, algorithm)
+	result, _, err = a.SendRequest(t.Context(), "echo", payload)
+	require.NoError(t, err)
+	require.Equal(t, payload, result)
+	require.Greater(t, wire.n.Load(), int64(len(payload)))
+}
+
+func TestCompressionNotNegotiated(t *testing.T) {
+	aIn, bOut := nio.Pipe(buffer.New(64 * 1024))
+	bIn, aOut := nio.Pipe(buffer.New(64 * 1024))
+
+	errs := make(chan error, 10)
+	a := NewConnection(aIn, aOut, nil, nil, nil)
+	b := NewConnection(bIn, bOut,
+		func(logger FunctionLogger, method string, params []any, res ResponseHandler) {
+			res(params[0], nil)
+		}, nil, func(err error) { errs <- err })
+	t.Cleanup(a.Close)
+	t.Cleanup(b.Close)
+	go a.Run()
+	go b.Run()
+
+	// The compressed messages are rejected until b enables the compression
+	require.NoError(t, a.SetCompression(CompressionDeflate, 64))
+	payload := strings.Repeat("-----BEGIN CERTIFICATE-----\n", 100)
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err := a.SendRequest(ctx, "echo", payload)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, <-errs, "invalid packet, expected array")
+	require.Equal(t, uint64(1), b.Stats().DecodeErrors)
+
+	require.NoError(t, b.SetCompression(CompressionDeflate, 64))
+	result, reqErr, err := a.SendRequest(t.Context(), "echo", payload)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, payload, result)
+}
+
+func TestUnreadInput(t *testing.T) {
+	in, out := net.Pipe()
+	notifications := make(chan string, 1)
+	conn := NewConnection(in, in, nil, func(_ FunctionLogger, method string, _ []any) {
+		notifications <- method
+	}, nil)
+	done := make(chan struct{})
+	go func() {
+		conn.Run()
+		close(done)
+	}()
+
+	// A complete notification followed by the beginning of a request
+	notification, err := msgpack.Marshal([]any{messageTypeNotification, "hello", []any{}})
+	require.NoError(t, err)
+	request, err := msgpack.Marshal([]any{messageTypeRequest, 1, "echo", []any{"hi"}})
+	require.NoError(t, err)
+	go func() { _, _ = out.Write(append(notification, request[:5]...)) }()
+	require.Equal(t, "hello", <-notifications)
+
+	// The rest of the request is received after Run is stopped
+	require.NoError(t, in.SetReadDeadline(time.Now()))
+	<-done
+	require.Equal(t, request[:5], conn.UnreadInput())
+}
+
+func TestInvalidRequestParams(t *testing.T) {
+	in, testdataIn := nio.Pipe(buffer.New(1024))
+	testdataOut, out := nio.Pipe(buffer.New(1024))
+	d := msgpack.NewDecoder(testdataOut)
+	d.UseLooseInterfaceDecoding(true)
+
+	var errs atomic.Int32
+	conn := NewConnection(in, out, func(logger FunctionLogger, method string, params []any, res ResponseHandler) {
+		res(params, nil)
+	}, nil, func(error) { errs.Add(1) })
+	t.Cleanup(conn.Close)
+	go conn.Run()
+
+	// The params hold an extension type not registered with the decoder
+	_, err := testdataIn.Write([]byte{0x94, 0x00, 0x01, 0xA4, 'e', 'c', 'h', 'o', 0x91, 0xD4, 0x10, 0x00})
+	require.NoError(t, err)
+	msg, err := d.DecodeSlice()
+	require.NoError(t, err)
+	require.Equal(t, int64(messageTypeResponse), msg[0])
+	require.Equal(t, int64(1), msg[1])
+	require.Equal(t, int64(errCodeInvalidParams), msg[2].([]any)[0])
+	require.Nil(t, msg[3])
+	require.Equal(t, int32(1), errs.Load())
+	require.Equal(t, uint64(1), conn.Stats().DecodeErrors)
+
+	// The request is no longer active
+	conn.activeInRequestsMutex.Lock()
+	require.Empty(t, conn.activeInRequests)
+	conn.activeInRequestsMutex.Unlock()
+
+	// The next requests are handled normally
+	require.NoError(t, msgpack.NewEncoder(testdataIn).Encode([]any{messageTypeRequest, 2, "echo", []any{"hi"}}))
+	msg, err = d.DecodeSlice()
+	require.NoError(t, err)
+	require.Equal(t, []any{int64(messageTypeResponse), int64(2), nil, []any{"hi"}}, msg)
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	_, compressed, err := decompress([]byte{0x93, 0x02, 0xA1, 'a', 0x90})
+	require.NoError(t, err)
+	require.False(t, compressed)
+
+	_, compressed, err = decompress([]byte{0xC7, 0x01, 0x05, 0x00})
+	require.True(t, compressed)
+	require.ErrorContains(t, err, "unsupported compressed message")
+
+	_, _, err = decompress([]byte{0xC7, 0x05, 0x01, 0x00})
+	require.ErrorContains(t, err, "invalid extension value")
+
+	_, _, err = decompress([]byte{0xC7, 0x02, 0x01, 0xFF, 0xFF})
+	require.ErrorContains(t, err, "can't decompress message")
+}
+
+func TestMetadata(t *testing.T) {
+	conn := new(Connection)
+	other := new(Connection)
+	identity := NewKey[string]("identity")
+	handles := NewKey[[]uint]("handles")
+
+	_, ok := identity.Get(conn)
+	require.False(t, ok)
+
+	identity.Set(conn, "alice")
+	handles.Set(conn, []uint{1, 2})
+	v, ok := identity.Get(conn)
+	require.True(t, ok)
+	require.Equal(t, "alice", v)
+	h, ok := handles.Get(conn)
+	require.True(t, ok)
+	require.Equal(t, []uint{1, 2}, h)
+
+	// The metadata are per connection, and keys with the same name are distinct
+	_, ok = identity.Get(other)
+	require.False(t, ok)
+	_, ok = NewKey[string]("identity").Get(conn)
+	require.False(t, ok)
+
+	identity.Delete(conn)
+	_, ok = identity.Get(conn)
+	require.False(t, ok)
+	_, ok = handles.Get(conn)
+	require.True(t, ok)
 }
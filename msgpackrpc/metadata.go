@@ -0,0 +1,83 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrpc
+
+// Key identifies a value of type T stored in the metadata of a Connection.
+// Keys are compared by identity, so each module should create its keys once
+// with NewKey and keep them in package variables.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey creates a new metadata key, the name is used only for debugging.
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+func (k *Key[T]) String() string {
+	return k.name
+}
+
+// Get returns the value stored with this key in the metadata of the
+// connection, and whether it was set.
+func (k *Key[T]) Get(c *Connection) (T, bool) {
+	if v, ok := c.Get(k); ok {
+		return v.(T), true
+	}
+	var zero T
+	return zero, false
+}
+
+// Set stores the value with this key in the metadata of the connection.
+func (k *Key[T]) Set(c *Connection, value T) {
+	c.Set(k, value)
+}
+
+// Delete removes the value stored with this key from the metadata of the
+// connection.
+func (k *Key[T]) Delete(c *Connection) {
+	c.Delete(k)
+}
+
+// Set stores a value in the metadata of the connection. The metadata keep
+// the per-client state of the API modules, and they are released with the
+// connection. The key must be comparable, a *Key is recommended to get a
+// typed access to the value.
+func (c *Connection) Set(key, value any) {
+	c.metadataMutex.Lock()
+	defer c.metadataMutex.Unlock()
+	if c.metadata == nil {
+		c.metadata = make(map[any]any)
+	}
+	c.metadata[key] = value
+}
+
+// Get returns the value stored with the given key in the metadata of the
+// connection, and whether it was set.
+func (c *Connection) Get(key any) (any, bool) {
+	c.metadataMutex.Lock()
+	defer c.metadataMutex.Unlock()
+	v, ok := c.metadata[key]
+	return v, ok
+}
+
+// Delete removes the value stored with the given key from the metadata of
+// the connection.
+func (c *Connection) Delete(key any) {
+	c.metadataMutex.Lock()
+	defer c.metadataMutex.Unlock()
+	delete(c.metadata, key)
+}
@@ -0,0 +1,71 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package msgpackrpc
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// RawMessage is a MessagePack encoded value, as received from the
+// connection. It is encoded verbatim when sent, so that the params and the
+// results can be forwarded to another connection without decoding and
+// re-encoding them (the binary payloads are copied as they are).
+type RawMessage []byte
+
+// MarshalMsgpack returns the encoded value as is.
+func (m RawMessage) MarshalMsgpack() ([]byte, error) {
+	if len(m) == 0 {
+		return []byte{0xC0}, nil // nil
+	}
+	return m, nil
+}
+
+// Decode decodes the value.
+func (m RawMessage) Decode() (any, error) {
+	return msgpack.NewDecoder(bytes.NewReader(m)).DecodeInterface()
+}
+
+// DecodeArray decodes the value, that must be an array (as the params of
+// requests and notifications).
+func (m RawMessage) DecodeArray() ([]any, error) {
+	v, err := m.Decode()
+	if err != nil {
+		return nil, err
+	}
+	a, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("expected array, got %T", v)
+	}
+	return a, nil
+}
+
+// LogValue decodes the value only when it is actually logged.
+func (m RawMessage) LogValue() slog.Value {
+	v, err := m.Decode()
+	if err != nil {
+		return slog.StringValue(fmt.Sprintf("<invalid: %s>", err))
+	}
+	return slog.AnyValue(v)
+}
+
+// isArray returns true if the value is an array.
+func (m RawMessage) isArray() bool {
+	return len(m) > 0 && (m[0]&0xF0 == 0x90 || m[0] == 0xDC || m[0] == 0xDD)
+}
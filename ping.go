@@ -0,0 +1,44 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// pingHandler implements $/ping: it echoes the optional payload, with the
+// times the request was received and the response sent by the router (in
+// microseconds since the Unix epoch), so that the client can measure the
+// round-trip latency and the skew of its clock.
+func pingHandler(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+	received := time.Now()
+	if len(params) > 1 {
+		res(nil, []any{1, "Invalid number of parameters, expected at most the payload"})
+		return
+	}
+	var payload any
+	if len(params) == 1 {
+		payload = params[0]
+	}
+	res(map[string]any{
+		"payload":   payload,
+		"recv_time": received.UnixMicro(),
+		"send_time": time.Now().UnixMicro(),
+	}, nil)
+}
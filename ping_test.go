@@ -0,0 +1,44 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPing(t *testing.T) {
+	var result, reqErr any
+	res := func(r, e any) { result, reqErr = r, e }
+
+	start := time.Now().UnixMicro()
+	pingHandler(nil, []any{[]byte{1, 2, 3}}, res)
+	require.Nil(t, reqErr)
+	pong := result.(map[string]any)
+	require.Equal(t, []byte{1, 2, 3}, pong["payload"])
+	require.GreaterOrEqual(t, pong["recv_time"], start)
+	require.GreaterOrEqual(t, pong["send_time"], pong["recv_time"])
+	require.LessOrEqual(t, pong["send_time"], time.Now().UnixMicro())
+
+	pingHandler(nil, []any{}, res)
+	require.Nil(t, reqErr)
+	require.Nil(t, result.(map[string]any)["payload"])
+
+	pingHandler(nil, []any{1, 2}, res)
+	require.NotNil(t, reqErr)
+}
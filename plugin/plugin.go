@@ -0,0 +1,103 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+// Package plugin implements the API modules of arduino-router that are
+// shipped as separate executables. The router launches each plugin listed
+// with --plugins, connected to it with a Unix socket inherited by the plugin,
+// and the plugin registers its methods with Serve.
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// FDEnv is the environment variable with the file descriptor of the
+// connection to the router, set by the router when it launches a plugin.
+const FDEnv = "ARDUINO_ROUTER_PLUGIN_FD"
+
+// Handler handles a request for a method of the plugin, it must call res
+// exactly once with the result or the error of the request.
+type Handler func(params []any, res msgpackrpc.ResponseHandler)
+
+// Connect returns the connection to the router inherited by the plugin.
+func Connect() (io.ReadWriteCloser, error) {
+	value, ok := os.LookupEnv(FDEnv)
+	if !ok {
+		return nil, errors.New("not launched by arduino-router: " + FDEnv + " not set")
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("invalid %s: %s", FDEnv, value)
+	}
+	f := os.NewFile(uintptr(fd), "arduino-router")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// Serve connects to the router and serves the given methods, see ServeConn.
+func Serve(methods map[string]Handler) error {
+	conn, err := Connect()
+	if err != nil {
+		return err
+	}
+	return ServeConn(conn, methods)
+}
+
+// ServeConn registers the given methods on the router connected to conn,
+// and handles their requests until the router closes the connection.
+func ServeConn(conn io.ReadWriteCloser, methods map[string]Handler) error {
+	rpc := msgpackrpc.NewConnection(conn, conn,
+		func(_ msgpackrpc.FunctionLogger, method string, params []any, res msgpackrpc.ResponseHandler) {
+			handler, ok := methods[method]
+			if !ok {
+				res(nil, []any{2, "Unknown method: " + method})
+				return
+			}
+			handler(params, res)
+		}, nil, nil)
+	done := make(chan struct{})
+	go func() {
+		rpc.Run()
+		close(done)
+	}()
+
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		_, reqErr, err := rpc.SendRequest(context.Background(), "$/register", name)
+		if err == nil && reqErr != nil {
+			err = fmt.Errorf("%v", reqErr)
+		}
+		if err != nil {
+			rpc.Close()
+			<-done
+			return fmt.Errorf("registering %s: %w", name, err)
+		}
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,78 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package plugin_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+	"github.com/arduino/arduino-router/plugin"
+)
+
+func TestServeConn(t *testing.T) {
+	router := msgpackrouter.New(0)
+	pluginEnd, routerEnd := net.Pipe()
+	_, closed := router.AcceptConnection(routerEnd)
+	served := make(chan error, 1)
+	go func() {
+		served <- plugin.ServeConn(pluginEnd, map[string]plugin.Handler{
+			"sensor/read": func(params []any, res msgpackrpc.ResponseHandler) {
+				res(map[string]any{"temperature": 21.5}, nil)
+			},
+		})
+	}()
+
+	clientEnd, routerEnd2 := net.Pipe()
+	router.AcceptConnection(routerEnd2)
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+	defer client.Close()
+
+	var result any
+	require.Eventually(t, func() bool {
+		var reqErr any
+		result, reqErr, _ = client.SendRequest(t.Context(), "sensor/read")
+		return reqErr == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, map[string]any{"temperature": 21.5}, result)
+
+	// Serve returns when the router closes the connection
+	routerEnd.Close()
+	<-closed
+	require.NoError(t, <-served)
+}
+
+func TestServeConnRegistrationError(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetDisabledMethods([]string{"hci/*"})
+	pluginEnd, routerEnd := net.Pipe()
+	router.AcceptConnection(routerEnd)
+	err := plugin.ServeConn(pluginEnd, map[string]plugin.Handler{
+		"hci/open": func(params []any, res msgpackrpc.ResponseHandler) {},
+	})
+	require.ErrorContains(t, err, "registering hci/open")
+}
+
+func TestConnect(t *testing.T) {
+	t.Setenv(plugin.FDEnv, "")
+	_, err := plugin.Connect()
+	require.Error(t, err)
+}
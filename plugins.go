@@ -0,0 +1,114 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/plugin"
+)
+
+// startPlugin launches the executable of a plugin, connected to the router
+// with a Unix socket inherited as file descriptor 3. The plugin is trusted
+// like the clients of the Unix socket: it does not need to authenticate.
+func startPlugin(router *msgpackrouter.Router, path string) error {
+	name := filepath.Base(path)
+	cmd, conn, err := launchConnected(name, []string{path})
+	if err != nil {
+		return err
+	}
+	slog.Info("Plugin started", "plugin", name, "pid", cmd.Process.Pid)
+
+	router.AcceptConnectionWithInfo(conn, msgpackrouter.ConnectionInfo{
+		Transport:  "plugin",
+		RemoteAddr: name,
+		Role:       msgpackrouter.RoleLocalService,
+	})
+	go func() {
+		err := cmd.Wait()
+		slog.Warn("Plugin exited", "plugin", name, "err", err)
+		conn.Close()
+	}()
+	return nil
+}
+
+// launchConnected starts the given command line with a Unix socket connected
+// to the router inherited as file descriptor 3, and returns the router end
+// of the socket. The lines written by the process to its standard error are
+// logged, the process receives SIGTERM if the router dies.
+func launchConnected(name string, args []string) (*exec.Cmd, net.Conn, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating socket for %s: %w", name, err)
+	}
+	childEnd := os.NewFile(uintptr(fds[1]), name)
+	defer childEnd.Close()
+	routerEnd := os.NewFile(uintptr(fds[0]), name)
+	conn, err := net.FileConn(routerEnd)
+	routerEnd.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating socket for %s: %w", name, err)
+	}
+
+	cmd := newSupervisedCommand(name, args)
+	cmd.ExtraFiles = []*os.File{childEnd}
+	cmd.Env = append(os.Environ(), plugin.FDEnv+"=3")
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("starting %s: %w", name, err)
+	}
+	return cmd, conn, nil
+}
+
+// newSupervisedCommand returns the command for the given command line, that
+// receives SIGTERM if the router dies and whose standard error lines are
+// logged.
+func newSupervisedCommand(name string, args []string) *exec.Cmd {
+	cmd := exec.Command(args[0], args[1:]...)
+	// Stop the process if the router dies
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+	cmd.Stderr = &lineLogger{name: name}
+	return cmd
+}
+
+// lineLogger logs each line written to it.
+type lineLogger struct {
+	name string
+	buf  []byte
+}
+
+func (l *lineLogger) Write(data []byte) (int, error) {
+	l.buf = append(l.buf, data...)
+	for {
+		line, rest, ok := bytes.Cut(l.buf, []byte{'\n'})
+		if !ok {
+			break
+		}
+		slog.Info("Process output", "process", l.name, "line", string(line))
+		l.buf = rest
+	}
+	return len(data), nil
+}
@@ -0,0 +1,72 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+	"github.com/arduino/arduino-router/plugin"
+)
+
+// TestMain runs the test binary as a plugin when it is launched by
+// startPlugin.
+func TestMain(m *testing.M) {
+	if _, ok := os.LookupEnv(plugin.FDEnv); ok {
+		err := plugin.Serve(map[string]plugin.Handler{
+			"demo/echo": func(params []any, res msgpackrpc.ResponseHandler) {
+				res(params, nil)
+			},
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// Restart the supervised services quickly, see services_test.go
+	serviceRestartDelay = 10 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+func TestStartPlugin(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleLocalService, nil)
+	require.NoError(t, startPlugin(router, os.Args[0]))
+
+	clientEnd, routerEnd := net.Pipe()
+	router.AcceptConnection(routerEnd)
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+	defer client.Close()
+
+	var result any
+	require.Eventually(t, func() bool {
+		var reqErr any
+		result, reqErr, _ = client.SendRequest(t.Context(), "demo/echo", "hello")
+		return reqErr == nil
+	}, 10*time.Second, 20*time.Millisecond)
+	require.Equal(t, []any{"hello"}, result)
+
+	require.Error(t, startPlugin(router, "/nonexistent/plugin"))
+}
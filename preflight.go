@@ -0,0 +1,138 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/arduino/arduino-router/internal/hciapi"
+	"github.com/arduino/arduino-router/internal/serialapi"
+)
+
+// preflightCheck is the result of a check of --preflight.
+type preflightCheck struct {
+	// Check is the kind of check: modules, serial, hci, socket or port.
+	Check string `json:"check"`
+	// Target is the checked resource, like the serial port or the address.
+	Target string `json:"target,omitempty"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+// preflightReport is the report printed by --preflight.
+type preflightReport struct {
+	OK     bool             `json:"ok"`
+	Checks []preflightCheck `json:"checks"`
+}
+
+// add records the result of a check.
+func (r *preflightReport) add(check, target string, err error) {
+	c := preflightCheck{Check: check, Target: target, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// preflight verifies that the router could start with the given settings,
+// without starting it: the access to the serial port and to the HCI user
+// channel, the directories of the Unix sockets and the availability of the
+// TCP ports.
+func preflight(cfg Config) preflightReport {
+	report := preflightReport{OK: true, Checks: []preflightCheck{}}
+	selection, err := newModuleSelection(cfg.EnableModules, cfg.DisableModules)
+	report.add("modules", "", err)
+
+	if cfg.SerialPortAddr != "" && selection.allowed("serial") {
+		report.add("serial", cfg.SerialPortAddr, serialapi.CheckPort(cfg.SerialPortAddr))
+	}
+	if selection.allowed("hci") {
+		report.add("hci", "", hciapi.CheckUserChannel())
+	}
+
+	var ports []string
+	for _, lc := range configuredListeners(cfg) {
+		switch lc.Network {
+		case "unix":
+			if !strings.HasPrefix(lc.Address, "@") {
+				report.add("socket", lc.Address, checkSocketPath(lc.Address))
+			}
+		case "tcp", "tls", "websocket":
+			ports = append(ports, lc.Address)
+		}
+	}
+	if selection.allowed("monitor") {
+		ports = append(ports, cfg.MonitorPortAddrs...)
+	}
+	for _, address := range []string{cfg.ListenHTTPAddr, cfg.ListenGRPCAddr} {
+		if address != "" {
+			ports = append(ports, address)
+		}
+	}
+	for _, address := range ports {
+		report.add("port", address, checkPort(address))
+	}
+	return report
+}
+
+// checkSocketPath verifies that the Unix socket can be created: its
+// directory must be writable, and no other process must be listening on it.
+func checkSocketPath(path string) error {
+	dir := filepath.Dir(path)
+	if err := unix.Access(dir, unix.W_OK); err != nil {
+		return fmt.Errorf("directory %s not writable: %w", dir, err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.New("socket in use by another process")
+	}
+	return nil
+}
+
+// checkPort verifies that the TCP address is available, listening on it.
+func checkPort(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+// printPreflight prints the report of preflight as JSON, and returns the
+// exit status: 1 if a check failed.
+func printPreflight(w io.Writer, cfg Config) int {
+	report := preflight(cfg)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to print the preflight report:", err)
+		return 1
+	}
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
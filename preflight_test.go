@@ -0,0 +1,78 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflight(t *testing.T) {
+	dir := t.TempDir()
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+	inUse := filepath.Join(dir, "in-use.sock")
+	l, err := net.Listen("unix", inUse)
+	require.NoError(t, err)
+	defer l.Close()
+
+	cfg := Config{
+		ListenTCPAddr:    "127.0.0.1:0",
+		ListenUnixAddrs:  []string{filepath.Join(dir, "router.sock"), "@arduino-router-test", inUse, "/missing/router.sock"},
+		MonitorPortAddrs: []string{busy.Addr().String()},
+		SerialPortAddr:   filepath.Join(dir, "ttyACM0"),
+		DisableModules:   []string{"hci"},
+	}
+	report := preflight(cfg)
+	require.False(t, report.OK)
+	results := map[string]bool{}
+	for _, c := range report.Checks {
+		results[c.Check+" "+c.Target] = c.OK
+		require.Equal(t, c.OK, c.Error == "", c.Check)
+	}
+	require.Equal(t, map[string]bool{
+		"modules ":                         true,
+		"serial " + cfg.SerialPortAddr:     false,
+		"socket " + cfg.ListenUnixAddrs[0]: true,
+		"socket " + inUse:                  false,
+		"socket /missing/router.sock":      false,
+		"port 127.0.0.1:0":                 true,
+		"port " + cfg.MonitorPortAddrs[0]:  false,
+	}, results)
+
+	// The report is printed as JSON, with a failure status
+	var out bytes.Buffer
+	require.Equal(t, 1, printPreflight(&out, cfg))
+	var printed preflightReport
+	require.NoError(t, json.Unmarshal(out.Bytes(), &printed))
+	require.Equal(t, report, printed)
+
+	// All the checks pass once the problems are fixed
+	cfg = Config{ListenUnixAddrs: []string{cfg.ListenUnixAddrs[0]}, DisableModules: []string{"hci"}}
+	out.Reset()
+	require.Equal(t, 0, printPreflight(&out, cfg))
+	require.Contains(t, out.String(), `"ok": true`)
+
+	report = preflight(Config{EnableModules: []string{"bluetooth"}})
+	require.False(t, report.OK)
+	require.Equal(t, "unknown module: bluetooth", report.Checks[0].Error)
+}
@@ -0,0 +1,131 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// linuxCapabilities are the Linux capabilities that can be kept after dropping
+// the privileges, by name.
+var linuxCapabilities = map[string]uint{
+	"net_admin":        unix.CAP_NET_ADMIN,
+	"net_bind_service": unix.CAP_NET_BIND_SERVICE,
+	"net_raw":          unix.CAP_NET_RAW,
+	"sys_rawio":        unix.CAP_SYS_RAWIO,
+}
+
+// capabilityMask returns the bit mask of the capabilities with the given
+// names.
+func capabilityMask(names []string) (uint32, error) {
+	var mask uint32
+	for _, name := range names {
+		c, ok := linuxCapabilities[strings.TrimPrefix(strings.ToLower(name), "cap_")]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability: %s", name)
+		}
+		mask |= 1 << c
+	}
+	return mask, nil
+}
+
+// privilegedIDs returns the user ID, the group ID and the supplementary
+// groups of the given user and group (names or numeric IDs). If group is
+// empty the primary group of the user is used.
+func privilegedIDs(userName, groupName string) (int, int, []int, error) {
+	uid, err := lookupUID(userName)
+	if err != nil {
+		return -1, -1, nil, err
+	}
+	var groups []int
+	gid := -1
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		gid, _ = strconv.Atoi(u.Gid)
+		// The supplementary groups give access to the devices opened later,
+		// for example the serial port reopened after a disconnection
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if g, err := strconv.Atoi(id); err == nil {
+					groups = append(groups, g)
+				}
+			}
+		}
+	}
+	if groupName != "" {
+		if gid, err = lookupGID(groupName); err != nil {
+			return -1, -1, nil, err
+		}
+	}
+	if gid == -1 {
+		return -1, -1, nil, fmt.Errorf("unknown primary group of user %s, a group must be given", userName)
+	}
+	return uid, gid, append(groups, gid), nil
+}
+
+// dropPrivileges switches the process to the given user and group, keeping
+// only the capabilities in keep. It must be called by root, after opening the
+// resources that require the privileges.
+func dropPrivileges(userName, groupName string, keep []string) error {
+	mask, err := capabilityMask(keep)
+	if err != nil {
+		return err
+	}
+	uid, gid, groups, err := privilegedIDs(userName, groupName)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("dropping privileges requires running as root")
+	}
+
+	// The capabilities are kept by all the threads across the change of user
+	if mask != 0 {
+		if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); errno == syscall.ENOTSUP {
+			return errors.New("keeping capabilities requires a binary built with CGO_ENABLED=0")
+		} else if errno != 0 {
+			return fmt.Errorf("keeping capabilities: %w", errno)
+		}
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setting supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setting group: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setting user: %w", err)
+	}
+
+	// The change of user clears the effective capabilities, restore the
+	// kept ones and drop all the others
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{{Effective: mask, Permitted: mask}}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("setting capabilities: %w", errno)
+	}
+	slog.Info("Dropped privileges", "uid", uid, "gid", gid, "capabilities", keep)
+	return nil
+}
@@ -0,0 +1,41 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrivileges(t *testing.T) {
+	mask, err := capabilityMask([]string{"net_raw", "CAP_NET_ADMIN"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1<<13|1<<12), mask)
+	_, err = capabilityMask([]string{"sys_admin"})
+	require.ErrorContains(t, err, "unknown capability: sys_admin")
+
+	uid, gid, groups, err := privilegedIDs(strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid()))
+	require.NoError(t, err)
+	require.Equal(t, os.Getuid(), uid)
+	require.Equal(t, os.Getgid(), gid)
+	require.Contains(t, groups, gid)
+
+	_, _, _, err = privilegedIDs("no-such-user-of-arduino-router", "")
+	require.ErrorContains(t, err, "invalid user")
+}
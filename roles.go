@@ -0,0 +1,66 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+// defaultRoles returns the built-in roles: the MCU and the local services
+// may call any method (the system API further restricts the power
+// transitions), while the remote clients cannot use the Bluetooth HCI,
+// the I2C and SPI buses, the ADC channels, the filesystem (also through
+// net/sendFile), the cloud session and the MCU monitor, cannot update or reboot the board or the MCU and cannot reconfigure the serial link
+// or the logging, cannot drain the Router or export its state, nor sniff the
+// routed messages.
+func defaultRoles() map[string]msgpackrouter.ACL {
+	return map[string]msgpackrouter.ACL{
+		msgpackrouter.RoleMCU:          nil,
+		msgpackrouter.RoleLocalService: nil,
+		msgpackrouter.RoleRemote:       {"!hci/*", "!i2c/*", "!spi/*", "!adc/*", "!fs/*", "!net/sendFile", "!ota/*", "!cloud/*", "!sys/reboot", "!sys/poweroff", "!sys/suspend", "!$/serial/*", "!$/watchdog/*", "!mon/*", "!$/log/*", "!$/drain", "!$/state/*", "!$/debug/*"},
+	}
+}
+
+// defaultListenerRole returns the role of the clients of a listener if not
+// configured. The TCP clients are local services only if the listener is
+// bound to a loopback address.
+func defaultListenerRole(network string, address string) string {
+	switch network {
+	case "tls", "websocket":
+		return msgpackrouter.RoleRemote
+	case "tcp":
+		if !isLoopbackAddress(address) {
+			return msgpackrouter.RoleRemote
+		}
+	}
+	return msgpackrouter.RoleLocalService
+}
+
+// isLoopbackAddress returns true if the host of the address is a loopback
+// IP address or localhost.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,44 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+func TestDefaultListenerRole(t *testing.T) {
+	for _, test := range []struct {
+		network, address, role string
+	}{
+		{"tcp", "127.0.0.1:8900", msgpackrouter.RoleLocalService},
+		{"tcp", "[::1]:8900", msgpackrouter.RoleLocalService},
+		{"tcp", "localhost:8900", msgpackrouter.RoleLocalService},
+		{"tcp", ":8900", msgpackrouter.RoleRemote},
+		{"tcp", "0.0.0.0:8900", msgpackrouter.RoleRemote},
+		{"tcp", "192.168.1.10:8900", msgpackrouter.RoleRemote},
+		{"tcp", "8900", msgpackrouter.RoleRemote},
+		{"tls", "127.0.0.1:8901", msgpackrouter.RoleRemote},
+		{"websocket", "127.0.0.1:8902", msgpackrouter.RoleRemote},
+		{"vsock", ":8903", msgpackrouter.RoleLocalService},
+		{"unix", "/var/run/arduino-router.sock", msgpackrouter.RoleLocalService},
+	} {
+		require.Equal(t, test.role, defaultListenerRole(test.network, test.address), "%s %s", test.network, test.address)
+	}
+}
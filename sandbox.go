@@ -0,0 +1,264 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxPolicy describes what the router is allowed to do once sandboxed.
+type sandboxPolicy struct {
+	// ReadOnly are the directories that can be read (and executed from, if
+	// Exec is true).
+	ReadOnly []string
+	// ReadWrite are the directories that can be read and modified.
+	ReadWrite []string
+	// Exec is true if the router runs external commands.
+	Exec bool
+}
+
+// deniedSyscalls are the system calls never needed by the router, that fail
+// with EPERM once sandboxed.
+var deniedSyscalls = []uintptr{
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_KEYCTL,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_ACCT,
+}
+
+// execSyscalls are the system calls denied if the router does not run
+// external commands.
+var execSyscalls = []uintptr{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+}
+
+// auditArchs are the seccomp architecture identifiers, by GOARCH.
+var auditArchs = map[string]uint32{
+	"amd64": unix.AUDIT_ARCH_X86_64,
+	"arm64": unix.AUDIT_ARCH_AARCH64,
+	"arm":   unix.AUDIT_ARCH_ARM,
+}
+
+// newSandboxPolicy returns the sandbox policy fitting the given settings and
+// enabled modules.
+func newSandboxPolicy(cfg Config, modules []string, services []ServiceManifest) sandboxPolicy {
+	p := sandboxPolicy{
+		ReadOnly:  []string{"/etc", "/usr", "/bin", "/sbin", "/lib", "/lib64", "/opt", "/proc", "/sys", "/run"},
+		ReadWrite: []string{"/dev", "/tmp"},
+		Exec: slices.Contains(modules, "sys") || len(cfg.Plugins) > 0 || len(services) > 0 ||
+			cfg.OTAApplyCommand != "" || cfg.WatchdogCommand != "",
+	}
+	if slices.Contains(modules, "fs") {
+		p.ReadWrite = append(p.ReadWrite, cfg.FSRoot)
+	}
+	if slices.Contains(modules, "ota") {
+		p.ReadWrite = append(p.ReadWrite, cfg.OTADir)
+	}
+	if slices.Contains(modules, "cloud") {
+		p.ReadWrite = append(p.ReadWrite, filepath.Dir(cfg.CloudCredentialsFile))
+	}
+	if slices.Contains(modules, "logs") {
+		p.ReadWrite = append(p.ReadWrite, filepath.Dir(cfg.RequestLogFile))
+	}
+	if slices.Contains(modules, "telemetry") {
+		p.ReadWrite = append(p.ReadWrite, filepath.Dir(cfg.TelemetryFile))
+	}
+	if cfg.LogFile != "" {
+		// The rotated log files are created next to the log file
+		p.ReadWrite = append(p.ReadWrite, filepath.Dir(cfg.LogFile))
+	}
+	for _, address := range cfg.ListenUnixAddrs {
+		if address != "" && !strings.HasPrefix(address, "@") {
+			// The socket file is removed when the listener is closed
+			p.ReadWrite = append(p.ReadWrite, filepath.Dir(address))
+		}
+	}
+	for _, lc := range cfg.Listeners {
+		if lc.Network == "unix" && !strings.HasPrefix(lc.Address, "@") {
+			p.ReadWrite = append(p.ReadWrite, filepath.Dir(lc.Address))
+		}
+	}
+	for _, plugin := range cfg.Plugins {
+		p.ReadOnly = append(p.ReadOnly, filepath.Dir(plugin))
+	}
+	for _, s := range services {
+		if len(s.Exec) > 0 && filepath.IsAbs(s.Exec[0]) {
+			p.ReadOnly = append(p.ReadOnly, filepath.Dir(s.Exec[0]))
+		}
+	}
+	return p
+}
+
+// seccompFilter returns the BPF program of the seccomp filter denying the
+// given system calls on the given architecture. The calls of the other
+// architectures kill the process.
+func seccompFilter(arch uint32, denied []uintptr) []unix.SockFilter {
+	const (
+		archOffset = 4 // offsetof(struct seccomp_data, arch)
+		nrOffset   = 0 // offsetof(struct seccomp_data, nr)
+		x32Bit     = 0x40000000
+	)
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	prog := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, archOffset),
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, nrOffset),
+	}
+	// The jumps to the final "deny" instruction are relative to the next
+	// instruction
+	deny := len(prog) + 1 + len(denied) + 1
+	prog = append(prog, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: uint8(deny - len(prog) - 1), K: x32Bit})
+	for _, nr := range denied {
+		prog = append(prog, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(deny - len(prog) - 1), K: uint32(nr)})
+	}
+	return append(prog,
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM)),
+	)
+}
+
+// applySandbox restricts the system calls and the filesystem access of all
+// the threads of the router, and of the commands it runs afterwards.
+func applySandbox(p sandboxPolicy) error {
+	arch, ok := auditArchs[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("sandbox not supported on %s", runtime.GOARCH)
+	}
+	denied := slices.Clone(deniedSyscalls)
+	if !p.Exec {
+		denied = append(denied, execSyscalls...)
+	}
+	if err := applySeccomp(seccompFilter(arch, denied)); err != nil {
+		return fmt.Errorf("applying seccomp filter: %w", err)
+	}
+	if err := applyLandlock(p); err != nil {
+		return fmt.Errorf("applying Landlock rules: %w", err)
+	}
+	return nil
+}
+
+// applySeccomp installs the seccomp filter on all the threads.
+func applySeccomp(filter []unix.SockFilter) error {
+	// The no_new_privs flag, required by the filter, is set on the calling
+	// thread and propagated with the filter to the other threads
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := syscall.RawSyscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// applyLandlock restricts the filesystem access of all the threads to the
+// directories of the policy. It does nothing if Landlock is not supported by
+// the kernel.
+func applyLandlock(p sandboxPolicy) error {
+	abi, _, errno := syscall.RawSyscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		slog.Warn("Landlock not supported by the kernel, the filesystem access is not restricted", "err", errno)
+		return nil
+	}
+
+	// The access rights of the first Landlock ABI, supported by all the
+	// kernels with Landlock
+	const (
+		readAccess = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+		allAccess  = 1<<13 - 1
+	)
+	roAccess := uint64(readAccess)
+	if p.Exec {
+		roAccess |= unix.LANDLOCK_ACCESS_FS_EXECUTE
+	}
+	rwAccess := uint64(allAccess &^ unix.LANDLOCK_ACCESS_FS_EXECUTE)
+	if p.Exec {
+		rwAccess |= unix.LANDLOCK_ACCESS_FS_EXECUTE
+	}
+
+	// Only the Access_fs field is passed, to support the older kernels
+	attr := unix.LandlockRulesetAttr{Access_fs: allAccess}
+	fd, _, errno := syscall.RawSyscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr.Access_fs), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer unix.Close(int(fd))
+	addRule := func(dir string, access uint64) error {
+		dirFd, err := unix.Open(dir, unix.O_PATH|unix.O_CLOEXEC|unix.O_DIRECTORY, 0)
+		if err != nil {
+			// The missing directories can be ignored
+			return nil
+		}
+		defer unix.Close(dirFd)
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(dirFd)}
+		if _, _, errno := syscall.RawSyscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("adding rule for %s: %w", dir, errno)
+		}
+		return nil
+	}
+	for _, dir := range p.ReadOnly {
+		if err := addRule(dir, roAccess); err != nil {
+			return err
+		}
+	}
+	for _, dir := range p.ReadWrite {
+		if err := addRule(dir, rwAccess); err != nil {
+			return err
+		}
+	}
+
+	// The rules are enforced on each thread
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno == syscall.ENOTSUP {
+		return fmt.Errorf("restricting the threads requires a binary built with CGO_ENABLED=0")
+	} else if errno != 0 {
+		return errno
+	}
+	slog.Info("Sandbox enabled", "landlock_abi", abi, "exec", p.Exec, "read_only", p.ReadOnly, "read_write", p.ReadWrite)
+	return nil
+}
@@ -0,0 +1,79 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSandboxPolicy(t *testing.T) {
+	cfg := Config{
+		FSRoot:          "/var/lib/arduino-router/fs",
+		OTADir:          "/var/lib/arduino-router/ota",
+		LogFile:         "/var/log/arduino-router/router.log",
+		ListenUnixAddrs: []string{"/var/run/arduino-router.sock", "@arduino-router"},
+		Plugins:         []string{"/usr/libexec/arduino-router/camera"},
+	}
+	p := newSandboxPolicy(cfg, []string{"network", "fs"}, nil)
+	require.True(t, p.Exec)
+	require.Contains(t, p.ReadWrite, "/var/lib/arduino-router/fs")
+	require.NotContains(t, p.ReadWrite, "/var/lib/arduino-router/ota")
+	require.Contains(t, p.ReadWrite, "/var/log/arduino-router")
+	require.Contains(t, p.ReadWrite, "/var/run")
+	require.Contains(t, p.ReadOnly, "/usr/libexec/arduino-router")
+
+	// No module runs external commands
+	cfg.Plugins = nil
+	require.False(t, newSandboxPolicy(cfg, []string{"network"}, nil).Exec)
+	require.True(t, newSandboxPolicy(cfg, []string{"network"}, []ServiceManifest{{Exec: []string{"/opt/camera"}}}).Exec)
+}
+
+func TestSandbox(t *testing.T) {
+	if os.Getenv("ARDUINO_ROUTER_TEST_SANDBOX") == "" {
+		// The sandbox applies to the whole process, test it in a child
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$", "-test.v")
+		cmd.Env = append(os.Environ(), "ARDUINO_ROUTER_TEST_SANDBOX="+t.TempDir())
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		return
+	}
+
+	dir := os.Getenv("ARDUINO_ROUTER_TEST_SANDBOX")
+	err := applySandbox(sandboxPolicy{ReadOnly: []string{"/proc"}, ReadWrite: []string{dir, "/dev"}})
+	// Landlock can not restrict all the threads of the binaries using cgo
+	landlock := err == nil
+	if err != nil && !strings.Contains(err.Error(), "CGO_ENABLED=0") {
+		require.NoError(t, err)
+	}
+
+	// The denied system calls fail
+	require.ErrorIs(t, unix.Unshare(unix.CLONE_NEWUTS), unix.EPERM)
+	require.ErrorIs(t, exec.Command("/bin/true").Run(), unix.EPERM)
+
+	// Only the allowed directories are accessible
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("ok"), 0600))
+	if landlock {
+		_, err := os.ReadDir("/etc")
+		require.ErrorIs(t, err, unix.EACCES)
+	}
+}
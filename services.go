@@ -0,0 +1,333 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// ServiceManifest describes a sidecar service supervised by the router, it
+// is read from a YAML file of the services directory.
+type ServiceManifest struct {
+	// Name is the name of the service, it is also the identity of its
+	// connection, the only one allowed to register its methods.
+	Name string `yaml:"name"`
+	// Methods are the methods provided by the service.
+	Methods []string `yaml:"methods"`
+	// Exec is the command line launching the service. Without Socket, the
+	// service is connected to the router with a Unix socket inherited as
+	// file descriptor 3, like a plugin, and registers its methods itself.
+	Exec []string `yaml:"exec"`
+	// Socket is the path of the Unix socket where the service listens, the
+	// router connects to it and registers the methods on its behalf.
+	Socket string `yaml:"socket"`
+}
+
+var (
+	// serviceRestartDelay and serviceRestartMaxDelay are the bounds of the
+	// exponential backoff used to restart a service that exited, or to
+	// reconnect to a service that closed its socket.
+	serviceRestartDelay    = time.Second
+	serviceRestartMaxDelay = time.Minute
+	// serviceStableTime is the time after which a running service is
+	// considered healthy, and its backoff is reset.
+	serviceStableTime = 30 * time.Second
+	// serviceCrashLoopFailures is the number of consecutive failures of a
+	// service that are reported as a crash loop.
+	serviceCrashLoopFailures = 5
+	// serviceDialTimeout is the time waited for the socket of a service
+	// launched by the router to accept the connections.
+	serviceDialTimeout = 10 * time.Second
+)
+
+// States of a supervised service
+const (
+	serviceStarting  = "starting"
+	serviceRunning   = "running"
+	serviceBackoff   = "backoff"
+	serviceCrashLoop = "crash-loop"
+)
+
+// service is a sidecar service supervised by the router.
+type service struct {
+	manifest ServiceManifest
+
+	lock      sync.Mutex
+	state     string
+	pid       int
+	since     time.Time
+	restarts  int
+	failures  int
+	lastError string
+}
+
+// loadServiceManifests reads the manifests (*.yaml and *.yml files) of the
+// given directory, a missing directory has no services.
+func loadServiceManifests(dir string) ([]ServiceManifest, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading services directory: %w", err)
+	}
+	var manifests []ServiceManifest
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading service manifest: %w", err)
+		}
+		var m ServiceManifest
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("parsing service manifest %s: %w", file, err)
+		}
+		if m.Name == "" {
+			return nil, fmt.Errorf("invalid service manifest %s: missing name", file)
+		}
+		if len(m.Methods) == 0 {
+			return nil, fmt.Errorf("invalid service manifest %s: missing methods", file)
+		}
+		if len(m.Exec) == 0 && m.Socket == "" {
+			return nil, fmt.Errorf("invalid service manifest %s: missing exec or socket", file)
+		}
+		if slices.ContainsFunc(manifests, func(other ServiceManifest) bool { return other.Name == m.Name }) {
+			return nil, fmt.Errorf("invalid service manifest %s: duplicate service %s", file, m.Name)
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
+
+// startService reserves the methods of the service and starts supervising
+// it: the service is launched (or its socket is connected) and restarted
+// with an exponential backoff whenever it exits.
+func startService(router *msgpackrouter.Router, m ServiceManifest) *service {
+	router.ReserveMethods(m.Name, m.Methods)
+	s := &service{manifest: m}
+	s.setState(serviceStarting, 0)
+	go s.supervise(router)
+	return s
+}
+
+// supervise runs the service and restarts it whenever it exits.
+func (s *service) supervise(router *msgpackrouter.Router) {
+	for {
+		start := time.Now()
+		err := s.run(router)
+		if err != nil {
+			slog.Error("Service failed", "service", s.manifest.Name, "err", err)
+		} else {
+			slog.Warn("Service stopped", "service", s.manifest.Name)
+		}
+
+		s.lock.Lock()
+		if time.Since(start) >= serviceStableTime {
+			s.failures = 0
+		}
+		s.failures++
+		failures := s.failures
+		s.lastError = ""
+		if err != nil {
+			s.lastError = err.Error()
+		}
+		s.lock.Unlock()
+
+		delay := serviceRestartBackoff(failures)
+		if failures >= serviceCrashLoopFailures {
+			if failures == serviceCrashLoopFailures {
+				slog.Error("Service is crash looping", "service", s.manifest.Name, "failures", failures)
+			}
+			s.setState(serviceCrashLoop, 0)
+		} else {
+			s.setState(serviceBackoff, 0)
+		}
+		slog.Info("Restarting service", "service", s.manifest.Name, "retry_in", delay)
+		time.Sleep(delay)
+
+		s.lock.Lock()
+		s.restarts++
+		s.lock.Unlock()
+		s.setState(serviceStarting, 0)
+	}
+}
+
+// serviceRestartBackoff returns the delay before restarting a service after
+// the given number of consecutive failures (starting from 1): the delay
+// doubles at every failure, from serviceRestartDelay up to
+// serviceRestartMaxDelay.
+func serviceRestartBackoff(failures int) time.Duration {
+	delay := serviceRestartDelay
+	for i := 1; i < failures && delay < serviceRestartMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, serviceRestartMaxDelay)
+}
+
+// setState updates the state of the service and the PID of its process.
+func (s *service) setState(state string, pid int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = state
+	s.pid = pid
+	s.since = time.Now()
+}
+
+// status returns the status of the service reported by $/services.
+func (s *service) status() map[string]any {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return map[string]any{
+		"name":       s.manifest.Name,
+		"methods":    s.manifest.Methods,
+		"state":      s.state,
+		"pid":        s.pid,
+		"since":      s.since.Format(time.RFC3339),
+		"restarts":   s.restarts,
+		"failures":   s.failures,
+		"last_error": s.lastError,
+	}
+}
+
+// run runs the service once, until it exits or closes its connection.
+func (s *service) run(router *msgpackrouter.Router) error {
+	m := s.manifest
+	info := msgpackrouter.ConnectionInfo{
+		Transport:  "service",
+		RemoteAddr: m.Name,
+		Identity:   m.Name,
+		Role:       msgpackrouter.RoleLocalService,
+	}
+
+	if m.Socket == "" {
+		// The service registers its methods on the inherited socket
+		cmd, conn, err := launchConnected(m.Name, m.Exec)
+		if err != nil {
+			return err
+		}
+		slog.Info("Service started", "service", m.Name, "pid", cmd.Process.Pid)
+		s.setState(serviceRunning, cmd.Process.Pid)
+		router.AcceptConnectionWithInfo(conn, info)
+		err = cmd.Wait()
+		conn.Close()
+		return err
+	}
+
+	var exited chan error
+	pid := 0
+	if len(m.Exec) > 0 {
+		cmd := newSupervisedCommand(m.Name, m.Exec)
+		if err := cmd.Start(); err != nil {
+			return fmt.Errorf("starting %s: %w", m.Name, err)
+		}
+		slog.Info("Service started", "service", m.Name, "pid", cmd.Process.Pid)
+		pid = cmd.Process.Pid
+		exited = make(chan error, 1)
+		go func() { exited <- cmd.Wait() }()
+		defer stopProcess(cmd, exited)
+	}
+
+	conn, err := dialService(m.Socket, exited)
+	if err != nil {
+		return err
+	}
+	rpc, closed := router.AcceptConnectionWithInfo(conn, info)
+	if err := router.RegisterMethods(rpc, m.Methods); err != nil {
+		conn.Close()
+		<-closed
+		return err
+	}
+	slog.Info("Service connected", "service", m.Name, "socket", m.Socket)
+	s.setState(serviceRunning, pid)
+	select {
+	case <-closed:
+		return nil
+	case err := <-exited:
+		// Let stopProcess know that the process has already exited
+		exited <- err
+		conn.Close()
+		<-closed
+		return err
+	}
+}
+
+// servicesHandler implements $/services: it returns the status of the
+// supervised services.
+func servicesHandler(services []*service) msgpackrouter.RouterRequestHandler {
+	return func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		if len(params) != 0 {
+			res(nil, []any{1, "Invalid number of parameters, expected no parameters"})
+			return
+		}
+		statuses := make([]any, len(services))
+		for i, s := range services {
+			statuses[i] = s.status()
+		}
+		res(statuses, nil)
+	}
+}
+
+// dialService connects to the socket of a service, waiting for it to be
+// ready if the service has just been launched (exited is not nil).
+func dialService(socket string, exited chan error) (net.Conn, error) {
+	deadline := time.Now().Add(serviceDialTimeout)
+	for {
+		conn, err := net.Dial("unix", socket)
+		if err == nil || exited == nil || time.Now().After(deadline) {
+			return conn, err
+		}
+		select {
+		case err := <-exited:
+			exited <- err
+			return nil, fmt.Errorf("service exited before opening its socket: %w", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// stopProcess terminates the process of a service if it is still running.
+func stopProcess(cmd *exec.Cmd, exited chan error) {
+	select {
+	case <-exited:
+		return
+	default:
+	}
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+}
@@ -0,0 +1,152 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestLoadServiceManifests(t *testing.T) {
+	manifests, err := loadServiceManifests(filepath.Join(t.TempDir(), "missing"))
+	require.NoError(t, err)
+	require.Empty(t, manifests)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "camera.yaml"), []byte(`
+name: camera
+methods: [camera/snap]
+exec: [/usr/bin/camera-service, --device, /dev/video0]
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a manifest"), 0644))
+	manifests, err = loadServiceManifests(dir)
+	require.NoError(t, err)
+	require.Equal(t, []ServiceManifest{{
+		Name:    "camera",
+		Methods: []string{"camera/snap"},
+		Exec:    []string{"/usr/bin/camera-service", "--device", "/dev/video0"},
+	}}, manifests)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.yml"), []byte("name: camera\nmethods: [x]\nsocket: /run/x.sock\n"), 0644))
+	_, err = loadServiceManifests(dir)
+	require.ErrorContains(t, err, "duplicate service camera")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.yml"), []byte("name: other\nmethods: [x]\n"), 0644))
+	_, err = loadServiceManifests(dir)
+	require.ErrorContains(t, err, "missing exec or socket")
+}
+
+func TestSocketService(t *testing.T) {
+	router := msgpackrouter.New(0)
+	socket := filepath.Join(t.TempDir(), "sensor.sock")
+	startService(router, ServiceManifest{Name: "sensor", Methods: []string{"sensor/read"}, Socket: socket})
+
+	clientEnd, routerEnd := net.Pipe()
+	router.AcceptConnection(routerEnd)
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+	defer client.Close()
+
+	// The methods are reserved until the service is listening
+	_, reqErr, err := client.SendRequest(t.Context(), "sensor/read")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeServiceStarting), "service sensor providing method sensor/read is starting"}, reqErr)
+	_, reqErr, err = client.SendRequest(t.Context(), "$/register", "sensor/read")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeRouteAlreadyExists), "route reserved by service sensor: sensor/read"}, reqErr)
+
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+	serve := func() net.Conn {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		rpc := msgpackrpc.NewConnection(conn, conn, func(_ msgpackrpc.FunctionLogger, _ string, _ []any, res msgpackrpc.ResponseHandler) {
+			res(21.5, nil)
+		}, nil, nil)
+		go rpc.Run()
+		return conn
+	}
+	read := func() bool {
+		result, _, _ := client.SendRequest(t.Context(), "sensor/read")
+		return result == 21.5
+	}
+
+	conn := serve()
+	require.Eventually(t, read, 5*time.Second, 10*time.Millisecond)
+
+	// The router reconnects when the service closes the socket
+	conn.Close()
+	conn = serve()
+	defer conn.Close()
+	require.Eventually(t, read, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestExecService(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.SetRole(msgpackrouter.RoleLocalService, nil)
+	// The test binary runs as a plugin, see TestMain
+	startService(router, ServiceManifest{Name: "demo", Methods: []string{"demo/echo"}, Exec: []string{os.Args[0]}})
+
+	clientEnd, routerEnd := net.Pipe()
+	router.AcceptConnection(routerEnd)
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+	defer client.Close()
+
+	var result any
+	require.Eventually(t, func() bool {
+		var reqErr any
+		result, reqErr, _ = client.SendRequest(t.Context(), "demo/echo", "hello")
+		return reqErr == nil
+	}, 10*time.Second, 20*time.Millisecond)
+	require.Equal(t, []any{"hello"}, result)
+}
+
+func TestServiceRestartBackoff(t *testing.T) {
+	require.Equal(t, serviceRestartDelay, serviceRestartBackoff(1))
+	require.Equal(t, 4*serviceRestartDelay, serviceRestartBackoff(3))
+	require.Equal(t, serviceRestartMaxDelay, serviceRestartBackoff(100))
+}
+
+func TestServiceCrashLoop(t *testing.T) {
+	router := msgpackrouter.New(0)
+	s := startService(router, ServiceManifest{Name: "broken", Methods: []string{"broken/call"}, Exec: []string{"/nonexistent/service"}})
+	handler := servicesHandler([]*service{s})
+
+	require.Eventually(t, func() bool {
+		var statuses any
+		handler(nil, nil, func(result, _ any) { statuses = result })
+		status := statuses.([]any)[0].(map[string]any)
+		return status["state"] == serviceCrashLoop
+	}, 10*time.Second, 10*time.Millisecond)
+
+	var statuses any
+	handler(nil, nil, func(result, _ any) { statuses = result })
+	status := statuses.([]any)[0].(map[string]any)
+	require.Equal(t, "broken", status["name"])
+	require.GreaterOrEqual(t, status["failures"], serviceCrashLoopFailures)
+	require.Contains(t, status["last_error"], "/nonexistent/service")
+	require.Equal(t, 0, status["pid"])
+}
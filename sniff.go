@@ -0,0 +1,123 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// newSniffCommand returns the "sniff" command, that prints the messages
+// routed by a running router.
+func newSniffCommand() *cobra.Command {
+	var socket string
+	var output string
+	cmd := &cobra.Command{
+		Use:  "sniff",
+		Long: "Print a live view of the messages routed by the router",
+		Run: func(cmd *cobra.Command, args []string) {
+			if !cmd.Flags().Changed("unix-port") {
+				socket = cmp.Or(os.Getenv("ARDUINO_ROUTER_SOCKET"), socket)
+			}
+			if output != "text" && output != "json" {
+				fmt.Fprintln(os.Stderr, "Invalid output format:", output)
+				os.Exit(1)
+			}
+			if err := sniff(socket, os.Stdout, output == "json"); err != nil {
+				fmt.Fprintln(os.Stderr, "Sniff failed:", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&socket, "unix-port", "u", "/var/run/arduino-router.sock", "Unix socket of the router")
+	cmd.Flags().StringVarP(&output, "output", "o", "text", "Output format (text, json)")
+	return cmd
+}
+
+// sniff connects to the router on the given Unix socket and prints the
+// routed messages to out, until the router closes the connection.
+func sniff(socket string, out io.Writer, jsonOutput bool) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return fmt.Errorf("connecting to router: %w", err)
+	}
+	rpc := msgpackrpc.NewConnection(conn, conn, nil,
+		func(_ msgpackrpc.FunctionLogger, method string, params []any) {
+			if method != msgpackrouter.TapMethod || len(params) != 1 {
+				return
+			}
+			event, ok := params[0].(map[string]any)
+			if !ok {
+				return
+			}
+			if jsonOutput {
+				data, _ := json.Marshal(event)
+				fmt.Fprintln(out, string(data))
+			} else {
+				fmt.Fprintln(out, formatTapEvent(event))
+			}
+		}, nil)
+	defer rpc.Close()
+	done := make(chan struct{})
+	go func() {
+		rpc.Run()
+		close(done)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, reqErr, err := rpc.SendRequest(ctx, msgpackrouter.TapMethod); err != nil {
+		return fmt.Errorf("calling %s: %w", msgpackrouter.TapMethod, err)
+	} else if reqErr != nil {
+		return fmt.Errorf("calling %s: %v", msgpackrouter.TapMethod, reqErr)
+	}
+	<-done
+	return nil
+}
+
+// formatTapEvent formats a tap event on a single line, for example:
+//
+//	12:01:02.345 request      #12 ping  unix pid=123 -> serial /dev/ttyACM0  18 B
+//	12:01:02.351 response     #12 ping  serial /dev/ttyACM0 -> unix pid=123  12 B  6.120ms
+func formatTapEvent(event map[string]any) string {
+	ts := fmt.Sprint(event["time"])
+	if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+		ts = t.Format("15:04:05.000")
+	}
+	id := ""
+	if v, ok := event["id"]; ok {
+		id = fmt.Sprintf("#%v ", v)
+	}
+	line := fmt.Sprintf("%s %-12s %s%v  %v -> %v  %v B", ts, event["type"], id, event["method"], event["from"], event["to"], event["size"])
+	if latency, ok := msgpackrpc.ToInt(event["latency_us"]); ok {
+		line += fmt.Sprintf("  %.3fms", float64(latency)/1000)
+	}
+	if isErr, _ := event["error"].(bool); isErr {
+		line += "  ERROR"
+	}
+	return line
+}
@@ -0,0 +1,280 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+// listener is an RPC listener with the ACL applied to its clients.
+type listener struct {
+	net.Listener
+	// socket is the listening socket, handed over to the new process on a
+	// hot restart, nil if the network does not support it.
+	socket  net.Listener
+	network string
+	address string
+	acl     msgpackrouter.ACL
+	role    string
+	prefix  string
+	// auth, if not nil, is required to the clients of the listener.
+	auth *tokenAuth
+	// errorLimit, if not nil, limits the rate of the errors of the clients.
+	errorLimit *msgpackrouter.ErrorLimit
+}
+
+// listenerNetwork opens a listener on the given address.
+type listenerNetwork func(address string) (net.Listener, error)
+
+// listenerNetworks are the networks of the listeners besides "tcp", "tls"
+// and "unix", by name.
+var listenerNetworks = map[string]listenerNetwork{}
+
+// registerListenerNetwork adds a network that can be used by the listeners.
+// The connections accepted by its listeners are reported with the network
+// name as transport.
+func registerListenerNetwork(network string, open listenerNetwork) {
+	listenerNetworks[network] = open
+}
+
+// openListener opens the listener described by lc, tlsConfig is used for
+// the "tls" listeners.
+func openListener(lc ListenerConfig, cfg Config, tlsConfig *tls.Config) (*listener, error) {
+	acl, err := listenerACL(lc, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch lc.Network {
+	case "tcp":
+		l, err := net.Listen("tcp", lc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on TCP port %s: %w", lc.Address, err)
+		}
+		slog.Info("Listening on TCP socket", "listen_addr", lc.Address, "profile", lc.Profile)
+		return &listener{Listener: l, socket: l, network: lc.Network, address: lc.Address, acl: acl, role: lc.Role, prefix: lc.Prefix}, nil
+	case "tls":
+		if tlsConfig == nil {
+			return nil, fmt.Errorf("TLS is not configured for listener %s", lc.Address)
+		}
+		l, err := net.Listen("tcp", lc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on TLS port %s: %w", lc.Address, err)
+		}
+		slog.Info("Listening on TLS socket", "listen_addr", lc.Address, "profile", lc.Profile)
+		return &listener{Listener: tls.NewListener(l, tlsConfig), socket: l, network: lc.Network, address: lc.Address, acl: acl, role: lc.Role, prefix: lc.Prefix}, nil
+	case "unix":
+		// The sockets starting with "@" are in the Linux abstract namespace:
+		// they have no socket file to remove and no file permissions.
+		abstract := strings.HasPrefix(lc.Address, "@")
+		if !abstract {
+			_ = os.Remove(lc.Address) // Remove the socket file if it exists
+		}
+		l, err := net.Listen("unix", lc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on UNIX socket %s: %w", lc.Address, err)
+		}
+		slog.Info("Listening on Unix socket", "listen_addr", lc.Address, "profile", lc.Profile)
+
+		// By default allow `arduino` user to write to a socket file owned by `root`
+		if !abstract {
+			mode := cmp.Or(lc.Mode, cfg.UnixSocketMode)
+			owner := cmp.Or(lc.Owner, cfg.UnixSocketOwner)
+			group := cmp.Or(lc.Group, cfg.UnixSocketGroup)
+			if err := setUnixSocketPermissions(lc.Address, mode, owner, group); err != nil {
+				l.Close()
+				return nil, fmt.Errorf("failed to set permissions of UNIX socket %s: %w", lc.Address, err)
+			}
+		}
+		return &listener{Listener: l, socket: l, network: lc.Network, address: lc.Address, acl: acl, role: lc.Role, prefix: lc.Prefix}, nil
+	default:
+		open, ok := listenerNetworks[lc.Network]
+		if !ok {
+			return nil, fmt.Errorf("invalid network for listener %s: %s", lc.Address, lc.Network)
+		}
+		l, err := open(lc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s socket %s: %w", lc.Network, lc.Address, err)
+		}
+		slog.Info("Listening on socket", "network", lc.Network, "listen_addr", lc.Address, "profile", lc.Profile)
+		return &listener{Listener: l, network: lc.Network, address: lc.Address, acl: acl, role: lc.Role, prefix: lc.Prefix}, nil
+	}
+}
+
+// configuredListeners returns the listeners of the configuration file and
+// of the flags.
+func configuredListeners(cfg Config) []ListenerConfig {
+	listeners := slices.Clone(cfg.Listeners)
+	if cfg.ListenTCPAddr != "" {
+		listeners = append(listeners, ListenerConfig{Network: "tcp", Address: cfg.ListenTCPAddr, Profile: cfg.ListenTCPProfile, Role: cfg.ListenTCPRole})
+	}
+	if cfg.ListenTLSAddr != "" {
+		listeners = append(listeners, ListenerConfig{Network: "tls", Address: cfg.ListenTLSAddr, Profile: cfg.ListenTLSProfile, Role: cfg.ListenTLSRole})
+	}
+	if cfg.ListenVsockAddr != "" {
+		listeners = append(listeners, ListenerConfig{Network: "vsock", Address: cfg.ListenVsockAddr, Profile: cfg.ListenVsockProfile, Role: cfg.ListenVsockRole})
+	}
+	if cfg.ListenWebSocketAddr != "" {
+		listeners = append(listeners, ListenerConfig{Network: "websocket", Address: cfg.ListenWebSocketAddr, Profile: cfg.ListenWebSocketProfile, Role: cfg.ListenWebSocketRole})
+	}
+	for _, address := range cfg.ListenUnixAddrs {
+		if address != "" {
+			listeners = append(listeners, ListenerConfig{Network: "unix", Address: address, Profile: cfg.ListenUnixProfile, Role: cfg.ListenUnixRole})
+		}
+	}
+	return listeners
+}
+
+// listenMonitor opens the TCP listeners of the monitor proxy on the given
+// addresses. If one of them fails the others are closed.
+func listenMonitor(addresses []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, address := range addresses {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on monitor address %s: %w", address, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenerACL returns the ACL of the profile of the listener, nil if the
+// listener has no profile.
+func listenerACL(lc ListenerConfig, cfg Config) (msgpackrouter.ACL, error) {
+	if lc.Profile == "" {
+		return nil, nil
+	}
+	patterns, ok := cfg.ACLProfiles[lc.Profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown ACL profile for listener %s: %s", lc.Address, lc.Profile)
+	}
+	return append(msgpackrouter.ACL{}, patterns...), nil
+}
+
+// setUnixSocketPermissions sets the file mode, owner and group of the Unix
+// socket. The mode is an octal string, owner and group are names or numeric
+// IDs, and are left unchanged if empty.
+func setUnixSocketPermissions(path, mode, owner, group string) error {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return fmt.Errorf("invalid unix socket mode: %s", mode)
+	}
+
+	uid, gid := -1, -1
+	if owner != "" {
+		if uid, err = lookupUID(owner); err != nil {
+			return err
+		}
+	}
+	if group != "" {
+		if gid, err = lookupGID(group); err != nil {
+			return err
+		}
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, os.FileMode(perm))
+}
+
+// lookupUID returns the ID of the user, given as name or numeric ID.
+func lookupUID(owner string) (int, error) {
+	if uid, err := strconv.Atoi(owner); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return -1, fmt.Errorf("invalid user: %w", err)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID returns the ID of the group, given as name or numeric ID.
+func lookupGID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, fmt.Errorf("invalid group: %w", err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// connectionInfo returns the metadata of a connection accepted by the
+// listener, including the credentials of the peer process for Unix sockets.
+func (l *listener) connectionInfo(conn net.Conn) msgpackrouter.ConnectionInfo {
+	info := msgpackrouter.ConnectionInfo{
+		Transport:  l.network,
+		RemoteAddr: conn.RemoteAddr().String(),
+		ACL:        l.acl,
+		Role:       l.role,
+		Prefix:     l.prefix,
+		ErrorLimit: l.errorLimit,
+	}
+	if l.auth != nil {
+		info.Authenticator = l.auth.authenticator(info.RemoteAddr)
+	}
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		if cred, err := peerCredentials(unixConn); err == nil {
+			info.PeerCredentials = cred
+		}
+	}
+	return info
+}
+
+// peerCredentials returns the credentials of the process connected to the
+// Unix socket (using SO_PEERCRED).
+func peerCredentials(conn *net.UnixConn) (*msgpackrouter.PeerCredentials, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *unix.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		ucred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &msgpackrouter.PeerCredentials{
+		PID: int(ucred.Pid),
+		UID: int(ucred.Uid),
+		GID: int(ucred.Gid),
+	}, nil
+}
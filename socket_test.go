@@ -0,0 +1,97 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "router.sock")
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, setUnixSocketPermissions(path, "0660", "", strconv.Itoa(os.Getgid())))
+	st, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0660), st.Mode().Perm())
+	require.Error(t, setUnixSocketPermissions(path, "0999", "", ""))
+
+	client, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	info := (&listener{Listener: l, network: "unix"}).connectionInfo(conn)
+	require.Equal(t, "unix", info.Transport)
+	require.NotNil(t, info.PeerCredentials)
+	require.Equal(t, os.Getpid(), info.PeerCredentials.PID)
+	require.Equal(t, os.Getuid(), info.PeerCredentials.UID)
+}
+
+func TestListenerNetworks(t *testing.T) {
+	registerListenerNetwork("test", func(address string) (net.Listener, error) {
+		return net.Listen("tcp", address)
+	})
+	t.Cleanup(func() { delete(listenerNetworks, "test") })
+
+	_, err := openListener(ListenerConfig{Network: "invalid", Address: "127.0.0.1:0"}, Config{}, nil)
+	require.ErrorContains(t, err, "invalid network for listener")
+
+	l, err := openListener(ListenerConfig{Network: "test", Address: "127.0.0.1:0"}, Config{}, nil)
+	require.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "test", l.connectionInfo(conn).Transport)
+}
+
+func TestUnixListeners(t *testing.T) {
+	// A socket in the abstract namespace has no file
+	name := "@arduino-router-test-" + strconv.Itoa(os.Getpid())
+	l, err := openListener(ListenerConfig{Network: "unix", Address: name}, Config{UnixSocketMode: "0666"}, nil)
+	require.NoError(t, err)
+	defer l.Close()
+	client, err := net.Dial("unix", name)
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, os.Getpid(), l.connectionInfo(conn).PeerCredentials.PID)
+
+	// The permissions of a listener override the flags
+	path := filepath.Join(t.TempDir(), "apps.sock")
+	l, err = openListener(ListenerConfig{Network: "unix", Address: path, Mode: "0600"}, Config{UnixSocketMode: "0666"}, nil)
+	require.NoError(t, err)
+	defer l.Close()
+	st, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), st.Mode().Perm())
+}
@@ -0,0 +1,141 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/internal/pubsubapi"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// stateVersion is the version of the format of the state snapshots.
+const stateVersion = 1
+
+// stateSnapshot is the state of the router that survives a reboot, returned
+// by $/state/export and restored at startup with --state-file. The state
+// bound to the client connections (registered methods, subscriptions,
+// schedules, open sockets) is not included.
+type stateSnapshot struct {
+	Version int `json:"version" msgpack:"version"`
+	// Reservations are the methods reserved by the sidecar services, with
+	// the name of the service.
+	Reservations map[string]string `json:"reservations,omitempty" msgpack:"reservations,omitempty"`
+	// Retained are the retained pub/sub messages, by topic.
+	Retained map[string]any `json:"retained,omitempty" msgpack:"retained,omitempty"`
+	// Monitor is the configuration of the MCU monitor proxy.
+	Monitor *monitorState `json:"monitor,omitempty" msgpack:"monitor,omitempty"`
+}
+
+// monitorState is the configuration of the MCU monitor proxy.
+type monitorState struct {
+	// Address is the first of the Addresses, for the snapshots read by the
+	// routers listening on a single address.
+	Address   string   `json:"address" msgpack:"address"`
+	Addresses []string `json:"addresses,omitempty" msgpack:"addresses,omitempty"`
+}
+
+// addresses returns the listening addresses of the monitor proxy.
+func (m *monitorState) addresses() []string {
+	if len(m.Addresses) == 0 {
+		return []string{m.Address}
+	}
+	return m.Addresses
+}
+
+// exportState returns the snapshot of the current state of the router.
+func exportState(router *msgpackrouter.Router, cfg *Config, modules []string) stateSnapshot {
+	state := stateSnapshot{Version: stateVersion, Reservations: router.Reservations()}
+	for _, module := range modules {
+		switch module {
+		case "pubsub":
+			state.Retained = pubsubapi.Retained()
+		case "monitor":
+			state.Monitor = &monitorState{Address: cfg.MonitorPortAddrs[0], Addresses: cfg.MonitorPortAddrs}
+		}
+	}
+	return state
+}
+
+// stateExportHandler implements $/state/export: it returns the snapshot of
+// the state, to be saved by the client as MessagePack (or JSON) and restored
+// with --state-file.
+func stateExportHandler(router *msgpackrouter.Router, cfg *Config, modules []string) msgpackrouter.RouterRequestHandler {
+	return func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		if len(params) != 0 {
+			res(nil, []any{1, "Invalid number of parameters, expected none"})
+			return
+		}
+		res(exportState(router, cfg, modules), nil)
+	}
+}
+
+// loadState reads a state snapshot from the given file, encoded in JSON or
+// in MessagePack. It returns nil if path is empty.
+func loadState(path string) (*stateSnapshot, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading state file: %w", err)
+	}
+	var state stateSnapshot
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(data, &state)
+	} else {
+		err = msgpack.Unmarshal(data, &state)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing state file %s: %w", path, err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported version of state file %s: %d", path, state.Version)
+	}
+	return &state, nil
+}
+
+// restoreReservations reserves the methods of the snapshot again, before the
+// sidecar services are started.
+func (s *stateSnapshot) restoreReservations(router *msgpackrouter.Router) {
+	if s == nil || len(s.Reservations) == 0 {
+		return
+	}
+	methods := map[string][]string{}
+	for method, service := range s.Reservations {
+		methods[service] = append(methods[service], method)
+	}
+	for service, m := range methods {
+		router.ReserveMethods(service, m)
+	}
+	slog.Info("Restored method reservations", "count", len(s.Reservations))
+}
+
+// restoreRetained publishes the retained messages of the snapshot again.
+func (s *stateSnapshot) restoreRetained() {
+	if s == nil || len(s.Retained) == 0 {
+		return
+	}
+	pubsubapi.RestoreRetained(s.Retained)
+	slog.Info("Restored retained messages", "count", len(s.Retained))
+}
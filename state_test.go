@@ -0,0 +1,81 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/internal/pubsubapi"
+)
+
+func TestStateSnapshot(t *testing.T) {
+	router := msgpackrouter.New(0)
+	router.ReserveMethods("camera", []string{"camera/snap", "camera/stream"})
+	pubsubapi.RestoreRetained(map[string]any{"device/name": "kitchen"})
+	cfg := Config{MonitorPortAddrs: []string{"127.0.0.1:7600", "[::1]:7600"}}
+
+	var result, reqErr any
+	res := func(r, e any) { result, reqErr = r, e }
+	stateExportHandler(router, &cfg, []string{"pubsub", "monitor"})(nil, []any{}, res)
+	require.Nil(t, reqErr)
+	state := result.(stateSnapshot)
+	require.Equal(t, stateVersion, state.Version)
+	require.Equal(t, map[string]string{"camera/snap": "camera", "camera/stream": "camera"}, state.Reservations)
+	require.Equal(t, map[string]any{"device/name": "kitchen"}, state.Retained)
+	require.Equal(t, &monitorState{Address: "127.0.0.1:7600", Addresses: []string{"127.0.0.1:7600", "[::1]:7600"}}, state.Monitor)
+	require.Equal(t, []string{"127.0.0.1:7600", "[::1]:7600"}, state.Monitor.addresses())
+	require.Equal(t, []string{"127.0.0.1:7500"}, (&monitorState{Address: "127.0.0.1:7500"}).addresses())
+
+	// The sections of the disabled modules are omitted
+	stateExportHandler(router, &cfg, nil)(nil, []any{}, res)
+	require.Nil(t, result.(stateSnapshot).Retained)
+	require.Nil(t, result.(stateSnapshot).Monitor)
+	stateExportHandler(router, &cfg, nil)(nil, []any{true}, res)
+	require.NotNil(t, reqErr)
+
+	// The snapshot is restored from MessagePack and from JSON
+	dir := t.TempDir()
+	msgpackData, err := msgpack.Marshal(state)
+	require.NoError(t, err)
+	jsonData, err := json.Marshal(state)
+	require.NoError(t, err)
+	for name, data := range map[string][]byte{"state.msgpack": msgpackData, "state.json": jsonData} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, data, 0600))
+		loaded, err := loadState(path)
+		require.NoError(t, err, name)
+		require.Equal(t, &state, loaded, name)
+
+		restored := msgpackrouter.New(0)
+		loaded.restoreReservations(restored)
+		require.Equal(t, state.Reservations, restored.Reservations())
+	}
+
+	loaded, err := loadState("")
+	require.NoError(t, err)
+	require.Nil(t, loaded)
+	path := filepath.Join(dir, "future.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 2}`), 0600))
+	_, err = loadState(path)
+	require.ErrorContains(t, err, "unsupported version")
+}
@@ -0,0 +1,77 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls", "cert.pem")
+	keyFile := filepath.Join(dir, "tls", "key.pem")
+
+	// First boot: the self-signed certificate is generated
+	tlsConfig, err := tlsServerConfig(certFile, keyFile, "")
+	require.NoError(t, err)
+	st, err := os.Stat(keyFile)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), st.Mode().Perm())
+
+	// Next boot: the certificate is reused
+	certPEM, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	_, err = tlsServerConfig(certFile, keyFile, "")
+	require.NoError(t, err)
+	certPEM2, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+	require.Equal(t, certPEM, certPEM2)
+
+	l, err := openListener(ListenerConfig{Network: "tls", Address: "127.0.0.1:0"}, Config{}, tlsConfig)
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("hello"))
+	}()
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(certPEM))
+	client, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	require.NoError(t, err)
+	defer client.Close()
+	buf := make([]byte, 5)
+	_, err = client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// A client certificate is required if a client CA is given
+	_, err = tlsServerConfig(certFile, keyFile, filepath.Join(dir, "missing-ca.pem"))
+	require.Error(t, err)
+	tlsConfig, err = tlsServerConfig(certFile, keyFile, certFile)
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+}
@@ -0,0 +1,126 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+)
+
+const (
+	// upstreamTimeout is the timeout of the connection to the upstream
+	// router and of its authentication.
+	upstreamTimeout = 10 * time.Second
+	// upstreamMaxBackoff is the maximum delay between connection attempts.
+	upstreamMaxBackoff = time.Minute
+)
+
+// upstreamLink keeps the router connected to an upstream router, where the
+// methods not available locally are forwarded.
+type upstreamLink struct {
+	router  *msgpackrouter.Router
+	address string
+	token   string
+	role    string
+	prefix  string
+	dial    func() (net.Conn, error)
+}
+
+// upstreamDialer returns a function connecting to the upstream router at the
+// given address, as HOST:PORT or unix:PATH.
+func upstreamDialer(address string) func() (net.Conn, error) {
+	network, addr := "tcp", address
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	return func() (net.Conn, error) {
+		return net.DialTimeout(network, addr, upstreamTimeout)
+	}
+}
+
+// startUpstream connects the router to the upstream router, authenticating
+// with the token if not empty, and reconnects when the connection is lost.
+// The requests received from the upstream router have the given role, and
+// only the methods with the given prefix (if not empty) are forwarded to it.
+func startUpstream(router *msgpackrouter.Router, address, token, role, prefix string, dial func() (net.Conn, error)) *upstreamLink {
+	u := &upstreamLink{
+		router:  router,
+		address: address,
+		token:   token,
+		role:    role,
+		prefix:  prefix,
+		dial:    dial,
+	}
+	go u.run()
+	return u
+}
+
+// run keeps the upstream router connected, retrying with an exponential
+// backoff.
+func (u *upstreamLink) run() {
+	backoff := time.Second
+	for {
+		connected, err := u.session()
+		if connected {
+			backoff = time.Second
+		}
+		slog.Warn("Upstream router disconnected", "address", u.address, "err", err, "retry_in", backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, upstreamMaxBackoff)
+	}
+}
+
+// session connects to the upstream router and forwards the methods to it
+// until the connection is lost. It returns true if the connection was
+// established.
+func (u *upstreamLink) session() (bool, error) {
+	conn, err := u.dial()
+	if err != nil {
+		return false, err
+	}
+	rpc, done := u.router.AcceptConnectionWithInfo(conn, msgpackrouter.ConnectionInfo{
+		Transport:  "upstream",
+		RemoteAddr: u.address,
+		Role:       u.role,
+		Prefix:     u.prefix,
+	})
+	if u.token != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+		_, reqErr, err := rpc.SendRequest(ctx, "$/auth", u.token)
+		cancel()
+		if err == nil && reqErr != nil {
+			err = fmt.Errorf("authentication failed: %v", reqErr)
+		}
+		if err != nil {
+			rpc.Close()
+			<-done
+			return false, err
+		}
+	}
+
+	slog.Info("Connected to upstream router", "address", u.address)
+	u.router.SetUpstream(rpc)
+	<-done
+	u.router.SetUpstream(nil)
+	return true, errors.New("connection closed")
+}
@@ -0,0 +1,120 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestUpstream(t *testing.T) {
+	upstream := msgpackrouter.New(0)
+	upstream.SetRole(msgpackrouter.RoleRemote, nil)
+	require.NoError(t, upstream.RegisterMethod("carrier/led", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		res(params[0], nil)
+	}))
+	local := msgpackrouter.New(0)
+	local.SetRole(msgpackrouter.RoleLocalService, nil)
+	local.SetRole(msgpackrouter.RoleRemote, nil)
+	require.NoError(t, local.RegisterMethod("module/temp", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res(21, nil)
+	}))
+
+	upstreamConns := make(chan net.Conn, 1)
+	dial := func() (net.Conn, error) {
+		localEnd, upstreamEnd := net.Pipe()
+		upstreamConns <- upstreamEnd
+		upstream.AcceptConnectionWithInfo(upstreamEnd, msgpackrouter.ConnectionInfo{
+			Role: msgpackrouter.RoleRemote,
+			Authenticator: func(token string) (string, string, error) {
+				if token != "secret" {
+					return "", "", errors.New("invalid token")
+				}
+				return "module", "", nil
+			},
+		})
+		return localEnd, nil
+	}
+
+	// The connection fails with a wrong token
+	u := &upstreamLink{router: local, address: "carrier:8900", token: "wrong", role: msgpackrouter.RoleRemote, dial: dial}
+	connected, err := u.session()
+	require.False(t, connected)
+	require.ErrorContains(t, err, "invalid token")
+	<-upstreamConns
+
+	startUpstream(local, "carrier:8900", "secret", msgpackrouter.RoleRemote, "", dial)
+	upstreamConn := <-upstreamConns
+
+	clientEnd, routerEnd := net.Pipe()
+	local.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Role: msgpackrouter.RoleLocalService})
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+	defer client.Close()
+
+	// The methods not available locally are forwarded to the upstream router
+	require.Eventually(t, func() bool {
+		result, _, err := client.SendRequest(t.Context(), "carrier/led", true)
+		return err == nil && result == true
+	}, time.Second, 10*time.Millisecond)
+	result, reqErr, err := client.SendRequest(t.Context(), "module/temp")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	require.Equal(t, int8(21), result)
+	_, reqErr, err = client.SendRequest(t.Context(), "carrier/missing")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAvailable), "method carrier/missing not available"}, reqErr)
+	require.Equal(t, uint64(2), local.Stats()["upstream_forwarded"])
+
+	// The forwarding stops when the upstream router disconnects
+	require.NoError(t, upstreamConn.Close())
+	require.Eventually(t, func() bool {
+		_, reqErr, err := client.SendRequest(t.Context(), "carrier/led", true)
+		return err == nil && reqErr != nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestUpstreamDoesNotLoop(t *testing.T) {
+	a := msgpackrouter.New(0)
+	b := msgpackrouter.New(0)
+	a.SetRole(msgpackrouter.RoleRemote, nil)
+	b.SetRole(msgpackrouter.RoleRemote, nil)
+
+	// The routers use each other as upstream on the same link
+	aEnd, bEnd := net.Pipe()
+	aConn, _ := a.AcceptConnectionWithInfo(aEnd, msgpackrouter.ConnectionInfo{Role: msgpackrouter.RoleRemote})
+	bConn, _ := b.AcceptConnectionWithInfo(bEnd, msgpackrouter.ConnectionInfo{Role: msgpackrouter.RoleRemote})
+	a.SetUpstream(aConn)
+	b.SetUpstream(bConn)
+	defer aConn.Close()
+
+	clientEnd, routerEnd := net.Pipe()
+	a.AcceptConnectionWithInfo(routerEnd, msgpackrouter.ConnectionInfo{Role: msgpackrouter.RoleRemote})
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+	defer client.Close()
+
+	_, reqErr, err := client.SendRequest(t.Context(), "missing/method")
+	require.NoError(t, err)
+	require.Equal(t, []any{int8(msgpackrouter.ErrCodeMethodNotAvailable), "method missing/method not available"}, reqErr)
+}
@@ -0,0 +1,56 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Commit and BuildDate may be set a build time with -ldflags, otherwise they
+// are taken from the VCS information embedded by the Go toolchain.
+var (
+	Commit    string
+	BuildDate string
+)
+
+// protocolRevision is the revision of the RPC protocol implemented by the
+// router, incremented on each change of the built-in methods.
+const protocolRevision = 1
+
+// versionInfo returns the build information of the router and the given
+// enabled API modules, returned by $/version.
+func versionInfo(modules []string) map[string]any {
+	commit, buildDate := Commit, BuildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && buildDate == "":
+				buildDate = s.Value
+			}
+		}
+	}
+	return map[string]any{
+		"version":           Version,
+		"commit":            commit,
+		"build_date":        buildDate,
+		"go_version":        runtime.Version(),
+		"protocol_revision": protocolRevision,
+		"modules":           modules,
+	}
+}
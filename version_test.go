@@ -0,0 +1,36 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionInfo(t *testing.T) {
+	Commit, BuildDate = "abcdef", "2025-01-01T00:00:00Z"
+	t.Cleanup(func() { Commit, BuildDate = "", "" })
+
+	info := versionInfo([]string{"network", "serial"})
+	require.Equal(t, Version, info["version"])
+	require.Equal(t, "abcdef", info["commit"])
+	require.Equal(t, "2025-01-01T00:00:00Z", info["build_date"])
+	require.Equal(t, runtime.Version(), info["go_version"])
+	require.Equal(t, protocolRevision, info["protocol_revision"])
+	require.Equal(t, []string{"network", "serial"}, info["modules"])
+}
@@ -0,0 +1,157 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	registerListenerNetwork("vsock", listenVsock)
+}
+
+// vsockAddr is the address of an AF_VSOCK socket.
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+
+func (a vsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.cid, a.port)
+}
+
+// parseVsockAddress parses a vsock address as PORT or CID:PORT, the CID is
+// VMADDR_CID_ANY if not given.
+func parseVsockAddress(address string) (vsockAddr, error) {
+	addr := vsockAddr{cid: unix.VMADDR_CID_ANY}
+	port := address
+	if cid, p, ok := strings.Cut(address, ":"); ok {
+		n, err := strconv.ParseUint(cid, 10, 32)
+		if err != nil {
+			return addr, fmt.Errorf("invalid vsock CID: %s", cid)
+		}
+		addr.cid = uint32(n)
+		port = p
+	}
+	n, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return addr, fmt.Errorf("invalid vsock port: %s", port)
+	}
+	addr.port = uint32(n)
+	return addr, nil
+}
+
+// vsockListener is a listener on an AF_VSOCK socket, that the net package
+// does not support. The socket is non-blocking, so that it's handled by the
+// runtime poller like the net sockets.
+type vsockListener struct {
+	file *os.File
+	raw  syscall.RawConn
+	addr vsockAddr
+}
+
+// listenVsock opens a vsock listener on the given address (see
+// parseVsockAddress).
+func listenVsock(address string) (net.Listener, error) {
+	addr, err := parseVsockAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: addr.cid, Port: addr.port}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Get the port assigned by the kernel if VMADDR_PORT_ANY is used
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			addr.port = vm.Port
+		}
+	}
+
+	file := os.NewFile(uintptr(fd), "vsock:"+addr.String())
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &vsockListener{file: file, raw: raw, addr: addr}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	var fd int
+	var sa unix.Sockaddr
+	var acceptErr error
+	err := l.raw.Read(func(listenFD uintptr) bool {
+		fd, sa, acceptErr = unix.Accept4(int(listenFD), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return !errors.Is(acceptErr, unix.EAGAIN)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, acceptErr
+	}
+	var remote vsockAddr
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote = vsockAddr{cid: vm.CID, port: vm.Port}
+	}
+	return &vsockConn{
+		File:   os.NewFile(uintptr(fd), "vsock:"+remote.String()),
+		local:  l.addr,
+		remote: remote,
+	}, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.file.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockConn is a connection accepted by a vsockListener.
+type vsockConn struct {
+	*os.File
+	local  vsockAddr
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,84 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseVsockAddress(t *testing.T) {
+	addr, err := parseVsockAddress("5000")
+	require.NoError(t, err)
+	require.Equal(t, vsockAddr{cid: unix.VMADDR_CID_ANY, port: 5000}, addr)
+	addr, err = parseVsockAddress("3:5000")
+	require.NoError(t, err)
+	require.Equal(t, vsockAddr{cid: 3, port: 5000}, addr)
+	require.Equal(t, "3:5000", addr.String())
+
+	for _, address := range []string{"", "port", "x:5000", "3:", "3:5000:1", "-1"} {
+		_, err := parseVsockAddress(address)
+		require.Error(t, err, address)
+	}
+}
+
+func TestVsockListener(t *testing.T) {
+	// VMADDR_PORT_ANY lets the kernel choose the port
+	l, err := listenVsock("4294967295")
+	if err != nil {
+		t.Skipf("vsock not available: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(vsockAddr).port
+	require.NotEqual(t, uint32(unix.VMADDR_PORT_ANY), port)
+
+	// Close wakes up a pending Accept
+	other, err := listenVsock("4294967295")
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		_, err := other.Accept()
+		done <- err
+	}()
+	require.NoError(t, other.Close())
+	require.Error(t, <-done)
+
+	// Connect to the listener through the vsock loopback
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	require.NoError(t, err)
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_LOCAL, Port: port}); err != nil {
+		unix.Close(fd)
+		t.Skipf("vsock loopback not available: %v", err)
+	}
+	client := os.NewFile(uintptr(fd), "client")
+	defer client.Close()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "vsock", conn.RemoteAddr().Network())
+
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
@@ -0,0 +1,165 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/internal/serialapi"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+// maxWatchdogTimeout is the maximum timeout of the watchdog.
+const maxWatchdogTimeout = time.Hour
+
+// watchdog is a software watchdog of the MCU: once armed, it must be kicked
+// before the timeout expires, otherwise the expire action is performed and
+// the watchdog is disarmed.
+type watchdog struct {
+	expire func()
+
+	lock        sync.Mutex
+	timeout     time.Duration
+	timer       *time.Timer
+	expirations int
+}
+
+// newWatchdog returns a disarmed watchdog performing the given action when
+// it expires.
+func newWatchdog(expire func()) *watchdog {
+	return &watchdog{expire: expire}
+}
+
+// arm starts the watchdog with the given timeout, or restarts it if it is
+// already armed.
+func (w *watchdog) arm(timeout time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timeout = timeout
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		w.lock.Lock()
+		if w.timer != timer {
+			// Kicked or disarmed meanwhile
+			w.lock.Unlock()
+			return
+		}
+		w.timer = nil
+		w.expirations++
+		w.lock.Unlock()
+		slog.Warn("Watchdog expired", "timeout", timeout)
+		w.expire()
+	})
+	w.timer = timer
+}
+
+// kick restarts the timeout of the watchdog, it returns false if the
+// watchdog is not armed.
+func (w *watchdog) kick() bool {
+	w.lock.Lock()
+	timeout := w.timeout
+	armed := w.timer != nil
+	w.lock.Unlock()
+	if armed {
+		w.arm(timeout)
+	}
+	return armed
+}
+
+// disarm stops the watchdog.
+func (w *watchdog) disarm() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// status returns the state of the watchdog reported by $/watchdog/status.
+func (w *watchdog) status() map[string]any {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return map[string]any{
+		"armed":       w.timer != nil,
+		"timeout":     w.timeout.Milliseconds(),
+		"expirations": w.expirations,
+	}
+}
+
+// watchdogAction returns the action performed when the watchdog expires:
+// the command, if not empty, otherwise the reset of the MCU with the DTR and
+// RTS lines of the serial port.
+func watchdogAction(command string) func() {
+	if args := strings.Fields(command); len(args) > 0 {
+		return func() {
+			if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+				slog.Error("Watchdog command failed", "command", command, "err", err, "output", string(out))
+			}
+		}
+	}
+	return func() {
+		if err := serialapi.ResetMCU(100 * time.Millisecond); err != nil {
+			slog.Error("Watchdog failed to reset the MCU", "err", err)
+		}
+	}
+}
+
+// registerWatchdog registers the $/watchdog/* methods.
+func registerWatchdog(router *msgpackrouter.Router, w *watchdog) error {
+	if err := router.RegisterMethod("$/watchdog/arm", func(_ *msgpackrpc.Connection, params []any, res msgpackrouter.RouterResponseHandler) {
+		if len(params) != 1 {
+			res(nil, []any{1, "Invalid number of parameters, expected timeout in ms"})
+			return
+		}
+		ms, ok := msgpackrpc.ToUint(params[0])
+		if !ok || ms == 0 || time.Duration(ms)*time.Millisecond > maxWatchdogTimeout {
+			res(nil, []any{1, fmt.Sprintf("Invalid parameter, expected timeout in ms (1-%d)", maxWatchdogTimeout.Milliseconds())})
+			return
+		}
+		w.arm(time.Duration(ms) * time.Millisecond)
+		res(true, nil)
+	}); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/watchdog/kick", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		if !w.kick() {
+			res(nil, []any{2, "Watchdog not armed"})
+			return
+		}
+		res(true, nil)
+	}); err != nil {
+		return err
+	}
+	if err := router.RegisterMethod("$/watchdog/disarm", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		w.disarm()
+		res(true, nil)
+	}); err != nil {
+		return err
+	}
+	return router.RegisterMethod("$/watchdog/status", func(_ *msgpackrpc.Connection, _ []any, res msgpackrouter.RouterResponseHandler) {
+		res(w.status(), nil)
+	})
+}
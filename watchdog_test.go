@@ -0,0 +1,83 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/arduino/arduino-router/internal/msgpackrouter"
+	"github.com/arduino/arduino-router/msgpackrpc"
+)
+
+func TestWatchdog(t *testing.T) {
+	expired := make(chan struct{}, 1)
+	w := newWatchdog(func() { expired <- struct{}{} })
+	router := msgpackrouter.New(0)
+	require.NoError(t, registerWatchdog(router, w))
+
+	clientEnd, routerEnd := net.Pipe()
+	router.AcceptConnection(routerEnd)
+	client := msgpackrpc.NewConnection(clientEnd, clientEnd, nil, nil, nil)
+	go client.Run()
+	defer client.Close()
+
+	_, reqErr, err := client.SendRequest(t.Context(), "$/watchdog/kick")
+	require.NoError(t, err)
+	require.Equal(t, int8(2), reqErr.([]any)[0])
+	_, reqErr, err = client.SendRequest(t.Context(), "$/watchdog/arm", 0)
+	require.NoError(t, err)
+	require.Equal(t, int8(1), reqErr.([]any)[0])
+
+	// The watchdog does not expire while it is kicked
+	_, reqErr, err = client.SendRequest(t.Context(), "$/watchdog/arm", 100)
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	for range 5 {
+		time.Sleep(40 * time.Millisecond)
+		require.NoError(t, client.SendNotification("$/watchdog/kick"))
+	}
+	require.Empty(t, expired)
+
+	select {
+	case <-expired:
+	case <-time.After(2 * time.Second):
+		require.Fail(t, "watchdog not expired")
+	}
+	status, _, err := client.SendRequest(t.Context(), "$/watchdog/status")
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"armed": false, "timeout": int8(100), "expirations": int8(1)}, status)
+
+	// A disarmed watchdog does not expire
+	w.arm(50 * time.Millisecond)
+	_, reqErr, err = client.SendRequest(t.Context(), "$/watchdog/disarm")
+	require.NoError(t, err)
+	require.Nil(t, reqErr)
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, expired)
+}
+
+func TestWatchdogCommand(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "expired")
+	watchdogAction("touch " + marker)()
+	require.FileExists(t, marker)
+	require.NoError(t, os.Remove(marker))
+}
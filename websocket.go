@@ -0,0 +1,309 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint:gosec // required by the WebSocket handshake
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerListenerNetwork("websocket", listenWebSocket)
+}
+
+// webSocketGUID is the key suffix of the WebSocket handshake (RFC 6455).
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// webSocketListener accepts WebSocket connections on an HTTP server: the
+// RPC messages are carried in binary messages, each message sent by the
+// Router is a single WebSocket message.
+type webSocketListener struct {
+	listener net.Listener
+	server   *http.Server
+	conns    chan net.Conn
+	done     chan struct{}
+	close    sync.Once
+}
+
+// listenWebSocket opens a WebSocket listener on the given TCP address, the
+// clients may connect to any path.
+func listenWebSocket(address string) (net.Listener, error) {
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	l := &webSocketListener{
+		listener: tcpListener,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	l.server = &http.Server{
+		Handler:           http.HandlerFunc(l.upgrade),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := l.server.Serve(tcpListener); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("WebSocket server stopped", "err", err)
+		}
+	}()
+	return l, nil
+}
+
+// upgrade performs the WebSocket handshake and passes the connection to
+// Accept.
+func (l *webSocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		slog.Error("WebSocket upgrade failed", "err", err)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- &webSocketConn{Conn: conn, in: rw.Reader}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// headerContains reports whether the comma separated values of the header
+// contain the given token, ignoring the case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for v := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for the given key.
+func webSocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + webSocketGUID)) //nolint:gosec
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	err := net.ErrClosed
+	l.close.Do(func() {
+		close(l.done)
+		// The hijacked connections are not closed by the server
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// webSocketConn is a WebSocket connection: Read returns the payload of the
+// data messages received, and Write sends a binary message.
+type webSocketConn struct {
+	net.Conn
+	in *bufio.Reader
+
+	// remaining and mask are the state of the frame being read
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+
+	writeLock sync.Mutex
+	closed    bool
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextDataFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.in.Read(p)
+	for i := range n {
+		p[i] ^= c.mask[c.maskPos]
+		c.maskPos = (c.maskPos + 1) % 4
+	}
+	c.remaining -= uint64(n) //nolint:gosec
+	return n, err
+}
+
+// nextDataFrame reads the header of the next data frame, handling the
+// control frames found before it.
+func (c *webSocketConn) nextDataFrame() error {
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.in, header[:]); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.in, ext[:]); err != nil {
+				return err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.in, ext[:]); err != nil {
+				return err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if !masked {
+			// The frames sent by the clients must be masked
+			c.writeClose(1002)
+			return errors.New("unmasked WebSocket frame")
+		}
+		if _, err := io.ReadFull(c.in, c.mask[:]); err != nil {
+			return err
+		}
+		c.maskPos = 0
+
+		switch opcode {
+		case wsContinuation, wsText, wsBinary:
+			c.remaining = length
+			return nil
+		case wsClose, wsPing, wsPong:
+			if length > 125 {
+				c.writeClose(1002)
+				return errors.New("invalid WebSocket control frame")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.in, payload); err != nil {
+				return err
+			}
+			for i := range payload {
+				payload[i] ^= c.mask[i%4]
+			}
+			switch opcode {
+			case wsClose:
+				c.writeClose(1000)
+				return io.EOF
+			case wsPing:
+				if err := c.writeFrame(wsPong, payload); err != nil {
+					return err
+				}
+			}
+		default:
+			c.writeClose(1002)
+			return fmt.Errorf("invalid WebSocket opcode: %d", opcode)
+		}
+	}
+}
+
+// Write sends p as a binary message.
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeClose sends a close frame with the given status code.
+func (c *webSocketConn) writeClose(code uint16) {
+	_ = c.writeFrame(wsClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// writeFrame sends a single (final, unmasked) frame.
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	return err
+}
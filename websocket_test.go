@@ -0,0 +1,122 @@
+// This file is part of arduino-router
+//
+// Copyright (C) ARDUINO SRL (www.arduino.cc)
+//
+// This software is released under the GNU General Public License version 3,
+// which covers the main part of arduino-router
+// The terms of this license can be found at:
+// https://www.gnu.org/licenses/gpl-3.0.en.html
+//
+// You can be released from the requirements of the above licenses by purchasing
+// a commercial license. Buying such a license is mandatory if you want to
+// modify or otherwise use the software for commercial activities involving the
+// Arduino software without disclosing the source code of your own applications.
+// To purchase a commercial license, send an email to license@arduino.cc.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clientFrame returns a frame sent by a WebSocket client, masked.
+func clientFrame(opcode byte, fin bool, payload []byte) []byte {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example of RFC 6455
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestWebSocketListener(t *testing.T) {
+	l, err := listenWebSocket("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	// A plain HTTP request is refused
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = io.WriteString(client, "GET /rpc HTTP/1.1\r\n"+
+		"Host: localhost\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	require.NoError(t, err)
+	clientIn := bufio.NewReader(client)
+	resp, err = http.ReadResponse(clientIn, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// A message fragmented in two frames, with a ping in between
+	_, err = client.Write(clientFrame(wsBinary, false, []byte{0x94, 0x00, 0x01}))
+	require.NoError(t, err)
+	_, err = client.Write(clientFrame(wsPing, true, []byte("hi")))
+	require.NoError(t, err)
+	_, err = client.Write(clientFrame(wsContinuation, true, []byte{0xa1, 0x61, 0x90}))
+	require.NoError(t, err)
+	buf := make([]byte, 6)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x94, 0x00, 0x01, 0xa1, 0x61, 0x90}, buf)
+
+	pong := make([]byte, 4)
+	_, err = io.ReadFull(clientIn, pong)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x80 | wsPong, 2, 'h', 'i'}, pong)
+
+	// Each write is a binary message
+	_, err = conn.Write([]byte{0x94, 0x01, 0x01, 0xc0, 0xc3})
+	require.NoError(t, err)
+	msg := make([]byte, 7)
+	_, err = io.ReadFull(clientIn, msg)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x80 | wsBinary, 5, 0x94, 0x01, 0x01, 0xc0, 0xc3}, msg)
+
+	// The close handshake ends the stream
+	_, err = client.Write(clientFrame(wsClose, true, []byte{0x03, 0xe8}))
+	require.NoError(t, err)
+	_, err = conn.Read(buf)
+	require.ErrorIs(t, err, io.EOF)
+	closeFrame := make([]byte, 4)
+	_, err = io.ReadFull(clientIn, closeFrame)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x80 | wsClose, 2, 0x03, 0xe8}, closeFrame)
+
+	// Close wakes up a pending Accept
+	done := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		done <- err
+	}()
+	require.NoError(t, l.Close())
+	require.ErrorIs(t, <-done, net.ErrClosed)
+}